@@ -0,0 +1,47 @@
+// +build !windows
+
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// ForeignRoutes lists the routes of the main routing table into nw, to be adopted with subnet.PlanAdoption.
+func ForeignRoutes(nw ip.IP4Net) ([]subnet.ForeignRoute, error) {
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: syscall.RT_TABLE_MAIN}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, err
+	}
+
+	var foreign []subnet.ForeignRoute
+	for _, r := range routes {
+		if r.Dst == nil || r.Dst.IP.To4() == nil || !nw.Contains(ip.FromIP(r.Dst.IP)) {
+			continue
+		}
+		fr := subnet.ForeignRoute{Dst: ip.FromIPNet(r.Dst)}
+		if r.Gw != nil {
+			fr.Gw = ip.FromIP(r.Gw)
+		}
+		foreign = append(foreign, fr)
+	}
+	return foreign, nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/routing"
+	"github.com/coreos/flannel/subnet"
+)
+
+// ForeignRoutes lists the routes into nw, to be adopted with subnet.PlanAdoption.
+func ForeignRoutes(nw ip.IP4Net) ([]subnet.ForeignRoute, error) {
+	routes, err := routing.RouterWindows{}.GetAllRoutes()
+	if err != nil {
+		return nil, err
+	}
+
+	var foreign []subnet.ForeignRoute
+	for _, r := range routes {
+		if r.DestinationSubnet == nil || r.DestinationSubnet.IP.To4() == nil || !nw.Contains(ip.FromIP(r.DestinationSubnet.IP)) {
+			continue
+		}
+		fr := subnet.ForeignRoute{Dst: ip.FromIPNet(r.DestinationSubnet)}
+		if r.GatewayAddress != nil && !r.GatewayAddress.IsUnspecified() {
+			fr.Gw = ip.FromIP(r.GatewayAddress)
+		}
+		foreign = append(foreign, fr)
+	}
+	return foreign, nil
+}
@@ -31,8 +31,15 @@ import (
 	"github.com/denverdino/aliyungo/metadata"
 )
 
+// backendConfig is the Backend section of the network config.
+type backendConfig struct {
+	AccessKeyID     string
+	AccessKeySecret string
+}
+
 func init() {
 	backend.Register("ali-vpc", New)
+	backend.RegisterConfig("ali-vpc", func() interface{} { return &backendConfig{} })
 }
 
 type AliVpcBackend struct {
@@ -50,10 +57,7 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backen
 
 func (be *AliVpcBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
 	// 1. Parse our configuration
-	cfg := struct {
-		AccessKeyID     string
-		AccessKeySecret string
-	}{}
+	cfg := backendConfig{}
 
 	if len(config.Backend) > 0 {
 		if err := json.Unmarshal(config.Backend, &cfg); err != nil {
@@ -64,7 +68,8 @@ func (be *AliVpcBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup
 
 	// 2. Acquire the lease form subnet manager
 	attrs := subnet.LeaseAttrs{
-		PublicIP: ip.FromIP(be.extIface.ExtAddr),
+		PublicIP:   ip.FromIP(be.extIface.ExtAddr),
+		PublicIPv6: be.extIface.ExtV6Addr,
 	}
 
 	l, err := be.sm.AcquireLease(ctx, &attrs)
@@ -75,7 +80,7 @@ func (be *AliVpcBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup
 		return nil, err
 
 	default:
-		return nil, fmt.Errorf("failed to acquire lease: %v", err)
+		return nil, fmt.Errorf("failed to acquire lease: %w", err)
 	}
 	if cfg.AccessKeyID == "" || cfg.AccessKeySecret == "" {
 		cfg.AccessKeyID = os.Getenv("ACCESS_KEY_ID")
@@ -42,7 +42,8 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backen
 
 func (be *AllocBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
 	attrs := subnet.LeaseAttrs{
-		PublicIP: ip.FromIP(be.extIface.ExtAddr),
+		PublicIP:   ip.FromIP(be.extIface.ExtAddr),
+		PublicIPv6: be.extIface.ExtV6Addr,
 	}
 
 	l, err := be.sm.AcquireLease(ctx, &attrs)
@@ -57,6 +58,6 @@ func (be *AllocBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup,
 		return nil, err
 
 	default:
-		return nil, fmt.Errorf("failed to acquire lease: %v", err)
+		return nil, fmt.Errorf("failed to acquire lease: %w", err)
 	}
 }
@@ -35,6 +35,7 @@ import (
 
 func init() {
 	backend.Register("aws-vpc", New)
+	backend.RegisterConfig("aws-vpc", func() interface{} { return &backendConfig{} })
 }
 
 type AwsVpcBackend struct {
@@ -93,7 +94,8 @@ func (be *AwsVpcBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup
 
 	// Acquire the lease form subnet manager
 	attrs := subnet.LeaseAttrs{
-		PublicIP: ip.FromIP(be.extIface.ExtAddr),
+		PublicIP:   ip.FromIP(be.extIface.ExtAddr),
+		PublicIPv6: be.extIface.ExtV6Addr,
 	}
 
 	l, err := be.sm.AcquireLease(ctx, &attrs)
@@ -104,7 +106,7 @@ func (be *AwsVpcBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup
 		return nil, err
 
 	default:
-		return nil, fmt.Errorf("failed to acquire lease: %v", err)
+		return nil, fmt.Errorf("failed to acquire lease: %w", err)
 	}
 
 	sess, _ := session.NewSession(aws.NewConfig().WithMaxRetries(5))
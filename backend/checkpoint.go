@@ -0,0 +1,77 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/coreos/flannel/pkg/fileutil"
+)
+
+// CheckpointDir is where backends save their runtime state, so that a restarted flanneld
+// can take over the devices and peers of the previous one instead of setting them up
+// from scratch. Checkpoints are disabled if it is empty.
+var CheckpointDir string
+
+func checkpointPath(name string) string {
+	return filepath.Join(CheckpointDir, name+".json")
+}
+
+// LoadCheckpoint reads the checkpoint of the named backend into v. It returns false if
+// checkpoints are disabled or there is none.
+func LoadCheckpoint(name string, v interface{}) (bool, error) {
+	if CheckpointDir == "" {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadFile(checkpointPath(name))
+	switch {
+	case os.IsNotExist(err):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SaveCheckpoint writes v as the checkpoint of the named backend.
+func SaveCheckpoint(name string, v interface{}) error {
+	if CheckpointDir == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteFileAtomic(checkpointPath(name), data, 0600)
+}
+
+// RemoveCheckpoint deletes the checkpoint of the named backend, e.g. after it removed its devices.
+func RemoveCheckpoint(name string) error {
+	if CheckpointDir == "" {
+		return nil
+	}
+	if err := os.Remove(checkpointPath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
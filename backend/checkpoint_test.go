@@ -0,0 +1,60 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	type state struct {
+		VNI int
+	}
+
+	// Disabled without directory
+	if err := SaveCheckpoint("test", state{VNI: 1}); err != nil {
+		t.Fatal(err)
+	}
+	var st state
+	if ok, err := LoadCheckpoint("test", &st); ok || err != nil {
+		t.Fatalf("expected no checkpoint, got %v, %v", ok, err)
+	}
+
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	CheckpointDir = dir
+	defer func() { CheckpointDir = "" }()
+
+	if ok, err := LoadCheckpoint("test", &st); ok || err != nil {
+		t.Fatalf("expected no checkpoint, got %v, %v", ok, err)
+	}
+	if err := SaveCheckpoint("test", state{VNI: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := LoadCheckpoint("test", &st); !ok || err != nil || st.VNI != 1 {
+		t.Fatalf("expected the saved checkpoint, got %v, %v, %+v", ok, err, st)
+	}
+	if err := RemoveCheckpoint("test"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := LoadCheckpoint("test", &st); ok || err != nil {
+		t.Fatalf("expected no checkpoint, got %v, %v", ok, err)
+	}
+}
@@ -24,9 +24,14 @@ import (
 )
 
 type ExternalInterface struct {
-	Iface     *net.Interface
-	IfaceAddr net.IP
-	ExtAddr   net.IP
+	Iface       *net.Interface
+	IfaceAddr   net.IP
+	IfaceV6Addr net.IP
+	ExtAddr     net.IP
+	ExtV6Addr   net.IP
+	// MTU of the external interface. Backends subtract their encapsulation
+	// overhead from it; see OverlayMTU.
+	MTU int
 }
 
 // Besides the entry points in the Backend interface, the backend's New()
@@ -44,4 +49,22 @@ type Network interface {
 	Run(ctx context.Context)
 }
 
+// ExternalInterfaceUpdater is implemented by networks that can move over to a
+// new address of the external interface without flanneld being restarted.
+type ExternalInterfaceUpdater interface {
+	UpdateExternalInterface(ctx context.Context, ei *ExternalInterface) error
+}
+
+// DataplaneCleaner is implemented by networks that can remove the routes and devices
+// they set up, for nodes that leave the flannel network.
+type DataplaneCleaner interface {
+	CleanUp() error
+}
+
+// DataplaneDumper is implemented by networks that can report the routes and neighbor
+// entries they programmed, for the debug endpoints of flanneld.
+type DataplaneDumper interface {
+	DumpDataplane() (*DataplaneDump, error)
+}
+
 type BackendCtor func(sm subnet.Manager, ei *ExternalInterface) (Backend, error)
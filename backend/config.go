@@ -0,0 +1,77 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+var configs = make(map[string]func() interface{})
+
+// RegisterConfig registers the type of the Backend section of the network config of a
+// backend type, next to Register. newConfig returns a pointer to a new value of the
+// type the backend decodes the section into.
+func RegisterConfig(backendType string, newConfig func() interface{}) {
+	configs[strings.ToLower(backendType)] = newConfig
+}
+
+// CheckConfig strictly decodes the Backend section of config into the config type of its
+// backend, so that misspelled settings and values of the wrong type are reported instead
+// of being ignored. Backends without registered config type take no settings besides
+// the Type.
+func CheckConfig(config *subnet.Config) error {
+	if len(config.Backend) == 0 {
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(config.Backend, &fields); err != nil {
+		return fmt.Errorf("invalid Backend: %v", err)
+	}
+	for name := range fields {
+		if strings.EqualFold(name, "Type") {
+			delete(fields, name)
+		}
+	}
+
+	newConfig, ok := configs[strings.ToLower(config.BackendType)]
+	if !ok {
+		if len(fields) == 0 {
+			return nil
+		}
+		var names []string
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("the %s backend takes no settings, got %s", config.BackendType, strings.Join(names, ", "))
+	}
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(newConfig()); err != nil {
+		return fmt.Errorf("invalid %s backend config: %v", config.BackendType, err)
+	}
+	return nil
+}
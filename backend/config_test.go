@@ -0,0 +1,51 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+func TestCheckConfig(t *testing.T) {
+	RegisterConfig("test", func() interface{} {
+		return &struct {
+			MTUConfig
+			Port int
+		}{}
+	})
+
+	for _, tc := range []struct {
+		backendType string
+		backend     string
+		valid       bool
+	}{
+		{"test", `{"Type":"test","Port":8472,"MTU":1400}`, true},
+		{"Test", `{"type":"Test","port":8472}`, true},
+		{"test", `{"Type":"test","Prot":8472}`, false},
+		{"test", `{"Type":"test","Port":"8472"}`, false},
+		{"test", `{"Type":"test","MTU":true}`, false},
+		{"none", `{"Type":"none"}`, true},
+		{"none", `{"Type":"none","Port":8472}`, false},
+		{"none", ``, true},
+	} {
+		config := &subnet.Config{BackendType: tc.backendType, Backend: json.RawMessage(tc.backend)}
+		if err := CheckConfig(config); (err == nil) != tc.valid {
+			t.Errorf("CheckConfig of %s %s returned %v, want valid %v", tc.backendType, tc.backend, err, tc.valid)
+		}
+	}
+}
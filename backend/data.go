@@ -0,0 +1,161 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+// DataSchema describes the BackendData that a backend type publishes on its leases, so
+// that malformed data of peers is rejected when it is watched, with an error naming the
+// lease, instead of failing deep in the dataplane code.
+//
+// The data carries its version in a "Version" field, unversioned data being version 0.
+// Data of a version newer than Version is validated like the current one, as fields the
+// daemon doesn't know are ignored when decoding, so that old and new daemons interoperate
+// while a cluster is upgraded.
+type DataSchema struct {
+	// Version is the version of the data the backend publishes.
+	Version int
+	// MinVersion is the oldest version of the data the backend understands.
+	MinVersion int
+	// Validate checks data of the given version.
+	Validate func(version int, data json.RawMessage) error
+}
+
+var schemas = make(map[string]DataSchema)
+
+// RegisterDataSchema registers the schema of the BackendData of a backend type, usually
+// next to Register.
+func RegisterDataSchema(backendType string, schema DataSchema) {
+	schemas[strings.ToLower(backendType)] = schema
+}
+
+// DataVersion returns the version of the BackendData data.
+func DataVersion(data json.RawMessage) (int, error) {
+	if len(data) == 0 || string(data) == "null" {
+		return 0, nil
+	}
+	var v struct {
+		Version int
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return 0, err
+	}
+	return v.Version, nil
+}
+
+// ValidateBackendData checks data published for a backend type against its registered
+// schema. Data of types without schema is accepted.
+func ValidateBackendData(backendType string, data json.RawMessage) error {
+	schema, ok := schemas[strings.ToLower(backendType)]
+	if !ok {
+		return nil
+	}
+
+	version, err := DataVersion(data)
+	if err != nil {
+		return fmt.Errorf("invalid %s data: %v", backendType, err)
+	}
+	if version < schema.MinVersion {
+		return fmt.Errorf("%s data version %d is older than the oldest supported version %d", backendType, version, schema.MinVersion)
+	}
+	if version > schema.Version {
+		log.V(1).Infof("Validating %s data version %d as version %d", backendType, version, schema.Version)
+		version = schema.Version
+	}
+	if schema.Validate != nil {
+		if err := schema.Validate(version, data); err != nil {
+			return fmt.Errorf("invalid %s data: %v", backendType, err)
+		}
+	}
+	return nil
+}
+
+// ValidateLease checks the data of all backend types published on a lease.
+func ValidateLease(l *subnet.Lease) error {
+	types := []string{l.Attrs.BackendType}
+	for bt := range l.Attrs.BackendDataByType {
+		if bt != l.Attrs.BackendType {
+			types = append(types, bt)
+		}
+	}
+	sort.Strings(types[1:])
+
+	for _, bt := range types {
+		if data, ok := l.Attrs.BackendDataFor(bt); ok {
+			if err := ValidateBackendData(bt, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validatingManager drops the leases with invalid backend data from the lease watches,
+// so that the backends only see leases they can decode. A lease whose data turns invalid
+// stays programmed with its previous data, until it is removed or fixed.
+type validatingManager struct {
+	subnet.Manager
+}
+
+func (m validatingManager) WatchLeases(ctx context.Context, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	for {
+		res, err := m.Manager.WatchLeases(ctx, cursor)
+		if err != nil {
+			return res, err
+		}
+
+		if len(res.Events) == 0 {
+			var snapshot []subnet.Lease
+			for i := range res.Snapshot {
+				if validLease(&res.Snapshot[i]) {
+					snapshot = append(snapshot, res.Snapshot[i])
+				}
+			}
+			res.Snapshot = snapshot
+			return res, nil
+		}
+
+		var events []subnet.Event
+		for _, evt := range res.Events {
+			if validLease(&evt.Lease) {
+				events = append(events, evt)
+			}
+		}
+		// A result without events is a snapshot, so keep watching if all were dropped
+		if len(events) > 0 {
+			res.Events = events
+			return res, nil
+		}
+		cursor = res.Cursor
+	}
+}
+
+func validLease(l *subnet.Lease) bool {
+	if err := ValidateLease(l); err != nil {
+		log.Warningf("Ignoring the lease of %v (public IP %v): %v", l.Subnet, l.Attrs.PublicIP, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+func init() {
+	// Version 1 added Key, which is required from then on
+	RegisterDataSchema("test", DataSchema{
+		Version:    2,
+		MinVersion: 1,
+		Validate: func(version int, data json.RawMessage) error {
+			var d struct{ Key string }
+			if err := json.Unmarshal(data, &d); err != nil {
+				return err
+			}
+			if d.Key == "" {
+				return errors.New("Key is missing")
+			}
+			return nil
+		},
+	})
+}
+
+func testDataLease(sn, data string) subnet.Lease {
+	_, n, _ := net.ParseCIDR(sn)
+	return subnet.Lease{
+		Subnet: ip.FromIPNet(n),
+		Attrs:  subnet.LeaseAttrs{BackendType: "test", BackendData: json.RawMessage(data)},
+	}
+}
+
+func TestValidateBackendData(t *testing.T) {
+	for _, tc := range []struct {
+		data  string
+		valid bool
+	}{
+		{`{"Version":1,"Key":"a"}`, true},
+		{`{"Version":2,"Key":"a"}`, true},
+		// Newer versions are validated as the current one
+		{`{"Version":3,"Key":"a","Extra":1}`, true},
+		{`{"Version":2}`, false},
+		{`{"Key":"a"}`, false},
+		{`{"Version":"2","Key":"a"}`, false},
+		{`[]`, false},
+	} {
+		if err := ValidateBackendData("test", json.RawMessage(tc.data)); (err == nil) != tc.valid {
+			t.Errorf("expected %s to be valid=%v, got %v", tc.data, tc.valid, err)
+		}
+	}
+
+	// Types without schema are accepted
+	if err := ValidateBackendData("host-gw", json.RawMessage(`[]`)); err != nil {
+		t.Errorf("expected data without schema to be accepted, got %v", err)
+	}
+}
+
+type resultsManager struct {
+	subnet.Manager
+	results []subnet.LeaseWatchResult
+}
+
+func (m *resultsManager) WatchLeases(ctx context.Context, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	res := m.results[0]
+	m.results = m.results[1:]
+	return res, nil
+}
+
+func TestValidatingManager(t *testing.T) {
+	valid, invalid := testDataLease("10.1.1.0/24", `{"Version":2,"Key":"a"}`), testDataLease("10.1.2.0/24", `{"Version":2}`)
+	sm := validatingManager{&resultsManager{results: []subnet.LeaseWatchResult{
+		{Snapshot: []subnet.Lease{valid, invalid}, Cursor: 1},
+		{Events: []subnet.Event{{Type: subnet.EventAdded, Lease: invalid}}, Cursor: 2},
+		{Events: []subnet.Event{{Type: subnet.EventAdded, Lease: invalid}, {Type: subnet.EventRemoved, Lease: valid}}, Cursor: 3},
+	}}}
+	ctx := context.Background()
+
+	res, err := sm.WatchLeases(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Snapshot) != 1 || res.Snapshot[0].Subnet != valid.Subnet {
+		t.Fatalf("expected only the valid lease in the snapshot, got %v", res.Snapshot)
+	}
+
+	// Results whose events are all dropped mustn't look like an empty snapshot
+	res, err = sm.WatchLeases(ctx, res.Cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Events) != 1 || res.Events[0].Type != subnet.EventRemoved || res.Cursor != 3 {
+		t.Fatalf("expected the events of the valid lease, got %+v", res)
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+// DataplaneDump is the state a network programmed, for operators diagnosing peers that
+// don't converge.
+type DataplaneDump struct {
+	// Routes are the routes to the peers the network keeps installed.
+	Routes []RouteEntry
+	// Neighbors are the FDB and ARP entries of the network device.
+	Neighbors []NeighborEntry `json:",omitempty"`
+	// FailedPeers are the peers that couldn't be programmed.
+	FailedPeers []PeerStatus
+}
+
+type RouteEntry struct {
+	Dst       string
+	Gw        string `json:",omitempty"`
+	LinkIndex int
+	Onlink    bool `json:",omitempty"`
+}
+
+type NeighborEntry struct {
+	// Type is "fdb" or "arp".
+	Type string
+	IP   string `json:",omitempty"`
+	MAC  string
+}
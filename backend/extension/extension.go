@@ -31,8 +31,17 @@ import (
 	"golang.org/x/net/context"
 )
 
+// backendConfig is the Backend section of the network config.
+type backendConfig struct {
+	PreStartupCommand   string
+	PostStartupCommand  string
+	SubnetAddCommand    string
+	SubnetRemoveCommand string
+}
+
 func init() {
 	backend.Register("extension", New)
+	backend.RegisterConfig("extension", func() interface{} { return &backendConfig{} })
 }
 
 type ExtensionBackend struct {
@@ -63,12 +72,7 @@ func (be *ExtensionBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGr
 
 	// Parse out configuration
 	if len(config.Backend) > 0 {
-		cfg := struct {
-			PreStartupCommand   string
-			PostStartupCommand  string
-			SubnetAddCommand    string
-			SubnetRemoveCommand string
-		}{}
+		cfg := backendConfig{}
 		if err := json.Unmarshal(config.Backend, &cfg); err != nil {
 			return nil, fmt.Errorf("error decoding backend config: %v", err)
 		}
@@ -97,6 +101,7 @@ func (be *ExtensionBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGr
 
 	attrs := subnet.LeaseAttrs{
 		PublicIP:    ip.FromIP(be.extIface.ExtAddr),
+		PublicIPv6:  be.extIface.ExtV6Addr,
 		BackendType: "extension",
 		BackendData: data,
 	}
@@ -110,7 +115,7 @@ func (be *ExtensionBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGr
 		return nil, err
 
 	default:
-		return nil, fmt.Errorf("failed to acquire lease: %v", err)
+		return nil, fmt.Errorf("failed to acquire lease: %w", err)
 	}
 
 	if len(n.postStartupCommand) > 0 {
@@ -76,7 +76,8 @@ func (n *network) handleSubnetEvents(batch []subnet.Event) {
 		case subnet.EventAdded:
 			log.Infof("Subnet added: %v via %v", evt.Lease.Subnet, evt.Lease.Attrs.PublicIP)
 
-			if evt.Lease.Attrs.BackendType != "extension" {
+			data, ok := evt.Lease.Attrs.BackendDataFor("extension")
+			if !ok {
 				log.Warningf("Ignoring non-extension subnet: type=%v", evt.Lease.Attrs.BackendType)
 				continue
 			}
@@ -84,8 +85,8 @@ func (n *network) handleSubnetEvents(batch []subnet.Event) {
 			if len(n.subnetAddCommand) > 0 {
 				backendData := ""
 
-				if len(evt.Lease.Attrs.BackendData) > 0 {
-					if err := json.Unmarshal(evt.Lease.Attrs.BackendData, &backendData); err != nil {
+				if len(data) > 0 {
+					if err := json.Unmarshal(data, &backendData); err != nil {
 						log.Errorf("failed to unmarshal BackendData: %v", err)
 						continue
 					}
@@ -107,7 +108,8 @@ func (n *network) handleSubnetEvents(batch []subnet.Event) {
 		case subnet.EventRemoved:
 			log.Info("Subnet removed: ", evt.Lease.Subnet)
 
-			if evt.Lease.Attrs.BackendType != "extension" {
+			data, ok := evt.Lease.Attrs.BackendDataFor("extension")
+			if !ok {
 				log.Warningf("Ignoring non-extension subnet: type=%v", evt.Lease.Attrs.BackendType)
 				continue
 			}
@@ -115,8 +117,8 @@ func (n *network) handleSubnetEvents(batch []subnet.Event) {
 			if len(n.subnetRemoveCommand) > 0 {
 				backendData := ""
 
-				if len(evt.Lease.Attrs.BackendData) > 0 {
-					if err := json.Unmarshal(evt.Lease.Attrs.BackendData, &backendData); err != nil {
+				if len(data) > 0 {
+					if err := json.Unmarshal(data, &backendData); err != nil {
 						log.Errorf("failed to unmarshal BackendData: %v", err)
 						continue
 					}
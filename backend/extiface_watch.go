@@ -0,0 +1,85 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package backend
+
+import (
+	"fmt"
+
+	log "github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// WatchExternalInterface follows the IPv4 addresses of the external interface.
+// When the address flannel is using goes away and another one takes its place,
+// bn is moved over to the new address if it implements ExternalInterfaceUpdater.
+// Otherwise, or if that fails, an error is returned so that flanneld can be
+// restarted and pick up the new address from scratch.
+func WatchExternalInterface(ctx context.Context, ei *ExternalInterface, bn Network) error {
+	updates := make(chan netlink.AddrUpdate)
+	done := make(chan struct{})
+	defer close(done)
+
+	if err := netlink.AddrSubscribe(updates, done); err != nil {
+		return fmt.Errorf("failed to subscribe to address changes: %v", err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case u, ok := <-updates:
+			if !ok {
+				return fmt.Errorf("address subscription closed")
+			}
+			if u.LinkIndex != ei.Iface.Index || u.LinkAddress.IP.To4() == nil {
+				continue
+			}
+
+			if ip.GetInterfaceIP4AddrMatch(ei.Iface, ei.IfaceAddr) == nil {
+				// The address in use is still there
+				continue
+			}
+
+			addr, err := ip.GetInterfaceIP4Addr(ei.Iface)
+			if err != nil {
+				// Wait for the replacement address to show up
+				log.Warningf("Address %s was removed from %s and there is no other IPv4 address yet", ei.IfaceAddr, ei.Iface.Name)
+				continue
+			}
+
+			newEI := *ei
+			newEI.IfaceAddr = addr
+			if ei.ExtAddr.Equal(ei.IfaceAddr) {
+				// The public IP wasn't set explicitly, so it follows the interface address
+				newEI.ExtAddr = addr
+			}
+			log.Infof("Address of %s changed from %s to %s", ei.Iface.Name, ei.IfaceAddr, addr)
+
+			updater, ok := bn.(ExternalInterfaceUpdater)
+			if !ok {
+				return fmt.Errorf("address of %s changed from %s to %s and the backend can't follow it without a restart", ei.Iface.Name, ei.IfaceAddr, addr)
+			}
+			if err := updater.UpdateExternalInterface(ctx, &newEI); err != nil {
+				return fmt.Errorf("failed to move over to %s: %v", addr, err)
+			}
+			ei = &newEI
+		}
+	}
+}
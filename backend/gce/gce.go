@@ -84,7 +84,8 @@ func (g *GCEBackend) ensureAPI() error {
 
 func (g *GCEBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
 	attrs := subnet.LeaseAttrs{
-		PublicIP: ip.FromIP(g.extIface.ExtAddr),
+		PublicIP:   ip.FromIP(g.extIface.ExtAddr),
+		PublicIPv6: g.extIface.ExtV6Addr,
 	}
 
 	l, err := g.sm.AcquireLease(ctx, &attrs)
@@ -95,7 +96,7 @@ func (g *GCEBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, co
 		return nil, err
 
 	default:
-		return nil, fmt.Errorf("failed to acquire lease: %v", err)
+		return nil, fmt.Errorf("failed to acquire lease: %w", err)
 	}
 
 	if err = g.ensureAPI(); err != nil {
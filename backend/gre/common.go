@@ -0,0 +1,70 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gre
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+
+	"github.com/coreos/flannel/backend"
+)
+
+const (
+	backendType = "gre"
+
+	modeGRE    = "gre"
+	modeGRETAP = "gretap"
+
+	// Names of the per-peer devices are the prefix of the mode followed by the hash of
+	// the peer address, which keeps them within the 15 characters of a device name.
+	greLinkPrefix    = "flgre-"
+	gretapLinkPrefix = "fltap-"
+
+	ethernetHeaderLen = 14
+	// The IPv6 header is 40 bytes instead of the 20 bytes of IPv4
+	ipv6ExtraHeaderLen = 20
+)
+
+func linkPrefix(mode string) string {
+	if mode == modeGRETAP {
+		return gretapLinkPrefix
+	}
+	return greLinkPrefix
+}
+
+// linkName returns the name of the device of mode tunneling to remote.
+func linkName(mode string, remote net.IP) string {
+	h := fnv.New32a()
+	h.Write(remote)
+	return fmt.Sprintf("%s%08x", linkPrefix(mode), h.Sum32())
+}
+
+func isPeerLink(name string) bool {
+	return strings.HasPrefix(name, greLinkPrefix) || strings.HasPrefix(name, gretapLinkPrefix)
+}
+
+// overhead returns the encapsulation overhead of mode with IPv4 or IPv6 outer headers.
+func overhead(mode string, outerIPv6 bool) int {
+	o := backend.GREOverhead
+	if mode == modeGRETAP {
+		o += ethernetHeaderLen
+	}
+	if outerIPv6 {
+		o += ipv6ExtraHeaderLen
+	}
+	return o
+}
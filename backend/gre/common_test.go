@@ -0,0 +1,59 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gre
+
+import (
+	"net"
+	"testing"
+)
+
+func TestLinkName(t *testing.T) {
+	v4, v6 := net.ParseIP("192.168.0.2").To4(), net.ParseIP("2001:db8::2")
+
+	for _, name := range []string{linkName(modeGRE, v4), linkName(modeGRETAP, v4), linkName(modeGRE, v6)} {
+		if len(name) > 15 {
+			t.Errorf("%q is longer than a device name can be", name)
+		}
+		if !isPeerLink(name) {
+			t.Errorf("expected %q to be recognized as a peer device", name)
+		}
+	}
+	if linkName(modeGRE, v4) != linkName(modeGRE, net.ParseIP("192.168.0.2").To4()) {
+		t.Error("expected the name of a peer to be stable")
+	}
+	if linkName(modeGRE, v4) == linkName(modeGRE, net.ParseIP("192.168.0.3").To4()) {
+		t.Error("expected peers to get different devices")
+	}
+	if isPeerLink("flannel.1") {
+		t.Error("expected other devices not to be recognized as peer devices")
+	}
+}
+
+func TestOverhead(t *testing.T) {
+	for _, tc := range []struct {
+		mode      string
+		outerIPv6 bool
+		overhead  int
+	}{
+		{modeGRE, false, 24},
+		{modeGRE, true, 44},
+		{modeGRETAP, false, 38},
+		{modeGRETAP, true, 58},
+	} {
+		if o := overhead(tc.mode, tc.outerIPv6); o != tc.overhead {
+			t.Errorf("expected an overhead of %d for %s (IPv6=%v), got %d", tc.overhead, tc.mode, tc.outerIPv6, o)
+		}
+	}
+}
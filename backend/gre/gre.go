@@ -0,0 +1,113 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gre
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/dataplane"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// backendConfig is the Backend section of the network config.
+type backendConfig struct {
+	backend.MTUConfig
+	Mode      string
+	OuterIPv6 bool
+}
+
+func init() {
+	backend.Register(backendType, New)
+	backend.RegisterConfig(backendType, func() interface{} { return &backendConfig{} })
+}
+
+type GREBackend struct {
+	sm       subnet.Manager
+	extIface *backend.ExternalInterface
+}
+
+func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backend, error) {
+	be := &GREBackend{
+		sm:       sm,
+		extIface: extIface,
+	}
+	return be, nil
+}
+
+func (be *GREBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
+	cfg := backendConfig{
+		Mode: modeGRE,
+	}
+
+	if len(config.Backend) > 0 {
+		if err := json.Unmarshal(config.Backend, &cfg); err != nil {
+			return nil, fmt.Errorf("error decoding GRE backend config: %v", err)
+		}
+	}
+	if cfg.Mode != modeGRE && cfg.Mode != modeGRETAP {
+		return nil, fmt.Errorf("unknown GRE Mode %q, must be %q or %q", cfg.Mode, modeGRE, modeGRETAP)
+	}
+	if cfg.OuterIPv6 && (be.extIface.IfaceV6Addr == nil || be.extIface.ExtV6Addr == nil) {
+		return nil, fmt.Errorf("OuterIPv6 requires an IPv6 address on %s", be.extIface.Iface.Name)
+	}
+
+	log.Infof("GRE config: Mode=%s OuterIPv6=%v", cfg.Mode, cfg.OuterIPv6)
+
+	mtu, err := backend.OverlayMTU(be.extIface, overhead(cfg.Mode, cfg.OuterIPv6), config)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := &subnet.LeaseAttrs{
+		PublicIP:    ip.FromIP(be.extIface.ExtAddr),
+		PublicIPv6:  be.extIface.ExtV6Addr,
+		BackendType: backendType,
+	}
+
+	l, err := be.sm.AcquireLease(ctx, attrs)
+	switch err {
+	case nil:
+
+	case context.Canceled, context.DeadlineExceeded:
+		return nil, err
+
+	default:
+		return nil, fmt.Errorf("failed to acquire lease: %w", err)
+	}
+
+	nl := dataplane.NewNetlink()
+	return &network{
+		SimpleNetwork: backend.SimpleNetwork{
+			SubnetLease: l,
+			ExtIface:    be.extIface,
+		},
+		sm:        be.sm,
+		mode:      cfg.Mode,
+		outerIPv6: cfg.OuterIPv6,
+		mtu:       mtu,
+		nl:        nl,
+		routes:    backend.NewRouteController(nl),
+		peers:     backend.NewPeerQuarantine(),
+		links:     make(map[ip.IP4Net]peerLink),
+	}, nil
+}
@@ -0,0 +1,363 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package gre
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/audit"
+	"github.com/coreos/flannel/pkg/dataplane"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// network programs a point-to-point GRE or GRETAP device per peer, and routes the subnet
+// of the peer through it.
+type network struct {
+	backend.SimpleNetwork
+	sm        subnet.Manager
+	mode      string
+	outerIPv6 bool
+	mtu       int
+	nl        dataplane.Netlink
+	routes    *backend.RouteController
+	peers     *backend.PeerQuarantine
+
+	mu    sync.Mutex
+	links map[ip.IP4Net]peerLink
+}
+
+type peerLink struct {
+	name  string
+	route netlink.Route
+}
+
+func (n *network) MTU() int {
+	return n.mtu
+}
+
+func (n *network) Run(ctx context.Context) {
+	wg := sync.WaitGroup{}
+
+	log.Info("Watching for new subnet leases")
+	evts := make(chan []subnet.Event)
+	wg.Add(1)
+	go func() {
+		subnet.WatchLeases(ctx, n.sm, n.SubnetLease, evts)
+		wg.Done()
+	}()
+
+	wg.Add(1)
+	go func() {
+		n.routes.Run(ctx)
+		wg.Done()
+	}()
+
+	defer wg.Wait()
+
+	retry := time.NewTicker(backend.PeerRetryInterval)
+	defer retry.Stop()
+
+	pruned := false
+	for {
+		select {
+		case evtBatch := <-evts:
+			n.handleSubnetEvents(evtBatch)
+			// The first batch is the snapshot of the leases, so devices of peers that left
+			// while flannel wasn't running are known by now
+			if !pruned {
+				n.pruneLinks()
+				pruned = true
+			}
+
+		case <-retry.C:
+			for _, l := range n.peers.Due() {
+				l := l
+				n.addPeer(&l)
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (n *network) handleSubnetEvents(batch []subnet.Event) {
+	for _, evt := range batch {
+		if _, ok := evt.Lease.Attrs.BackendDataFor(backendType); !ok {
+			log.Warningf("Ignoring non-%v subnet: type=%v", backendType, evt.Lease.Attrs.BackendType)
+			continue
+		}
+
+		switch evt.Type {
+		case subnet.EventAdded:
+			log.Infof("Subnet added: %v via %v", evt.Lease.Subnet, n.remoteIP(&evt.Lease))
+			n.addPeer(&evt.Lease)
+
+		case subnet.EventRemoved:
+			log.Info("Subnet removed: ", evt.Lease.Subnet)
+			n.peers.Remove(evt.Lease.Subnet)
+			n.removePeer(evt.Lease.Subnet)
+
+		default:
+			log.Error("Internal error: unknown event type: ", int(evt.Type))
+		}
+	}
+}
+
+// remoteIP returns the outer destination of the tunnel to the owner of lease.
+func (n *network) remoteIP(lease *subnet.Lease) net.IP {
+	if n.outerIPv6 {
+		return lease.Attrs.PublicIPv6
+	}
+	return lease.Attrs.PublicIP.ToIP()
+}
+
+func (n *network) localIP() net.IP {
+	if n.outerIPv6 {
+		return n.ExtIface.IfaceV6Addr
+	}
+	return n.ExtIface.IfaceAddr
+}
+
+// addPeer sets up the device and route to the subnet of lease, leaving retries of
+// failures to the peer quarantine.
+func (n *network) addPeer(lease *subnet.Lease) {
+	if err := n.programPeer(lease); err != nil {
+		log.Errorf("Failed to set up the GRE tunnel to %v: %v", lease.Subnet, err)
+		n.peers.Failed(lease, err)
+		return
+	}
+	n.peers.Succeeded(lease.Subnet)
+}
+
+func (n *network) programPeer(lease *subnet.Lease) error {
+	remote := n.remoteIP(lease)
+	if remote == nil {
+		return fmt.Errorf("the peer has no public IPv6 address")
+	}
+
+	name := linkName(n.mode, remote)
+	link, err := n.ensureLink(name, remote)
+	if err != nil {
+		return err
+	}
+
+	route := netlink.Route{
+		Dst:       lease.Subnet.ToIPNet(),
+		LinkIndex: link.Attrs().Index,
+	}
+	if n.mode == modeGRETAP {
+		// Ethernet needs a next hop to resolve: the peer has its subnet address on the
+		// device of its end of the tunnel
+		route.Gw = lease.Subnet.IP.ToIP()
+		route.Flags = int(netlink.FLAG_ONLINK)
+	} else {
+		route.Scope = netlink.SCOPE_LINK
+	}
+
+	n.routes.Add(route)
+	err = n.nl.RouteReplace(&route)
+	audit.Log(audit.KindRoute, audit.ActionReplace, "", route.String(), err)
+	if err != nil {
+		n.routes.Remove(route)
+		return fmt.Errorf("failed to add route to %v: %v", lease.Subnet, err)
+	}
+
+	n.mu.Lock()
+	old, ok := n.links[lease.Subnet]
+	n.links[lease.Subnet] = peerLink{name: name, route: route}
+	n.mu.Unlock()
+
+	// The public IP of the peer changed
+	if ok && old.name != name {
+		n.deleteLinkIfUnused(old.name)
+	}
+	return nil
+}
+
+func (n *network) removePeer(sn ip.IP4Net) {
+	n.mu.Lock()
+	pl, ok := n.links[sn]
+	delete(n.links, sn)
+	n.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	n.routes.Remove(pl.route)
+	err := n.nl.RouteDel(&pl.route)
+	audit.Log(audit.KindRoute, audit.ActionDelete, pl.route.String(), "", err)
+	if err != nil && err != syscall.ESRCH {
+		log.Errorf("Error deleting route to %v: %v", sn, err)
+	}
+	n.deleteLinkIfUnused(pl.name)
+}
+
+// deleteLinkIfUnused deletes the device name unless a subnet is still routed through it.
+func (n *network) deleteLinkIfUnused(name string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, pl := range n.links {
+		if pl.name == name {
+			return
+		}
+	}
+	deleteLink(name)
+}
+
+func deleteLink(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	err = netlink.LinkDel(link)
+	audit.Log(audit.KindLink, audit.ActionDelete, name, "", err)
+	if err != nil {
+		log.Errorf("Failed to delete %s: %v", name, err)
+	}
+	return err
+}
+
+// pruneLinks deletes the per-peer devices of peers that are gone.
+func (n *network) pruneLinks() {
+	links, err := netlink.LinkList()
+	if err != nil {
+		log.Errorf("Failed to list links: %v", err)
+		return
+	}
+
+	n.mu.Lock()
+	used := make(map[string]bool)
+	for _, pl := range n.links {
+		used[pl.name] = true
+	}
+	n.mu.Unlock()
+
+	for _, link := range links {
+		if name := link.Attrs().Name; isPeerLink(name) && !used[name] {
+			log.Infof("Deleting %s of a peer that is gone", name)
+			deleteLink(name)
+		}
+	}
+}
+
+// ensureLink creates the device tunneling to remote, or recreates it if it exists with
+// other attributes.
+func (n *network) ensureLink(name string, remote net.IP) (netlink.Link, error) {
+	var link netlink.Link
+	attrs := netlink.LinkAttrs{Name: name, MTU: n.mtu}
+	if n.mode == modeGRETAP {
+		link = &netlink.Gretap{LinkAttrs: attrs, Local: n.localIP(), Remote: remote}
+	} else {
+		link = &netlink.Gretun{LinkAttrs: attrs, Local: n.localIP(), Remote: remote}
+	}
+
+	existing, err := netlink.LinkByName(name)
+	if err == nil && !linkMatches(existing, link) {
+		log.Warningf("%q already exists with incompatible attributes; recreating device", name)
+		if err := deleteLink(name); err != nil {
+			return nil, err
+		}
+		existing = nil
+	}
+
+	if existing == nil {
+		err := netlink.LinkAdd(link)
+		audit.Log(audit.KindLink, audit.ActionAdd, "", fmt.Sprintf("%s type %s local %v remote %v", name, link.Type(), n.localIP(), remote), err)
+		if err != nil && err != syscall.EEXIST {
+			return nil, fmt.Errorf("failed to create %s: %w", name, err)
+		}
+		if existing, err = netlink.LinkByName(name); err != nil {
+			return nil, err
+		}
+	}
+
+	if existing.Attrs().MTU != n.mtu {
+		if err := netlink.LinkSetMTU(existing, n.mtu); err != nil {
+			return nil, fmt.Errorf("failed to set %v MTU to %d: %w", name, n.mtu, err)
+		}
+	}
+
+	// The /32 address of the subnet is the source of host to workload traffic, and the
+	// next hop GRETAP peers resolve
+	ipnLocal := n.SubnetLease.Subnet
+	ipnLocal.PrefixLen = 32
+	if err := netlink.AddrAdd(existing, &netlink.Addr{IPNet: ipnLocal.ToIPNet()}); err != nil && err != syscall.EEXIST {
+		return nil, fmt.Errorf("failed to add IP address %v to %v: %w", ipnLocal, name, err)
+	}
+
+	if err := netlink.LinkSetUp(existing); err != nil {
+		return nil, fmt.Errorf("failed to set interface %v to UP state: %w", name, err)
+	}
+	return existing, nil
+}
+
+func linkMatches(existing, link netlink.Link) bool {
+	if existing.Type() != link.Type() {
+		return false
+	}
+	switch e := existing.(type) {
+	case *netlink.Gretun:
+		l := link.(*netlink.Gretun)
+		return e.Local.Equal(l.Local) && e.Remote.Equal(l.Remote)
+	case *netlink.Gretap:
+		l := link.(*netlink.Gretap)
+		return e.Local.Equal(l.Local) && e.Remote.Equal(l.Remote)
+	}
+	return false
+}
+
+// CleanUp deletes the per-peer devices, and with them the routes through them.
+func (n *network) CleanUp() error {
+	n.mu.Lock()
+	links := n.links
+	n.links = make(map[ip.IP4Net]peerLink)
+	n.mu.Unlock()
+
+	var failed int
+	for _, pl := range links {
+		n.routes.Remove(pl.route)
+		if err := deleteLink(pl.name); err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to delete %d GRE devices", failed)
+	}
+	return nil
+}
+
+// DumpDataplane reports the routes and the failing peers.
+func (n *network) DumpDataplane() (*backend.DataplaneDump, error) {
+	return &backend.DataplaneDump{
+		Routes:      backend.DumpRoutes(n.routes.Routes()),
+		FailedPeers: n.peers.Status(),
+	}, nil
+}
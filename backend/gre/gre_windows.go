@@ -1,4 +1,4 @@
-// Copyright 2015 flannel authors
+// Copyright 2020 flannel authors
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -12,20 +12,12 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package etcdv2
+package gre
 
 import (
-	"math/rand"
-	"time"
+	log "github.com/golang/glog"
 )
 
-var rnd *rand.Rand
-
 func init() {
-	seed := time.Now().UnixNano()
-	rnd = rand.New(rand.NewSource(seed))
-}
-
-func randInt(lo, hi int) int {
-	return lo + int(rnd.Int31n(int32(hi-lo)))
+	log.Infof("gre is not supported on this platform")
 }
@@ -31,6 +31,7 @@ import (
 
 func init() {
 	backend.Register("host-gw", New)
+	backend.RegisterConfig("host-gw", func() interface{} { return &backend.MTUConfig{} })
 }
 
 type HostgwBackend struct {
@@ -51,13 +52,18 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backen
 }
 
 func (be *HostgwBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
+	mtu, err := backend.OverlayMTU(be.extIface, 0, config)
+	if err != nil {
+		return nil, err
+	}
+
 	n := &backend.RouteNetwork{
 		SimpleNetwork: backend.SimpleNetwork{
 			ExtIface: be.extIface,
 		},
 		SM:          be.sm,
 		BackendType: "host-gw",
-		Mtu:         be.extIface.Iface.MTU,
+		Mtu:         mtu,
 		LinkIndex:   be.extIface.Iface.Index,
 	}
 	n.GetRoute = func(lease *subnet.Lease) *netlink.Route {
@@ -70,6 +76,7 @@ func (be *HostgwBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup
 
 	attrs := subnet.LeaseAttrs{
 		PublicIP:    ip.FromIP(be.extIface.ExtAddr),
+		PublicIPv6:  be.extIface.ExtV6Addr,
 		BackendType: "host-gw",
 	}
 
@@ -82,7 +89,7 @@ func (be *HostgwBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup
 		return nil, err
 
 	default:
-		return nil, fmt.Errorf("failed to acquire lease: %v", err)
+		return nil, fmt.Errorf("failed to acquire lease: %w", err)
 	}
 
 	return n, nil
@@ -31,8 +31,15 @@ import (
 	"k8s.io/apimachinery/pkg/util/wait"
 )
 
+// backendConfig is the Backend section of the network config.
+type backendConfig struct {
+	Name          string
+	DNSServerList string
+}
+
 func init() {
 	backend.Register("host-gw", New)
+	backend.RegisterConfig("host-gw", func() interface{} { return &backendConfig{} })
 }
 
 type HostgwBackend struct {
@@ -55,10 +62,7 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backen
 
 func (be *HostgwBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
 	// 1. Parse configuration
-	cfg := struct {
-		Name          string
-		DNSServerList string
-	}{}
+	cfg := backendConfig{}
 	if len(config.Backend) > 0 {
 		if err := json.Unmarshal(config.Backend, &cfg); err != nil {
 			return nil, errors.Annotate(err, "error decoding windows host-gw backend config")
@@ -89,6 +93,7 @@ func (be *HostgwBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup
 	// 2. Acquire the lease form subnet manager
 	attrs := subnet.LeaseAttrs{
 		PublicIP:    ip.FromIP(be.extIface.ExtAddr),
+		PublicIPv6:  be.extIface.ExtV6Addr,
 		BackendType: "host-gw",
 	}
 
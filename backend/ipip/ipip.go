@@ -19,6 +19,7 @@ package ipip
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"syscall"
 
 	"sync"
@@ -36,8 +37,15 @@ const (
 	tunnelName  = "flannel.ipip"
 )
 
+// backendConfig is the Backend section of the network config.
+type backendConfig struct {
+	backend.MTUConfig
+	DirectRouting bool
+}
+
 func init() {
 	backend.Register(backendType, New)
+	backend.RegisterConfig(backendType, func() interface{} { return &backendConfig{} })
 }
 
 type IPIPBackend struct {
@@ -54,9 +62,7 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backen
 }
 
 func (be *IPIPBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
-	cfg := struct {
-		DirectRouting bool
-	}{}
+	cfg := backendConfig{}
 
 	if len(config.Backend) > 0 {
 		if err := json.Unmarshal(config.Backend, &cfg); err != nil {
@@ -66,6 +72,11 @@ func (be *IPIPBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup,
 
 	log.Infof("IPIP config: DirectRouting=%v", cfg.DirectRouting)
 
+	mtu, err := backend.OverlayMTU(be.extIface, backend.IPIPOverhead, config)
+	if err != nil {
+		return nil, err
+	}
+
 	n := &backend.RouteNetwork{
 		SimpleNetwork: backend.SimpleNetwork{
 			ExtIface: be.extIface,
@@ -76,6 +87,7 @@ func (be *IPIPBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup,
 
 	attrs := &subnet.LeaseAttrs{
 		PublicIP:    ip.FromIP(be.extIface.ExtAddr),
+		PublicIPv6:  be.extIface.ExtV6Addr,
 		BackendType: backendType,
 	}
 
@@ -86,10 +98,10 @@ func (be *IPIPBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup,
 	case context.Canceled, context.DeadlineExceeded:
 		return nil, err
 	default:
-		return nil, fmt.Errorf("failed to acquire lease: %v", err)
+		return nil, fmt.Errorf("failed to acquire lease: %w", err)
 	}
 
-	link, err := be.configureIPIPDevice(n.SubnetLease)
+	link, err := be.configureIPIPDevice(n.SubnetLease, be.extIface.IfaceAddr, mtu)
 
 	if err != nil {
 		return nil, err
@@ -97,6 +109,14 @@ func (be *IPIPBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup,
 
 	n.Mtu = link.MTU
 	n.LinkIndex = link.Index
+	n.MoveTunnel = func(ei *backend.ExternalInterface) (int, error) {
+		// The device is recreated with the new local address
+		link, err := be.configureIPIPDevice(n.SubnetLease, ei.IfaceAddr, n.Mtu)
+		if err != nil {
+			return 0, err
+		}
+		return link.Index, nil
+	}
 	n.GetRoute = func(lease *subnet.Lease) *netlink.Route {
 		route := netlink.Route{
 			Dst:       lease.Subnet.ToIPNet(),
@@ -124,7 +144,7 @@ func (be *IPIPBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup,
 	return n, nil
 }
 
-func (be *IPIPBackend) configureIPIPDevice(lease *subnet.Lease) (*netlink.Iptun, error) {
+func (be *IPIPBackend) configureIPIPDevice(lease *subnet.Lease, local net.IP, expectMTU int) (*netlink.Iptun, error) {
 	// When modprobe ipip module, a tunl0 ipip device is created automatically per network namespace by ipip kernel module.
 	// It is the namespace default IPIP device with attributes local=any and remote=any.
 	// When receiving IPIP protocol packets, kernel will forward them to tunl0 as a fallback device
@@ -134,7 +154,7 @@ func (be *IPIPBackend) configureIPIPDevice(lease *subnet.Lease) (*netlink.Iptun,
 	// So we have two options of creating ipip device, either rename tunl0 to flannel.ipip or create an new ipip device
 	// and set local attribute of flannel.ipip to distinguish these two devices.
 	// Considering tunl0 might be used by users, so choose the later option.
-	link := &netlink.Iptun{LinkAttrs: netlink.LinkAttrs{Name: tunnelName}, Local: be.extIface.IfaceAddr}
+	link := &netlink.Iptun{LinkAttrs: netlink.LinkAttrs{Name: tunnelName}, Local: local}
 
 	if err := netlink.LinkAdd(link); err != nil {
 		if err != syscall.EEXIST {
@@ -159,35 +179,34 @@ func (be *IPIPBackend) configureIPIPDevice(lease *subnet.Lease) (*netlink.Iptun,
 
 		// local attribute may change if a user changes iface configuration, we need to recreate the device to ensure
 		// local and remote attribute is expected.
-		// local should be equal to the extIface.IfaceAddr and remote should be nil (or equal to 0.0.0.0)
-		if ipip.Local == nil || !ipip.Local.Equal(be.extIface.IfaceAddr) || (ipip.Remote != nil && ipip.Remote.String() != "0.0.0.0") {
+		// local should be equal to the address of the external interface and remote should be nil (or equal to 0.0.0.0)
+		if ipip.Local == nil || !ipip.Local.Equal(local) || (ipip.Remote != nil && ipip.Remote.String() != "0.0.0.0") {
 			log.Warningf("%q already exists with incompatable attributes: local=%v remote=%v; recreating device",
 				tunnelName, ipip.Local, ipip.Remote)
 
 			if err = netlink.LinkDel(existing); err != nil {
-				return nil, fmt.Errorf("failed to delete interface: %v", err)
+				return nil, fmt.Errorf("failed to delete interface: %w", err)
 			}
 
 			if err = netlink.LinkAdd(link); err != nil {
-				return nil, fmt.Errorf("failed to create ipip interface: %v", err)
+				return nil, fmt.Errorf("failed to create ipip interface: %w", err)
 			}
+		} else {
+			// Keep using the existing device, whose index the routes need
+			link = ipip
 		}
 	}
 
 	// Due to the extra 20 byte IP header that the tunnel will add to each packet,
-	// MTU size for both the workload and tunnel interfaces should be 20 bytes less than the selected iface (specified with the --iface option).
-	expectMTU := be.extIface.Iface.MTU - 20
-	if expectMTU <= 0 {
-		return nil, fmt.Errorf("MTU %d of iface %s is too small for ipip mode to work", be.extIface.Iface.MTU, be.extIface.Iface.Name)
-	}
-
+	// MTU size for both the workload and tunnel interfaces should be 20 bytes less than the selected iface (specified with the --iface option),
+	// unless it was configured explicitly.
 	oldMTU := link.Attrs().MTU
-	if oldMTU > expectMTU || oldMTU == 0 {
+	if oldMTU != expectMTU {
 		log.Infof("current MTU of %s is %d, setting it to %d", tunnelName, oldMTU, expectMTU)
 		err := netlink.LinkSetMTU(link, expectMTU)
 
 		if err != nil {
-			return nil, fmt.Errorf("failed to set %v MTU to %d: %v", tunnelName, expectMTU, err)
+			return nil, fmt.Errorf("failed to set %v MTU to %d: %w", tunnelName, expectMTU, err)
 		}
 		// change MTU as it will be written into /run/flannel/subnet.env
 		link.Attrs().MTU = expectMTU
@@ -197,11 +216,11 @@ func (be *IPIPBackend) configureIPIPDevice(lease *subnet.Lease) (*netlink.Iptun,
 	// This IP is just used as a source address for host to workload traffic (so
 	// the return path for the traffic has an address on the flannel network to use as the destination)
 	if err := ip.EnsureV4AddressOnLink(ip.IP4Net{IP: lease.Subnet.IP, PrefixLen: 32}, link); err != nil {
-		return nil, fmt.Errorf("failed to ensure address of interface %s: %s", link.Attrs().Name, err)
+		return nil, fmt.Errorf("failed to ensure address of interface %s: %w", link.Attrs().Name, err)
 	}
 
 	if err := netlink.LinkSetUp(link); err != nil {
-		return nil, fmt.Errorf("failed to set %v UP: %v", tunnelName, err)
+		return nil, fmt.Errorf("failed to set %v UP: %w", tunnelName, err)
 	}
 
 	return link, nil
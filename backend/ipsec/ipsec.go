@@ -50,8 +50,16 @@ const (
 	minPasswordLength  = 96
 )
 
+// backendConfig is the Backend section of the network config.
+type backendConfig struct {
+	UDPEncap    bool
+	ESPProposal string
+	PSK         string
+}
+
 func init() {
 	backend.Register("ipsec", New)
+	backend.RegisterConfig("ipsec", func() interface{} { return &backendConfig{} })
 }
 
 type IPSECBackend struct {
@@ -72,11 +80,7 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (
 func (be *IPSECBackend) RegisterNetwork(
 	ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
 
-	cfg := struct {
-		UDPEncap    bool
-		ESPProposal string
-		PSK         string
-	}{
+	cfg := backendConfig{
 		UDPEncap:    false,
 		ESPProposal: defaultESPProposal,
 	}
@@ -97,6 +101,7 @@ func (be *IPSECBackend) RegisterNetwork(
 
 	attrs := subnet.LeaseAttrs{
 		PublicIP:    ip.FromIP(be.extIface.ExtAddr),
+		PublicIPv6:  be.extIface.ExtV6Addr,
 		BackendType: "ipsec",
 	}
 
@@ -109,12 +114,12 @@ func (be *IPSECBackend) RegisterNetwork(
 		return nil, err
 
 	default:
-		return nil, fmt.Errorf("failed to acquire lease: %v", err)
+		return nil, fmt.Errorf("failed to acquire lease: %w", err)
 	}
 
 	ikeDaemon, err := NewCharonIKEDaemon(ctx, wg, cfg.ESPProposal)
 	if err != nil {
-		return nil, fmt.Errorf("error creating CharonIKEDaemon struct: %v", err)
+		return nil, fmt.Errorf("error creating CharonIKEDaemon struct: %w", err)
 	}
 
 	return newNetwork(be.sm, be.extIface, cfg.UDPEncap, cfg.PSK, ikeDaemon, l)
@@ -111,7 +111,7 @@ func (n *network) handleSubnetEvents(batch []subnet.Event) {
 		case subnet.EventAdded:
 			log.Info("Subnet added: ", evt.Lease.Subnet)
 
-			if evt.Lease.Attrs.BackendType != "ipsec" {
+			if _, ok := evt.Lease.Attrs.BackendDataFor("ipsec"); !ok {
 				log.Warningf("Ignoring non-ipsec event: type: %v", evt.Lease.Attrs.BackendType)
 				continue
 			}
@@ -136,7 +136,7 @@ func (n *network) handleSubnetEvents(batch []subnet.Event) {
 
 		case subnet.EventRemoved:
 			log.Info("Subnet removed: ", evt.Lease.Subnet)
-			if evt.Lease.Attrs.BackendType != "ipsec" {
+			if _, ok := evt.Lease.Attrs.BackendDataFor("ipsec"); !ok {
 				log.Warningf("Ignoring non-ipsec event: type: %v", evt.Lease.Attrs.BackendType)
 				continue
 			}
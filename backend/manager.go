@@ -39,10 +39,12 @@ type manager struct {
 	wg       sync.WaitGroup
 }
 
+// NewManager returns a Manager creating the backends with sm, whose lease watches skip the
+// leases with invalid backend data.
 func NewManager(ctx context.Context, sm subnet.Manager, extIface *ExternalInterface) Manager {
 	return &manager{
 		ctx:      ctx,
-		sm:       sm,
+		sm:       validatingManager{sm},
 		extIface: extIface,
 		active:   make(map[string]Backend),
 	}
@@ -92,3 +94,9 @@ func (bm *manager) GetBackend(backendType string) (Backend, error) {
 func Register(name string, ctor BackendCtor) {
 	constructors[name] = ctor
 }
+
+// Registered tells whether a backend of the given type is compiled in.
+func Registered(backendType string) bool {
+	_, ok := constructors[strings.ToLower(backendType)]
+	return ok
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+
+	log "github.com/golang/glog"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+// Encapsulation overhead of the backends, in bytes.
+const (
+	VXLANOverhead = 50 // 20 bytes IP hdr + 8 bytes UDP hdr + 8 bytes VXLAN hdr + 14 bytes inner Ethernet hdr
+	UDPOverhead   = 28 // 20 bytes IP hdr + 8 bytes UDP hdr
+	IPIPOverhead  = 20 // 20 bytes IP hdr
+	GREOverhead   = 24 // 20 bytes IP hdr + 4 bytes GRE hdr
+	// 20 bytes IP hdr + 32 bytes TCP hdr with timestamps + 29 bytes TLS record + 2 bytes frame length
+	TCPTLSOverhead = 83
+
+	// minMTU is the smallest MTU an IPv4 link must support (RFC 791).
+	minMTU = 68
+)
+
+// ExtMTU returns the MTU of the external interface.
+func (ei *ExternalInterface) ExtMTU() int {
+	if ei.MTU > 0 {
+		return ei.MTU
+	}
+	return ei.Iface.MTU
+}
+
+// MTUConfig is the setting of the Backend section read by OverlayMTU, embedded in the
+// config types of the backends calling it.
+type MTUConfig struct {
+	MTU int
+}
+
+// OverlayMTU returns the MTU to use for the flannel network: the MTU of the
+// external interface minus the given encapsulation overhead, unless the
+// Backend section of config sets an explicit "MTU".
+func OverlayMTU(ei *ExternalInterface, overhead int, config *subnet.Config) (int, error) {
+	var cfg MTUConfig
+
+	if config != nil && len(config.Backend) > 0 {
+		if err := json.Unmarshal(config.Backend, &cfg); err != nil {
+			return 0, fmt.Errorf("error decoding backend MTU: %v", err)
+		}
+	}
+
+	mtu := ei.ExtMTU() - overhead
+	if cfg.MTU != 0 {
+		if cfg.MTU < minMTU {
+			return 0, fmt.Errorf("configured MTU %d is smaller than the minimum of %d", cfg.MTU, minMTU)
+		}
+		if cfg.MTU > mtu {
+			log.Warningf("Configured MTU %d is larger than the %d bytes that fit in the MTU of %s (%d); packets may be fragmented or dropped", cfg.MTU, mtu, ei.Iface.Name, ei.ExtMTU())
+		}
+		log.Infof("Using configured MTU %d", cfg.MTU)
+		return cfg.MTU, nil
+	}
+
+	if mtu < minMTU {
+		return 0, fmt.Errorf("MTU %d of iface %s is too small to carry %d bytes of encapsulation overhead", ei.ExtMTU(), ei.Iface.Name, overhead)
+	}
+	return mtu, nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+func TestOverlayMTU(t *testing.T) {
+	ei := &ExternalInterface{Iface: &net.Interface{Name: "eth0", MTU: 1500}}
+
+	for _, tc := range []struct {
+		backend  string
+		overhead int
+		mtu      int
+		fail     bool
+	}{
+		{backend: ``, overhead: VXLANOverhead, mtu: 1450},
+		{backend: `{"Type": "udp"}`, overhead: UDPOverhead, mtu: 1472},
+		{backend: `{"Type": "vxlan", "MTU": 1400}`, overhead: VXLANOverhead, mtu: 1400},
+		{backend: `{"Type": "ipip", "MTU": 9000}`, overhead: IPIPOverhead, mtu: 9000},
+		{backend: `{"Type": "ipip", "MTU": 60}`, overhead: IPIPOverhead, fail: true},
+		{backend: `{"Type": "ipip", "MTU": "1400"}`, overhead: IPIPOverhead, fail: true},
+		{backend: ``, overhead: 1450, fail: true},
+	} {
+		config := &subnet.Config{Backend: []byte(tc.backend)}
+		mtu, err := OverlayMTU(ei, tc.overhead, config)
+		switch {
+		case tc.fail && err == nil:
+			t.Errorf("%q: expected an error, got MTU %d", tc.backend, mtu)
+		case !tc.fail && err != nil:
+			t.Errorf("%q: unexpected error: %v", tc.backend, err)
+		case !tc.fail && mtu != tc.mtu:
+			t.Errorf("%q: expected MTU %d, got %d", tc.backend, tc.mtu, mtu)
+		}
+	}
+
+	// The detected MTU takes precedence over the one of the interface
+	ei.MTU = 1400
+	if mtu, err := OverlayMTU(ei, VXLANOverhead, &subnet.Config{}); err != nil || mtu != 1350 {
+		t.Errorf("expected MTU 1350, got %d (%v)", mtu, err)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"sync"
+)
+
+const (
+	// ParallelBatchSize is the number of items from which ParallelApply spreads the work
+	// over several goroutines. Smaller batches, like the events of a running cluster, are
+	// not worth the overhead.
+	ParallelBatchSize = 64
+
+	parallelWorkers = 8
+)
+
+// ParallelApply calls fn for every index in [0, n) and returns once all calls are done.
+// Backends use it to program the dataplane state of many peers at once, e.g. when
+// applying the initial snapshot of a large cluster, so the calls for different indexes
+// must not depend on each other.
+func ParallelApply(n int, fn func(i int)) {
+	if n < ParallelBatchSize {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+
+	idx := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < parallelWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range idx {
+				fn(i)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		idx <- i
+	}
+	close(idx)
+	wg.Wait()
+}
@@ -0,0 +1,46 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestParallelApply(t *testing.T) {
+	for _, n := range []int{0, 1, ParallelBatchSize - 1, ParallelBatchSize, 5000} {
+		calls := make([]int32, n)
+		ParallelApply(n, func(i int) {
+			atomic.AddInt32(&calls[i], 1)
+		})
+		for i, c := range calls {
+			if c != 1 {
+				t.Fatalf("n=%d: index %d was applied %d times", n, i, c)
+			}
+		}
+	}
+}
+
+func TestParallelApplySmallBatchInOrder(t *testing.T) {
+	var order []int
+	ParallelApply(ParallelBatchSize-1, func(i int) {
+		order = append(order, i)
+	})
+	for i, v := range order {
+		if v != i {
+			t.Fatalf("expected index %d at position %d, got %d", i, i, v)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/negcache"
+	"github.com/coreos/flannel/subnet"
+)
+
+const (
+	// PeerRetryInterval is how often backends should check for failed peers that are due for a retry.
+	PeerRetryInterval = time.Second
+
+	peerRetryBase       = 5 * time.Second
+	peerRetryMax        = 5 * time.Minute
+	peerQuarantineAfter = 3
+)
+
+// PeerStatus describes a peer whose dataplane state could not be programmed.
+type PeerStatus struct {
+	Subnet      ip.IP4Net
+	PublicIP    ip.IP4
+	Failures    int
+	Quarantined bool
+	LastError   string
+	NextRetry   time.Time
+}
+
+type failedPeer struct {
+	lease    subnet.Lease
+	failures int
+	lastErr  error
+	next     time.Time
+}
+
+// PeerQuarantine keeps track of peers for which programming the dataplane
+// (routes, ARP and FDB entries) keeps failing. Instead of retrying such a peer
+// in a tight loop, each failure pushes its next retry further out using
+// exponential backoff, and after a few consecutive failures the peer is
+// reported as quarantined.
+type PeerQuarantine struct {
+	mux   sync.Mutex
+	peers map[ip.IP4Net]*failedPeer
+	now   func() time.Time
+}
+
+func NewPeerQuarantine() *PeerQuarantine {
+	return &PeerQuarantine{
+		peers: make(map[ip.IP4Net]*failedPeer),
+		now:   time.Now,
+	}
+}
+
+func retryDelay(failures int) time.Duration {
+	return negcache.Backoff(peerRetryBase, peerRetryMax, failures)
+}
+
+// Failed records a failure to program the dataplane for lease and schedules the next retry.
+func (q *PeerQuarantine) Failed(lease *subnet.Lease, err error) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	p, ok := q.peers[lease.Subnet]
+	if !ok {
+		p = &failedPeer{}
+		q.peers[lease.Subnet] = p
+	}
+	p.lease = *lease
+	p.failures++
+	p.lastErr = err
+
+	delay := retryDelay(p.failures)
+	p.next = q.now().Add(delay)
+
+	switch {
+	case p.failures == peerQuarantineAfter:
+		log.Warningf("Quarantining peer %v (%v) after %d failures, retrying in %v: %v", lease.Subnet, lease.Attrs.PublicIP, p.failures, delay, err)
+	case p.failures > peerQuarantineAfter:
+		log.V(2).Infof("Peer %v (%v) still failing (%d failures), retrying in %v: %v", lease.Subnet, lease.Attrs.PublicIP, p.failures, delay, err)
+	default:
+		log.Errorf("Failed to program peer %v (%v), retrying in %v: %v", lease.Subnet, lease.Attrs.PublicIP, delay, err)
+	}
+}
+
+// Succeeded clears the failure state of the peer owning sn, if any.
+func (q *PeerQuarantine) Succeeded(sn ip.IP4Net) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if p, ok := q.peers[sn]; ok {
+		if p.failures >= peerQuarantineAfter {
+			log.Infof("Peer %v (%v) recovered after %d failures", sn, p.lease.Attrs.PublicIP, p.failures)
+		}
+		delete(q.peers, sn)
+	}
+}
+
+// Remove stops tracking the peer owning sn, e.g. because its lease was removed.
+func (q *PeerQuarantine) Remove(sn ip.IP4Net) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	delete(q.peers, sn)
+}
+
+// Due returns the leases of failed peers whose retry time has been reached.
+// The caller is expected to report the outcome of the retry through Failed or Succeeded.
+func (q *PeerQuarantine) Due() []subnet.Lease {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	now := q.now()
+	var due []subnet.Lease
+	for _, p := range q.peers {
+		if !now.Before(p.next) {
+			due = append(due, p.lease)
+		}
+	}
+	return due
+}
+
+// Status returns the state of all peers that are currently failing, ordered by subnet.
+func (q *PeerQuarantine) Status() []PeerStatus {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	status := make([]PeerStatus, 0, len(q.peers))
+	for sn, p := range q.peers {
+		ps := PeerStatus{
+			Subnet:      sn,
+			PublicIP:    p.lease.Attrs.PublicIP,
+			Failures:    p.failures,
+			Quarantined: p.failures >= peerQuarantineAfter,
+			NextRetry:   p.next,
+		}
+		if p.lastErr != nil {
+			ps.LastError = p.lastErr.Error()
+		}
+		status = append(status, ps)
+	}
+
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Subnet.IP < status[j].Subnet.IP
+	})
+	return status
+}
@@ -0,0 +1,79 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+func TestRetryDelay(t *testing.T) {
+	expected := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 40 * time.Second}
+	for i, d := range expected {
+		if got := retryDelay(i + 1); got != d {
+			t.Errorf("retryDelay(%d): expected %v, got %v", i+1, d, got)
+		}
+	}
+
+	if got := retryDelay(100); got != peerRetryMax {
+		t.Errorf("retryDelay should be capped at %v, got %v", peerRetryMax, got)
+	}
+}
+
+func TestPeerQuarantine(t *testing.T) {
+	now := time.Unix(1000, 0)
+	q := NewPeerQuarantine()
+	q.now = func() time.Time { return now }
+
+	lease := &subnet.Lease{
+		Subnet: ip.IP4Net{IP: ip.MustParseIP4("10.1.2.0"), PrefixLen: 24},
+		Attrs:  subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.2")},
+	}
+
+	for i := 0; i < peerQuarantineAfter; i++ {
+		q.Failed(lease, errors.New("boom"))
+		if due := q.Due(); len(due) != 0 {
+			t.Fatalf("peer should not be due right after a failure: %v", due)
+		}
+		now = now.Add(retryDelay(i + 1))
+		if due := q.Due(); len(due) != 1 || !due[0].Subnet.Equal(lease.Subnet) {
+			t.Fatalf("peer should be due after its backoff expired: %v", due)
+		}
+	}
+
+	status := q.Status()
+	if len(status) != 1 {
+		t.Fatalf("expected one failing peer, got %v", status)
+	}
+	if !status[0].Quarantined || status[0].Failures != peerQuarantineAfter || status[0].LastError != "boom" {
+		t.Errorf("unexpected peer status: %+v", status[0])
+	}
+
+	q.Succeeded(lease.Subnet)
+	if status := q.Status(); len(status) != 0 {
+		t.Errorf("expected no failing peers after success, got %v", status)
+	}
+
+	q.Failed(lease, errors.New("boom"))
+	q.Remove(lease.Subnet)
+	now = now.Add(peerRetryMax)
+	if due := q.Due(); len(due) != 0 {
+		t.Errorf("removed peer should not be retried: %v", due)
+	}
+}
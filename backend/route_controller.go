@@ -0,0 +1,195 @@
+// +build !windows
+
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/dataplane"
+)
+
+// RouteResyncInterval is how often the RouteController compares its routes with the
+// routing table, in case it missed a route deletion.
+const RouteResyncInterval = routeCheckRetries * time.Second
+
+// RouteController owns the routes a backend intends to exist and re-installs the ones
+// that get deleted behind its back, e.g. by NetworkManager or dhclient. Backends tell
+// it about the routes they installed or removed; there is at most one route per
+// destination.
+type RouteController struct {
+	nl     dataplane.Netlink
+	mux    sync.Mutex
+	routes map[string]netlink.Route
+}
+
+func NewRouteController(nl dataplane.Netlink) *RouteController {
+	return &RouteController{
+		nl:     nl,
+		routes: make(map[string]netlink.Route),
+	}
+}
+
+// Add records route as intended, replacing any previous route to the same destination.
+func (c *RouteController) Add(route netlink.Route) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.routes[route.Dst.String()] = route
+}
+
+// Remove forgets route, unless the destination has been taken over by another route since.
+func (c *RouteController) Remove(route netlink.Route) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	key := route.Dst.String()
+	if r, ok := c.routes[key]; ok && routeEqual(r, route) {
+		delete(c.routes, key)
+	}
+}
+
+// Routes returns the intended routes, ordered by destination.
+func (c *RouteController) Routes() []netlink.Route {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	routes := make([]netlink.Route, 0, len(c.routes))
+	for _, r := range c.routes {
+		routes = append(routes, r)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].Dst.String() < routes[j].Dst.String()
+	})
+	return routes
+}
+
+func (c *RouteController) intended(route *netlink.Route) (netlink.Route, bool) {
+	if route.Dst == nil {
+		return netlink.Route{}, false
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	r, ok := c.routes[route.Dst.String()]
+	return r, ok && routeMatches(r, *route)
+}
+
+// Run re-installs deleted routes until ctx is done. Deletions are picked up from
+// netlink notifications right away, and by comparing with the routing table every
+// RouteResyncInterval.
+func (c *RouteController) Run(ctx context.Context) {
+	updates := make(chan netlink.RouteUpdate)
+	if err := c.nl.RouteSubscribe(updates, ctx.Done()); err != nil {
+		log.Errorf("Failed to subscribe to route updates, only checking routes every %v: %v", RouteResyncInterval, err)
+		updates = nil
+	}
+
+	resync := time.NewTicker(RouteResyncInterval)
+	defer resync.Stop()
+
+	for {
+		select {
+		case u, ok := <-updates:
+			if !ok {
+				log.Errorf("Route update subscription closed, only checking routes every %v", RouteResyncInterval)
+				updates = nil
+				continue
+			}
+			if u.Type != syscall.RTM_DELROUTE {
+				continue
+			}
+			if r, ok := c.intended(&u.Route); ok {
+				c.restore(r)
+			}
+
+		case <-resync.C:
+			c.Resync()
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Resync re-installs the intended routes missing from the routing table.
+func (c *RouteController) Resync() {
+	routeList, err := c.nl.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		log.Errorf("Error fetching route list. Will automatically retry: %v", err)
+		return
+	}
+
+	for _, route := range c.Routes() {
+		exist := false
+		for _, r := range routeList {
+			if r.Dst == nil {
+				continue
+			}
+			if routeMatches(route, r) {
+				exist = true
+				break
+			}
+		}
+
+		if !exist {
+			c.restore(route)
+		}
+	}
+}
+
+func (c *RouteController) restore(route netlink.Route) {
+	if err := addRoute(c.nl, &route); err != nil {
+		if err != syscall.EEXIST {
+			log.Errorf("Error recovering route to %v: %v, %v", route.Dst, route.Gw, err)
+		}
+		return
+	}
+	log.Infof("Route recovered %v : %v", route.Dst, route.Gw)
+}
+
+// routeMatches tells whether the kernel route actual is the intended route. An intended route
+// without link index, like a direct route of vxlan, matches on any link.
+func routeMatches(intended, actual netlink.Route) bool {
+	if intended.LinkIndex == 0 {
+		intended.LinkIndex = actual.LinkIndex
+	}
+	return actual.Dst != nil && routeEqual(intended, actual)
+}
+
+// DumpRoutes converts routes for a DataplaneDump.
+func DumpRoutes(routes []netlink.Route) []RouteEntry {
+	entries := make([]RouteEntry, 0, len(routes))
+	for _, r := range routes {
+		e := RouteEntry{LinkIndex: r.LinkIndex, Onlink: r.Flags&int(netlink.FLAG_ONLINK) != 0}
+		if r.Dst != nil {
+			e.Dst = r.Dst.String()
+		}
+		if r.Gw != nil {
+			e.Gw = r.Gw.String()
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package backend
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coreos/flannel/pkg/dataplane"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/context"
+)
+
+func testRoute(dst, gw string, linkIndex int) netlink.Route {
+	_, n, _ := net.ParseCIDR(dst)
+	return netlink.Route{Dst: n, Gw: net.ParseIP(gw), LinkIndex: linkIndex}
+}
+
+func TestRouteControllerAddRemove(t *testing.T) {
+	c := NewRouteController(dataplane.NewFakeNetlink())
+	r1 := testRoute("10.1.1.0/24", "192.168.0.1", 2)
+	r2 := testRoute("10.1.1.0/24", "192.168.0.2", 2)
+
+	c.Add(r1)
+	c.Add(r2)
+	routes := c.Routes()
+	if len(routes) != 1 || !routeEqual(routes[0], r2) {
+		t.Fatalf("expected the latest route to the destination, got %v", routes)
+	}
+
+	// The replaced route doesn't remove its successor
+	c.Remove(r1)
+	if len(c.Routes()) != 1 {
+		t.Fatal("expected the route to remain after removing a replaced route")
+	}
+	c.Remove(r2)
+	if len(c.Routes()) != 0 {
+		t.Fatalf("expected no routes, got %v", c.Routes())
+	}
+}
+
+func TestRouteControllerIntended(t *testing.T) {
+	c := NewRouteController(dataplane.NewFakeNetlink())
+	direct := testRoute("10.1.1.0/24", "192.168.0.1", 0)
+	c.Add(direct)
+
+	// Direct routes match on any link
+	deleted := testRoute("10.1.1.0/24", "192.168.0.1", 3)
+	if _, ok := c.intended(&deleted); !ok {
+		t.Fatal("expected the deleted route to be intended")
+	}
+
+	other := testRoute("10.1.1.0/24", "192.168.0.9", 3)
+	if _, ok := c.intended(&other); ok {
+		t.Fatal("expected a route via another gateway not to be intended")
+	}
+	if _, ok := c.intended(&netlink.Route{LinkIndex: 3}); ok {
+		t.Fatal("expected a default route not to be intended")
+	}
+}
+
+func TestRouteControllerResync(t *testing.T) {
+	nl := dataplane.NewFakeNetlink()
+	c := NewRouteController(nl)
+	r1 := testRoute("10.1.1.0/24", "192.168.0.1", 2)
+	r2 := testRoute("10.1.2.0/24", "192.168.0.2", 2)
+	nl.AddRoutes(r1)
+	c.Add(r1)
+	c.Add(r2)
+
+	c.Resync()
+	nl.Expect(t, "RouteAdd 10.1.2.0/24 via 192.168.0.2 dev 2")
+	c.Resync()
+	nl.Expect(t)
+}
+
+func TestRouteControllerRun(t *testing.T) {
+	nl := dataplane.NewFakeNetlink()
+	c := NewRouteController(nl)
+	r1 := testRoute("10.1.1.0/24", "192.168.0.1", 2)
+	nl.AddRoutes(r1)
+	c.Add(r1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// The route is restored as soon as the deletion is notified, without a resync.
+	// Deletions before Run subscribed go unnoticed, so they're repeated until then.
+	restored := false
+	for i := 0; i < 100 && !restored; i++ {
+		nl.DeleteRoutes(r1)
+		time.Sleep(10 * time.Millisecond)
+		restored = len(nl.Routes()) == 1
+	}
+	if !restored {
+		t.Fatal("expected the deleted route to be restored")
+	}
+	nl.Expect(t, "RouteAdd 10.1.1.0/24 via 192.168.0.1 dev 2")
+}
+
+func TestDumpRoutes(t *testing.T) {
+	onlink := testRoute("10.1.2.0/24", "10.1.2.0", 3)
+	onlink.Flags = int(netlink.FLAG_ONLINK)
+	entries := DumpRoutes([]netlink.Route{testRoute("10.1.1.0/24", "192.168.0.1", 2), onlink})
+
+	expected := []RouteEntry{
+		{Dst: "10.1.1.0/24", Gw: "192.168.0.1", LinkIndex: 2},
+		{Dst: "10.1.2.0/24", Gw: "10.1.2.0", LinkIndex: 3, Onlink: true},
+	}
+	if len(entries) != len(expected) || entries[0] != expected[0] || entries[1] != expected[1] {
+		t.Errorf("expected %+v, got %+v", expected, entries)
+	}
+}
@@ -18,13 +18,17 @@ package backend
 
 import (
 	"bytes"
-	"net"
+	"fmt"
 	"sync"
+	"syscall"
 	"time"
 
 	log "github.com/golang/glog"
 	"golang.org/x/net/context"
 
+	"github.com/coreos/flannel/pkg/audit"
+	"github.com/coreos/flannel/pkg/dataplane"
+	"github.com/coreos/flannel/pkg/ip"
 	"github.com/coreos/flannel/subnet"
 	"github.com/vishvananda/netlink"
 )
@@ -36,11 +40,28 @@ const (
 type RouteNetwork struct {
 	SimpleNetwork
 	BackendType string
-	routes      []netlink.Route
+	routes      *RouteController
 	SM          subnet.Manager
 	GetRoute    func(lease *subnet.Lease) *netlink.Route
+	Netlink     dataplane.Netlink
 	Mtu         int
 	LinkIndex   int
+	// MoveTunnel moves the tunnel device of the backend over to the new address of the
+	// external interface, and returns the index of the device. Networks without it only
+	// follow address changes with routes out of the external interface (host-gw).
+	MoveTunnel func(ei *ExternalInterface) (int, error)
+	peers      *PeerQuarantine
+	// extIfaceUpdates hands the changes of the external interface to Run, which owns the lease
+	extIfaceUpdates chan extIfaceUpdate
+
+	// initOnce creates the state the backends don't set, as the admin server dumps the
+	// dataplane while Run programs it
+	initOnce sync.Once
+}
+
+type extIfaceUpdate struct {
+	ei     *ExternalInterface
+	result chan error
 }
 
 func (n *RouteNetwork) MTU() int {
@@ -48,6 +69,7 @@ func (n *RouteNetwork) MTU() int {
 }
 
 func (n *RouteNetwork) Run(ctx context.Context) {
+	n.init()
 	wg := sync.WaitGroup{}
 
 	log.Info("Watching for new subnet leases")
@@ -58,76 +80,171 @@ func (n *RouteNetwork) Run(ctx context.Context) {
 		wg.Done()
 	}()
 
-	n.routes = make([]netlink.Route, 0, 10)
 	wg.Add(1)
 	go func() {
-		n.routeCheck(ctx)
+		n.Routes().Run(ctx)
 		wg.Done()
 	}()
 
 	defer wg.Wait()
 
+	retry := time.NewTicker(PeerRetryInterval)
+	defer retry.Stop()
+
 	for {
 		select {
 		case evtBatch := <-evts:
 			n.handleSubnetEvents(evtBatch)
 
+		case <-retry.C:
+			n.retryFailedPeers()
+
+		case u := <-n.extIfaceUpdates:
+			u.result <- n.updateExternalInterface(ctx, u.ei)
+
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (n *RouteNetwork) handleSubnetEvents(batch []subnet.Event) {
-	for _, evt := range batch {
-		switch evt.Type {
-		case subnet.EventAdded:
-			log.Infof("Subnet added: %v via %v", evt.Lease.Subnet, evt.Lease.Attrs.PublicIP)
+// init creates the route controller and the peer quarantine, and defaults Netlink to the
+// current network namespace.
+func (n *RouteNetwork) init() {
+	n.initOnce.Do(func() {
+		if n.Netlink == nil {
+			n.Netlink = dataplane.NewNetlink()
+		}
+		n.peers = NewPeerQuarantine()
+		n.routes = NewRouteController(n.Netlink)
+		n.extIfaceUpdates = make(chan extIfaceUpdate)
+	})
+}
 
-			if evt.Lease.Attrs.BackendType != n.BackendType {
-				log.Warningf("Ignoring non-%v subnet: type=%v", n.BackendType, evt.Lease.Attrs.BackendType)
-				continue
-			}
-			route := n.GetRoute(&evt.Lease)
+// Peers returns the failure state of peers whose routes could not be programmed.
+func (n *RouteNetwork) Peers() *PeerQuarantine {
+	n.init()
+	return n.peers
+}
 
-			n.addToRouteList(*route)
-			// Check if route exists before attempting to add it
-			routeList, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: route.Dst}, netlink.RT_FILTER_DST)
-			if err != nil {
-				log.Warningf("Unable to list routes: %v", err)
-			}
+// Routes returns the controller keeping the routes to the peers installed.
+func (n *RouteNetwork) Routes() *RouteController {
+	n.init()
+	return n.routes
+}
 
-			if len(routeList) > 0 && !routeEqual(routeList[0], *route) {
-				// Same Dst different Gw or different link index. Remove it, correct route will be added below.
-				log.Warningf("Replacing existing route to %v via %v dev index %d with %v via %v dev index %d.", evt.Lease.Subnet, routeList[0].Gw, routeList[0].LinkIndex, evt.Lease.Subnet, evt.Lease.Attrs.PublicIP, route.LinkIndex)
-				if err := netlink.RouteDel(&routeList[0]); err != nil {
-					log.Errorf("Error deleting route to %v: %v", evt.Lease.Subnet, err)
-					continue
-				}
-				n.removeFromRouteList(routeList[0])
-			}
+// DumpDataplane reports the routes and the failing peers.
+func (n *RouteNetwork) DumpDataplane() (*DataplaneDump, error) {
+	return &DataplaneDump{
+		Routes:      DumpRoutes(n.Routes().Routes()),
+		FailedPeers: n.Peers().Status(),
+	}, nil
+}
 
-			if len(routeList) > 0 && routeEqual(routeList[0], *route) {
-				// Same Dst and same Gw, keep it and do not attempt to add it.
-				log.Infof("Route to %v via %v dev index %d already exists, skipping.", evt.Lease.Subnet, evt.Lease.Attrs.PublicIP, routeList[0].LinkIndex)
-			} else if err := netlink.RouteAdd(route); err != nil {
-				log.Errorf("Error adding route to %v via %v dev index %d: %v", evt.Lease.Subnet, evt.Lease.Attrs.PublicIP, route.LinkIndex, err)
-				continue
-			}
+// netlink returns the Netlink to program routes with, which defaults to the current network namespace.
+func (n *RouteNetwork) netlink() dataplane.Netlink {
+	n.init()
+	return n.Netlink
+}
+
+// UpdateExternalInterface moves the tunnel device over to the new address of the external
+// interface, if the routes go through one, and publishes the new public IP of the node.
+func (n *RouteNetwork) UpdateExternalInterface(ctx context.Context, ei *ExternalInterface) error {
+	n.init()
+	u := extIfaceUpdate{ei: ei, result: make(chan error, 1)}
+	select {
+	case n.extIfaceUpdates <- u:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-u.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (n *RouteNetwork) updateExternalInterface(ctx context.Context, ei *ExternalInterface) error {
+	if n.LinkIndex != ei.Iface.Index {
+		if n.MoveTunnel == nil {
+			return fmt.Errorf("%v tunnel device is bound to the previous address", n.BackendType)
+		}
+		index, err := n.MoveTunnel(ei)
+		if err != nil {
+			return fmt.Errorf("failed to move the %v tunnel device over to %v: %w", n.BackendType, ei.IfaceAddr, err)
+		}
+		n.moveRoutes(n.LinkIndex, index)
+		n.LinkIndex = index
+	}
+
+	lease := *n.SubnetLease
+	lease.Attrs.PublicIP = ip.FromIP(ei.ExtAddr)
+	lease.Attrs.PublicIPv6 = ei.ExtV6Addr
+	if err := n.SM.RenewLease(ctx, &lease); err != nil {
+		return fmt.Errorf("failed to publish public IP %v: %w", ei.ExtAddr, err)
+	}
+	*n.SubnetLease = lease
+	n.ExtIface = ei
+
+	// Routes that were dropped along with the old address are restored by the route controller.
+	log.Infof("Public IP changed to %v", ei.ExtAddr)
+	return nil
+}
+
+// moveRoutes points the routes through the device from over to the device to, which
+// replaced it. The routes of a deleted device are gone, so they are installed again.
+func (n *RouteNetwork) moveRoutes(from, to int) {
+	if from == to {
+		return
+	}
+	for _, route := range n.Routes().Routes() {
+		if route.LinkIndex == from {
+			route.LinkIndex = to
+			n.Routes().Add(route)
+		}
+	}
+	n.Routes().Resync()
+}
+
+func (n *RouteNetwork) retryFailedPeers() {
+	var batch []subnet.Event
+	for _, l := range n.Peers().Due() {
+		batch = append(batch, subnet.Event{Type: subnet.EventAdded, Lease: l})
+	}
+	if len(batch) > 0 {
+		n.handleSubnetEvents(batch)
+	}
+}
+
+func (n *RouteNetwork) handleSubnetEvents(batch []subnet.Event) {
+	// Consecutive added leases don't depend on each other, so they are programmed together.
+	var added []subnet.Lease
+	for _, evt := range batch {
+		switch evt.Type {
+		case subnet.EventAdded:
+			added = append(added, evt.Lease)
 
 		case subnet.EventRemoved:
+			n.addSubnets(added)
+			added = nil
+
 			log.Info("Subnet removed: ", evt.Lease.Subnet)
 
-			if evt.Lease.Attrs.BackendType != n.BackendType {
+			if _, ok := evt.Lease.Attrs.BackendDataFor(n.BackendType); !ok {
 				log.Warningf("Ignoring non-%v subnet: type=%v", n.BackendType, evt.Lease.Attrs.BackendType)
 				continue
 			}
 
 			route := n.GetRoute(&evt.Lease)
 			// Always remove the route from the route list.
-			n.removeFromRouteList(*route)
+			n.Routes().Remove(*route)
+			n.Peers().Remove(evt.Lease.Subnet)
 
-			if err := netlink.RouteDel(route); err != nil {
+			err := n.netlink().RouteDel(route)
+			audit.Log(audit.KindRoute, audit.ActionDelete, route.String(), "", err)
+			if err != nil {
 				log.Errorf("Error deleting route to %v: %v", evt.Lease.Subnet, err)
 				continue
 			}
@@ -136,66 +253,102 @@ func (n *RouteNetwork) handleSubnetEvents(batch []subnet.Event) {
 			log.Error("Internal error: unknown event type: ", int(evt.Type))
 		}
 	}
+	n.addSubnets(added)
 }
 
-func (n *RouteNetwork) addToRouteList(route netlink.Route) {
-	for _, r := range n.routes {
-		if routeEqual(r, route) {
-			return
+// addSubnets adds the routes to the subnets of leases. Large batches like the initial
+// snapshot are applied in parallel.
+func (n *RouteNetwork) addSubnets(leases []subnet.Lease) {
+	var peers []subnet.Lease
+	index := make(map[ip.IP4Net]int)
+	for _, lease := range leases {
+		log.Infof("Subnet added: %v via %v", lease.Subnet, lease.Attrs.PublicIP)
+
+		if _, ok := lease.Attrs.BackendDataFor(n.BackendType); !ok {
+			log.Warningf("Ignoring non-%v subnet: type=%v", n.BackendType, lease.Attrs.BackendType)
+			continue
+		}
+		// Only the latest lease of a subnet is programmed
+		if i, ok := index[lease.Subnet]; ok {
+			peers[i] = lease
+		} else {
+			index[lease.Subnet] = len(peers)
+			peers = append(peers, lease)
 		}
 	}
-	n.routes = append(n.routes, route)
-}
 
-func (n *RouteNetwork) removeFromRouteList(route netlink.Route) {
-	for index, r := range n.routes {
-		if routeEqual(r, route) {
-			n.routes = append(n.routes[:index], n.routes[index+1:]...)
-			return
+	if len(peers) >= ParallelBatchSize {
+		log.V(1).Infof("Adding %d routes in parallel", len(peers))
+	}
+	errs := make([]error, len(peers))
+	ParallelApply(len(peers), func(i int) {
+		errs[i] = n.addSubnet(&peers[i])
+	})
+
+	for i := range peers {
+		if errs[i] != nil {
+			n.Peers().Failed(&peers[i], errs[i])
+		} else {
+			n.Peers().Succeeded(peers[i].Subnet)
 		}
 	}
 }
 
-func (n *RouteNetwork) routeCheck(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-time.After(routeCheckRetries * time.Second):
-			n.checkSubnetExistInRoutes()
+func (n *RouteNetwork) addSubnet(lease *subnet.Lease) error {
+	route := n.GetRoute(lease)
+
+	n.Routes().Add(*route)
+	// Check if route exists before attempting to add it
+	routeList, err := n.netlink().RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: route.Dst}, netlink.RT_FILTER_DST)
+	if err != nil {
+		log.Warningf("Unable to list routes: %v", err)
+	}
+
+	if len(routeList) > 0 && !routeEqual(routeList[0], *route) {
+		// Same Dst different Gw or different link index. Remove it, correct route will be added below.
+		log.Warningf("Replacing existing route to %v via %v dev index %d with %v via %v dev index %d.", lease.Subnet, routeList[0].Gw, routeList[0].LinkIndex, lease.Subnet, lease.Attrs.PublicIP, route.LinkIndex)
+		err := n.netlink().RouteDel(&routeList[0])
+		audit.Log(audit.KindRoute, audit.ActionDelete, routeList[0].String(), "", err)
+		if err != nil {
+			n.Routes().Remove(*route)
+			return fmt.Errorf("error deleting route to %v: %v", lease.Subnet, err)
 		}
 	}
-}
 
-func (n *RouteNetwork) checkSubnetExistInRoutes() {
-	routeList, err := netlink.RouteList(nil, netlink.FAMILY_V4)
-	if err == nil {
-		for _, route := range n.routes {
-			exist := false
-			for _, r := range routeList {
-				if r.Dst == nil {
-					continue
-				}
-				if routeEqual(r, route) {
-					exist = true
-					break
-				}
-			}
+	if len(routeList) > 0 && routeEqual(routeList[0], *route) {
+		// Same Dst and same Gw, keep it and do not attempt to add it.
+		log.Infof("Route to %v via %v dev index %d already exists, skipping.", lease.Subnet, lease.Attrs.PublicIP, routeList[0].LinkIndex)
+	} else if err := addRoute(n.netlink(), route); err != nil {
+		// Leave retrying to the peer quarantine rather than the route controller.
+		n.Routes().Remove(*route)
+		return fmt.Errorf("error adding route to %v via %v dev index %d: %v", lease.Subnet, lease.Attrs.PublicIP, route.LinkIndex, err)
+	}
+	return nil
+}
 
-			if !exist {
-				if err := netlink.RouteAdd(&route); err != nil {
-					if nerr, ok := err.(net.Error); !ok {
-						log.Errorf("Error recovering route to %v: %v, %v", route.Dst, route.Gw, nerr)
-					}
-					continue
-				} else {
-					log.Infof("Route recovered %v : %v", route.Dst, route.Gw)
-				}
-			}
+// CleanUp deletes the routes to the peers.
+func (n *RouteNetwork) CleanUp() error {
+	var failed int
+	for _, route := range n.Routes().Routes() {
+		route := route
+		n.Routes().Remove(route)
+		err := n.netlink().RouteDel(&route)
+		audit.Log(audit.KindRoute, audit.ActionDelete, route.String(), "", err)
+		if err != nil && err != syscall.ESRCH {
+			log.Errorf("Error deleting route to %v: %v", route.Dst, err)
+			failed++
 		}
-	} else {
-		log.Errorf("Error fetching route list. Will automatically retry: %v", err)
 	}
+	if failed > 0 {
+		return fmt.Errorf("failed to delete %d routes", failed)
+	}
+	return nil
+}
+
+func addRoute(nl dataplane.Netlink, route *netlink.Route) error {
+	err := nl.RouteAdd(route)
+	audit.Log(audit.KindRoute, audit.ActionAdd, "", route.String(), err)
+	return err
 }
 
 func routeEqual(x, y netlink.Route) bool {
@@ -17,12 +17,15 @@ package backend
 
 import (
 	"net"
+	"syscall"
 	"testing"
 
+	"github.com/coreos/flannel/pkg/dataplane"
 	"github.com/coreos/flannel/pkg/ip"
 	"github.com/coreos/flannel/pkg/ns"
 	"github.com/coreos/flannel/subnet"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/net/context"
 )
 
 func TestRouteCache(t *testing.T) {
@@ -59,20 +62,138 @@ func TestRouteCache(t *testing.T) {
 		{Type: subnet.EventAdded, Lease: subnet.Lease{
 			Subnet: subnet1, Attrs: subnet.LeaseAttrs{PublicIP: gw1, BackendType: "host-gw"}}},
 	})
-	if len(nw.routes) != 1 {
-		t.Fatal(nw.routes)
+	routes := nw.Routes().Routes()
+	if len(routes) != 1 {
+		t.Fatal(routes)
 	}
-	if !routeEqual(nw.routes[0], netlink.Route{Dst: subnet1.ToIPNet(), Gw: gw1.ToIP(), LinkIndex: lo.Attrs().Index}) {
-		t.Fatal(nw.routes[0])
+	if !routeEqual(routes[0], netlink.Route{Dst: subnet1.ToIPNet(), Gw: gw1.ToIP(), LinkIndex: lo.Attrs().Index}) {
+		t.Fatal(routes[0])
 	}
 	// change gateway of previous route
 	nw.handleSubnetEvents([]subnet.Event{
 		{Type: subnet.EventAdded, Lease: subnet.Lease{
 			Subnet: subnet1, Attrs: subnet.LeaseAttrs{PublicIP: gw2, BackendType: "host-gw"}}}})
-	if len(nw.routes) != 1 {
-		t.Fatal(nw.routes)
+	routes = nw.Routes().Routes()
+	if len(routes) != 1 {
+		t.Fatal(routes)
 	}
-	if !routeEqual(nw.routes[0], netlink.Route{Dst: subnet1.ToIPNet(), Gw: gw2.ToIP(), LinkIndex: lo.Attrs().Index}) {
-		t.Fatal(nw.routes[0])
+	if !routeEqual(routes[0], netlink.Route{Dst: subnet1.ToIPNet(), Gw: gw2.ToIP(), LinkIndex: lo.Attrs().Index}) {
+		t.Fatal(routes[0])
+	}
+}
+
+func TestRouteNetworkOperations(t *testing.T) {
+	nl := dataplane.NewFakeNetlink()
+	nw := &RouteNetwork{
+		BackendType: "host-gw",
+		LinkIndex:   2,
+		Netlink:     nl,
+	}
+	nw.GetRoute = func(lease *subnet.Lease) *netlink.Route {
+		return &netlink.Route{
+			Dst:       lease.Subnet.ToIPNet(),
+			Gw:        lease.Attrs.PublicIP.ToIP(),
+			LinkIndex: nw.LinkIndex,
+		}
+	}
+	lease := func(gw string) subnet.Lease {
+		_, sn, _ := net.ParseCIDR("10.1.1.0/24")
+		return subnet.Lease{
+			Subnet: ip.FromIPNet(sn),
+			Attrs:  subnet.LeaseAttrs{PublicIP: ip.FromIP(net.ParseIP(gw)), BackendType: "host-gw"},
+		}
+	}
+
+	nw.handleSubnetEvents([]subnet.Event{{Type: subnet.EventAdded, Lease: lease("192.168.0.1")}})
+	nl.Expect(t, "RouteAdd 10.1.1.0/24 via 192.168.0.1 dev 2")
+
+	// A moved peer replaces its route
+	nw.handleSubnetEvents([]subnet.Event{{Type: subnet.EventAdded, Lease: lease("192.168.0.2")}})
+	nl.Expect(t,
+		"RouteDel 10.1.1.0/24 via 192.168.0.1 dev 2",
+		"RouteAdd 10.1.1.0/24 via 192.168.0.2 dev 2")
+
+	// A failed route is retried through the peer quarantine
+	nl.Errors = map[string]error{"RouteDel": syscall.EPERM}
+	nw.handleSubnetEvents([]subnet.Event{{Type: subnet.EventAdded, Lease: lease("192.168.0.3")}})
+	nl.Expect(t, "RouteDel 10.1.1.0/24 via 192.168.0.2 dev 2")
+	if len(nw.Routes().Routes()) != 0 {
+		t.Fatalf("expected the failed route not to be kept, got %v", nw.Routes().Routes())
+	}
+	nl.Errors = nil
+
+	nw.handleSubnetEvents([]subnet.Event{{Type: subnet.EventRemoved, Lease: lease("192.168.0.2")}})
+	nl.Expect(t, "RouteDel 10.1.1.0/24 via 192.168.0.2 dev 2")
+	if len(nl.Routes()) != 0 {
+		t.Fatalf("expected no routes, got %v", nl.Routes())
+	}
+
+	// Cleaning up deletes the routes to all peers
+	nw.handleSubnetEvents([]subnet.Event{{Type: subnet.EventAdded, Lease: lease("192.168.0.4")}})
+	nl.Expect(t, "RouteAdd 10.1.1.0/24 via 192.168.0.4 dev 2")
+	if err := nw.CleanUp(); err != nil {
+		t.Fatal(err)
+	}
+	nl.Expect(t, "RouteDel 10.1.1.0/24 via 192.168.0.4 dev 2")
+	if len(nl.Routes()) != 0 || len(nw.Routes().Routes()) != 0 {
+		t.Fatalf("expected no routes, got %v", nl.Routes())
+	}
+}
+
+// renewManager records the renewed leases.
+type renewManager struct {
+	subnet.Manager
+	renewed []subnet.Lease
+}
+
+func (m *renewManager) RenewLease(ctx context.Context, lease *subnet.Lease) error {
+	m.renewed = append(m.renewed, *lease)
+	return nil
+}
+
+func TestRouteNetworkMovesTunnel(t *testing.T) {
+	nl := dataplane.NewFakeNetlink()
+	sm := &renewManager{}
+	nw := &RouteNetwork{
+		SimpleNetwork: SimpleNetwork{
+			SubnetLease: &subnet.Lease{Attrs: subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.1")}},
+			ExtIface:    &ExternalInterface{Iface: &net.Interface{Index: 1}},
+		},
+		BackendType: "ipip",
+		SM:          sm,
+		LinkIndex:   2,
+		Netlink:     nl,
+	}
+	nw.GetRoute = func(lease *subnet.Lease) *netlink.Route {
+		return &netlink.Route{
+			Dst:       lease.Subnet.ToIPNet(),
+			Gw:        lease.Attrs.PublicIP.ToIP(),
+			LinkIndex: nw.LinkIndex,
+		}
+	}
+	_, sn, _ := net.ParseCIDR("10.1.1.0/24")
+	peer := subnet.Lease{Subnet: ip.FromIPNet(sn), Attrs: subnet.LeaseAttrs{PublicIP: ip.MustParseIP4("192.168.0.2"), BackendType: "ipip"}}
+	nw.handleSubnetEvents([]subnet.Event{{Type: subnet.EventAdded, Lease: peer}})
+	nl.Expect(t, "RouteAdd 10.1.1.0/24 via 192.168.0.2 dev 2")
+
+	ei := &ExternalInterface{Iface: &net.Interface{Index: 1}, IfaceAddr: net.ParseIP("192.168.0.10"), ExtAddr: net.ParseIP("192.168.0.10")}
+
+	// Without a way to move the tunnel device, the new address can't be followed
+	if err := nw.updateExternalInterface(context.Background(), ei); err == nil {
+		t.Fatal("expected the tunnel device to be bound to the previous address")
+	}
+
+	// The device is recreated, taking the routes through it along
+	nw.MoveTunnel = func(ei *ExternalInterface) (int, error) {
+		nl.RouteDel(&netlink.Route{Dst: sn})
+		nl.Calls()
+		return 3, nil
+	}
+	if err := nw.updateExternalInterface(context.Background(), ei); err != nil {
+		t.Fatal(err)
+	}
+	nl.Expect(t, "RouteAdd 10.1.1.0/24 via 192.168.0.2 dev 3")
+	if nw.LinkIndex != 3 || len(sm.renewed) != 1 || sm.renewed[0].Attrs.PublicIP != ip.MustParseIP4("192.168.0.10") {
+		t.Fatalf("expected the new device and public IP to be used, got dev %d and renewed %+v", nw.LinkIndex, sm.renewed)
 	}
 }
@@ -0,0 +1,169 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcptls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// certLoader holds the node certificate and the CA pool, and reloads them when their
+// files change so that certificates can be rotated without restarting flannel.
+type certLoader struct {
+	certFile, keyFile, caFile string
+
+	mu       sync.Mutex
+	modTimes [3]time.Time
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+}
+
+func newCertLoader(certFile, keyFile, caFile string) (*certLoader, error) {
+	l := &certLoader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if _, err := l.refresh(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *certLoader) stat() ([3]time.Time, error) {
+	var modTimes [3]time.Time
+	for i, f := range []string{l.certFile, l.keyFile, l.caFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = fi.ModTime()
+	}
+	return modTimes, nil
+}
+
+// refresh reloads the files if they changed since they were last loaded, and returns
+// whether they did. Files that can't be loaded, e.g. while they're being replaced, keep
+// the previous certificates in use.
+func (l *certLoader) refresh() (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	modTimes, err := l.stat()
+	if err == nil && l.cert != nil && modTimes == l.modTimes {
+		return false, nil
+	}
+
+	if err == nil {
+		var cert tls.Certificate
+		var pool *x509.CertPool
+		if cert, pool, err = loadCerts(l.certFile, l.keyFile, l.caFile); err == nil {
+			l.cert, l.pool, l.modTimes = &cert, pool, modTimes
+			return true, nil
+		}
+	}
+
+	if l.cert == nil {
+		return false, err
+	}
+	log.Warningf("Failed to reload the tcp-tls certificates, keeping the current ones: %v", err)
+	return false, nil
+}
+
+func (l *certLoader) current() (*tls.Certificate, *x509.CertPool) {
+	l.refresh()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cert, l.pool
+}
+
+func loadCerts(certFile, keyFile, caFile string) (tls.Certificate, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("failed to load the certificate: %v", err)
+	}
+
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return tls.Certificate{}, nil, fmt.Errorf("failed to read the CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return tls.Certificate{}, nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return cert, pool, nil
+}
+
+// serverConfig requires peers to present a certificate signed by the current CA.
+func (l *certLoader) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := l.current()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    pool,
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+			}, nil
+		},
+	}
+}
+
+// clientConfig verifies that peers present a certificate signed by the current CA. Peers
+// are dialed by their public IP, which node certificates rarely carry, so the chain is
+// verified without checking the host name.
+func (l *certLoader) clientConfig() *tls.Config {
+	cert, pool := l.current()
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		Certificates:       []tls.Certificate{*cert},
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, pool)
+		},
+	}
+}
+
+func verifyChain(rawCerts [][]byte, pool *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return errors.New("peer presented no certificate")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("failed to parse the peer certificate: %v", err)
+		}
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return err
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcptls
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/coreos/flannel/backend"
+)
+
+const (
+	backendType = "tcp-tls"
+	defaultPort = 8286
+
+	// maxFrameLen is the largest packet a frame can carry: its length is sent in 2 bytes.
+	maxFrameLen = 1<<16 - 1
+)
+
+func init() {
+	backend.RegisterDataSchema(backendType, backend.DataSchema{Validate: validateLeaseData})
+}
+
+// leaseData is the BackendData of tcp-tls leases: the port peers dial to reach the node.
+type leaseData struct {
+	Port int
+}
+
+func validateLeaseData(version int, data json.RawMessage) error {
+	var d leaseData
+	if err := json.Unmarshal(data, &d); err != nil {
+		return err
+	}
+	if d.Port <= 0 || d.Port > 65535 {
+		return fmt.Errorf("invalid Port %d", d.Port)
+	}
+	return nil
+}
+
+// writeFrame sends pkt prefixed with its length in a single write, so that each packet
+// goes out in one TLS record.
+func writeFrame(w io.Writer, pkt []byte) error {
+	if len(pkt) > maxFrameLen {
+		return fmt.Errorf("packet of %d bytes is too large to frame", len(pkt))
+	}
+	buf := make([]byte, 2+len(pkt))
+	binary.BigEndian.PutUint16(buf, uint16(len(pkt)))
+	copy(buf[2:], pkt)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readFrame reads the next packet from r into buf, which must hold maxFrameLen bytes.
+func readFrame(r io.Reader, buf []byte) ([]byte, error) {
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(buf))
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package tcptls
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+// backendConfig is the Backend section of the network config.
+type backendConfig struct {
+	backend.MTUConfig
+	Port     int
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
+func init() {
+	backend.Register(backendType, New)
+	backend.RegisterConfig(backendType, func() interface{} { return &backendConfig{} })
+}
+
+type TCPTLSBackend struct {
+	sm       subnet.Manager
+	extIface *backend.ExternalInterface
+}
+
+func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backend, error) {
+	be := TCPTLSBackend{
+		sm:       sm,
+		extIface: extIface,
+	}
+	return &be, nil
+}
+
+func (be *TCPTLSBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
+	cfg := backendConfig{
+		Port: defaultPort,
+	}
+
+	if len(config.Backend) > 0 {
+		if err := json.Unmarshal(config.Backend, &cfg); err != nil {
+			return nil, fmt.Errorf("error decoding tcp-tls backend config: %v", err)
+		}
+	}
+	if cfg.CertFile == "" || cfg.KeyFile == "" || cfg.CAFile == "" {
+		return nil, fmt.Errorf("tcp-tls backend requires CertFile, KeyFile and CAFile")
+	}
+	if cfg.Port <= 0 || cfg.Port > 65535 {
+		return nil, fmt.Errorf("invalid tcp-tls Port %d", cfg.Port)
+	}
+
+	certs, err := newCertLoader(cfg.CertFile, cfg.KeyFile, cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	mtu, err := backend.OverlayMTU(be.extIface, backend.TCPTLSOverhead, config)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(&leaseData{Port: cfg.Port})
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := subnet.LeaseAttrs{
+		PublicIP:    ip.FromIP(be.extIface.ExtAddr),
+		PublicIPv6:  be.extIface.ExtV6Addr,
+		BackendType: backendType,
+		BackendData: json.RawMessage(data),
+	}
+
+	l, err := be.sm.AcquireLease(ctx, &attrs)
+	switch err {
+	case nil:
+
+	case context.Canceled, context.DeadlineExceeded:
+		return nil, err
+
+	default:
+		return nil, fmt.Errorf("failed to acquire lease: %w", err)
+	}
+
+	// Like udp, the TUN device gets a route to the whole overlay network
+	tunNet := ip.IP4Net{
+		IP:        l.Subnet.IP,
+		PrefixLen: config.Network.PrefixLen,
+	}
+
+	return newNetwork(be.sm, be.extIface, cfg.Port, mtu, tunNet, l, certs)
+}
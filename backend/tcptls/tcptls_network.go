@@ -0,0 +1,482 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package tcptls
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+const (
+	tunName = "flannel.tls"
+
+	// peerQueueLen is the number of packets queued for a peer; packets beyond it are
+	// dropped while the peer is unreachable or slow.
+	peerQueueLen = 256
+
+	dialTimeout       = 10 * time.Second
+	writeTimeout      = 10 * time.Second
+	handshakeTimeout  = 10 * time.Second
+	maxRedialInterval = 30 * time.Second
+	certCheckInterval = time.Minute
+)
+
+type network struct {
+	backend.SimpleNetwork
+	sm       subnet.Manager
+	port     int
+	mtu      int
+	tunNet   ip.IP4Net
+	tun      *os.File
+	listener net.Listener
+	certs    *certLoader
+
+	mu      sync.Mutex
+	peers   map[ip.IP4Net]*peer
+	inbound map[net.Conn]bool
+}
+
+// peer is the connection to another node. Packets to its subnet are queued on out and
+// sent by a goroutine that (re)connects as needed; the connection is only used for
+// sending, packets from the peer arrive on the connection it dialed to us.
+type peer struct {
+	addr     string
+	publicIP ip.IP4
+	out      chan []byte
+	done     chan struct{}
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newNetwork(sm subnet.Manager, extIface *backend.ExternalInterface, port int, mtu int, tunNet ip.IP4Net, l *subnet.Lease, certs *certLoader) (*network, error) {
+	n := &network{
+		SimpleNetwork: backend.SimpleNetwork{
+			SubnetLease: l,
+			ExtIface:    extIface,
+		},
+		sm:      sm,
+		port:    port,
+		mtu:     mtu,
+		tunNet:  tunNet,
+		certs:   certs,
+		peers:   make(map[ip.IP4Net]*peer),
+		inbound: make(map[net.Conn]bool),
+	}
+
+	var name string
+	var err error
+	n.tun, name, err = ip.OpenTun(tunName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open TUN device: %w", err)
+	}
+	if err := configureIface(name, tunNet, mtu); err != nil {
+		n.tun.Close()
+		return nil, err
+	}
+
+	addr := net.JoinHostPort(extIface.IfaceAddr.String(), strconv.Itoa(port))
+	n.listener, err = tls.Listen("tcp", addr, certs.serverConfig())
+	if err != nil {
+		n.tun.Close()
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	return n, nil
+}
+
+func (n *network) MTU() int {
+	return n.mtu
+}
+
+func (n *network) Run(ctx context.Context) {
+	defer n.tun.Close()
+
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+
+	wg.Add(1)
+	go func() {
+		n.acceptPeers(ctx)
+		wg.Done()
+	}()
+
+	// Reads on the TUN device can't be interrupted, so this goroutine isn't waited for
+	go n.readTun(ctx)
+
+	log.Info("Watching for new subnet leases")
+
+	evts := make(chan []subnet.Event)
+
+	wg.Add(1)
+	go func() {
+		subnet.WatchLeases(ctx, n.sm, n.SubnetLease, evts)
+		wg.Done()
+	}()
+
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case evtBatch := <-evts:
+			n.processSubnetEvents(evtBatch)
+
+		case <-ticker.C:
+			if changed, _ := n.certs.refresh(); changed {
+				log.Info("tcp-tls certificates changed, reconnecting to the peers")
+				n.resetConns()
+			}
+
+		case <-ctx.Done():
+			n.listener.Close()
+			n.mu.Lock()
+			for sn, p := range n.peers {
+				p.stop()
+				delete(n.peers, sn)
+			}
+			for conn := range n.inbound {
+				conn.Close()
+			}
+			n.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (n *network) processSubnetEvents(batch []subnet.Event) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, evt := range batch {
+		sn := evt.Lease.Subnet
+
+		switch evt.Type {
+		case subnet.EventAdded:
+			if evt.Lease.Attrs.BackendType != backendType {
+				log.Warningf("Ignoring non-tcp-tls subnet %v: type=%v", sn, evt.Lease.Attrs.BackendType)
+				continue
+			}
+			var data leaseData
+			if err := json.Unmarshal(evt.Lease.Attrs.BackendData, &data); err != nil {
+				log.Errorf("Failed to decode the tcp-tls data of subnet %v: %v", sn, err)
+				continue
+			}
+			addr := net.JoinHostPort(evt.Lease.Attrs.PublicIP.String(), strconv.Itoa(data.Port))
+
+			if old, ok := n.peers[sn]; ok {
+				if old.addr == addr {
+					continue
+				}
+				old.stop()
+			}
+			log.Infof("Subnet added: %v via %s", sn, addr)
+
+			p := &peer{
+				addr:     addr,
+				publicIP: evt.Lease.Attrs.PublicIP,
+				out:      make(chan []byte, peerQueueLen),
+				done:     make(chan struct{}),
+			}
+			n.peers[sn] = p
+			go n.runPeer(p)
+
+		case subnet.EventRemoved:
+			log.Info("Subnet removed: ", sn)
+
+			if p, ok := n.peers[sn]; ok {
+				p.stop()
+				delete(n.peers, sn)
+			}
+
+		default:
+			log.Error("Internal error: unknown event type: ", int(evt.Type))
+		}
+	}
+}
+
+// lookup returns the peer whose subnet contains dst.
+func (n *network) lookup(dst ip.IP4) *peer {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for sn, p := range n.peers {
+		if sn.Contains(dst) {
+			return p
+		}
+	}
+	return nil
+}
+
+// resetConns closes the connections so that they're established again with the current
+// certificates.
+func (n *network) resetConns() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, p := range n.peers {
+		p.closeConn()
+	}
+	for conn := range n.inbound {
+		conn.Close()
+	}
+}
+
+func (n *network) readTun(ctx context.Context) {
+	buf := make([]byte, maxFrameLen)
+	for {
+		nr, err := n.tun.Read(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Errorf("Failed to read from the TUN device: %v", err)
+			}
+			return
+		}
+
+		pkt := buf[:nr]
+		if len(pkt) < 20 || pkt[0]>>4 != 4 {
+			continue
+		}
+		p := n.lookup(ip.FromIP(net.IP(pkt[16:20])))
+		if p == nil {
+			continue
+		}
+
+		select {
+		case p.out <- append([]byte(nil), pkt...):
+		default:
+			log.V(1).Infof("Dropping packet to %s: queue is full", p.addr)
+		}
+	}
+}
+
+func (n *network) runPeer(p *peer) {
+	interval := time.Second
+	for {
+		// Dial from the interface address so that the peer sees the public IP of this node
+		dialer := &net.Dialer{Timeout: dialTimeout, LocalAddr: &net.TCPAddr{IP: n.ExtIface.IfaceAddr}}
+		conn, err := tls.DialWithDialer(dialer, "tcp", p.addr, n.certs.clientConfig())
+		if err != nil {
+			log.Warningf("Failed to connect to tcp-tls peer %s: %v", p.addr, err)
+			select {
+			case <-p.done:
+				return
+			case <-time.After(interval):
+			}
+			if interval *= 2; interval > maxRedialInterval {
+				interval = maxRedialInterval
+			}
+			continue
+		}
+		interval = time.Second
+		log.Infof("Connected to tcp-tls peer %s", p.addr)
+
+		if !p.setConn(conn) {
+			return
+		}
+		err = p.send(conn)
+		conn.Close()
+		if err == nil {
+			return
+		}
+		log.Warningf("Lost the connection to tcp-tls peer %s: %v", p.addr, err)
+	}
+}
+
+func (p *peer) send(conn net.Conn) error {
+	for {
+		select {
+		case pkt := <-p.out:
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := writeFrame(conn, pkt); err != nil {
+				return err
+			}
+		case <-p.done:
+			return nil
+		}
+	}
+}
+
+// setConn records conn as the current connection, unless the peer was stopped.
+func (p *peer) setConn(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	select {
+	case <-p.done:
+		conn.Close()
+		return false
+	default:
+	}
+	p.conn = conn
+	return true
+}
+
+func (p *peer) closeConn() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn != nil {
+		p.conn.Close()
+	}
+}
+
+func (p *peer) stop() {
+	p.mu.Lock()
+	close(p.done)
+	p.mu.Unlock()
+	p.closeConn()
+}
+
+func (n *network) acceptPeers(ctx context.Context) {
+	for {
+		conn, err := n.listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Errorf("Failed to accept a tcp-tls connection: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		n.mu.Lock()
+		n.inbound[conn] = true
+		n.mu.Unlock()
+
+		go func() {
+			n.receive(conn.(*tls.Conn))
+
+			n.mu.Lock()
+			delete(n.inbound, conn)
+			n.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// receive writes the packets sent by a peer to the TUN device.
+func (n *network) receive(conn *tls.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		log.Warningf("tcp-tls handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	ids := peerIdentities(conn)
+
+	buf := make([]byte, maxFrameLen)
+	for {
+		pkt, err := readFrame(conn, buf)
+		if err != nil {
+			if err != io.EOF {
+				log.V(1).Infof("Connection from tcp-tls peer %s closed: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if !n.accepts(pkt, ids) {
+			continue
+		}
+		if _, err := n.tun.Write(pkt); err != nil {
+			log.V(1).Infof("Failed to write to the TUN device: %v", err)
+		}
+	}
+}
+
+// peerIdentities returns the public IPs that the peer on conn is known by: the address it
+// connected from and the IP addresses its certificate was issued for.
+func peerIdentities(conn *tls.Conn) map[ip.IP4]bool {
+	ids := make(map[ip.IP4]bool)
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && addr.IP.To4() != nil {
+		ids[ip.FromIP(addr.IP)] = true
+	}
+	if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		for _, a := range certs[0].IPAddresses {
+			if a.To4() != nil {
+				ids[ip.FromIP(a)] = true
+			}
+		}
+	}
+	return ids
+}
+
+// accepts reports whether pkt is an IPv4 packet to the subnet of this node from the
+// subnet of the peer known by ids, so that peers can neither use the node to reach other
+// destinations nor spoof the addresses of other nodes.
+func (n *network) accepts(pkt []byte, ids map[ip.IP4]bool) bool {
+	if len(pkt) < 20 || pkt[0]>>4 != 4 {
+		return false
+	}
+	src, dst := ip.FromIP(net.IP(pkt[12:16])), ip.FromIP(net.IP(pkt[16:20]))
+	if !n.SubnetLease.Subnet.Contains(dst) {
+		return false
+	}
+	p := n.lookup(src)
+	return p != nil && ids[p.publicIP]
+}
+
+func configureIface(ifname string, ipn ip.IP4Net, mtu int) error {
+	iface, err := netlink.LinkByName(ifname)
+	if err != nil {
+		return fmt.Errorf("failed to lookup interface %v", ifname)
+	}
+
+	// Ensure that the device has a /32 address so that no broadcast routes are created
+	ipnLocal := ipn
+	ipnLocal.PrefixLen = 32
+
+	err = netlink.AddrAdd(iface, &netlink.Addr{IPNet: ipnLocal.ToIPNet(), Label: ""})
+	if err != nil {
+		return fmt.Errorf("failed to add IP address %v to %v: %w", ipnLocal.String(), ifname, err)
+	}
+
+	err = netlink.LinkSetMTU(iface, mtu)
+	if err != nil {
+		return fmt.Errorf("failed to set MTU for %v: %w", ifname, err)
+	}
+
+	err = netlink.LinkSetUp(iface)
+	if err != nil {
+		return fmt.Errorf("failed to set interface %v to UP state: %w", ifname, err)
+	}
+
+	err = netlink.RouteAdd(&netlink.Route{
+		LinkIndex: iface.Attrs().Index,
+		Scope:     netlink.SCOPE_UNIVERSE,
+		Dst:       ipn.Network().ToIPNet(),
+	})
+	if err != nil && err != syscall.EEXIST {
+		return fmt.Errorf("failed to add route (%v -> %v): %w", ipn.Network().String(), ifname, err)
+	}
+
+	return nil
+}
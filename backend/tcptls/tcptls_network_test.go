@@ -0,0 +1,65 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package tcptls
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+func testPacket(src, dst string) []byte {
+	pkt := make([]byte, 20)
+	pkt[0] = 0x45
+	copy(pkt[12:16], net.ParseIP(src).To4())
+	copy(pkt[16:20], net.ParseIP(dst).To4())
+	return pkt
+}
+
+func TestAccepts(t *testing.T) {
+	_, own, _ := net.ParseCIDR("10.5.1.0/24")
+	_, other, _ := net.ParseCIDR("10.5.2.0/24")
+	_, third, _ := net.ParseCIDR("10.5.3.0/24")
+	n := &network{
+		SimpleNetwork: backend.SimpleNetwork{
+			SubnetLease: &subnet.Lease{Subnet: ip.FromIPNet(own)},
+		},
+		peers: map[ip.IP4Net]*peer{
+			ip.FromIPNet(other): {publicIP: ip.MustParseIP4("192.168.0.2")},
+			ip.FromIPNet(third): {publicIP: ip.MustParseIP4("192.168.0.3")},
+		},
+	}
+	ids := map[ip.IP4]bool{ip.MustParseIP4("192.168.0.2"): true}
+
+	for _, tc := range []struct {
+		name   string
+		pkt    []byte
+		accept bool
+	}{
+		{"from the peer's subnet", testPacket("10.5.2.7", "10.5.1.9"), true},
+		{"to another subnet", testPacket("10.5.2.7", "10.5.3.9"), false},
+		{"from another peer's subnet", testPacket("10.5.3.7", "10.5.1.9"), false},
+		{"from outside the network", testPacket("172.16.0.1", "10.5.1.9"), false},
+		{"truncated", testPacket("10.5.2.7", "10.5.1.9")[:19], false},
+	} {
+		if got := n.accepts(tc.pkt, ids); got != tc.accept {
+			t.Errorf("%s: expected accepts to return %v, got %v", tc.name, tc.accept, got)
+		}
+	}
+}
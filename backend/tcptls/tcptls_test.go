@@ -0,0 +1,209 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcptls
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFrames(t *testing.T) {
+	var b bytes.Buffer
+	pkts := [][]byte{[]byte("first packet"), {}, bytes.Repeat([]byte{1}, 1500)}
+	for _, pkt := range pkts {
+		if err := writeFrame(&b, pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeFrame(&b, make([]byte, maxFrameLen+1)); err == nil {
+		t.Error("expected an oversized packet to be rejected")
+	}
+
+	buf := make([]byte, maxFrameLen)
+	for _, pkt := range pkts {
+		got, err := readFrame(&b, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, pkt) {
+			t.Errorf("expected %d bytes, got %d", len(pkt), len(got))
+		}
+	}
+	if _, err := readFrame(&b, buf); err == nil {
+		t.Error("expected an error at the end of the stream")
+	}
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCert(t *testing.T, ca *testCA, isCA bool) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "flannel"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	parent, signer := tmpl, key
+	if ca != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func newTestCA(t *testing.T) *testCA {
+	cert, key, certPEM, _ := newTestCert(t, nil, true)
+	return &testCA{cert: cert, key: key, pem: certPEM}
+}
+
+// writeNodeCerts writes a certificate signed by ca, modified at mtime, to dir.
+func writeNodeCerts(t *testing.T, dir string, ca *testCA, mtime time.Time) (string, string, string) {
+	_, _, certPEM, keyPEM := newTestCert(t, ca, false)
+	files := map[string][]byte{"node.crt": certPEM, "node.key": keyPEM, "ca.crt": ca.pem}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "node.crt"), filepath.Join(dir, "node.key"), filepath.Join(dir, "ca.crt")
+}
+
+func handshake(server, client *certLoader) error {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- tls.Server(c1, server.serverConfig()).Handshake()
+	}()
+	err := tls.Client(c2, client.clientConfig()).Handshake()
+	// Unblock the server if the client gave up
+	c2.Close()
+	if serr := <-errs; err == nil {
+		err = serr
+	}
+	return err
+}
+
+func TestCertRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcptls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "a"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "b"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	ca := newTestCA(t)
+	start := time.Now().Add(-time.Hour)
+	a, err := newCertLoader(writeNodeCerts(t, filepath.Join(dir, "a"), ca, start))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newCertLoader(writeNodeCerts(t, filepath.Join(dir, "b"), ca, start))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := handshake(a, b); err != nil {
+		t.Fatalf("expected nodes of the same CA to connect, got %v", err)
+	}
+
+	// Node b moves to another CA: a rejects it until it trusts the new CA too
+	other := newTestCA(t)
+	writeNodeCerts(t, filepath.Join(dir, "b"), other, start.Add(time.Minute))
+	if changed, err := b.refresh(); !changed || err != nil {
+		t.Fatalf("expected the new certificates to be loaded, got %v, %v", changed, err)
+	}
+	if err := handshake(a, b); err == nil {
+		t.Fatal("expected a certificate of another CA to be rejected")
+	}
+
+	writeNodeCerts(t, filepath.Join(dir, "a"), other, start.Add(time.Minute))
+	if err := handshake(a, b); err != nil {
+		t.Fatalf("expected the rotated certificates to be used, got %v", err)
+	}
+
+	// Unchanged files aren't reloaded, and broken ones keep the current certificates
+	if changed, _ := a.refresh(); changed {
+		t.Error("expected unchanged files not to be reloaded")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "a", "node.crt"), []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := a.refresh(); changed || err != nil {
+		t.Errorf("expected broken files to be skipped, got %v, %v", changed, err)
+	}
+	if err := handshake(a, b); err != nil {
+		t.Errorf("expected the current certificates to stay in use, got %v", err)
+	}
+}
+
+func TestValidateLeaseData(t *testing.T) {
+	if err := validateLeaseData(0, []byte(`{"Port":8286}`)); err != nil {
+		t.Error(err)
+	}
+	if err := validateLeaseData(0, []byte(`{}`)); err == nil {
+		t.Error("expected a missing Port to be rejected")
+	}
+}
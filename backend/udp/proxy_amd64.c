@@ -13,6 +13,8 @@
 // limitations under the License.
 // +build !windows
 
+#define _GNU_SOURCE
+
 #include <stdlib.h>
 #include <stdio.h>
 #include <stdarg.h>
@@ -23,6 +25,7 @@
 #include <poll.h>
 #include <unistd.h>
 #include <sys/types.h>
+#include <sys/socket.h>
 #include <arpa/inet.h>
 #include <netinet/in.h>
 #include <linux/ip.h>
@@ -32,6 +35,9 @@
 #define CMD_DEFINE
 #include "proxy_amd64.h"
 
+/* Maximum number of packets moved per recvmmsg()/sendmmsg() call */
+#define BATCH_SIZE 32
+
 struct ip_net {
 	in_addr_t ip;
 	in_addr_t mask;
@@ -42,6 +48,16 @@ struct route_entry {
 	struct sockaddr_in next_hop;
 };
 
+/* A ring of preallocated packet buffers along with the headers to move them
+ * in one system call. */
+struct batch {
+	char               *bufs;
+	size_t              buflen;
+	struct iovec        iov[BATCH_SIZE];
+	struct mmsghdr      msgs[BATCH_SIZE];
+	struct sockaddr_in  dsts[BATCH_SIZE];
+};
+
 typedef struct icmp_pkt {
 	struct iphdr   iph;
 	struct icmphdr icmph;
@@ -247,33 +263,65 @@ static ssize_t tun_recv_packet(int tun, char *buf, size_t buflen) {
 	return nread;
 }
 
-static ssize_t sock_recv_packet(int sock, char *buf, size_t buflen) {
-	ssize_t nread = recv(sock, buf, buflen, MSG_DONTWAIT);
+static int batch_init(struct batch *b, size_t buflen) {
+	int i;
 
-	if( nread < sizeof(struct iphdr) ) {
-		if( nread < 0 ) {
-			if( errno != EAGAIN && errno != EWOULDBLOCK )
-				log_error("UDP recv failed: %s\n", strerror(errno));
-		} else {
-			log_error("UDP recv packet too small: %d bytes\n", (int)nread);
-		}
-		return -1;
+	memset(b, 0, sizeof(*b));
+	b->buflen = buflen;
+	b->bufs = (char *) malloc(BATCH_SIZE * buflen);
+	if( !b->bufs )
+		return 0;
+
+	for( i = 0; i < BATCH_SIZE; i++ ) {
+		b->iov[i].iov_base = b->bufs + i * buflen;
+		b->iov[i].iov_len = buflen;
+		b->msgs[i].msg_hdr.msg_iov = &b->iov[i];
+		b->msgs[i].msg_hdr.msg_iovlen = 1;
 	}
 
-	return nread;
+	return 1;
 }
 
-static void sock_send_packet(int sock, char *pkt, size_t pktlen, struct sockaddr_in *dst) {
-	ssize_t nsent = sendto(sock, pkt, pktlen, 0, (struct sockaddr *)dst, sizeof(struct sockaddr_in));
+static int sock_recv_batch(int sock, struct batch *b) {
+	int i, n;
 
-	if( nsent != pktlen ) {
-		if( nsent < 0 ) {
+	for( i = 0; i < BATCH_SIZE; i++ ) {
+		b->iov[i].iov_len = b->buflen;
+		b->msgs[i].msg_hdr.msg_name = NULL;
+		b->msgs[i].msg_hdr.msg_namelen = 0;
+	}
+
+	n = recvmmsg(sock, b->msgs, BATCH_SIZE, MSG_DONTWAIT, NULL);
+	if( n < 0 ) {
+		if( errno != EAGAIN && errno != EWOULDBLOCK )
+			log_error("UDP recv failed: %s\n", strerror(errno));
+		return 0;
+	}
+
+	return n;
+}
+
+static void sock_send_batch(int sock, struct batch *b, int npkts) {
+	int i, sent = 0;
+
+	for( i = 0; i < npkts; i++ ) {
+		b->msgs[i].msg_hdr.msg_name = &b->dsts[i];
+		b->msgs[i].msg_hdr.msg_namelen = sizeof(struct sockaddr_in);
+	}
+
+	while( sent < npkts ) {
+		int n = sendmmsg(sock, b->msgs + sent, npkts - sent, 0);
+		if( n < 0 ) {
+			if( errno == EINTR )
+				continue;
+
+			/* Drop the packet that can't be sent and carry on with the rest */
 			log_error("UDP send to %s:%hu failed: %s\n",
-					inet_ntoa(dst->sin_addr), ntohs(dst->sin_port), strerror(errno));
-		} else {
-			log_error("Was only able to send %d out of %d bytes to %s:%hu\n",
-					(int)nsent, (int)pktlen, inet_ntoa(dst->sin_addr), ntohs(dst->sin_port));
+					inet_ntoa(b->dsts[sent].sin_addr), ntohs(b->dsts[sent].sin_port), strerror(errno));
+			sent++;
+			continue;
 		}
+		sent += n;
 	}
 }
 
@@ -313,53 +361,68 @@ inline static int decrement_ttl(struct iphdr *iph) {
 	return 1;
 }
 
-static int tun_to_udp(int tun, int sock, char *buf, size_t buflen) {
-	struct iphdr *iph;
-	struct sockaddr_in *next_hop;
+static int tun_to_udp(int tun, int sock, struct batch *b) {
+	int nread = 0, npkts = 0;
 
-	ssize_t pktlen = tun_recv_packet(tun, buf, buflen);
-	if( pktlen < 0 )
-		return 0;
-	
-	iph = (struct iphdr *)buf;
+	/* TUN has no batched read, so collect up to a batch of packets and send
+	 * them with a single sendmmsg() */
+	while( nread < BATCH_SIZE ) {
+		struct iphdr *iph;
+		struct sockaddr_in *next_hop;
+		char *buf = b->iov[npkts].iov_base;
 
-	next_hop = find_route((in_addr_t) iph->daddr);
-	if( !next_hop ) {
-		send_net_unreachable(tun, buf);
-		goto _active;
-	}
+		ssize_t pktlen = tun_recv_packet(tun, buf, b->buflen);
+		if( pktlen < 0 )
+			break;
+		nread++;
+
+		iph = (struct iphdr *)buf;
 
-	if( !decrement_ttl(iph) ) {
-		/* TTL went to 0, discard.
-		 * TODO: send back ICMP Time Exceeded
-		 */
-		goto _active;
+		next_hop = find_route((in_addr_t) iph->daddr);
+		if( !next_hop ) {
+			send_net_unreachable(tun, buf);
+			continue;
+		}
+
+		if( !decrement_ttl(iph) ) {
+			/* TTL went to 0, discard.
+			 * TODO: send back ICMP Time Exceeded
+			 */
+			continue;
+		}
+
+		b->iov[npkts].iov_len = pktlen;
+		b->dsts[npkts] = *next_hop;
+		npkts++;
 	}
 
-	sock_send_packet(sock, buf, pktlen, next_hop);
-_active:
-	return 1;
+	sock_send_batch(sock, b, npkts);
+	return nread > 0;
 }
 
-static int udp_to_tun(int sock, int tun, char *buf, size_t buflen) {
-	struct iphdr *iph;
+static int udp_to_tun(int sock, int tun, struct batch *b) {
+	int i, npkts = sock_recv_batch(sock, b);
 
-	ssize_t pktlen = sock_recv_packet(sock, buf, buflen);
-	if( pktlen < 0 )
-		return 0;
+	for( i = 0; i < npkts; i++ ) {
+		char *buf = b->iov[i].iov_base;
+		size_t pktlen = b->msgs[i].msg_len;
 
-	iph = (struct iphdr *)buf;
+		if( pktlen < sizeof(struct iphdr) ) {
+			log_error("UDP recv packet too small: %d bytes\n", (int)pktlen);
+			continue;
+		}
 
-	if( !decrement_ttl(iph) ) {
-		/* TTL went to 0, discard.
-		 * TODO: send back ICMP Time Exceeded
-		 */
-		goto _active;
+		if( !decrement_ttl((struct iphdr *)buf) ) {
+			/* TTL went to 0, discard.
+			 * TODO: send back ICMP Time Exceeded
+			 */
+			continue;
+		}
+
+		tun_send_packet(tun, buf, pktlen);
 	}
 
-	tun_send_packet(tun, buf, pktlen);
-_active:
-	return 1;
+	return npkts > 0;
 }
 
 static void process_cmd(int ctl) {
@@ -403,7 +466,7 @@ enum PFD {
 };
 
 void run_proxy(int tun, int sock, int ctl, in_addr_t tun_ip, size_t tun_mtu, int log_errors) {
-	char *buf;
+	struct batch tx, rx;
 	struct pollfd fds[PFD_CNT] = {
 		{
 			.fd = tun,
@@ -423,9 +486,8 @@ void run_proxy(int tun, int sock, int ctl, in_addr_t tun_ip, size_t tun_mtu, int
 	tun_addr = tun_ip;
 	log_enabled = log_errors;
 
-	buf = (char *) malloc(tun_mtu);
-	if( !buf ) {
-		log_error("Failed to allocate %d byte buffer\n", tun_mtu);
+	if( !batch_init(&tx, tun_mtu) || !batch_init(&rx, tun_mtu) ) {
+		log_error("Failed to allocate %d byte buffers\n", BATCH_SIZE * tun_mtu);
 		exit(1);
 	}
 
@@ -447,8 +509,8 @@ void run_proxy(int tun, int sock, int ctl, in_addr_t tun_ip, size_t tun_mtu, int
 		if( fds[PFD_TUN].revents & POLLIN || fds[PFD_SOCK].revents & POLLIN )
 			do {
 				activity = 0;
-				activity += tun_to_udp(tun, sock, buf, tun_mtu);
-				activity += udp_to_tun(sock, tun, buf, tun_mtu);
+				activity += tun_to_udp(tun, sock, &tx);
+				activity += udp_to_tun(sock, tun, &rx);
 
 				/* As long as tun or udp is readable bypass poll().
 				 * We'll just occasionally get EAGAIN on an unreadable fd which
@@ -461,6 +523,7 @@ void run_proxy(int tun, int sock, int ctl, in_addr_t tun_ip, size_t tun_mtu, int
 			} while( activity );
 	}
 
-	free(buf);
+	free(tx.bufs);
+	free(rx.bufs);
 }
 
@@ -27,8 +27,15 @@ import (
 	"github.com/coreos/flannel/subnet"
 )
 
+// backendConfig is the Backend section of the network config.
+type backendConfig struct {
+	backend.MTUConfig
+	Port int
+}
+
 func init() {
 	backend.Register("udp", New)
+	backend.RegisterConfig("udp", func() interface{} { return &backendConfig{} })
 }
 
 const (
@@ -49,9 +56,7 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backen
 }
 
 func (be *UdpBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
-	cfg := struct {
-		Port int
-	}{
+	cfg := backendConfig{
 		Port: defaultPort,
 	}
 
@@ -62,9 +67,15 @@ func (be *UdpBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, c
 		}
 	}
 
+	mtu, err := backend.OverlayMTU(be.extIface, backend.UDPOverhead, config)
+	if err != nil {
+		return nil, err
+	}
+
 	// Acquire the lease form subnet manager
 	attrs := subnet.LeaseAttrs{
-		PublicIP: ip.FromIP(be.extIface.ExtAddr),
+		PublicIP:   ip.FromIP(be.extIface.ExtAddr),
+		PublicIPv6: be.extIface.ExtV6Addr,
 	}
 
 	l, err := be.sm.AcquireLease(ctx, &attrs)
@@ -75,7 +86,7 @@ func (be *UdpBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, c
 		return nil, err
 
 	default:
-		return nil, fmt.Errorf("failed to acquire lease: %v", err)
+		return nil, fmt.Errorf("failed to acquire lease: %w", err)
 	}
 
 	// Tunnel's subnet is that of the whole overlay network (e.g. /16)
@@ -85,5 +96,5 @@ func (be *UdpBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, c
 		PrefixLen: config.Network.PrefixLen,
 	}
 
-	return newNetwork(be.sm, be.extIface, cfg.Port, tunNet, l)
+	return newNetwork(be.sm, be.extIface, cfg.Port, mtu, tunNet, l)
 }
@@ -23,6 +23,6 @@ import (
 	"github.com/coreos/flannel/subnet"
 )
 
-func newNetwork(sm subnet.Manager, extIface *backend.ExternalInterface, port int, nw ip.IP4Net, l *subnet.Lease) (*backend.SimpleNetwork, error) {
+func newNetwork(sm subnet.Manager, extIface *backend.ExternalInterface, port int, mtu int, nw ip.IP4Net, l *subnet.Lease) (*backend.SimpleNetwork, error) {
 	return nil, fmt.Errorf("UDP backend is not supported on this architecture")
 }
@@ -33,10 +33,6 @@ import (
 	"github.com/coreos/flannel/subnet"
 )
 
-const (
-	encapOverhead = 28 // 20 bytes IP hdr + 8 bytes UDP hdr
-)
-
 type network struct {
 	backend.SimpleNetwork
 	name   string
@@ -47,9 +43,10 @@ type network struct {
 	conn   *net.UDPConn
 	tunNet ip.IP4Net
 	sm     subnet.Manager
+	mtu    int
 }
 
-func newNetwork(sm subnet.Manager, extIface *backend.ExternalInterface, port int, nw ip.IP4Net, l *subnet.Lease) (*network, error) {
+func newNetwork(sm subnet.Manager, extIface *backend.ExternalInterface, port int, mtu int, nw ip.IP4Net, l *subnet.Lease) (*network, error) {
 	n := &network{
 		SimpleNetwork: backend.SimpleNetwork{
 			SubnetLease: l,
@@ -57,6 +54,7 @@ func newNetwork(sm subnet.Manager, extIface *backend.ExternalInterface, port int
 		},
 		port: port,
 		sm:   sm,
+		mtu:  mtu,
 	}
 
 	n.tunNet = nw
@@ -68,12 +66,12 @@ func newNetwork(sm subnet.Manager, extIface *backend.ExternalInterface, port int
 	var err error
 	n.conn, err = net.ListenUDP("udp4", &net.UDPAddr{IP: extIface.IfaceAddr, Port: port})
 	if err != nil {
-		return nil, fmt.Errorf("failed to start listening on UDP socket: %v", err)
+		return nil, fmt.Errorf("failed to start listening on UDP socket: %w", err)
 	}
 
 	n.ctl, n.ctl2, err = newCtlSockets()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create control socket: %v", err)
+		return nil, fmt.Errorf("failed to create control socket: %w", err)
 	}
 
 	return n, nil
@@ -120,7 +118,7 @@ func (n *network) Run(ctx context.Context) {
 }
 
 func (n *network) MTU() int {
-	return n.ExtIface.Iface.MTU - encapOverhead
+	return n.mtu
 }
 
 func newCtlSockets() (*os.File, *os.File, error) {
@@ -140,7 +138,7 @@ func (n *network) initTun() error {
 
 	n.tun, tunName, err = ip.OpenTun("flannel%d")
 	if err != nil {
-		return fmt.Errorf("failed to open TUN device: %v", err)
+		return fmt.Errorf("failed to open TUN device: %w", err)
 	}
 
 	err = configureIface(tunName, n.tunNet, n.MTU())
@@ -161,17 +159,17 @@ func configureIface(ifname string, ipn ip.IP4Net, mtu int) error {
 
 	err = netlink.AddrAdd(iface, &netlink.Addr{IPNet: ipnLocal.ToIPNet(), Label: ""})
 	if err != nil {
-		return fmt.Errorf("failed to add IP address %v to %v: %v", ipnLocal.String(), ifname, err)
+		return fmt.Errorf("failed to add IP address %v to %v: %w", ipnLocal.String(), ifname, err)
 	}
 
 	err = netlink.LinkSetMTU(iface, mtu)
 	if err != nil {
-		return fmt.Errorf("failed to set MTU for %v: %v", ifname, err)
+		return fmt.Errorf("failed to set MTU for %v: %w", ifname, err)
 	}
 
 	err = netlink.LinkSetUp(iface)
 	if err != nil {
-		return fmt.Errorf("failed to set interface %v to UP state: %v", ifname, err)
+		return fmt.Errorf("failed to set interface %v to UP state: %w", ifname, err)
 	}
 
 	// explicitly add a route since there might be a route for a subnet already
@@ -182,7 +180,7 @@ func configureIface(ifname string, ipn ip.IP4Net, mtu int) error {
 		Dst:       ipn.Network().ToIPNet(),
 	})
 	if err != nil && err != syscall.EEXIST {
-		return fmt.Errorf("failed to add route (%v -> %v): %v", ipn.Network().String(), ifname, err)
+		return fmt.Errorf("failed to add route (%v -> %v): %w", ipn.Network().String(), ifname, err)
 	}
 
 	return nil
@@ -0,0 +1,97 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package vxlan
+
+import (
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+const (
+	checkpointName = "vxlan"
+	// checkpointSaveInterval is how often the checkpoint is saved at most while the peers change
+	checkpointSaveInterval = 5 * time.Second
+)
+
+// checkpoint is the state of the vxlan network saved for the next flanneld. The MAC
+// address is reused if the device has to be recreated, so that the FDB entries of the
+// peers stay valid, and the peers are diffed with the first snapshot of the leases
+// instead of being programmed from scratch.
+type checkpoint struct {
+	VNI   uint32         `json:"vni"`
+	MAC   hardwareAddr   `json:"mac"`
+	Peers []subnet.Lease `json:"peers"`
+}
+
+// loadCheckpoint returns the checkpoint of the device with vni, if there is one.
+func loadCheckpoint(vni uint32) *checkpoint {
+	var cp checkpoint
+	ok, err := backend.LoadCheckpoint(checkpointName, &cp)
+	switch {
+	case err != nil:
+		log.Warningf("ignoring the vxlan checkpoint: %v", err)
+		return nil
+	case !ok:
+		return nil
+	case cp.VNI != vni:
+		log.Infof("ignoring the vxlan checkpoint of VNI %d", cp.VNI)
+		return nil
+	}
+	log.Infof("loaded the vxlan checkpoint with MAC %v and %d peers", cp.MAC, len(cp.Peers))
+	return &cp
+}
+
+// peers returns the peers of the checkpoint other than own, the subnet of this node,
+// which may have been the subnet of a peer before the restart.
+func (cp *checkpoint) peers(own ip.IP4Net) []subnet.Lease {
+	peers := make([]subnet.Lease, 0, len(cp.Peers))
+	for _, l := range cp.Peers {
+		if !l.Subnet.Equal(own) {
+			peers = append(peers, l)
+		}
+	}
+	return peers
+}
+
+// maybeSaveCheckpoint saves the checkpoint if the peers changed since it was last saved,
+// at most every checkpointSaveInterval, so that bursts of lease events are saved once.
+func (nw *network) maybeSaveCheckpoint() {
+	if nw.checkpointDirty && time.Since(nw.checkpointSaved) >= checkpointSaveInterval {
+		nw.saveCheckpoint()
+	}
+}
+
+func (nw *network) saveCheckpoint() {
+	cp := checkpoint{
+		VNI:   nw.dev.attrs.vni,
+		MAC:   hardwareAddr(nw.dev.MACAddr()),
+		Peers: make([]subnet.Lease, 0, len(nw.leases)),
+	}
+	for _, l := range nw.leases {
+		cp.Peers = append(cp.Peers, l)
+	}
+	if err := backend.SaveCheckpoint(checkpointName, cp); err != nil {
+		log.Warningf("failed to save the vxlan checkpoint: %v", err)
+		return
+	}
+	nw.checkpointDirty = false
+	nw.checkpointSaved = time.Now()
+}
@@ -18,14 +18,18 @@
 package vxlan
 
 import (
+	"bytes"
 	"fmt"
 	"net"
 	"syscall"
 
 	log "github.com/golang/glog"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/net/context"
 
 	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+	"github.com/coreos/flannel/pkg/audit"
+	"github.com/coreos/flannel/pkg/dataplane"
 	"github.com/coreos/flannel/pkg/ip"
 )
 
@@ -37,17 +41,25 @@ type vxlanDeviceAttrs struct {
 	vtepPort  int
 	gbp       bool
 	learning  bool
+	mtu       int
+	// hwAddr is the MAC address of a new device, random if nil
+	hwAddr net.HardwareAddr
+	// misses enables L2 and L3 miss notifications, see subscribeMisses
+	misses bool
 }
 
 type vxlanDevice struct {
 	link          *netlink.Vxlan
+	attrs         vxlanDeviceAttrs
 	directRouting bool
+	nl            dataplane.Netlink
 }
 
 func newVXLANDevice(devAttrs *vxlanDeviceAttrs) (*vxlanDevice, error) {
 	link := &netlink.Vxlan{
 		LinkAttrs: netlink.LinkAttrs{
-			Name: devAttrs.name,
+			Name:         devAttrs.name,
+			HardwareAddr: devAttrs.hwAddr,
 		},
 		VxlanId:      int(devAttrs.vni),
 		VtepDevIndex: devAttrs.vtepIndex,
@@ -55,6 +67,8 @@ func newVXLANDevice(devAttrs *vxlanDeviceAttrs) (*vxlanDevice, error) {
 		Port:         devAttrs.vtepPort,
 		Learning:     devAttrs.learning,
 		GBP:          devAttrs.gbp,
+		L2miss:       devAttrs.misses,
+		L3miss:       devAttrs.misses,
 	}
 
 	link, err := ensureLink(link)
@@ -62,10 +76,26 @@ func newVXLANDevice(devAttrs *vxlanDeviceAttrs) (*vxlanDevice, error) {
 		return nil, err
 	}
 
+	if devAttrs.mtu > 0 && link.MTU != devAttrs.mtu {
+		log.Infof("current MTU of %s is %d, setting it to %d", devAttrs.name, link.MTU, devAttrs.mtu)
+		if err := netlink.LinkSetMTU(link, devAttrs.mtu); err != nil {
+			return nil, fmt.Errorf("failed to set %v MTU to %d: %w", devAttrs.name, devAttrs.mtu, err)
+		}
+		link.MTU = devAttrs.mtu
+	}
+
 	_, _ = sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/accept_ra", devAttrs.name), "0")
+	if devAttrs.misses {
+		// Ask userspace (us) for the neighbors of the device, instead of probing for them
+		if _, err := sysctl.Sysctl(fmt.Sprintf("net/ipv4/neigh/%s/app_solicit", devAttrs.name), "3"); err != nil {
+			log.Warningf("failed to enable L3 miss notifications of %s: %v", devAttrs.name, err)
+		}
+	}
 
 	return &vxlanDevice{
-		link: link,
+		link:  link,
+		attrs: *devAttrs,
+		nl:    dataplane.NewNetlink(),
 	}, nil
 }
 
@@ -88,12 +118,12 @@ func ensureLink(vxlan *netlink.Vxlan) (*netlink.Vxlan, error) {
 		// delete existing
 		log.Warningf("%q already exists with incompatable configuration: %v; recreating device", vxlan.Name, incompat)
 		if err = netlink.LinkDel(existing); err != nil {
-			return nil, fmt.Errorf("failed to delete interface: %v", err)
+			return nil, fmt.Errorf("failed to delete interface: %w", err)
 		}
 
 		// create new
 		if err = netlink.LinkAdd(vxlan); err != nil {
-			return nil, fmt.Errorf("failed to create vxlan interface: %v", err)
+			return nil, fmt.Errorf("failed to create vxlan interface: %w", err)
 		}
 	} else if err != nil {
 		return nil, err
@@ -115,16 +145,24 @@ func ensureLink(vxlan *netlink.Vxlan) (*netlink.Vxlan, error) {
 
 func (dev *vxlanDevice) Configure(ipn ip.IP4Net) error {
 	if err := ip.EnsureV4AddressOnLink(ipn, dev.link); err != nil {
-		return fmt.Errorf("failed to ensure address of interface %s: %s", dev.link.Attrs().Name, err)
+		return fmt.Errorf("failed to ensure address of interface %s: %w", dev.link.Attrs().Name, err)
 	}
 
 	if err := netlink.LinkSetUp(dev.link); err != nil {
-		return fmt.Errorf("failed to set interface %s to UP state: %s", dev.link.Attrs().Name, err)
+		return fmt.Errorf("failed to set interface %s to UP state: %w", dev.link.Attrs().Name, err)
 	}
 
 	return nil
 }
 
+// Destroy deletes the device.
+func (dev *vxlanDevice) Destroy() error {
+	if err := netlink.LinkDel(dev.link); err != nil {
+		return fmt.Errorf("failed to delete %v: %v", dev.link.Name, err)
+	}
+	return nil
+}
+
 func (dev *vxlanDevice) MACAddr() net.HardwareAddr {
 	return dev.link.HardwareAddr
 }
@@ -134,49 +172,120 @@ type neighbor struct {
 	IP  ip.IP4
 }
 
-func (dev *vxlanDevice) AddFDB(n neighbor) error {
-	log.V(4).Infof("calling AddFDB: %v, %v", n.IP, n.MAC)
-	return netlink.NeighSet(&netlink.Neigh{
+func (n neighbor) String() string {
+	return fmt.Sprintf("%v %v", n.IP, n.MAC)
+}
+
+// fdbEntry forwards the frames to MAC to the VTEP at the IPv4 or IPv6 address Dst.
+type fdbEntry struct {
+	MAC net.HardwareAddr
+	Dst net.IP
+}
+
+func (e fdbEntry) String() string {
+	return fmt.Sprintf("%v %v", e.Dst, e.MAC)
+}
+
+func (dev *vxlanDevice) AddFDB(n fdbEntry) error {
+	log.V(4).Infof("calling AddFDB: %v, %v", n.Dst, n.MAC)
+	before := dev.currentNeigh(syscall.AF_BRIDGE, func(e netlink.Neigh) bool { return bytes.Equal(e.HardwareAddr, n.MAC) })
+	err := dev.nl.NeighSet(&netlink.Neigh{
 		LinkIndex:    dev.link.Index,
 		State:        netlink.NUD_PERMANENT,
 		Family:       syscall.AF_BRIDGE,
 		Flags:        netlink.NTF_SELF,
-		IP:           n.IP.ToIP(),
+		IP:           n.Dst,
 		HardwareAddr: n.MAC,
 	})
+	audit.Log(audit.KindFDB, audit.ActionReplace, before, n.String(), err)
+	return err
 }
 
-func (dev *vxlanDevice) DelFDB(n neighbor) error {
-	log.V(4).Infof("calling DelFDB: %v, %v", n.IP, n.MAC)
-	return netlink.NeighDel(&netlink.Neigh{
+func (dev *vxlanDevice) DelFDB(n fdbEntry) error {
+	log.V(4).Infof("calling DelFDB: %v, %v", n.Dst, n.MAC)
+	err := dev.nl.NeighDel(&netlink.Neigh{
 		LinkIndex:    dev.link.Index,
 		Family:       syscall.AF_BRIDGE,
 		Flags:        netlink.NTF_SELF,
-		IP:           n.IP.ToIP(),
+		IP:           n.Dst,
 		HardwareAddr: n.MAC,
 	})
+	audit.Log(audit.KindFDB, audit.ActionDelete, n.String(), "", err)
+	return err
 }
 
 func (dev *vxlanDevice) AddARP(n neighbor) error {
 	log.V(4).Infof("calling AddARP: %v, %v", n.IP, n.MAC)
-	return netlink.NeighSet(&netlink.Neigh{
+	before := dev.currentNeigh(netlink.FAMILY_V4, func(e netlink.Neigh) bool { return e.IP.Equal(n.IP.ToIP()) })
+	err := dev.nl.NeighSet(&netlink.Neigh{
 		LinkIndex:    dev.link.Index,
 		State:        netlink.NUD_PERMANENT,
 		Type:         syscall.RTN_UNICAST,
 		IP:           n.IP.ToIP(),
 		HardwareAddr: n.MAC,
 	})
+	audit.Log(audit.KindARP, audit.ActionReplace, before, n.String(), err)
+	return err
 }
 
 func (dev *vxlanDevice) DelARP(n neighbor) error {
 	log.V(4).Infof("calling DelARP: %v, %v", n.IP, n.MAC)
-	return netlink.NeighDel(&netlink.Neigh{
+	err := dev.nl.NeighDel(&netlink.Neigh{
 		LinkIndex:    dev.link.Index,
 		State:        netlink.NUD_PERMANENT,
 		Type:         syscall.RTN_UNICAST,
 		IP:           n.IP.ToIP(),
 		HardwareAddr: n.MAC,
 	})
+	audit.Log(audit.KindARP, audit.ActionDelete, n.String(), "", err)
+	return err
+}
+
+// currentNeigh returns the neighbor entry that is about to be overwritten, for the audit trail.
+// The lookup is skipped when auditing is disabled.
+func (dev *vxlanDevice) currentNeigh(family int, match func(netlink.Neigh) bool) string {
+	if !audit.Enabled() {
+		return ""
+	}
+	neighs, err := dev.nl.NeighList(dev.link.Index, family)
+	if err != nil {
+		return ""
+	}
+	for _, e := range neighs {
+		if match(e) {
+			return fmt.Sprintf("%v %v", e.IP, e.HardwareAddr)
+		}
+	}
+	return ""
+}
+
+// subscribeMisses sends the neighbor misses reported by the kernel to misses until ctx is done.
+// An L2 miss carries the MAC address without FDB entry, an L3 miss the IP address without
+// ARP entry.
+func subscribeMisses(ctx context.Context, misses chan<- netlink.Neigh) error {
+	updates := make(chan netlink.NeighUpdate)
+	if err := netlink.NeighSubscribe(updates, ctx.Done()); err != nil {
+		return fmt.Errorf("failed to subscribe to neighbor misses: %v", err)
+	}
+
+	for {
+		select {
+		case u, ok := <-updates:
+			if !ok {
+				return fmt.Errorf("neighbor subscription closed")
+			}
+			if u.Type != syscall.RTM_GETNEIGH {
+				continue
+			}
+			select {
+			case misses <- u.Neigh:
+			case <-ctx.Done():
+				return nil
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
 }
 
 func vxlanLinksIncompat(l1, l2 netlink.Link) string {
@@ -207,6 +316,10 @@ func vxlanLinksIncompat(l1, l2 netlink.Link) string {
 		return fmt.Sprintf("l2miss: %v vs %v", v1.L2miss, v2.L2miss)
 	}
 
+	if v1.L3miss != v2.L3miss {
+		return fmt.Sprintf("l3miss: %v vs %v", v1.L3miss, v2.L3miss)
+	}
+
 	if v1.Port > 0 && v2.Port > 0 && v1.Port != v2.Port {
 		return fmt.Sprintf("port: %v vs %v", v1.Port, v2.Port)
 	}
@@ -0,0 +1,56 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vxlan
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/coreos/flannel/backend"
+)
+
+func init() {
+	backend.RegisterDataSchema("vxlan", backend.DataSchema{Validate: validateLeaseData})
+}
+
+// validateLeaseData checks the vxlan data of the Linux and Windows nodes. Windows nodes
+// publish an empty VtepMAC until their network is created.
+func validateLeaseData(version int, data json.RawMessage) error {
+	var attrs struct {
+		VNI     *uint32
+		VtepMAC *string
+	}
+	if err := json.Unmarshal(data, &attrs); err != nil {
+		return err
+	}
+
+	if attrs.VNI != nil && *attrs.VNI >= 1<<24 {
+		return fmt.Errorf("VNI %d is out of range", *attrs.VNI)
+	}
+	if attrs.VtepMAC == nil {
+		return fmt.Errorf("VtepMAC is missing")
+	}
+	if *attrs.VtepMAC != "" {
+		mac, err := net.ParseMAC(*attrs.VtepMAC)
+		if err != nil {
+			return fmt.Errorf("invalid VtepMAC: %v", err)
+		}
+		if len(mac) != 6 {
+			return fmt.Errorf("VtepMAC %v is not an Ethernet address", mac)
+		}
+	}
+	return nil
+}
@@ -66,8 +66,21 @@ import (
 	"github.com/coreos/flannel/subnet"
 )
 
+// backendConfig is the Backend section of the network config.
+type backendConfig struct {
+	backend.MTUConfig
+	VNI           int
+	Port          int
+	GBP           bool
+	Learning      bool
+	DirectRouting bool
+	MissHandling  bool
+	OuterIPv6     bool
+}
+
 func init() {
 	backend.Register("vxlan", New)
+	backend.RegisterConfig("vxlan", func() interface{} { return &backendConfig{} })
 }
 
 const (
@@ -88,7 +101,7 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backen
 	return backend, nil
 }
 
-func newSubnetAttrs(publicIP net.IP, mac net.HardwareAddr) (*subnet.LeaseAttrs, error) {
+func newSubnetAttrs(publicIP, publicIPv6 net.IP, mac net.HardwareAddr) (*subnet.LeaseAttrs, error) {
 	data, err := json.Marshal(&vxlanLeaseAttrs{hardwareAddr(mac)})
 	if err != nil {
 		return nil, err
@@ -96,6 +109,7 @@ func newSubnetAttrs(publicIP net.IP, mac net.HardwareAddr) (*subnet.LeaseAttrs,
 
 	return &subnet.LeaseAttrs{
 		PublicIP:    ip.FromIP(publicIP),
+		PublicIPv6:  publicIPv6,
 		BackendType: "vxlan",
 		BackendData: json.RawMessage(data),
 	}, nil
@@ -103,13 +117,7 @@ func newSubnetAttrs(publicIP net.IP, mac net.HardwareAddr) (*subnet.LeaseAttrs,
 
 func (be *VXLANBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
 	// Parse our configuration
-	cfg := struct {
-		VNI           int
-		Port          int
-		GBP           bool
-		Learning      bool
-		DirectRouting bool
-	}{
+	cfg := backendConfig{
 		VNI: defaultVNI,
 	}
 
@@ -118,16 +126,37 @@ func (be *VXLANBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup,
 			return nil, fmt.Errorf("error decoding VXLAN backend config: %v", err)
 		}
 	}
-	log.Infof("VXLAN config: VNI=%d Port=%d GBP=%v Learning=%v DirectRouting=%v", cfg.VNI, cfg.Port, cfg.GBP, cfg.Learning, cfg.DirectRouting)
+	if cfg.OuterIPv6 && (be.extIface.IfaceV6Addr == nil || be.extIface.ExtV6Addr == nil) {
+		return nil, fmt.Errorf("OuterIPv6 requires an IPv6 address on %s", be.extIface.Iface.Name)
+	}
+	log.Infof("VXLAN config: VNI=%d Port=%d GBP=%v Learning=%v DirectRouting=%v MissHandling=%v OuterIPv6=%v", cfg.VNI, cfg.Port, cfg.GBP, cfg.Learning, cfg.DirectRouting, cfg.MissHandling, cfg.OuterIPv6)
+
+	overhead := backend.VXLANOverhead
+	vtepAddr := be.extIface.IfaceAddr
+	if cfg.OuterIPv6 {
+		// The IPv6 header is 20 bytes longer than the IPv4 one
+		overhead += 20
+		vtepAddr = be.extIface.IfaceV6Addr
+	}
+	mtu, err := backend.OverlayMTU(be.extIface, overhead, config)
+	if err != nil {
+		return nil, err
+	}
 
 	devAttrs := vxlanDeviceAttrs{
 		vni:       uint32(cfg.VNI),
 		name:      fmt.Sprintf("flannel.%v", cfg.VNI),
 		vtepIndex: be.extIface.Iface.Index,
-		vtepAddr:  be.extIface.IfaceAddr,
+		vtepAddr:  vtepAddr,
 		vtepPort:  cfg.Port,
 		gbp:       cfg.GBP,
 		learning:  cfg.Learning,
+		mtu:       mtu,
+		misses:    cfg.MissHandling,
+	}
+	cp := loadCheckpoint(devAttrs.vni)
+	if cp != nil {
+		devAttrs.hwAddr = net.HardwareAddr(cp.MAC)
 	}
 
 	dev, err := newVXLANDevice(&devAttrs)
@@ -136,7 +165,7 @@ func (be *VXLANBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup,
 	}
 	dev.directRouting = cfg.DirectRouting
 
-	subnetAttrs, err := newSubnetAttrs(be.extIface.ExtAddr, dev.MACAddr())
+	subnetAttrs, err := newSubnetAttrs(be.extIface.ExtAddr, be.extIface.ExtV6Addr, dev.MACAddr())
 	if err != nil {
 		return nil, err
 	}
@@ -147,17 +176,25 @@ func (be *VXLANBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup,
 	case context.Canceled, context.DeadlineExceeded:
 		return nil, err
 	default:
-		return nil, fmt.Errorf("failed to acquire lease: %v", err)
+		return nil, fmt.Errorf("failed to acquire lease: %w", err)
 	}
 
 	// Ensure that the device has a /32 address so that no broadcast routes are created.
 	// This IP is just used as a source address for host to workload traffic (so
 	// the return path for the traffic has an address on the flannel network to use as the destination)
 	if err := dev.Configure(ip.IP4Net{IP: lease.Subnet.IP, PrefixLen: 32}); err != nil {
-		return nil, fmt.Errorf("failed to configure interface %s: %s", dev.link.Attrs().Name, err)
+		return nil, fmt.Errorf("failed to configure interface %s: %w", dev.link.Attrs().Name, err)
 	}
 
-	return newNetwork(be.subnetMgr, be.extIface, dev, ip.IP4Net{}, lease)
+	nw, err := newNetwork(be.subnetMgr, be.extIface, dev, ip.IP4Net{}, lease)
+	if err != nil {
+		return nil, err
+	}
+	nw.outerIPv6 = cfg.OuterIPv6
+	if cp != nil {
+		nw.restoredPeers = cp.peers(lease.Subnet)
+	}
+	return nw, nil
 }
 
 // So we can make it JSON (un)marshalable
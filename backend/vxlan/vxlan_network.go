@@ -16,9 +16,12 @@
 package vxlan
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	log "github.com/golang/glog"
 	"github.com/vishvananda/netlink"
@@ -27,19 +30,41 @@ import (
 	"syscall"
 
 	"github.com/coreos/flannel/backend"
+	"github.com/coreos/flannel/pkg/audit"
+	"github.com/coreos/flannel/pkg/dataplane"
 	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/negcache"
 	"github.com/coreos/flannel/subnet"
 )
 
 type network struct {
 	backend.SimpleNetwork
-	dev       *vxlanDevice
+	dev     *vxlanDevice
+	devName string
+	// nl is the netlink client of the device, which stays the same when Run recreates it
+	nl        dataplane.Netlink
 	subnetMgr subnet.Manager
+	// outerIPv6 tunnels to the public IPv6 addresses of the peers
+	outerIPv6 bool
+	peers     *backend.PeerQuarantine
+	routes    *backend.RouteController
+	// leases of all peers, to reprogram them after the device has been recreated
+	leases map[ip.IP4Net]subnet.Lease
+	// restoredPeers are the peers of the checkpoint, programmed by the previous flanneld
+	restoredPeers   []subnet.Lease
+	extIfaceUpdates chan extIfaceUpdate
+	// unknownMisses holds the misses for which there is no lease, so that the
+	// lease table isn't searched again for each packet sent to them
+	unknownMisses *negcache.Cache
+	// checkpointDirty is set when the peers changed since the checkpoint was saved
+	checkpointDirty bool
+	checkpointSaved time.Time
 }
 
-const (
-	encapOverhead = 50
-)
+type extIfaceUpdate struct {
+	ei     *backend.ExternalInterface
+	result chan error
+}
 
 func newNetwork(subnetMgr subnet.Manager, extIface *backend.ExternalInterface, dev *vxlanDevice, _ ip.IP4Net, lease *subnet.Lease) (*network, error) {
 	nw := &network{
@@ -49,6 +74,14 @@ func newNetwork(subnetMgr subnet.Manager, extIface *backend.ExternalInterface, d
 		},
 		subnetMgr: subnetMgr,
 		dev:       dev,
+		devName:   dev.attrs.name,
+		nl:        dev.nl,
+		peers:     backend.NewPeerQuarantine(),
+		routes:    backend.NewRouteController(dev.nl),
+
+		leases:          make(map[ip.IP4Net]subnet.Lease),
+		extIfaceUpdates: make(chan extIfaceUpdate),
+		unknownMisses:   negcache.New(time.Second, time.Minute),
 	}
 
 	return nw, nil
@@ -57,142 +90,538 @@ func newNetwork(subnetMgr subnet.Manager, extIface *backend.ExternalInterface, d
 func (nw *network) Run(ctx context.Context) {
 	wg := sync.WaitGroup{}
 
+	// Take over the peers of the previous flanneld, so that the first snapshot of the
+	// leases only brings the changes since
+	if len(nw.restoredPeers) > 0 {
+		log.V(0).Infof("taking over %d peers from the checkpoint", len(nw.restoredPeers))
+		nw.addSubnets(nw.restoredPeers)
+	}
+	known := make([]subnet.Lease, 0, len(nw.leases))
+	for _, l := range nw.leases {
+		known = append(known, l)
+	}
+	nw.saveCheckpoint()
+
 	log.V(0).Info("watching for new subnet leases")
 	events := make(chan []subnet.Event)
 	wg.Add(1)
 	go func() {
-		subnet.WatchLeases(ctx, nw.subnetMgr, nw.SubnetLease, events)
+		subnet.WatchLeasesFrom(ctx, nw.subnetMgr, nw.SubnetLease, known, events)
 		log.V(1).Info("WatchLeases exited")
 		wg.Done()
 	}()
 
+	wg.Add(1)
+	go func() {
+		nw.routes.Run(ctx)
+		wg.Done()
+	}()
+
+	misses := make(chan netlink.Neigh, 100)
+	if nw.dev.attrs.misses {
+		log.V(0).Info("watching for L2/L3 misses")
+		wg.Add(1)
+		go func() {
+			nw.monitorMisses(ctx, misses)
+			wg.Done()
+		}()
+	}
+
 	defer wg.Wait()
 
+	retry := time.NewTicker(backend.PeerRetryInterval)
+	defer retry.Stop()
+
 	for {
 		select {
 		case evtBatch := <-events:
 			nw.handleSubnetEvents(evtBatch)
+			nw.checkpointDirty = true
+			nw.maybeSaveCheckpoint()
+
+		case <-retry.C:
+			nw.retryFailedPeers()
+			nw.maybeSaveCheckpoint()
+
+		case u := <-nw.extIfaceUpdates:
+			u.result <- nw.updateExternalInterface(ctx, u.ei)
+
+		case miss := <-misses:
+			nw.handleMiss(miss)
 
 		case <-ctx.Done():
+			if nw.checkpointDirty {
+				nw.saveCheckpoint()
+			}
 			return
 		}
 	}
 }
 
+func (nw *network) monitorMisses(ctx context.Context, misses chan<- netlink.Neigh) {
+	for {
+		err := subscribeMisses(ctx, misses)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Errorf("Watching for L2/L3 misses failed, retrying: %v", err)
+
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleMiss programs the FDB or ARP entry the kernel is missing from the lease table.
+// This restores entries that were removed behind flannel's back.
+func (nw *network) handleMiss(miss netlink.Neigh) {
+	if miss.LinkIndex != nw.dev.link.Attrs().Index {
+		return
+	}
+
+	switch {
+	case len(miss.IP) == 0 && len(miss.HardwareAddr) > 0:
+		key := "L2 " + miss.HardwareAddr.String()
+		if nw.unknownMisses.Missing(key) {
+			return
+		}
+		for _, l := range nw.leases {
+			mac, ok := leaseVtepMAC(&l)
+			if !ok || !bytes.Equal(mac, miss.HardwareAddr) {
+				continue
+			}
+			dst := nw.vtepDst(&l.Attrs)
+			if dst == nil {
+				return
+			}
+			log.V(2).Infof("L2 miss: %v, adding FDB entry via %v", mac, dst)
+			if err := nw.dev.AddFDB(fdbEntry{Dst: dst, MAC: mac}); err != nil {
+				log.Error("AddFDB failed: ", err)
+			}
+			return
+		}
+		log.V(2).Infof("L2 miss: no lease with VTEP MAC %v", miss.HardwareAddr)
+		nw.unknownMisses.Miss(key)
+
+	case len(miss.IP) > 0 && len(miss.HardwareAddr) == 0:
+		if miss.IP.To4() == nil {
+			return
+		}
+		key := "L3 " + miss.IP.String()
+		if nw.unknownMisses.Missing(key) {
+			return
+		}
+		addr := ip.FromIP(miss.IP)
+		for _, l := range nw.leases {
+			if !l.Subnet.Contains(addr) {
+				continue
+			}
+			mac, ok := leaseVtepMAC(&l)
+			if !ok {
+				return
+			}
+			log.V(2).Infof("L3 miss: %v, adding ARP entry with %v", miss.IP, mac)
+			if err := nw.dev.AddARP(neighbor{IP: addr, MAC: mac}); err != nil {
+				log.Error("AddARP failed: ", err)
+			}
+			return
+		}
+		log.V(2).Infof("L3 miss: no lease for %v", miss.IP)
+		nw.unknownMisses.Miss(key)
+	}
+}
+
+// vtepDst returns the outer destination of the frames to the owner of attrs, nil if it has
+// no address of the family of the tunnels.
+func (nw *network) vtepDst(attrs *subnet.LeaseAttrs) net.IP {
+	if nw.outerIPv6 {
+		return attrs.PublicIPv6
+	}
+	return attrs.PublicIP.ToIP()
+}
+
+func leaseVtepMAC(l *subnet.Lease) (net.HardwareAddr, bool) {
+	var vxlanAttrs vxlanLeaseAttrs
+	data, ok := l.Attrs.BackendDataFor("vxlan")
+	if !ok {
+		return nil, false
+	}
+	if err := json.Unmarshal(data, &vxlanAttrs); err != nil {
+		return nil, false
+	}
+	return net.HardwareAddr(vxlanAttrs.VtepMAC), true
+}
+
+func (nw *network) retryFailedPeers() {
+	var batch []subnet.Event
+	for _, l := range nw.peers.Due() {
+		batch = append(batch, subnet.Event{Type: subnet.EventAdded, Lease: l})
+	}
+	if len(batch) > 0 {
+		nw.handleSubnetEvents(batch)
+	}
+}
+
+// UpdateExternalInterface moves the VXLAN device over to a new address of the external interface.
+func (nw *network) UpdateExternalInterface(ctx context.Context, ei *backend.ExternalInterface) error {
+	u := extIfaceUpdate{ei: ei, result: make(chan error, 1)}
+	select {
+	case nw.extIfaceUpdates <- u:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-u.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (nw *network) updateExternalInterface(ctx context.Context, ei *backend.ExternalInterface) error {
+	devAttrs := nw.dev.attrs
+	devAttrs.vtepIndex = ei.Iface.Index
+	devAttrs.vtepAddr = ei.IfaceAddr
+	if nw.outerIPv6 {
+		devAttrs.vtepAddr = ei.IfaceV6Addr
+	}
+
+	// The source address of an existing device can't be changed, so this recreates it.
+	dev, err := newVXLANDevice(&devAttrs)
+	if err != nil {
+		return err
+	}
+	dev.directRouting = nw.dev.directRouting
+	dev.nl = nw.nl
+
+	if err := dev.Configure(ip.IP4Net{IP: nw.SubnetLease.Subnet.IP, PrefixLen: 32}); err != nil {
+		return fmt.Errorf("failed to configure interface %s: %w", dev.link.Attrs().Name, err)
+	}
+
+	subnetAttrs, err := newSubnetAttrs(ei.ExtAddr, ei.ExtV6Addr, dev.MACAddr())
+	if err != nil {
+		return err
+	}
+	lease := *nw.SubnetLease
+	lease.Attrs = *subnetAttrs
+	if err := nw.subnetMgr.RenewLease(ctx, &lease); err != nil {
+		return fmt.Errorf("failed to publish public IP %v and VTEP MAC %v: %w", ei.ExtAddr, dev.MACAddr(), err)
+	}
+
+	*nw.SubnetLease = lease
+	nw.dev = dev
+	nw.ExtIface = ei
+	log.Infof("Moved %s over to %v, public IP %v", dev.link.Attrs().Name, ei.IfaceAddr, ei.ExtAddr)
+
+	// The routes, ARP and FDB entries of all peers went away with the old device
+	batch := make([]subnet.Event, 0, len(nw.leases))
+	for _, l := range nw.leases {
+		batch = append(batch, subnet.Event{Type: subnet.EventAdded, Lease: l})
+	}
+	nw.handleSubnetEvents(batch)
+	return nil
+}
+
 func (nw *network) MTU() int {
-	return nw.ExtIface.Iface.MTU - encapOverhead
+	return nw.dev.link.MTU
 }
 
 type vxlanLeaseAttrs struct {
 	VtepMAC hardwareAddr
 }
 
+// peerUpdate is the state of an added lease while its ARP, FDB and route entries are programmed.
+type peerUpdate struct {
+	lease   subnet.Lease
+	vtepMAC net.HardwareAddr
+	direct  bool
+	err     error
+}
+
 func (nw *network) handleSubnetEvents(batch []subnet.Event) {
+	// Consecutive added leases don't depend on each other, so they are programmed together.
+	var added []subnet.Lease
 	for _, event := range batch {
-		sn := event.Lease.Subnet
-		attrs := event.Lease.Attrs
-		if attrs.BackendType != "vxlan" {
+		switch event.Type {
+		case subnet.EventAdded:
+			added = append(added, event.Lease)
+		case subnet.EventRemoved:
+			nw.addSubnets(added)
+			added = nil
+			nw.removeSubnet(event.Lease)
+		default:
+			log.Error("internal error: unknown event type: ", int(event.Type))
+		}
+	}
+	nw.addSubnets(added)
+}
+
+// addSubnets programs the leases in phases: first the ARP and FDB entries of all peers, then
+// their routes, as the kernel would ARP for the gateway of a vxlan route whose ARP entry isn't
+// there yet. Within a phase, large batches like the initial snapshot are applied in parallel.
+func (nw *network) addSubnets(leases []subnet.Lease) {
+	var peers []*peerUpdate
+	index := make(map[ip.IP4Net]int)
+	for _, lease := range leases {
+		sn := lease.Subnet
+		attrs := lease.Attrs
+		data, ok := attrs.BackendDataFor("vxlan")
+		if !ok {
 			log.Warningf("ignoring non-vxlan subnet(%s): type=%v", sn, attrs.BackendType)
 			continue
 		}
 
 		var vxlanAttrs vxlanLeaseAttrs
-		if err := json.Unmarshal(attrs.BackendData, &vxlanAttrs); err != nil {
-			log.Error("error decoding subnet lease JSON: ", err)
+		if err := json.Unmarshal(data, &vxlanAttrs); err != nil {
+			l := lease
+			nw.peers.Failed(&l, fmt.Errorf("error decoding subnet lease JSON: %v", err))
 			continue
 		}
 
-		// This route is used when traffic should be vxlan encapsulated
-		vxlanRoute := netlink.Route{
-			LinkIndex: nw.dev.link.Attrs().Index,
-			Scope:     netlink.SCOPE_UNIVERSE,
-			Dst:       sn.ToIPNet(),
-			Gw:        sn.IP.ToIP(),
+		nw.leases[sn] = lease
+		p := &peerUpdate{lease: lease, vtepMAC: net.HardwareAddr(vxlanAttrs.VtepMAC)}
+		// Only the latest lease of a subnet is programmed
+		if i, ok := index[sn]; ok {
+			peers[i] = p
+		} else {
+			index[sn] = len(peers)
+			peers = append(peers, p)
 		}
-		vxlanRoute.SetFlag(syscall.RTNH_F_ONLINK)
+	}
 
-		// directRouting is where the remote host is on the same subnet so vxlan isn't required.
-		directRoute := netlink.Route{
-			Dst: sn.ToIPNet(),
-			Gw:  attrs.PublicIP.ToIP(),
+	if len(peers) > 0 {
+		// Misses for the new leases can be resolved now
+		nw.unknownMisses.Purge()
+	}
+
+	if len(peers) >= backend.ParallelBatchSize {
+		log.V(1).Infof("programming %d subnets in parallel", len(peers))
+	}
+	backend.ParallelApply(len(peers), func(i int) { nw.addNeighbors(peers[i]) })
+	backend.ParallelApply(len(peers), func(i int) { nw.addRoute(peers[i]) })
+
+	for _, p := range peers {
+		if p.err != nil {
+			nw.peers.Failed(&p.lease, p.err)
+		} else {
+			nw.peers.Succeeded(p.lease.Subnet)
 		}
-		var directRoutingOK = false
-		if nw.dev.directRouting {
-			if dr, err := ip.DirectRouting(attrs.PublicIP.ToIP()); err != nil {
-				log.Error(err)
-			} else {
-				directRoutingOK = dr
-			}
+	}
+}
+
+func (nw *network) addNeighbors(p *peerUpdate) {
+	sn := p.lease.Subnet
+	attrs := p.lease.Attrs
+	p.direct = nw.directRoutingOK(attrs.PublicIP)
+	if p.direct {
+		return
+	}
+
+	dst := nw.vtepDst(&attrs)
+	if dst == nil {
+		p.err = fmt.Errorf("peer %v has no public IPv6 address to tunnel to", attrs.PublicIP)
+		return
+	}
+
+	log.V(2).Infof("adding subnet: %s PublicIP: %s VtepMAC: %s", sn, dst, p.vtepMAC)
+	if err := nw.dev.AddARP(neighbor{IP: sn.IP, MAC: p.vtepMAC}); err != nil {
+		p.err = fmt.Errorf("AddARP failed: %v", err)
+		return
+	}
+
+	if err := nw.dev.AddFDB(fdbEntry{Dst: dst, MAC: p.vtepMAC}); err != nil {
+		p.err = fmt.Errorf("AddFDB failed: %v", err)
+
+		// Try to clean up the ARP entry
+		if err := nw.dev.DelARP(neighbor{IP: sn.IP, MAC: p.vtepMAC}); err != nil {
+			log.Error("DelARP failed: ", err)
+		}
+	}
+}
+
+func (nw *network) addRoute(p *peerUpdate) {
+	if p.err != nil {
+		return
+	}
+	sn := p.lease.Subnet
+	attrs := p.lease.Attrs
+
+	if p.direct {
+		log.V(2).Infof("Adding direct route to subnet: %s PublicIP: %s", sn, attrs.PublicIP)
+
+		directRoute := directRoute(&p.lease)
+		if err := nw.replaceRoute(&directRoute); err != nil {
+			p.err = fmt.Errorf("error adding route to %v via %v: %v", sn, attrs.PublicIP, err)
+			return
 		}
+		nw.routes.Add(directRoute)
+		return
+	}
 
-		switch event.Type {
-		case subnet.EventAdded:
-			if directRoutingOK {
-				log.V(2).Infof("Adding direct route to subnet: %s PublicIP: %s", sn, attrs.PublicIP)
-
-				if err := netlink.RouteReplace(&directRoute); err != nil {
-					log.Errorf("Error adding route to %v via %v: %v", sn, attrs.PublicIP, err)
-					continue
-				}
-			} else {
-				log.V(2).Infof("adding subnet: %s PublicIP: %s VtepMAC: %s", sn, attrs.PublicIP, net.HardwareAddr(vxlanAttrs.VtepMAC))
-				if err := nw.dev.AddARP(neighbor{IP: sn.IP, MAC: net.HardwareAddr(vxlanAttrs.VtepMAC)}); err != nil {
-					log.Error("AddARP failed: ", err)
-					continue
-				}
-
-				if err := nw.dev.AddFDB(neighbor{IP: attrs.PublicIP, MAC: net.HardwareAddr(vxlanAttrs.VtepMAC)}); err != nil {
-					log.Error("AddFDB failed: ", err)
-
-					// Try to clean up the ARP entry then continue
-					if err := nw.dev.DelARP(neighbor{IP: event.Lease.Subnet.IP, MAC: net.HardwareAddr(vxlanAttrs.VtepMAC)}); err != nil {
-						log.Error("DelARP failed: ", err)
-					}
-
-					continue
-				}
-
-				// Set the route - the kernel would ARP for the Gw IP address if it hadn't already been set above so make sure
-				// this is done last.
-				if err := netlink.RouteReplace(&vxlanRoute); err != nil {
-					log.Errorf("failed to add vxlanRoute (%s -> %s): %v", vxlanRoute.Dst, vxlanRoute.Gw, err)
-
-					// Try to clean up both the ARP and FDB entries then continue
-					if err := nw.dev.DelARP(neighbor{IP: event.Lease.Subnet.IP, MAC: net.HardwareAddr(vxlanAttrs.VtepMAC)}); err != nil {
-						log.Error("DelARP failed: ", err)
-					}
-
-					if err := nw.dev.DelFDB(neighbor{IP: event.Lease.Attrs.PublicIP, MAC: net.HardwareAddr(vxlanAttrs.VtepMAC)}); err != nil {
-						log.Error("DelFDB failed: ", err)
-					}
-
-					continue
-				}
+	vxlanRoute := nw.vxlanRoute(sn)
+	if err := nw.replaceRoute(&vxlanRoute); err != nil {
+		p.err = fmt.Errorf("failed to add vxlanRoute (%s -> %s): %v", vxlanRoute.Dst, vxlanRoute.Gw, err)
+
+		// Try to clean up both the ARP and FDB entries
+		if err := nw.dev.DelARP(neighbor{IP: sn.IP, MAC: p.vtepMAC}); err != nil {
+			log.Error("DelARP failed: ", err)
+		}
+
+		if err := nw.dev.DelFDB(fdbEntry{Dst: nw.vtepDst(&attrs), MAC: p.vtepMAC}); err != nil {
+			log.Error("DelFDB failed: ", err)
+		}
+		return
+	}
+	nw.routes.Add(vxlanRoute)
+}
+
+func (nw *network) removeSubnet(lease subnet.Lease) {
+	sn := lease.Subnet
+	attrs := lease.Attrs
+	data, ok := attrs.BackendDataFor("vxlan")
+	if !ok {
+		log.Warningf("ignoring non-vxlan subnet(%s): type=%v", sn, attrs.BackendType)
+		return
+	}
+
+	delete(nw.leases, sn)
+	nw.peers.Remove(sn)
+
+	var vxlanAttrs vxlanLeaseAttrs
+	if err := json.Unmarshal(data, &vxlanAttrs); err != nil {
+		log.Error("error decoding subnet lease JSON: ", err)
+		return
+	}
+
+	if nw.directRoutingOK(attrs.PublicIP) {
+		log.V(2).Infof("Removing direct route to subnet: %s PublicIP: %s", sn, attrs.PublicIP)
+		directRoute := directRoute(&lease)
+		nw.routes.Remove(directRoute)
+		if err := nw.deleteRoute(&directRoute); err != nil {
+			log.Errorf("Error deleting route to %v via %v: %v", sn, attrs.PublicIP, err)
+		}
+		return
+	}
+
+	log.V(2).Infof("removing subnet: %s PublicIP: %s VtepMAC: %s", sn, attrs.PublicIP, net.HardwareAddr(vxlanAttrs.VtepMAC))
+
+	// Try to remove all entries - don't bail out if one of them fails.
+	if err := nw.dev.DelARP(neighbor{IP: sn.IP, MAC: net.HardwareAddr(vxlanAttrs.VtepMAC)}); err != nil {
+		log.Error("DelARP failed: ", err)
+	}
+
+	if err := nw.dev.DelFDB(fdbEntry{Dst: nw.vtepDst(&attrs), MAC: net.HardwareAddr(vxlanAttrs.VtepMAC)}); err != nil {
+		log.Error("DelFDB failed: ", err)
+	}
+
+	vxlanRoute := nw.vxlanRoute(sn)
+	nw.routes.Remove(vxlanRoute)
+	if err := nw.deleteRoute(&vxlanRoute); err != nil {
+		log.Errorf("failed to delete vxlanRoute (%s -> %s): %v", vxlanRoute.Dst, vxlanRoute.Gw, err)
+	}
+}
+
+// directRoutingOK tells whether the peer is on the same subnet so vxlan isn't required.
+func (nw *network) directRoutingOK(publicIP ip.IP4) bool {
+	if !nw.dev.directRouting {
+		return false
+	}
+	dr, err := ip.DirectRouting(publicIP.ToIP())
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	return dr
+}
+
+// vxlanRoute returns the route used when traffic to sn should be vxlan encapsulated.
+func (nw *network) vxlanRoute(sn ip.IP4Net) netlink.Route {
+	route := netlink.Route{
+		LinkIndex: nw.dev.link.Attrs().Index,
+		Scope:     netlink.SCOPE_UNIVERSE,
+		Dst:       sn.ToIPNet(),
+		Gw:        sn.IP.ToIP(),
+	}
+	route.SetFlag(syscall.RTNH_F_ONLINK)
+	return route
+}
+
+func directRoute(lease *subnet.Lease) netlink.Route {
+	return netlink.Route{
+		Dst: lease.Subnet.ToIPNet(),
+		Gw:  lease.Attrs.PublicIP.ToIP(),
+	}
+}
+
+func (nw *network) replaceRoute(route *netlink.Route) error {
+	before := ""
+	if audit.Enabled() {
+		routes, err := nw.dev.nl.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: route.Dst}, netlink.RT_FILTER_DST)
+		if err == nil && len(routes) > 0 {
+			before = routes[0].String()
+		}
+	}
+	err := nw.dev.nl.RouteReplace(route)
+	audit.Log(audit.KindRoute, audit.ActionReplace, before, route.String(), err)
+	return err
+}
+
+// CleanUp deletes the direct routes to the peers and the vxlan device, which takes the
+// other routes, the ARP and the FDB entries with it.
+func (nw *network) CleanUp() error {
+	for _, route := range nw.routes.Routes() {
+		route := route
+		nw.routes.Remove(route)
+		if route.LinkIndex == nw.dev.link.Index {
+			continue
+		}
+		if err := nw.deleteRoute(&route); err != nil && err != syscall.ESRCH {
+			log.Errorf("Error deleting route to %v: %v", route.Dst, err)
+		}
+	}
+	if err := backend.RemoveCheckpoint(checkpointName); err != nil {
+		log.Warningf("failed to remove the vxlan checkpoint: %v", err)
+	}
+	return nw.dev.Destroy()
+}
+
+// DumpDataplane reports the routes, the FDB and ARP entries of the vxlan device and the
+// failing peers. The device is looked up by name, as Run recreates it when the external
+// interface changes.
+func (nw *network) DumpDataplane() (*backend.DataplaneDump, error) {
+	dump := &backend.DataplaneDump{
+		Routes:      backend.DumpRoutes(nw.routes.Routes()),
+		FailedPeers: nw.peers.Status(),
+	}
+
+	link, err := nw.nl.LinkByName(nw.devName)
+	if err != nil {
+		return nil, err
+	}
+	for _, family := range []int{syscall.AF_BRIDGE, netlink.FAMILY_V4} {
+		neighs, err := nw.nl.NeighList(link.Attrs().Index, family)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range neighs {
+			e := backend.NeighborEntry{Type: "arp", MAC: n.HardwareAddr.String()}
+			if family == syscall.AF_BRIDGE {
+				e.Type = "fdb"
 			}
-		case subnet.EventRemoved:
-			if directRoutingOK {
-				log.V(2).Infof("Removing direct route to subnet: %s PublicIP: %s", sn, attrs.PublicIP)
-				if err := netlink.RouteDel(&directRoute); err != nil {
-					log.Errorf("Error deleting route to %v via %v: %v", sn, attrs.PublicIP, err)
-				}
-			} else {
-				log.V(2).Infof("removing subnet: %s PublicIP: %s VtepMAC: %s", sn, attrs.PublicIP, net.HardwareAddr(vxlanAttrs.VtepMAC))
-
-				// Try to remove all entries - don't bail out if one of them fails.
-				if err := nw.dev.DelARP(neighbor{IP: sn.IP, MAC: net.HardwareAddr(vxlanAttrs.VtepMAC)}); err != nil {
-					log.Error("DelARP failed: ", err)
-				}
-
-				if err := nw.dev.DelFDB(neighbor{IP: attrs.PublicIP, MAC: net.HardwareAddr(vxlanAttrs.VtepMAC)}); err != nil {
-					log.Error("DelFDB failed: ", err)
-				}
-
-				if err := netlink.RouteDel(&vxlanRoute); err != nil {
-					log.Errorf("failed to delete vxlanRoute (%s -> %s): %v", vxlanRoute.Dst, vxlanRoute.Gw, err)
-				}
+			if n.IP != nil {
+				e.IP = n.IP.String()
 			}
-		default:
-			log.Error("internal error: unknown event type: ", int(event.Type))
+			dump.Neighbors = append(dump.Neighbors, e)
 		}
 	}
+	return dump, nil
+}
+
+func (nw *network) deleteRoute(route *netlink.Route) error {
+	err := nw.dev.nl.RouteDel(route)
+	audit.Log(audit.KindRoute, audit.ActionDelete, route.String(), "", err)
+	return err
 }
@@ -40,8 +40,19 @@ import (
 	"net"
 )
 
+// backendConfig is the Backend section of the network config.
+type backendConfig struct {
+	Name          string
+	MacPrefix     string
+	VNI           int
+	Port          int
+	GBP           bool
+	DirectRouting bool
+}
+
 func init() {
 	backend.Register("vxlan", New)
+	backend.RegisterConfig("vxlan", func() interface{} { return &backendConfig{} })
 }
 
 const (
@@ -63,7 +74,7 @@ func New(sm subnet.Manager, extIface *backend.ExternalInterface) (backend.Backen
 	return backend, nil
 }
 
-func newSubnetAttrs(publicIP net.IP, vnid uint16, mac net.HardwareAddr) (*subnet.LeaseAttrs, error) {
+func newSubnetAttrs(publicIP, publicIPv6 net.IP, vnid uint16, mac net.HardwareAddr) (*subnet.LeaseAttrs, error) {
 	var hardwareAddress hardwareAddr
 	if mac != nil {
 		hardwareAddress = hardwareAddr(mac)
@@ -79,6 +90,7 @@ func newSubnetAttrs(publicIP net.IP, vnid uint16, mac net.HardwareAddr) (*subnet
 
 	return &subnet.LeaseAttrs{
 		PublicIP:    ip.FromIP(publicIP),
+		PublicIPv6:  publicIPv6,
 		BackendType: "vxlan",
 		BackendData: json.RawMessage(data),
 	}, nil
@@ -86,14 +98,7 @@ func newSubnetAttrs(publicIP net.IP, vnid uint16, mac net.HardwareAddr) (*subnet
 
 func (be *VXLANBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup, config *subnet.Config) (backend.Network, error) {
 	// 1. Parse configuration
-	cfg := struct {
-		Name          string
-		MacPrefix     string
-		VNI           int
-		Port          int
-		GBP           bool
-		DirectRouting bool
-	}{
+	cfg := backendConfig{
 		VNI:       defaultVNI,
 		Port:      vxlanPort,
 		MacPrefix: "0E-2A",
@@ -131,7 +136,7 @@ func (be *VXLANBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup,
 		return nil, err
 	}
 
-	subnetAttrs, err := newSubnetAttrs(be.extIface.ExtAddr, uint16(cfg.VNI), nil)
+	subnetAttrs, err := newSubnetAttrs(be.extIface.ExtAddr, be.extIface.ExtV6Addr, uint16(cfg.VNI), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -142,7 +147,7 @@ func (be *VXLANBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup,
 	case context.Canceled, context.DeadlineExceeded:
 		return nil, err
 	default:
-		return nil, fmt.Errorf("failed to acquire lease: %v", err)
+		return nil, fmt.Errorf("failed to acquire lease: %w", err)
 	}
 
 	devAttrs := vxlanDeviceAttrs{
@@ -185,7 +190,7 @@ func (be *VXLANBackend) RegisterNetwork(ctx context.Context, wg *sync.WaitGroup,
 		return nil, fmt.Errorf("Cannot parse DR MAC %v: %+v", newDrMac, err)
 	}
 
-	subnetAttrs, err = newSubnetAttrs(be.extIface.ExtAddr, uint16(cfg.VNI), mac)
+	subnetAttrs, err = newSubnetAttrs(be.extIface.ExtAddr, be.extIface.ExtV6Addr, uint16(cfg.VNI), mac)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,204 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+// flannel-ipam is a CNI IPAM plugin that assigns the containers of a node addresses
+// from the subnet leased to the node, as read from the subnet file of flanneld.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/joho/godotenv"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/ipam"
+)
+
+const (
+	defaultSubnetFile = "/run/flannel/subnet.env"
+	defaultDataDir    = "/var/lib/cni/flannel-ipam"
+
+	// CNI error codes
+	errCodeIncompatibleVersion = 1
+	errCodeInvalidConfig       = 7
+	errCodeInternal            = 999
+)
+
+var supportedVersions = []string{"0.3.0", "0.3.1", "0.4.0"}
+
+type netConf struct {
+	CNIVersion string `json:"cniVersion"`
+	Name       string `json:"name"`
+	IPAM       struct {
+		SubnetFile string `json:"subnetFile"`
+		DataDir    string `json:"dataDir"`
+	} `json:"ipam"`
+}
+
+type ipConfig struct {
+	Version string `json:"version"`
+	Address string `json:"address"`
+	Gateway string `json:"gateway"`
+}
+
+type route struct {
+	Dst string `json:"dst"`
+}
+
+type result struct {
+	CNIVersion string     `json:"cniVersion"`
+	IPs        []ipConfig `json:"ips"`
+	Routes     []route    `json:"routes"`
+}
+
+type cniError struct {
+	CNIVersion string `json:"cniVersion"`
+	Code       int    `json:"code"`
+	Msg        string `json:"msg"`
+}
+
+func main() {
+	if err := run(); err != nil {
+		json.NewEncoder(os.Stdout).Encode(err)
+		os.Exit(1)
+	}
+}
+
+func run() *cniError {
+	cmd := os.Getenv("CNI_COMMAND")
+	if cmd == "VERSION" {
+		json.NewEncoder(os.Stdout).Encode(map[string]interface{}{
+			"cniVersion":        supportedVersions[len(supportedVersions)-1],
+			"supportedVersions": supportedVersions,
+		})
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return &cniError{Code: errCodeInternal, Msg: fmt.Sprintf("failed to read the network config: %v", err)}
+	}
+	var conf netConf
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return &cniError{Code: errCodeInvalidConfig, Msg: fmt.Sprintf("failed to parse the network config: %v", err)}
+	}
+	fail := func(code int, format string, args ...interface{}) *cniError {
+		return &cniError{CNIVersion: conf.CNIVersion, Code: code, Msg: fmt.Sprintf(format, args...)}
+	}
+	if !supported(conf.CNIVersion) {
+		return fail(errCodeIncompatibleVersion, "unsupported CNI version %q", conf.CNIVersion)
+	}
+	if conf.Name == "" {
+		return fail(errCodeInvalidConfig, "the network config has no name")
+	}
+	if conf.IPAM.SubnetFile == "" {
+		conf.IPAM.SubnetFile = defaultSubnetFile
+	}
+	if conf.IPAM.DataDir == "" {
+		conf.IPAM.DataDir = defaultDataDir
+	}
+
+	containerID := os.Getenv("CNI_CONTAINERID")
+	if containerID == "" {
+		return fail(errCodeInvalidConfig, "CNI_CONTAINERID is not set")
+	}
+	owner := containerID + "/" + os.Getenv("CNI_IFNAME")
+
+	env, err := godotenv.Read(conf.IPAM.SubnetFile)
+	if err != nil {
+		return fail(errCodeInternal, "failed to read the subnet file: %v", err)
+	}
+	var network, subnet ip.IP4Net
+	if err := network.UnmarshalJSON([]byte(env["FLANNEL_NETWORK"])); err != nil {
+		return fail(errCodeInternal, "invalid FLANNEL_NETWORK in %s: %v", conf.IPAM.SubnetFile, err)
+	}
+	if err := subnet.UnmarshalJSON([]byte(env["FLANNEL_SUBNET"])); err != nil {
+		return fail(errCodeInternal, "invalid FLANNEL_SUBNET in %s: %v", conf.IPAM.SubnetFile, err)
+	}
+
+	// Plugins run concurrently for different containers, so the allocations are
+	// serialized with a lock next to the state file
+	path := filepath.Join(conf.IPAM.DataDir, conf.Name+".json")
+	unlock, err := lock(path + ".lock")
+	if err != nil {
+		return fail(errCodeInternal, "failed to lock %s: %v", path, err)
+	}
+	defer unlock()
+
+	a, err := ipam.New(subnet, path)
+	if err != nil {
+		return fail(errCodeInternal, "%v", err)
+	}
+
+	switch cmd {
+	case "ADD":
+		addr, err := a.Allocate(owner)
+		if err != nil {
+			return fail(errCodeInternal, "failed to allocate an address for %s: %v", owner, err)
+		}
+		json.NewEncoder(os.Stdout).Encode(result{
+			CNIVersion: conf.CNIVersion,
+			IPs: []ipConfig{{
+				Version: "4",
+				Address: ip.IP4Net{IP: addr, PrefixLen: subnet.PrefixLen}.String(),
+				Gateway: a.Gateway().String(),
+			}},
+			Routes: []route{{Dst: network.String()}},
+		})
+
+	case "DEL":
+		if err := a.Release(owner); err != nil {
+			return fail(errCodeInternal, "failed to release the address of %s: %v", owner, err)
+		}
+
+	case "CHECK":
+		if _, ok := a.Lookup(owner); !ok {
+			return fail(errCodeInternal, "%s has no address", owner)
+		}
+
+	default:
+		return fail(errCodeInvalidConfig, "unknown CNI_COMMAND %q", cmd)
+	}
+	return nil
+}
+
+func supported(version string) bool {
+	for _, v := range supportedVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+func lock(path string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// flannelctl is a command line tool to operate a flannel network.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/coreos/flannel/subnet/etcdv2"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"migrate": {"migrate [options]: copy the network config and the leases from one datastore to another, keeping the subnets of the nodes", runMigrate},
+	"perf":    {"perf [options] <peer-subnet>: measure the latency and throughput to a peer over the overlay and directly", runPerf},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [options] [args]\n\nCommands:\n", os.Args[0])
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	os.Exit(2)
+}
+
+func main() {
+	// Quiet the glog warnings of the flannel packages about unparsed flags
+	flag.CommandLine.Parse(nil)
+
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// etcdFlags are the options to reach the etcd datastore, named like the ones of flanneld
+// after prefix, so that a command can take the options of two datastores.
+type etcdFlags struct {
+	endpoints string
+	cfg       etcdv2.EtcdConfig
+}
+
+func addEtcdFlags(fs *flag.FlagSet, prefix string) *etcdFlags {
+	f := &etcdFlags{}
+	fs.StringVar(&f.endpoints, prefix+"etcd-endpoints", "http://127.0.0.1:4001,http://127.0.0.1:2379", "a comma-delimited list of etcd endpoints")
+	fs.StringVar(&f.cfg.DiscoverySRV, prefix+"etcd-discovery-srv", "", "domain whose SRV records list the etcd endpoints (overrides etcd-endpoints)")
+	fs.StringVar(&f.cfg.Prefix, prefix+"etcd-prefix", "/coreos.com/network", "etcd prefix")
+	fs.StringVar(&f.cfg.Keyfile, prefix+"etcd-keyfile", "", "SSL key file used to secure etcd communication")
+	fs.StringVar(&f.cfg.Certfile, prefix+"etcd-certfile", "", "SSL certification file used to secure etcd communication")
+	fs.StringVar(&f.cfg.CAFile, prefix+"etcd-cafile", "", "SSL Certificate Authority file used to secure etcd communication")
+	fs.StringVar(&f.cfg.Username, prefix+"etcd-username", "", "username for BasicAuth to etcd")
+	fs.StringVar(&f.cfg.Password, prefix+"etcd-password", "", "password for BasicAuth to etcd")
+	return f
+}
+
+func (f *etcdFlags) config() *etcdv2.EtcdConfig {
+	cfg := f.cfg
+	cfg.Endpoints = strings.Split(f.endpoints, ",")
+	return &cfg
+}
@@ -0,0 +1,121 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+	"github.com/coreos/flannel/subnet/etcdv2"
+	"github.com/coreos/flannel/subnet/kube"
+)
+
+// kubeFlags are the options to reach the Kubernetes API, named like the ones of flanneld.
+type kubeFlags struct {
+	apiUrl, kubeconfig, annotationPrefix, netConfPath string
+}
+
+func addKubeFlags(fs *flag.FlagSet) *kubeFlags {
+	f := &kubeFlags{}
+	fs.StringVar(&f.apiUrl, "kube-api-url", "", "Kubernetes API server URL")
+	fs.StringVar(&f.kubeconfig, "kubeconfig-file", "", "kubeconfig file location")
+	fs.StringVar(&f.annotationPrefix, "kube-annotation-prefix", "flannel.alpha.coreos.com", "Kubernetes annotation prefix")
+	fs.StringVar(&f.netConfPath, "net-config-path", "/etc/kube-flannel/net-conf.json", "path to the network configuration file of kube-subnet-mgr")
+	return f
+}
+
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := fs.String("from", "etcd", `datastore to read from, "etcd" or "kube"`)
+	to := fs.String("to", "kube", `datastore to write to, "etcd" or "kube"`)
+	fromEtcd := addEtcdFlags(fs, "")
+	toEtcd := addEtcdFlags(fs, "to-")
+	kubeOpts := addKubeFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "only report what would be migrated")
+	timeout := fs.Duration("timeout", 5*time.Minute, "how long the migration may take")
+	fs.Parse(args)
+
+	if *from == *to && *from != "etcd" {
+		return fmt.Errorf("--from and --to are both %q", *from)
+	}
+	src, err := leaseStore(*from, fromEtcd, kubeOpts)
+	if err != nil {
+		return fmt.Errorf("source: %v", err)
+	}
+	dst, err := leaseStore(*to, toEtcd, kubeOpts)
+	if err != nil {
+		return fmt.Errorf("destination: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	r, err := subnet.Migrate(ctx, src, dst, *dryRun)
+	if r != nil {
+		printMigration(r, *dryRun)
+	}
+	return err
+}
+
+func leaseStore(kind string, etcd *etcdFlags, k *kubeFlags) (subnet.LeaseStore, error) {
+	switch kind {
+	case "etcd":
+		sm, err := etcdv2.NewLocalManager(etcd.config(), ip.IP4Net{})
+		if err != nil {
+			return nil, err
+		}
+		return sm.(subnet.LeaseStore), nil
+	case "kube":
+		return kube.NewLeaseStore(k.apiUrl, k.kubeconfig, k.annotationPrefix, k.netConfPath)
+	default:
+		return nil, fmt.Errorf("unknown datastore %q, must be \"etcd\" or \"kube\"", kind)
+	}
+}
+
+func printMigration(r *subnet.MigrationReport, dryRun bool) {
+	verb := "Migrated"
+	if dryRun {
+		verb = "Would migrate"
+	}
+	if r.ConfigCopied {
+		fmt.Printf("%s the network config\n", verb)
+	}
+	for _, sn := range r.Imported {
+		fmt.Printf("%s %v\n", verb, sn)
+	}
+	for _, sn := range r.Unchanged {
+		fmt.Printf("Already migrated %v\n", sn)
+	}
+	for _, sn := range r.Skipped {
+		fmt.Printf("Skipped expired %v\n", sn)
+	}
+
+	var failed []ip.IP4Net
+	for sn := range r.Failed {
+		failed = append(failed, sn)
+	}
+	sort.Slice(failed, func(i, j int) bool {
+		return failed[i].IP < failed[j].IP
+	})
+	for _, sn := range failed {
+		fmt.Printf("Failed %v: %v\n", sn, r.Failed[sn])
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/perf"
+	"github.com/coreos/flannel/subnet/etcdv2"
+)
+
+func runPerf(args []string) error {
+	fs := flag.NewFlagSet("perf", flag.ExitOnError)
+	etcd := addEtcdFlags(fs, "")
+	peerIP := fs.String("peer-ip", "", "public IP of the peer, instead of looking it up in its lease (needed with the Kubernetes subnet manager)")
+	healthzPort := fs.Int("healthz-port", 0, "healthz port of the peer flanneld, which needs to run with --debug-perf")
+	duration := fs.Duration("duration", 5*time.Second, "how long to send data for, in each test")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("expected the subnet of the peer, e.g. 10.5.72.0/24")
+	}
+	if *healthzPort == 0 {
+		return errors.New("--healthz-port is required")
+	}
+	_, sn, err := net.ParseCIDR(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	peer := ip.FromIPNet(sn)
+
+	publicIP := net.ParseIP(*peerIP)
+	if publicIP == nil {
+		if *peerIP != "" {
+			return fmt.Errorf("invalid peer IP %q", *peerIP)
+		}
+		if publicIP, err = lookupPublicIP(etcd.config(), peer); err != nil {
+			return err
+		}
+	}
+
+	target, err := startPerfServer(publicIP, *healthzPort)
+	if err != nil {
+		return err
+	}
+	if target.OverlayIP == nil {
+		return fmt.Errorf("peer %v has no address inside %v to test the overlay with", publicIP, peer)
+	}
+	port := strconv.Itoa(target.Port)
+
+	fmt.Printf("Testing peer %v at %v for %v each\n", peer, publicIP, *duration)
+	overlay, err := perf.Run(net.JoinHostPort(target.OverlayIP.String(), port), *duration)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("overlay  %-15v %v\n", target.OverlayIP, overlay)
+	underlay, err := perf.Run(net.JoinHostPort(publicIP.String(), port), *duration)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("underlay %-15v %v\n", publicIP, underlay)
+
+	if underlay.Throughput() > 0 {
+		fmt.Printf("Encapsulation overhead: %.1f%% throughput, %+v rtt\n",
+			100*(1-overlay.Throughput()/underlay.Throughput()), overlay.RTT-underlay.RTT)
+	}
+	return nil
+}
+
+// lookupPublicIP returns the public IP of the lease of sn.
+func lookupPublicIP(cfg *etcdv2.EtcdConfig, sn ip.IP4Net) (net.IP, error) {
+	sm, err := etcdv2.NewLocalManager(cfg, ip.IP4Net{})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	res, err := sm.WatchLeases(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list leases: %v", err)
+	}
+	for _, l := range res.Snapshot {
+		if l.Subnet.Equal(sn) {
+			return l.Attrs.PublicIP.ToIP(), nil
+		}
+	}
+	return nil, fmt.Errorf("no lease for %v", sn)
+}
+
+// startPerfServer asks the flanneld of the peer to start a performance test server.
+func startPerfServer(publicIP net.IP, healthzPort int) (*perf.Target, error) {
+	url := fmt.Sprintf("http://%s/debug/perf", net.JoinHostPort(publicIP.String(), strconv.Itoa(healthzPort)))
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s (is flanneld running with --debug-perf?)", url, resp.Status)
+	}
+	target := &perf.Target{}
+	if err := json.NewDecoder(resp.Body).Decode(target); err != nil {
+		return nil, fmt.Errorf("invalid response from %s: %v", url, err)
+	}
+	return target, nil
+}
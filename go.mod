@@ -32,7 +32,7 @@ require (
 	github.com/joho/godotenv v0.0.0-20161216230537-726cc8b906e3
 	github.com/jonboulle/clockwork v0.1.0
 	github.com/juju/errors v0.0.0-20170703010042-c7d06af17c68
-	github.com/juju/ratelimit v0.0.0-20151125201925-77ed1c8a0121 // indirect
+	github.com/juju/ratelimit v0.0.0-20151125201925-77ed1c8a0121
 	github.com/juju/testing v0.0.0-20200706033705-4c23f9c453cd // indirect
 	github.com/mailru/easyjson v0.0.0-20160728113105-d5b7844b561a // indirect
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
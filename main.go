@@ -15,25 +15,38 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
+	"text/template"
 
 	"github.com/coreos/pkg/flagutil"
 	log "github.com/golang/glog"
 	"golang.org/x/net/context"
 
 	"github.com/coreos/flannel/network"
+	"github.com/coreos/flannel/pkg/audit"
+	"github.com/coreos/flannel/pkg/bgp"
+	"github.com/coreos/flannel/pkg/dns"
+	"github.com/coreos/flannel/pkg/fileutil"
+	"github.com/coreos/flannel/pkg/hooks"
 	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/perf"
+	"github.com/coreos/flannel/pkg/preflight"
 	"github.com/coreos/flannel/subnet"
 	"github.com/coreos/flannel/subnet/etcdv2"
 	"github.com/coreos/flannel/subnet/kube"
@@ -44,6 +57,7 @@ import (
 	"github.com/joho/godotenv"
 
 	"sync"
+	"sync/atomic"
 
 	// Backends need to be imported for their init() to get executed and them to register
 	"github.com/coreos/flannel/backend"
@@ -52,9 +66,11 @@ import (
 	_ "github.com/coreos/flannel/backend/awsvpc"
 	_ "github.com/coreos/flannel/backend/extension"
 	_ "github.com/coreos/flannel/backend/gce"
+	_ "github.com/coreos/flannel/backend/gre"
 	_ "github.com/coreos/flannel/backend/hostgw"
 	_ "github.com/coreos/flannel/backend/ipip"
 	_ "github.com/coreos/flannel/backend/ipsec"
+	_ "github.com/coreos/flannel/backend/tcptls"
 	_ "github.com/coreos/flannel/backend/udp"
 	_ "github.com/coreos/flannel/backend/vxlan"
 	"github.com/coreos/go-systemd/daemon"
@@ -73,6 +89,7 @@ func (t *flagSlice) Set(val string) error {
 
 type CmdLineOpts struct {
 	etcdEndpoints          string
+	etcdDiscoverySRV       string
 	etcdPrefix             string
 	etcdKeyfile            string
 	etcdCertfile           string
@@ -81,24 +98,63 @@ type CmdLineOpts struct {
 	etcdPassword           string
 	help                   bool
 	version                bool
+	validateConfig         string
 	kubeSubnetMgr          bool
 	kubeApiUrl             string
 	kubeAnnotationPrefix   string
 	kubeConfigFile         string
 	iface                  flagSlice
 	ifaceRegex             flagSlice
+	ifaceCanReach          string
 	ipMasq                 bool
+	ip6Masq                bool
 	subnetFile             string
+	watchStateFile         string
+	checkpointDir          string
+	leaseLabels            string
+	nodeID                 string
+	adoptRoutes            bool
+	releaseLeaseOnExit     bool
+	cleanUpOnExit          bool
+	peerSelector           string
+	leaseBackendData       string
+	leaseCache             bool
+	reapLeases             bool
+	reapInterval           int
+	reapKubeNodes          bool
+	reapMax                int
 	subnetDir              string
 	publicIP               string
+	publicIPv6             string
 	subnetLeaseRenewMargin int
+	registryQPS            float64
+	registryBurst          int
+	registryRetries        int
 	healthzIP              string
 	healthzPort            int
+	adminPort              int
+	debugPerf              bool
+	preflightChecks        bool
 	charonExecutablePath   string
 	charonViciUri          string
 	iptablesResyncSeconds  int
 	iptablesForwardRules   bool
+	iptablesBackend        string
 	netConfPath            string
+	cniConfTemplate        string
+	cniConfFile            string
+	auditLog               string
+	dnsListen              string
+	dnsDomain              string
+	hostsFile              string
+	hostsFileFormat        string
+	onLeaseAdded           string
+	onLeaseRemoved         string
+	leaseHookTimeout       time.Duration
+	leaseHookStateFile     string
+	bgpPeers               string
+	bgpLocalAS             uint
+	bgpRouterID            string
 }
 
 var (
@@ -110,6 +166,7 @@ var (
 
 func init() {
 	flannelFlags.StringVar(&opts.etcdEndpoints, "etcd-endpoints", "http://127.0.0.1:4001,http://127.0.0.1:2379", "a comma-delimited list of etcd endpoints")
+	flannelFlags.StringVar(&opts.etcdDiscoverySRV, "etcd-discovery-srv", "", "domain whose SRV records list the etcd endpoints, overrides etcd-endpoints")
 	flannelFlags.StringVar(&opts.etcdPrefix, "etcd-prefix", "/coreos.com/network", "etcd prefix")
 	flannelFlags.StringVar(&opts.etcdKeyfile, "etcd-keyfile", "", "SSL key file used to secure etcd communication")
 	flannelFlags.StringVar(&opts.etcdCertfile, "etcd-certfile", "", "SSL certification file used to secure etcd communication")
@@ -118,20 +175,59 @@ func init() {
 	flannelFlags.StringVar(&opts.etcdPassword, "etcd-password", "", "password for BasicAuth to etcd")
 	flannelFlags.Var(&opts.iface, "iface", "interface to use (IP or name) for inter-host communication. Can be specified multiple times to check each option in order. Returns the first match found.")
 	flannelFlags.Var(&opts.ifaceRegex, "iface-regex", "regex expression to match the first interface to use (IP or name) for inter-host communication. Can be specified multiple times to check each regex in order. Returns the first match found. Regexes are checked after specific interfaces specified by the iface option have already been checked.")
+	flannelFlags.StringVar(&opts.ifaceCanReach, "iface-can-reach", "", "detect the interface to use (and its IP) from the route to this address. Only used if neither iface nor iface-regex are given.")
 	flannelFlags.StringVar(&opts.subnetFile, "subnet-file", "/run/flannel/subnet.env", "filename where env variables (subnet, MTU, ... ) will be written to")
+	flannelFlags.StringVar(&opts.watchStateFile, "watch-state-file", "", "filename where the etcd lease watch state is saved to, so that a restarted flanneld can resume the watch (disabled if empty)")
+	flannelFlags.StringVar(&opts.checkpointDir, "checkpoint-dir", "", "directory where backends save their devices and peers, so that a restarted flanneld can take them over without interrupting traffic (disabled if empty, only supported by vxlan)")
+	flannelFlags.StringVar(&opts.leaseLabels, "lease-labels", "", "labels published on the lease of this node, e.g. \"tier=web,zone=a\" (ignored with kube-subnet-mgr, which uses the node labels)")
+	flannelFlags.StringVar(&opts.nodeID, "node-id", "", "stable identifier of this node, e.g. its hostname, from which the hash SubnetAllocation derives its subnet (the public IP if empty, etcd only)")
+	flannelFlags.StringVar(&opts.peerSelector, "peer-selector", "", "label selector of the peers to build routes and tunnels to, e.g. \"tier=web\" (all peers if empty)")
+	flannelFlags.StringVar(&opts.leaseBackendData, "lease-backend-data", "", "JSON object of the data of additional backends run on this node keyed by backend type, published on the lease next to the data of the backend of flanneld, e.g. '{\"ipsec\":{}}'")
+	flannelFlags.BoolVar(&opts.leaseCache, "lease-cache", false, "keep the leases in memory from a single watch of the datastore, shared by the backend and the DNS server (always on with dns-listen, hosts-file or the lease hooks)")
+	flannelFlags.BoolVar(&opts.reapLeases, "reap-leases", false, "remove the leases that are past their expiration, by the node elected among the ones with this flag (etcd only)")
+	flannelFlags.IntVar(&opts.reapInterval, "reap-interval", 5, "how often to look for leases to reap, in minutes")
+	flannelFlags.BoolVar(&opts.reapKubeNodes, "reap-kube-nodes", false, "with reap-leases, also remove the leases whose public IP isn't the one of a Kubernetes node, contacting the API like kube-subnet-mgr; reservations are kept")
+	flannelFlags.IntVar(&opts.reapMax, "reap-max", subnet.DefaultMaxReaps, "how many leases to reap at most per interval, the others being left to the next one (0 for no limit)")
+	flannelFlags.BoolVar(&opts.adoptRoutes, "adopt-routes", false, "at startup, report the routes into the flannel network that don't belong to a lease as proposed reservations, and the conflicting ones (etcd only)")
+	flannelFlags.BoolVar(&opts.releaseLeaseOnExit, "release-lease-on-exit", false, "release the subnet lease when stopped by SIGTERM or SIGINT, instead of keeping it for the restarted flanneld (etcd only)")
+	flannelFlags.BoolVar(&opts.cleanUpOnExit, "clean-up-on-exit", false, "remove the routes, devices and iptables rules of flannel when stopped by SIGTERM or SIGINT, instead of keeping them for the restarted flanneld")
 	flannelFlags.StringVar(&opts.publicIP, "public-ip", "", "IP accessible by other nodes for inter-host communication")
-	flannelFlags.IntVar(&opts.subnetLeaseRenewMargin, "subnet-lease-renew-margin", 60, "subnet lease renewal margin, in minutes, ranging from 1 to 1439")
+	flannelFlags.StringVar(&opts.publicIPv6, "public-ipv6", "", "IPv6 address accessible by other nodes for inter-host communication")
+	flannelFlags.IntVar(&opts.subnetLeaseRenewMargin, "subnet-lease-renew-margin", 60, "subnet lease renewal margin, in minutes, at least 1 and less than the LeaseDuration of the config")
+	flannelFlags.Float64Var(&opts.registryQPS, "registry-qps", 5, "average number of operations per second on etcd or the Kubernetes API, shared by lease acquisition, renewal and watches (0 for no limit)")
+	flannelFlags.IntVar(&opts.registryBurst, "registry-burst", 10, "number of operations on etcd or the Kubernetes API allowed at once above registry-qps")
+	flannelFlags.IntVar(&opts.registryRetries, "registry-retries", subnet.DefaultRetryPolicy.Retries, "how many times a failed operation on etcd or the Kubernetes API is retried, with an exponential backoff, before giving up")
 	flannelFlags.BoolVar(&opts.ipMasq, "ip-masq", false, "setup IP masquerade rule for traffic destined outside of overlay network")
+	flannelFlags.BoolVar(&opts.ip6Masq, "ip6-masq", false, "setup ip6tables masquerade rule for traffic leaving the IPv6Network of the config")
 	flannelFlags.BoolVar(&opts.kubeSubnetMgr, "kube-subnet-mgr", false, "contact the Kubernetes API for subnet assignment instead of etcd.")
 	flannelFlags.StringVar(&opts.kubeApiUrl, "kube-api-url", "", "Kubernetes API server URL. Does not need to be specified if flannel is running in a pod.")
 	flannelFlags.StringVar(&opts.kubeAnnotationPrefix, "kube-annotation-prefix", "flannel.alpha.coreos.com", `Kubernetes annotation prefix. Can contain single slash "/", otherwise it will be appended at the end.`)
 	flannelFlags.StringVar(&opts.kubeConfigFile, "kubeconfig-file", "", "kubeconfig file location. Does not need to be specified if flannel is running in a pod.")
 	flannelFlags.BoolVar(&opts.version, "version", false, "print version and exit")
+	flannelFlags.StringVar(&opts.validateConfig, "validate-config", "", `strictly parse the network config in this file ("-" for stdin), print it with the defaults filled in and exit`)
 	flannelFlags.StringVar(&opts.healthzIP, "healthz-ip", "0.0.0.0", "the IP address for healthz server to listen")
 	flannelFlags.IntVar(&opts.healthzPort, "healthz-port", 0, "the port for healthz server to listen(0 to disable)")
+	flannelFlags.IntVar(&opts.adminPort, "admin-port", 0, "the port on 127.0.0.1 to serve pprof, /debug/leases and /debug/routes on (0 to disable)")
+	flannelFlags.BoolVar(&opts.preflightChecks, "preflight-checks", true, "check the kernel modules, devices and sysctls the backend needs before acquiring the lease, and exit if any is missing")
+	flannelFlags.BoolVar(&opts.debugPerf, "debug-perf", false, "serve /debug/perf on the healthz server, so that flannelctl perf can measure the overlay throughput to this node")
 	flannelFlags.IntVar(&opts.iptablesResyncSeconds, "iptables-resync", 5, "resync period for iptables rules, in seconds")
 	flannelFlags.BoolVar(&opts.iptablesForwardRules, "iptables-forward-rules", true, "add default accept rules to FORWARD chain in iptables")
+	flannelFlags.StringVar(&opts.iptablesBackend, "iptables-backend", "iptables", `tool used to manage masquerade and forward rules, either "iptables" or "nft"`)
 	flannelFlags.StringVar(&opts.netConfPath, "net-config-path", "/etc/kube-flannel/net-conf.json", "path to the network configuration file")
+	flannelFlags.StringVar(&opts.cniConfTemplate, "cni-conf-template", "", "path to a Go template of a CNI network configuration, rendered with the leased subnet after startup")
+	flannelFlags.StringVar(&opts.cniConfFile, "cni-conf-file", "/etc/cni/net.d/10-flannel.conflist", "filename where the rendered CNI network configuration will be written to")
+	flannelFlags.StringVar(&opts.dnsListen, "dns-listen", "", "UDP address (e.g. 127.0.0.1:5353) to serve DNS records of the node subnets on (empty to disable)")
+	flannelFlags.StringVar(&opts.dnsDomain, "dns-domain", dns.DefaultDomain, "domain of the DNS records served on dns-listen")
+	flannelFlags.StringVar(&opts.hostsFile, "hosts-file", "", "file to write the names of the node subnets and their public IPs to whenever the leases change (empty to disable)")
+	flannelFlags.StringVar(&opts.onLeaseAdded, "on-lease-added", "", "program to run with the details of the lease in environment variables whenever the lease of a peer is added or changed (empty to disable)")
+	flannelFlags.StringVar(&opts.onLeaseRemoved, "on-lease-removed", "", "program to run with the details of the lease in environment variables whenever the lease of a peer is removed (empty to disable)")
+	flannelFlags.DurationVar(&opts.leaseHookTimeout, "lease-hook-timeout", hooks.DefaultTimeout, "time after which programs run by on-lease-added and on-lease-removed are killed")
+	flannelFlags.StringVar(&opts.leaseHookStateFile, "lease-hook-state-file", "/run/flannel/lease-hooks.json", "filename where the leases the lease hooks ran for are saved to, so that a restarted flanneld doesn't run them again (disabled if empty)")
+	flannelFlags.StringVar(&opts.bgpPeers, "bgp-peers", "", "comma separated BGP peers to announce the subnet of this node to, as address=AS, e.g. \"10.0.0.1=64512\" (empty to disable)")
+	flannelFlags.UintVar(&opts.bgpLocalAS, "bgp-local-as", 0, "AS number of this node in the sessions to bgp-peers")
+	flannelFlags.StringVar(&opts.bgpRouterID, "bgp-router-id", "", "BGP router ID of this node (defaults to the public IP)")
+	flannelFlags.StringVar(&opts.hostsFileFormat, "hosts-file-format", dns.FormatHosts, `format of hosts-file: "hosts" or "dnsmasq"`)
+	flannelFlags.StringVar(&opts.auditLog, "audit-log", "", `file to append a record of every route, ARP, FDB and firewall change to, or "syslog" (empty to disable)`)
 
 	// glog will log to tmp files by default. override so all entries
 	// can flow into journald (if running under systemd)
@@ -161,23 +257,53 @@ func usage() {
 
 func newSubnetManager() (subnet.Manager, error) {
 	if opts.kubeSubnetMgr {
-		return kube.NewSubnetManager(opts.kubeApiUrl, opts.kubeConfigFile, opts.kubeAnnotationPrefix, opts.netConfPath)
+		sm, err := kube.NewSubnetManager(opts.kubeApiUrl, opts.kubeConfigFile, opts.kubeAnnotationPrefix, opts.netConfPath)
+		if err != nil {
+			return nil, err
+		}
+		rlm := newRateLimitedManager(sm, kube.IsRetriable)
+		// The lease watch of the kube subnet manager reads its node informer
+		rlm.UnlimitedWatches = true
+		return rlm, nil
 	}
 
 	cfg := &etcdv2.EtcdConfig{
-		Endpoints: strings.Split(opts.etcdEndpoints, ","),
-		Keyfile:   opts.etcdKeyfile,
-		Certfile:  opts.etcdCertfile,
-		CAFile:    opts.etcdCAFile,
-		Prefix:    opts.etcdPrefix,
-		Username:  opts.etcdUsername,
-		Password:  opts.etcdPassword,
+		Endpoints:    strings.Split(opts.etcdEndpoints, ","),
+		DiscoverySRV: opts.etcdDiscoverySRV,
+		Keyfile:      opts.etcdKeyfile,
+		Certfile:     opts.etcdCertfile,
+		CAFile:       opts.etcdCAFile,
+		Prefix:       opts.etcdPrefix,
+		Username:     opts.etcdUsername,
+		Password:     opts.etcdPassword,
+		NodeID:       opts.nodeID,
 	}
 
 	// Attempt to renew the lease for the subnet specified in the subnetFile
 	prevSubnet := ReadCIDRFromSubnetFile(opts.subnetFile, "FLANNEL_SUBNET")
 
-	return etcdv2.NewLocalManager(cfg, prevSubnet)
+	esm, err := etcdv2.NewLocalManager(cfg, prevSubnet)
+	if err != nil {
+		return nil, err
+	}
+	sm := subnet.Manager(newRateLimitedManager(esm, etcdv2.IsRetriable))
+	if opts.watchStateFile == "" {
+		return sm, nil
+	}
+	return subnet.NewWatchStateManager(sm, opts.watchStateFile, "etcd "+opts.etcdPrefix), nil
+}
+
+// newRateLimitedManager limits the rate of the operations of sm on the datastore and
+// retries the failed ones, and publishes the counts of both on /debug/vars.
+func newRateLimitedManager(sm subnet.Manager, transient func(error) bool) *subnet.RateLimitedManager {
+	policy := subnet.DefaultRetryPolicy
+	policy.Retries = opts.registryRetries
+	policy.Transient = transient
+	rlm := subnet.NewRateLimitedManager(sm, opts.registryQPS, opts.registryBurst, policy)
+	expvar.Publish("registry_operations", expvar.Func(func() interface{} {
+		return rlm.Stats()
+	}))
+	return rlm
 }
 
 func main() {
@@ -188,10 +314,28 @@ func main() {
 
 	flagutil.SetFlagsFromEnv(flannelFlags, "FLANNELD")
 
+	if opts.validateConfig != "" {
+		if err := printConfig(opts.validateConfig); err != nil {
+			fatal(exitConfigInvalid, err)
+		}
+		os.Exit(0)
+	}
+
 	// Validate flags
-	if opts.subnetLeaseRenewMargin >= 24*60 || opts.subnetLeaseRenewMargin <= 0 {
-		log.Error("Invalid subnet-lease-renew-margin option, out of acceptable range")
-		os.Exit(1)
+	if opts.subnetLeaseRenewMargin <= 0 {
+		fatal(exitConfigInvalid, errors.New("Invalid subnet-lease-renew-margin option, out of acceptable range"))
+	}
+
+	if opts.registryQPS < 0 || opts.registryBurst < 0 || opts.registryRetries < 0 {
+		fatal(exitConfigInvalid, errors.New("Invalid registry-qps, registry-burst or registry-retries option, must not be negative"))
+	}
+
+	if opts.iptablesBackend != "iptables" && opts.iptablesBackend != "nft" {
+		fatal(exitConfigInvalid, fmt.Errorf("Invalid iptables-backend option %q, must be either iptables or nft", opts.iptablesBackend))
+	}
+
+	if err := audit.Open(opts.auditLog); err != nil {
+		fatal(exitConfigInvalid, fmt.Errorf("Failed to open audit log %q: %w", opts.auditLog, err))
 	}
 
 	// Work out which interface to use
@@ -199,15 +343,18 @@ func main() {
 	var err error
 	// Check the default interface only if no interfaces are specified
 	if len(opts.iface) == 0 && len(opts.ifaceRegex) == 0 {
-		extIface, err = LookupExtIface(opts.publicIP, "")
+		if len(opts.ifaceCanReach) > 0 {
+			extIface, err = LookupExtIface("", "", opts.ifaceCanReach)
+		} else {
+			extIface, err = LookupExtIface(opts.publicIP, "", "")
+		}
 		if err != nil {
-			log.Error("Failed to find any valid interface to use: ", err)
-			os.Exit(1)
+			fatal(exitConfigInvalid, fmt.Errorf("Failed to find any valid interface to use: %w", err))
 		}
 	} else {
 		// Check explicitly specified interfaces
 		for _, iface := range opts.iface {
-			extIface, err = LookupExtIface(iface, "")
+			extIface, err = LookupExtIface(iface, "", "")
 			if err != nil {
 				log.Infof("Could not find valid interface matching %s: %s", iface, err)
 			}
@@ -220,7 +367,7 @@ func main() {
 		// Check interfaces that match any specified regexes
 		if extIface == nil {
 			for _, ifaceRegex := range opts.ifaceRegex {
-				extIface, err = LookupExtIface("", ifaceRegex)
+				extIface, err = LookupExtIface("", ifaceRegex, "")
 				if err != nil {
 					log.Infof("Could not find valid interface matching %s: %s", ifaceRegex, err)
 				}
@@ -233,17 +380,48 @@ func main() {
 
 		if extIface == nil {
 			// Exit if any of the specified interfaces do not match
-			log.Error("Failed to find interface to use that matches the interfaces and/or regexes provided")
-			os.Exit(1)
+			fatal(exitConfigInvalid, errors.New("Failed to find interface to use that matches the interfaces and/or regexes provided"))
 		}
 	}
 
 	sm, err := newSubnetManager()
 	if err != nil {
-		log.Error("Failed to create SubnetManager: ", err)
-		os.Exit(1)
+		fatal(exitDatastoreUnreachable, fmt.Errorf("Failed to create SubnetManager: %w", err))
 	}
 	log.Infof("Created subnet manager: %s", sm.Name())
+	wsm, _ := sm.(*subnet.WatchStateManager)
+	releaser, _ := sm.(subnet.LeaseReleaser)
+	// Route adoption needs all leases, not only the ones of the selected peers
+	allLeasesSM := sm
+	// The reaper needs the current leases of the datastore, not the saved watch state
+	reaperSM := sm
+	if wsm != nil {
+		reaperSM = wsm.Manager
+	}
+
+	if opts.leaseLabels != "" || opts.peerSelector != "" {
+		leaseLabels, err := subnet.ParseLabels(opts.leaseLabels)
+		if err != nil {
+			fatal(exitConfigInvalid, fmt.Errorf("Invalid lease labels %q: %w", opts.leaseLabels, err))
+		}
+		if sm, err = subnet.NewSelectorManager(sm, leaseLabels, opts.peerSelector); err != nil {
+			fatal(exitConfigInvalid, fmt.Errorf("Invalid peer selector %q: %w", opts.peerSelector, err))
+		}
+		log.Infof("Selecting peers matching %q", opts.peerSelector)
+	}
+
+	var leaseBackendData map[string]json.RawMessage
+	if opts.leaseBackendData != "" {
+		if leaseBackendData, err = subnet.ParseBackendDataByType(opts.leaseBackendData); err != nil {
+			fatal(exitConfigInvalid, fmt.Errorf("Invalid lease backend data %q: %w", opts.leaseBackendData, err))
+		}
+		for bt, data := range leaseBackendData {
+			if err := backend.ValidateBackendData(bt, data); err != nil {
+				fatal(exitConfigInvalid, fmt.Errorf("Invalid lease backend data: %w", err))
+			}
+		}
+		sm = subnet.NewBackendDataManager(sm, leaseBackendData)
+	}
 
 	// Register for SIGINT and SIGTERM
 	log.Info("Installing signal handlers")
@@ -258,15 +436,31 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	wg := sync.WaitGroup{}
 
+	signaled := false
 	wg.Add(1)
 	go func() {
-		shutdownHandler(ctx, sigs, cancel)
+		signaled = shutdownHandler(ctx, sigs, cancel)
 		wg.Done()
 	}()
 
+	// The DNS server, the hosts file and the lease hooks read the leases from the cache
+	var cache *subnet.LeaseCache
+	if opts.leaseCache || opts.dnsListen != "" || opts.hostsFile != "" || opts.onLeaseAdded != "" || opts.onLeaseRemoved != "" {
+		cache = subnet.NewLeaseCache(sm)
+		sm = cache
+		wg.Add(1)
+		go func() {
+			cache.Run(ctx)
+			wg.Done()
+		}()
+	}
+
+	// The healthz server has its own mux, so that the handlers other packages register on
+	// http.DefaultServeMux, like pprof, aren't served on the network
+	healthzMux := http.NewServeMux()
 	if opts.healthzPort > 0 {
 		// It's not super easy to shutdown the HTTP server so don't attempt to stop it cleanly
-		go mustRunHealthz()
+		go mustRunHealthz(healthzMux)
 	}
 
 	// Fetch the network config (i.e. what backend to use etc..).
@@ -275,43 +469,107 @@ func main() {
 		wg.Wait()
 		os.Exit(0)
 	}
+	if err != nil {
+		cancel()
+		wg.Wait()
+		fatal(exitDatastoreUnreachable, fmt.Errorf("Couldn't fetch network config: %w", err))
+	}
+
+	renewMargin := time.Duration(opts.subnetLeaseRenewMargin) * time.Minute
+	if !opts.kubeSubnetMgr && renewMargin >= config.LeaseTTL() {
+		cancel()
+		wg.Wait()
+		fatal(exitConfigInvalid, fmt.Errorf("Invalid subnet-lease-renew-margin option, %v is not shorter than the LeaseDuration %v", renewMargin, config.LeaseTTL()))
+	}
+	leaseDuration.Set(int64(config.LeaseTTL().Seconds()))
+
+	if _, ok := leaseBackendData[config.BackendType]; ok {
+		cancel()
+		wg.Wait()
+		fatal(exitConfigInvalid, fmt.Errorf("Invalid lease backend data, the data of the %s backend is published by flanneld", config.BackendType))
+	}
+
+	if opts.adoptRoutes {
+		reportRouteAdoption(ctx, allLeasesSM, config)
+	}
+
+	backend.CheckpointDir = opts.checkpointDir
 
 	// Create a backend manager then use it to create the backend and register the network with it.
 	bm := backend.NewManager(ctx, sm, extIface)
 	be, err := bm.GetBackend(config.BackendType)
 	if err != nil {
-		log.Errorf("Error fetching backend: %s", err)
 		cancel()
 		wg.Wait()
-		os.Exit(1)
+		fatal(exitConfigInvalid, fmt.Errorf("Error fetching backend: %w", err))
+	}
+
+	if opts.preflightChecks {
+		if err := runPreflight(config, extIface); err != nil {
+			cancel()
+			wg.Wait()
+			fatal(exitKernelUnsupported, err)
+		}
 	}
 
 	bn, err := be.RegisterNetwork(ctx, &wg, config)
 	if err != nil {
-		log.Errorf("Error registering network: %s", err)
 		cancel()
 		wg.Wait()
-		os.Exit(1)
+		fatal(registerNetworkExitCode(err), fmt.Errorf("Error registering network: %w", err))
 	}
 
-	// Set up ipMasq if needed
-	if opts.ipMasq {
-		if err = recycleIPTables(config.Network, bn.Lease()); err != nil {
-			log.Errorf("Failed to recycle IPTables rules, %v", err)
-			cancel()
-			wg.Wait()
-			os.Exit(1)
+	if opts.iptablesBackend == "nft" {
+		// nftables keeps all of flannel's rules in a single table that gets replaced atomically,
+		// so there are no stale rules from a previous network or subnet to recycle.
+		if opts.ipMasq || opts.iptablesForwardRules {
+			log.Infof("Setting up nftables rules (masquerade=%v, forward=%v)", opts.ipMasq, opts.iptablesForwardRules)
+			go network.SetupAndEnsureNFTables(network.NFTablesRuleset{
+				Network:    config.Network,
+				Subnet:     bn.Lease().Subnet,
+				Masquerade: opts.ipMasq,
+				Forward:    opts.iptablesForwardRules,
+			}, opts.iptablesResyncSeconds)
+		}
+	} else {
+		// Set up ipMasq if needed
+		if opts.ipMasq {
+			if err = recycleIPTables(config.Network, bn.Lease()); err != nil {
+				cancel()
+				wg.Wait()
+				fatal(exitError, fmt.Errorf("Failed to recycle IPTables rules, %w", err))
+			}
+			log.Infof("Setting up masking rules")
+			go network.SetupAndEnsureIPTables(network.MasqRules(config.Network, bn.Lease()), opts.iptablesResyncSeconds)
+		}
+
+		// Always enables forwarding rules. This is needed for Docker versions >1.13 (https://docs.docker.com/engine/userguide/networking/default_network/container-communication/#container-communication-between-hosts)
+		// In Docker 1.12 and earlier, the default FORWARD chain policy was ACCEPT.
+		// In Docker 1.13 and later, Docker sets the default policy of the FORWARD chain to DROP.
+		if opts.iptablesForwardRules {
+			log.Infof("Changing default FORWARD chain policy to ACCEPT")
+			go network.SetupAndEnsureIPTables(network.ForwardRules(config.Network.String()), opts.iptablesResyncSeconds)
 		}
-		log.Infof("Setting up masking rules")
-		go network.SetupAndEnsureIPTables(network.MasqRules(config.Network, bn.Lease()), opts.iptablesResyncSeconds)
 	}
 
-	// Always enables forwarding rules. This is needed for Docker versions >1.13 (https://docs.docker.com/engine/userguide/networking/default_network/container-communication/#container-communication-between-hosts)
-	// In Docker 1.12 and earlier, the default FORWARD chain policy was ACCEPT.
-	// In Docker 1.13 and later, Docker sets the default policy of the FORWARD chain to DROP.
-	if opts.iptablesForwardRules {
-		log.Infof("Changing default FORWARD chain policy to ACCEPT")
-		go network.SetupAndEnsureIPTables(network.ForwardRules(config.Network.String()), opts.iptablesResyncSeconds)
+	if config.IPv6Network != "" && (opts.ip6Masq || opts.iptablesForwardRules) {
+		if opts.iptablesBackend == "nft" {
+			log.Warning("Not setting up rules for the IPv6Network, only supported by the iptables backend")
+		} else {
+			if opts.ip6Masq {
+				log.Infof("Setting up IPv6 masking rules")
+				go network.SetupAndEnsureIP6Tables(network.MasqIP6Rules(config.IPv6Network), opts.iptablesResyncSeconds)
+			}
+			if opts.iptablesForwardRules {
+				go network.SetupAndEnsureIP6Tables(network.ForwardRules(config.IPv6Network), opts.iptablesResyncSeconds)
+			}
+		}
+	} else if opts.ip6Masq {
+		log.Warning("Not setting up IPv6 masking rules, the config has no IPv6Network")
+	}
+
+	if opts.debugPerf && opts.healthzPort > 0 {
+		healthzMux.HandleFunc("/debug/perf", perfHandler(bn.Lease().Subnet))
 	}
 
 	if err := WriteSubnetFile(opts.subnetFile, config.Network, opts.ipMasq, bn); err != nil {
@@ -321,6 +579,15 @@ func main() {
 		log.Infof("Wrote subnet file to %s", opts.subnetFile)
 	}
 
+	if opts.cniConfTemplate != "" {
+		if err := WriteCNIConfig(opts.cniConfTemplate, opts.cniConfFile, config.Network, opts.ipMasq, bn); err != nil {
+			// Continue, even though it failed.
+			log.Warningf("Failed to write CNI config: %s", err)
+		} else {
+			log.Infof("Wrote CNI config to %s", opts.cniConfFile)
+		}
+	}
+
 	// Start "Running" the backend network. This will block until the context is done so run in another goroutine.
 	log.Info("Running backend.")
 	wg.Add(1)
@@ -329,6 +596,99 @@ func main() {
 		wg.Done()
 	}()
 
+	if opts.adminPort > 0 {
+		wg.Add(1)
+		go func() {
+			runAdminServer(ctx, cache, bn)
+			wg.Done()
+		}()
+	}
+
+	if opts.reapLeases {
+		if r, err := newReaper(reaperSM, bn.Lease()); err != nil {
+			log.Errorf("Not reaping leases: %v", err)
+		} else {
+			log.Infof("Reaping leases every %d minutes", opts.reapInterval)
+			wg.Add(1)
+			go func() {
+				r.Run(ctx)
+				wg.Done()
+			}()
+		}
+	}
+
+	if opts.dnsListen != "" {
+		wg.Add(1)
+		go func() {
+			if err := dns.NewServer(opts.dnsDomain).Run(ctx, cache, bn.Lease(), opts.dnsListen); err != nil {
+				log.Errorf("DNS server failed: %v", err)
+			}
+			wg.Done()
+		}()
+	}
+
+	if opts.hostsFile != "" {
+		e, err := dns.NewHostsExporter(opts.hostsFile, opts.hostsFileFormat, opts.dnsDomain)
+		if err != nil {
+			log.Errorf("Not exporting the leases: %v", err)
+		} else {
+			wg.Add(1)
+			go func() {
+				e.Run(ctx, cache, bn.Lease())
+				wg.Done()
+			}()
+		}
+	}
+
+	if opts.onLeaseAdded != "" || opts.onLeaseRemoved != "" {
+		r := &hooks.Runner{
+			Added:     opts.onLeaseAdded,
+			Removed:   opts.onLeaseRemoved,
+			Timeout:   opts.leaseHookTimeout,
+			StatePath: opts.leaseHookStateFile,
+		}
+		wg.Add(1)
+		go func() {
+			r.Run(ctx, cache, bn.Lease())
+			wg.Done()
+		}()
+	}
+
+	// The BGP sessions outlive ctx, so that the subnet can be withdrawn before its lease
+	// is released on exit.
+	var speaker *bgp.Speaker
+	bgpCtx, stopBGP := context.WithCancel(context.Background())
+	bgpDone := make(chan struct{})
+	if opts.bgpPeers != "" {
+		if speaker, err = newBGPSpeaker(extIface); err != nil {
+			log.Errorf("Not announcing the subnet over BGP: %v", err)
+			speaker = nil
+		} else {
+			speaker.Announce(bn.Lease().Subnet)
+			go func() {
+				speaker.Run(bgpCtx)
+				close(bgpDone)
+			}()
+		}
+	}
+
+	// Follow address changes of the external interface with the backends that can. If that
+	// fails, exit so that flanneld gets restarted with the new address.
+	extIfaceErr := make(chan error, 1)
+	if _, ok := bn.(backend.ExternalInterfaceUpdater); ok {
+		wg.Add(1)
+		go func() {
+			if err := backend.WatchExternalInterface(ctx, extIface, bn); err != nil {
+				log.Errorf("External interface changed, shutting down: %v", err)
+				extIfaceErr <- fmt.Errorf("External interface changed: %w", err)
+				cancel()
+			}
+			wg.Done()
+		}()
+	} else {
+		log.Infof("The %s backend doesn't follow address changes of %s, restart flanneld after changing its address", config.BackendType, extIface.Iface.Name)
+	}
+
 	daemon.SdNotify(false, "READY=1")
 
 	// Kube subnet mgr doesn't lease the subnet for this node - it just uses the podCidr that's already assigned.
@@ -343,10 +703,84 @@ func main() {
 	log.Info("Waiting for all goroutines to exit")
 	// Block waiting for all the goroutines to finish.
 	wg.Wait()
+	if wsm != nil {
+		if err := wsm.Save(); err != nil {
+			log.Warningf("Failed to save watch state: %v", err)
+		}
+	}
+	if signaled {
+		cleanUpOnExit(config, bn, releaser, speaker)
+	}
+	stopBGP()
+	if speaker != nil {
+		<-bgpDone
+	}
+	select {
+	case err := <-extIfaceErr:
+		fatal(exitError, err)
+	default:
+	}
 	log.Info("Exiting cleanly...")
 	os.Exit(0)
 }
 
+// Exit codes of flanneld, so that wrappers can tell why it stopped.
+const (
+	exitError                = 1 // any fatal error without a more specific code
+	exitConfigInvalid        = 2
+	exitDatastoreUnreachable = 3
+	exitSubnetsExhausted     = 4
+	exitKernelUnsupported    = 5
+)
+
+var exitReasons = map[int]string{
+	exitError:                "error",
+	exitConfigInvalid:        "config-invalid",
+	exitDatastoreUnreachable: "datastore-unreachable",
+	exitSubnetsExhausted:     "subnets-exhausted",
+	exitKernelUnsupported:    "kernel-unsupported",
+}
+
+// fatalRecord is written to stderr as the last line of output before flanneld exits on a fatal error.
+type fatalRecord struct {
+	Time   time.Time `json:"time"`
+	Code   int       `json:"code"`
+	Reason string    `json:"reason"`
+	Error  string    `json:"error"`
+}
+
+// fatal logs err, writes a fatalRecord for it and exits with code.
+func fatal(code int, err error) {
+	log.Error(err)
+	log.Flush()
+
+	b, jerr := json.Marshal(fatalRecord{
+		Time:   time.Now(),
+		Code:   code,
+		Reason: exitReasons[code],
+		Error:  err.Error(),
+	})
+	if jerr == nil {
+		fmt.Fprintln(os.Stderr, string(b))
+	}
+	os.Exit(code)
+}
+
+// registerNetworkExitCode picks the exit code for an error registering the network.
+func registerNetworkExitCode(err error) int {
+	switch {
+	case errors.Is(err, subnet.ErrNoMoreSubnets):
+		return exitSubnetsExhausted
+	case errors.Is(err, subnet.ErrUnreachable):
+		return exitDatastoreUnreachable
+	case errors.Is(err, syscall.EOPNOTSUPP),
+		errors.Is(err, syscall.EPROTONOSUPPORT),
+		errors.Is(err, syscall.EAFNOSUPPORT):
+		return exitKernelUnsupported
+	}
+	return exitError
+}
+
 func recycleIPTables(nw ip.IP4Net, lease *subnet.Lease) error {
 	prevNetwork := ReadCIDRFromSubnetFile(opts.subnetFile, "FLANNEL_NETWORK")
 	prevSubnet := ReadCIDRFromSubnetFile(opts.subnetFile, "FLANNEL_SUBNET")
@@ -363,26 +797,150 @@ func recycleIPTables(nw ip.IP4Net, lease *subnet.Lease) error {
 	return nil
 }
 
-func shutdownHandler(ctx context.Context, sigs chan os.Signal, cancel context.CancelFunc) {
+// shutdownHandler returns whether the shutdown was caused by a signal.
+func shutdownHandler(ctx context.Context, sigs chan os.Signal, cancel context.CancelFunc) bool {
+	// Unregister to get default OS nuke behaviour in case we don't exit cleanly
+	defer signal.Stop(sigs)
+
 	// Wait for the context do be Done or for the signal to come in to shutdown.
 	select {
 	case <-ctx.Done():
 		log.Info("Stopping shutdownHandler...")
+		return false
 	case <-sigs:
 		// Call cancel on the context to close everything down.
 		cancel()
 		log.Info("shutdownHandler sent cancel signal...")
+		return true
 	}
+}
 
-	// Unregister to get default OS nuke behaviour in case we don't exit cleanly
-	signal.Stop(sigs)
+// newBGPSpeaker returns the speaker announcing the subnet of this node to --bgp-peers,
+// with the public IP as next hop.
+func newBGPSpeaker(extIface *backend.ExternalInterface) (*bgp.Speaker, error) {
+	peers, err := bgp.ParsePeers(opts.bgpPeers)
+	if err != nil {
+		return nil, err
+	}
+	if opts.bgpLocalAS == 0 || uint64(opts.bgpLocalAS) > math.MaxUint32 {
+		return nil, fmt.Errorf("--bgp-local-as must be set to a valid AS number")
+	}
+
+	routerID := extIface.ExtAddr
+	if opts.bgpRouterID != "" {
+		if routerID = net.ParseIP(opts.bgpRouterID); routerID == nil {
+			return nil, fmt.Errorf("invalid --bgp-router-id %q", opts.bgpRouterID)
+		}
+	}
+
+	return bgp.NewSpeaker(bgp.Config{
+		LocalAS:  uint32(opts.bgpLocalAS),
+		RouterID: routerID,
+		NextHop:  extIface.ExtAddr,
+		Peers:    peers,
+	})
+}
+
+// cleanUpOnExit undoes the setup of flanneld as far as asked for by --release-lease-on-exit
+// and --clean-up-on-exit. By default the lease, the routes and the devices are kept, so
+// that a restarted flanneld takes over without interrupting the traffic.
+func cleanUpOnExit(config *subnet.Config, bn backend.Network, releaser subnet.LeaseReleaser, speaker *bgp.Speaker) {
+	if opts.cleanUpOnExit {
+		if c, ok := bn.(backend.DataplaneCleaner); ok {
+			log.Info("Removing the routes and devices of the backend")
+			if err := c.CleanUp(); err != nil {
+				log.Errorf("Failed to remove the routes and devices of the backend: %v", err)
+			}
+		} else {
+			log.Warningf("The %s backend can't remove its routes and devices", config.BackendType)
+		}
+
+		var err error
+		if opts.iptablesBackend == "nft" {
+			if opts.ipMasq || opts.iptablesForwardRules {
+				err = network.DeleteNFTables()
+			}
+		} else {
+			if opts.ipMasq {
+				err = network.DeleteIPTables(network.MasqRules(config.Network, bn.Lease()))
+			}
+			if opts.iptablesForwardRules {
+				if ferr := network.DeleteIPTables(network.ForwardRules(config.Network.String())); err == nil {
+					err = ferr
+				}
+			}
+			if config.IPv6Network != "" {
+				if opts.ip6Masq {
+					if merr := network.DeleteIP6Tables(network.MasqIP6Rules(config.IPv6Network)); err == nil {
+						err = merr
+					}
+				}
+				if opts.iptablesForwardRules {
+					if ferr := network.DeleteIP6Tables(network.ForwardRules(config.IPv6Network)); err == nil {
+						err = ferr
+					}
+				}
+			}
+		}
+		if err != nil {
+			log.Errorf("Failed to remove the firewall rules: %v", err)
+		}
+	}
+
+	if opts.releaseLeaseOnExit {
+		switch {
+		case opts.kubeSubnetMgr:
+			log.Warning("Not releasing the subnet, it is the pod CIDR of the node")
+		case releaser == nil:
+			log.Warning("The subnet manager can't release the lease")
+		default:
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			sn := bn.Lease().Subnet
+			// Stop the BGP peers from routing the subnet here before another node can lease it
+			if speaker != nil {
+				if err := speaker.Withdraw(ctx, sn); err != nil {
+					log.Warningf("Failed to withdraw %v from the BGP peers: %v", sn, err)
+				}
+			}
+			if err := releaser.ReleaseLease(ctx, sn); err != nil {
+				log.Errorf("Failed to release the lease of %v: %v", sn, err)
+			} else {
+				log.Infof("Released the lease of %v", sn)
+			}
+		}
+	}
+}
+
+// newReaper returns the reaper of the leases of sm, elected by the public IP of the node.
+func newReaper(sm subnet.Manager, lease *subnet.Lease) (*subnet.Reaper, error) {
+	if opts.kubeSubnetMgr {
+		return nil, errors.New("the leases of kube-subnet-mgr are removed with their nodes")
+	}
+	r, err := subnet.NewReaper(sm, lease.Attrs.PublicIP)
+	if err != nil {
+		return nil, err
+	}
+	if opts.reapInterval > 0 {
+		r.Interval = time.Duration(opts.reapInterval) * time.Minute
+	}
+	r.MaxReaps = opts.reapMax
+	if opts.reapKubeNodes {
+		if r.LiveNodes, err = kube.NewNodeLister(opts.kubeApiUrl, opts.kubeConfigFile, opts.kubeAnnotationPrefix); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
 }
 
+// getConfig fetches the network config, retrying every second until it is found. It gives
+// up if the datastore stays unreachable through the retries of the subnet manager.
 func getConfig(ctx context.Context, sm subnet.Manager) (*subnet.Config, error) {
-	// Retry every second until it succeeds
 	for {
 		config, err := sm.GetNetworkConfig(ctx)
-		if err != nil {
+		if errors.Is(err, subnet.ErrUnreachable) {
+			return nil, err
+		} else if err != nil {
 			log.Errorf("Couldn't fetch network config: %s", err)
 		} else if config == nil {
 			log.Warningf("Couldn't find network config: %s", err)
@@ -399,6 +957,90 @@ func getConfig(ctx context.Context, sm subnet.Manager) (*subnet.Config, error) {
 	}
 }
 
+// reportRouteAdoption logs reservations that keep the existing routes into the network working,
+// e.g. when migrating from another networking solution, and the routes in the way of that.
+// Nothing is changed; the reservations are up to the administrator.
+func reportRouteAdoption(ctx context.Context, sm subnet.Manager, config *subnet.Config) {
+	if opts.kubeSubnetMgr {
+		log.Warning("Route adoption is only supported with etcd, the node subnets are assigned by Kubernetes")
+		return
+	}
+
+	routes, err := backend.ForeignRoutes(config.Network)
+	if err != nil {
+		log.Errorf("Failed to list routes to adopt: %v", err)
+		return
+	}
+	res, err := sm.WatchLeases(ctx, nil)
+	if err != nil {
+		log.Errorf("Failed to list leases for route adoption: %v", err)
+		return
+	}
+
+	plan := subnet.PlanAdoption(config, routes, res.Snapshot)
+	for _, l := range plan.Reservations {
+		log.Infof("Route adoption: reserve %v for %v with: etcdctl set %s/subnets/%s '{\"PublicIP\":\"%s\"}'",
+			l.Subnet, l.Attrs.PublicIP, opts.etcdPrefix, subnet.MakeSubnetKey(l.Subnet), l.Attrs.PublicIP)
+	}
+	for _, c := range plan.Conflicts {
+		log.Warningf("Route adoption conflict: %s", c)
+	}
+	log.Infof("Route adoption: %d reservations proposed, %d conflicts", len(plan.Reservations), len(plan.Conflicts))
+}
+
+// preflightResults are the results of the last preflight checks, served on /healthz/preflight.
+var preflightResults atomic.Value
+
+// runPreflight checks the kernel for the backend of config, logs what's missing and
+// returns an error if the backend can't work without it.
+func runPreflight(config *subnet.Config, extIface *backend.ExternalInterface) error {
+	popts := preflight.Options{
+		BackendType: config.BackendType,
+		IPv6:        config.IPv6Network != "",
+		ExtIface:    extIface.Iface.Name,
+	}
+	// Backends that can tunnel over IPv6 have the OuterIPv6 setting; broken settings are
+	// reported by the backend
+	var outer struct{ OuterIPv6 bool }
+	if json.Unmarshal(config.Backend, &outer) == nil {
+		popts.OuterIPv6 = outer.OuterIPv6
+	}
+	if iface, err := ip.GetDefaultGatewayInterface(); err == nil {
+		popts.DefaultIface = iface.Name
+	}
+
+	results := preflight.Run(popts)
+	preflightResults.Store(results)
+	for _, r := range results {
+		switch r.Status {
+		case preflight.StatusOK:
+			log.V(1).Infof("Preflight check %s passed", r.Check)
+		case preflight.StatusWarning:
+			log.Warningf("Preflight check %s: %s", r.Check, r.Message)
+		}
+	}
+	return preflight.Err(results)
+}
+
+// Lease metrics, served on /debug/vars of the healthz and admin servers
+var (
+	leaseDuration      = expvar.NewInt("lease_duration_seconds")
+	leaseRenewals      = expvar.NewInt("lease_renewals")
+	leaseRenewalErrors = expvar.NewInt("lease_renewal_errors")
+	leaseExpiration    atomic.Value
+)
+
+func init() {
+	expvar.Publish("lease_remaining_seconds", expvar.Func(func() interface{} {
+		exp, _ := leaseExpiration.Load().(time.Time)
+		if exp.IsZero() {
+			// Not leased yet, or a lease of the kube subnet manager, which doesn't expire
+			return nil
+		}
+		return int64(time.Until(exp).Seconds())
+	}))
+}
+
 func MonitorLease(ctx context.Context, sm subnet.Manager, bn backend.Network, wg *sync.WaitGroup) error {
 	// Use the subnet manager to start watching leases.
 	evts := make(chan subnet.Event)
@@ -410,6 +1052,7 @@ func MonitorLease(ctx context.Context, sm subnet.Manager, bn backend.Network, wg
 	}()
 
 	renewMargin := time.Duration(opts.subnetLeaseRenewMargin) * time.Minute
+	leaseExpiration.Store(bn.Lease().Expiration)
 	dur := bn.Lease().Expiration.Sub(time.Now()) - renewMargin
 
 	for {
@@ -418,17 +1061,21 @@ func MonitorLease(ctx context.Context, sm subnet.Manager, bn backend.Network, wg
 			err := sm.RenewLease(ctx, bn.Lease())
 			if err != nil {
 				log.Error("Error renewing lease (trying again in 1 min): ", err)
+				leaseRenewalErrors.Add(1)
 				dur = time.Minute
 				continue
 			}
 
 			log.Info("Lease renewed, new expiration: ", bn.Lease().Expiration)
+			leaseRenewals.Add(1)
+			leaseExpiration.Store(bn.Lease().Expiration)
 			dur = bn.Lease().Expiration.Sub(time.Now()) - renewMargin
 
 		case e := <-evts:
 			switch e.Type {
 			case subnet.EventAdded:
 				bn.Lease().Expiration = e.Lease.Expiration
+				leaseExpiration.Store(e.Lease.Expiration)
 				dur = bn.Lease().Expiration.Sub(time.Now()) - renewMargin
 				log.Infof("Waiting for %s to renew lease", dur)
 
@@ -444,7 +1091,7 @@ func MonitorLease(ctx context.Context, sm subnet.Manager, bn backend.Network, wg
 	}
 }
 
-func LookupExtIface(ifname string, ifregex string) (*backend.ExternalInterface, error) {
+func LookupExtIface(ifname string, ifregex string, ifcanreach string) (*backend.ExternalInterface, error) {
 	var iface *net.Interface
 	var ifaceAddr net.IP
 	var err error
@@ -514,6 +1161,20 @@ func LookupExtIface(ifname string, ifregex string) (*backend.ExternalInterface,
 
 			return nil, fmt.Errorf("Could not match pattern %s to any of the available network interfaces (%s)", ifregex, strings.Join(availableFaces, ", "))
 		}
+	} else if len(ifcanreach) > 0 {
+		dst := net.ParseIP(ifcanreach)
+		if dst == nil {
+			return nil, fmt.Errorf("invalid iface-can-reach address: %s", ifcanreach)
+		}
+		log.Infof("Determining interface and IP address used to reach %s", dst)
+		var src net.IP
+		if iface, src, err = ip.GetInterfaceBySpecificIPRouting(dst); err != nil {
+			return nil, fmt.Errorf("failed to get interface to reach %s: %s", dst, err)
+		}
+		// An IPv6 destination only selects the interface, its IPv4 address is looked up below
+		if ip.FamilyOf(src) == ip.IPv4 {
+			ifaceAddr = src
+		}
 	} else {
 		log.Info("Determining IP address of default interface")
 		if iface, err = ip.GetDefaultGatewayInterface(); err != nil {
@@ -537,9 +1198,8 @@ func LookupExtIface(ifname string, ifregex string) (*backend.ExternalInterface,
 	var extAddr net.IP
 
 	if len(opts.publicIP) > 0 {
-		extAddr = net.ParseIP(opts.publicIP)
-		if extAddr == nil {
-			return nil, fmt.Errorf("invalid public IP address: %s", opts.publicIP)
+		if extAddr, err = ip.IPv4.ParseIP(opts.publicIP); err != nil {
+			return nil, fmt.Errorf("invalid public IP address: %v", err)
 		}
 		log.Infof("Using %s as external address", extAddr)
 	}
@@ -549,58 +1209,213 @@ func LookupExtIface(ifname string, ifregex string) (*backend.ExternalInterface,
 		extAddr = ifaceAddr
 	}
 
-	return &backend.ExternalInterface{
-		Iface:     iface,
-		IfaceAddr: ifaceAddr,
-		ExtAddr:   extAddr,
-	}, nil
-}
+	var extV6Addr net.IP
 
-func WriteSubnetFile(path string, nw ip.IP4Net, ipMasq bool, bn backend.Network) error {
-	dir, name := filepath.Split(path)
-	os.MkdirAll(dir, 0755)
+	if len(opts.publicIPv6) > 0 {
+		if extV6Addr, err = ip.IPv6.ParseIP(opts.publicIPv6); err != nil {
+			return nil, fmt.Errorf("invalid public IPv6 address: %v", err)
+		}
+		log.Infof("Using %s as external IPv6 address", extV6Addr)
+	}
 
-	tempFile := filepath.Join(dir, "."+name)
-	f, err := os.Create(tempFile)
+	ifaceV6Addr, err := ip.GetInterfaceIP6Addr(iface)
 	if err != nil {
-		return err
+		log.V(1).Infof("No IPv6 address found on interface %s: %s", iface.Name, err)
+		ifaceV6Addr = nil
+	}
+
+	if extV6Addr == nil && ifaceV6Addr != nil {
+		log.Infof("Defaulting external IPv6 address to interface address (%s)", ifaceV6Addr)
+		extV6Addr = ifaceV6Addr
 	}
 
+	return &backend.ExternalInterface{
+		Iface:       iface,
+		IfaceAddr:   ifaceAddr,
+		IfaceV6Addr: ifaceV6Addr,
+		ExtAddr:     extAddr,
+		ExtV6Addr:   extV6Addr,
+		MTU:         iface.MTU,
+	}, nil
+}
+
+func WriteSubnetFile(path string, nw ip.IP4Net, ipMasq bool, bn backend.Network) error {
 	// Write out the first usable IP by incrementing
 	// sn.IP by one
 	sn := bn.Lease().Subnet
 	sn.IP += 1
 
-	fmt.Fprintf(f, "FLANNEL_NETWORK=%s\n", nw)
-	fmt.Fprintf(f, "FLANNEL_SUBNET=%s\n", sn)
-	fmt.Fprintf(f, "FLANNEL_MTU=%d\n", bn.MTU())
-	_, err = fmt.Fprintf(f, "FLANNEL_IPMASQ=%v\n", ipMasq)
-	f.Close()
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "FLANNEL_NETWORK=%s\n", nw)
+	fmt.Fprintf(&b, "FLANNEL_SUBNET=%s\n", sn)
+	fmt.Fprintf(&b, "FLANNEL_MTU=%d\n", bn.MTU())
+	fmt.Fprintf(&b, "FLANNEL_IPMASQ=%v\n", ipMasq)
+	return fileutil.WriteFileAtomic(path, b.Bytes(), 0644)
+}
+
+// cniConfData is what a CNI config template given by --cni-conf-template gets rendered with.
+type cniConfData struct {
+	Network ip.IP4Net
+	Subnet  ip.IP4Net
+	Gateway ip.IP4
+	MTU     int
+	IPMasq  bool
+}
+
+func WriteCNIConfig(templatePath, path string, nw ip.IP4Net, ipMasq bool, bn backend.Network) error {
+	tmpl, err := template.ParseFiles(templatePath)
 	if err != nil {
 		return err
 	}
 
-	// rename(2) the temporary file to the desired location so that it becomes
-	// atomically visible with the contents
-	return os.Rename(tempFile, path)
-	//TODO - is this safe? What if it's not on the same FS?
+	sn := bn.Lease().Subnet
+	data := cniConfData{
+		Network: nw,
+		Subnet:  sn,
+		Gateway: sn.IP + 1,
+		MTU:     bn.MTU(),
+		IPMasq:  ipMasq,
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return err
+	}
+	return fileutil.WriteFileAtomic(path, b.Bytes(), 0644)
 }
 
-func mustRunHealthz() {
+func mustRunHealthz(mux *http.ServeMux) {
 	address := net.JoinHostPort(opts.healthzIP, strconv.Itoa(opts.healthzPort))
 	log.Infof("Start healthz server on %s", address)
 
-	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("flanneld is running"))
 	})
+	mux.HandleFunc("/healthz/preflight", func(w http.ResponseWriter, r *http.Request) {
+		results, _ := preflightResults.Load().([]preflight.Result)
+		w.Header().Set("Content-Type", "application/json")
+		if preflight.Err(results) != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		json.NewEncoder(w).Encode(results)
+	})
+	mux.Handle("/debug/vars", expvar.Handler())
 
-	if err := http.ListenAndServe(address, nil); err != nil {
+	if err := http.ListenAndServe(address, mux); err != nil {
 		log.Errorf("Start healthz server error. %v", err)
 		panic(err)
 	}
 }
 
+// runAdminServer serves pprof and dumps of the leases and the programmed routes on
+// localhost until ctx is done, for diagnosing convergence problems.
+func runAdminServer(ctx context.Context, cache *subnet.LeaseCache, bn backend.Network) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	mux.HandleFunc("/debug/leases", func(w http.ResponseWriter, r *http.Request) {
+		if cache == nil {
+			http.Error(w, "the leases are only kept with --lease-cache", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, cache.Leases())
+	})
+	mux.HandleFunc("/debug/routes", func(w http.ResponseWriter, r *http.Request) {
+		dumper, ok := bn.(backend.DataplaneDumper)
+		if !ok {
+			http.Error(w, "the backend can't report its routes", http.StatusNotFound)
+			return
+		}
+		dump, err := dumper.DumpDataplane()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, dump)
+	})
+
+	server := &http.Server{Addr: net.JoinHostPort("127.0.0.1", strconv.Itoa(opts.adminPort)), Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	log.Infof("Start admin server on %s", server.Addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Errorf("Admin server failed: %v", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Errorf("Failed to write response: %v", err)
+	}
+}
+
+// perfHandler starts a performance test server for flannelctl perf, telling it the port and
+// the address inside sn to test the overlay with.
+func perfHandler(sn ip.IP4Net) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		s, err := perf.Listen()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		go s.Serve()
+
+		log.Infof("Started performance test server on port %d for %s", s.Port(), r.RemoteAddr)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(perf.Target{Port: s.Port(), OverlayIP: perf.LocalAddrIn(sn)})
+	}
+}
+
+// printConfig strictly parses the network config in path and prints the effective config,
+// without contacting the datastore.
+func printConfig(path string) error {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read the network config: %v", err)
+	}
+
+	config, err := subnet.ParseConfigStrict(string(data))
+	if err != nil {
+		return fmt.Errorf("Invalid network config: %v", err)
+	}
+	if !backend.Registered(config.BackendType) {
+		return fmt.Errorf("Invalid network config: unknown backend type %q", config.BackendType)
+	}
+	if err := backend.CheckConfig(config); err != nil {
+		return fmt.Errorf("Invalid network config: %v", err)
+	}
+
+	out, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
 func ReadCIDRFromSubnetFile(path string, CIDRKey string) ip.IP4Net {
 	var prevCIDR ip.IP4Net
 	if _, err := os.Stat(path); !os.IsNotExist(err) {
@@ -23,6 +23,7 @@ import (
 
 	"time"
 
+	"github.com/coreos/flannel/pkg/audit"
 	"github.com/coreos/flannel/pkg/ip"
 	"github.com/coreos/flannel/subnet"
 	"github.com/coreos/go-iptables/iptables"
@@ -74,6 +75,24 @@ func MasqRules(ipn ip.IP4Net, lease *subnet.Lease) []IPTablesRule {
 	}
 }
 
+// MasqIP6Rules returns the ip6tables rules masquerading the traffic of the IPv6 network
+// ipn that leaves it. Unlike MasqRules, traffic from the host to the network is left
+// alone, as the IPv6 network isn't split into node subnets.
+func MasqIP6Rules(ipn string) []IPTablesRule {
+	masq := []string{"-j", "MASQUERADE"}
+	ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
+	if err == nil && ipt.HasRandomFully() {
+		masq = append(masq, "--random-fully")
+	}
+
+	return []IPTablesRule{
+		// This rule makes sure we don't NAT traffic within the network
+		{"nat", "POSTROUTING", []string{"-s", ipn, "-d", ipn, "-j", "RETURN"}},
+		// NAT if it's not multicast traffic
+		{"nat", "POSTROUTING", append([]string{"-s", ipn, "!", "-d", "ff00::/8"}, masq...)},
+	}
+}
+
 func ForwardRules(flannelNetwork string) []IPTablesRule {
 	return []IPTablesRule{
 		// These rules allow traffic to be forwarded if it is to or from the flannel network range.
@@ -97,11 +116,32 @@ func ipTablesRulesExist(ipt IPTables, rules []IPTablesRule) (bool, error) {
 	return true, nil
 }
 
+// SetupAndEnsureIPTables installs rules with iptables and keeps re-installing them every
+// resyncPeriod seconds, in case something else (e.g. kube-proxy or firewalld) flushed them.
 func SetupAndEnsureIPTables(rules []IPTablesRule, resyncPeriod int) {
-	ipt, err := iptables.New()
+	setupAndEnsure(iptables.ProtocolIPv4, rules, resyncPeriod)
+}
+
+// SetupAndEnsureIP6Tables is the ip6tables equivalent of SetupAndEnsureIPTables.
+func SetupAndEnsureIP6Tables(rules []IPTablesRule, resyncPeriod int) {
+	setupAndEnsure(iptables.ProtocolIPv6, rules, resyncPeriod)
+}
+
+// DeleteIPTables delete specified iptables rules
+func DeleteIPTables(rules []IPTablesRule) error {
+	return deleteRules(iptables.ProtocolIPv4, rules)
+}
+
+// DeleteIP6Tables delete specified ip6tables rules
+func DeleteIP6Tables(rules []IPTablesRule) error {
+	return deleteRules(iptables.ProtocolIPv6, rules)
+}
+
+func setupAndEnsure(proto iptables.Protocol, rules []IPTablesRule, resyncPeriod int) {
+	ipt, err := iptables.NewWithProtocol(proto)
 	if err != nil {
 		// if we can't find iptables, give up and return
-		log.Errorf("Failed to setup IPTables. iptables binary was not found: %v", err)
+		log.Errorf("Failed to setup %s. %s binary was not found: %v", binaryName(proto), binaryName(proto), err)
 		return
 	}
 
@@ -112,25 +152,31 @@ func SetupAndEnsureIPTables(rules []IPTablesRule, resyncPeriod int) {
 	for {
 		// Ensure that all the iptables rules exist every 5 seconds
 		if err := ensureIPTables(ipt, rules); err != nil {
-			log.Errorf("Failed to ensure iptables rules: %v", err)
+			log.Errorf("Failed to ensure %s rules: %v", binaryName(proto), err)
 		}
 
 		time.Sleep(time.Duration(resyncPeriod) * time.Second)
 	}
 }
 
-// DeleteIPTables delete specified iptables rules
-func DeleteIPTables(rules []IPTablesRule) error {
-	ipt, err := iptables.New()
+func deleteRules(proto iptables.Protocol, rules []IPTablesRule) error {
+	ipt, err := iptables.NewWithProtocol(proto)
 	if err != nil {
 		// if we can't find iptables, give up and return
-		log.Errorf("Failed to setup IPTables. iptables binary was not found: %v", err)
+		log.Errorf("Failed to setup %s. %s binary was not found: %v", binaryName(proto), binaryName(proto), err)
 		return err
 	}
 	teardownIPTables(ipt, rules)
 	return nil
 }
 
+func binaryName(proto iptables.Protocol) string {
+	if proto == iptables.ProtocolIPv6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
 func ensureIPTables(ipt IPTables, rules []IPTablesRule) error {
 	exists, err := ipTablesRulesExist(ipt, rules)
 	if err != nil {
@@ -154,6 +200,7 @@ func setupIPTables(ipt IPTables, rules []IPTablesRule) error {
 	for _, rule := range rules {
 		log.Info("Adding iptables rule: ", strings.Join(rule.rulespec, " "))
 		err := ipt.AppendUnique(rule.table, rule.chain, rule.rulespec...)
+		audit.Log(audit.KindIPTables, audit.ActionAdd, "", rule.String(), err)
 		if err != nil {
 			return fmt.Errorf("failed to insert IPTables rule: %v", err)
 		}
@@ -167,6 +214,12 @@ func teardownIPTables(ipt IPTables, rules []IPTablesRule) {
 		log.Info("Deleting iptables rule: ", strings.Join(rule.rulespec, " "))
 		// We ignore errors here because if there's an error it's almost certainly because the rule
 		// doesn't exist, which is fine (we don't need to delete rules that don't exist)
-		ipt.Delete(rule.table, rule.chain, rule.rulespec...)
+		if err := ipt.Delete(rule.table, rule.chain, rule.rulespec...); err == nil {
+			audit.Log(audit.KindIPTables, audit.ActionDelete, rule.String(), "", nil)
+		}
 	}
 }
+
+func (r IPTablesRule) String() string {
+	return fmt.Sprintf("-t %s -A %s %s", r.table, r.chain, strings.Join(r.rulespec, " "))
+}
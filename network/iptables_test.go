@@ -20,6 +20,7 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/coreos/flannel/pkg/dataplane"
 	"github.com/coreos/flannel/pkg/ip"
 	"github.com/coreos/flannel/subnet"
 )
@@ -81,15 +82,64 @@ func TestDeleteRules(t *testing.T) {
 }
 
 func TestEnsureRules(t *testing.T) {
-	// If any masqRules are missing, they should be all deleted and recreated in the correct order
-	ipt_correct := &MockIPTables{}
-	setupIPTables(ipt_correct, MasqRules(ip.IP4Net{}, lease()))
-	// setup a mock instance where we delete some masqRules and run `ensureIPTables`
-	ipt_recreate := &MockIPTables{}
-	setupIPTables(ipt_recreate, MasqRules(ip.IP4Net{}, lease()))
-	ipt_recreate.rules = ipt_recreate.rules[0:2]
-	ensureIPTables(ipt_recreate, MasqRules(ip.IP4Net{}, lease()))
-	if !reflect.DeepEqual(ipt_recreate.rules, ipt_correct.rules) {
-		t.Errorf("iptables masqRules after ensureIPTables are incorrected. Expected: %#v, Actual: %#v", ipt_recreate.rules, ipt_correct.rules)
+	for _, tc := range []struct {
+		name  string
+		rules []IPTablesRule
+		// keep is how many of the rules are left after something else deleted the others,
+		// e.g. firewalld reloading
+		keep int
+	}{
+		{"some masq rules deleted", MasqRules(ip.IP4Net{}, lease()), 2},
+		{"IPv4 forward rules flushed", ForwardRules("10.0.0.0/8"), 0},
+		{"IPv6 forward rules flushed", ForwardRules("fd00:10::/64"), 0},
+	} {
+		// Missing rules are restored by deleting and recreating them all in the correct order
+		ipt := &MockIPTables{}
+		setupIPTables(ipt, tc.rules)
+		ipt.rules = ipt.rules[:tc.keep]
+		if err := ensureIPTables(ipt, tc.rules); err != nil {
+			t.Fatalf("%s: ensureIPTables failed: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(ipt.rules, tc.rules) {
+			t.Errorf("%s: rules were not restored. Expected: %#v, Actual: %#v", tc.name, tc.rules, ipt.rules)
+		}
+	}
+}
+
+func TestMasqIP6Rules(t *testing.T) {
+	ipt := &MockIPTables{}
+	setupIPTables(ipt, MasqIP6Rules("fd00:10::/64"))
+	if len(ipt.rules) != 2 {
+		t.Fatalf("expected 2 rules, got %#v", ipt.rules)
+	}
+	// Only traffic leaving the network is masqueraded
+	if masq := ipt.rules[1].rulespec; masq[0] != "-s" || masq[1] != "fd00:10::/64" || masq[6] != "MASQUERADE" {
+		t.Errorf("unexpected masquerade rule %v", masq)
+	}
+}
+
+func TestEnsureRulesOperations(t *testing.T) {
+	// A partially flushed chain is torn down and recreated so that the rules stay in order
+	ipt := dataplane.NewFakeIPTables()
+	rules := ForwardRules("10.0.0.0/8")
+	setupIPTables(ipt, rules)
+	ipt.Expect(t,
+		"AppendUnique filter FORWARD -s 10.0.0.0/8 -j ACCEPT",
+		"AppendUnique filter FORWARD -d 10.0.0.0/8 -j ACCEPT")
+
+	ipt.Delete("filter", "FORWARD", "-s", "10.0.0.0/8", "-j", "ACCEPT")
+	ipt.Calls()
+	if err := ensureIPTables(ipt, rules); err != nil {
+		t.Fatalf("ensureIPTables failed: %v", err)
+	}
+	ipt.Expect(t,
+		"Delete filter FORWARD -s 10.0.0.0/8 -j ACCEPT",
+		"Delete filter FORWARD -d 10.0.0.0/8 -j ACCEPT",
+		"AppendUnique filter FORWARD -s 10.0.0.0/8 -j ACCEPT",
+		"AppendUnique filter FORWARD -d 10.0.0.0/8 -j ACCEPT")
+
+	if err := ensureIPTables(ipt, rules); err != nil {
+		t.Fatalf("ensureIPTables failed: %v", err)
 	}
+	ipt.Expect(t)
 }
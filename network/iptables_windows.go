@@ -35,6 +35,10 @@ func MasqRules(ipn ip.IP4Net, lease *subnet.Lease) []IPTablesRule {
 	return nil
 }
 
+func MasqIP6Rules(ipn string) []IPTablesRule {
+	return nil
+}
+
 func ForwardRules(flannelNetwork string) []IPTablesRule {
 	return nil
 }
@@ -43,9 +47,31 @@ func SetupAndEnsureIPTables(rules []IPTablesRule, resyncPeriod int) {
 
 }
 
+func SetupAndEnsureIP6Tables(rules []IPTablesRule, resyncPeriod int) {
+
+}
+
 func DeleteIPTables(rules []IPTablesRule) error {
 	return nil
 }
 
+func DeleteIP6Tables(rules []IPTablesRule) error {
+	return nil
+}
+
 func teardownIPTables(ipt IPTables, rules []IPTablesRule) {
 }
+
+type NFTablesRuleset struct {
+	Network    ip.IP4Net
+	Subnet     ip.IP4Net
+	Masquerade bool
+	Forward    bool
+}
+
+func SetupAndEnsureNFTables(rs NFTablesRuleset, resyncPeriod int) {
+}
+
+func DeleteNFTables() error {
+	return nil
+}
@@ -0,0 +1,266 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/coreos/flannel/pkg/audit"
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+const (
+	nftFamily = "ip"
+	nftTable  = "flannel"
+)
+
+type NFTables interface {
+	// Apply runs script as a single nft transaction.
+	Apply(script string) error
+	// Check has the kernel validate script without applying it.
+	Check(script string) error
+	// ListTable returns the current contents of the given table.
+	ListTable(family, table string) (string, error)
+}
+
+// NFTablesRuleset describes the rules flannel keeps in its dedicated nftables table.
+// The whole table is replaced atomically whenever it needs to be (re)installed.
+type NFTablesRuleset struct {
+	Network    ip.IP4Net
+	Subnet     ip.IP4Net
+	Masquerade bool
+	Forward    bool
+
+	// fullyRandom fully randomizes the source ports of masqueraded traffic, if the kernel
+	// and nft support it.
+	fullyRandom bool
+}
+
+func (rs NFTablesRuleset) rules() map[string][]string {
+	n := rs.Network.String()
+	sn := rs.Subnet.String()
+	masq := "masquerade"
+	if rs.fullyRandom {
+		masq = "masquerade fully-random"
+	}
+
+	rules := map[string][]string{}
+	if rs.Masquerade {
+		rules["postrouting"] = []string{
+			// This rule makes sure we don't NAT traffic within overlay network (e.g. coming out of docker0)
+			fmt.Sprintf("ip saddr %s ip daddr %s return", n, n),
+			// NAT if it's not multicast traffic
+			fmt.Sprintf("ip saddr %s ip daddr != 224.0.0.0/4 %s", n, masq),
+			// Prevent performing Masquerade on external traffic which arrives from a Node that owns the container/pod IP address
+			fmt.Sprintf("ip saddr != %s ip daddr %s return", n, sn),
+			// Masquerade anything headed towards flannel from the host
+			fmt.Sprintf("ip saddr != %s ip daddr %s %s", n, n, masq),
+		}
+	}
+	if rs.Forward {
+		rules["forward"] = []string{
+			// These rules allow traffic to be forwarded if it is to or from the flannel network range.
+			fmt.Sprintf("ip saddr %s accept", n),
+			fmt.Sprintf("ip daddr %s accept", n),
+		}
+	}
+	return rules
+}
+
+// script renders an nft script that replaces the flannel table in one transaction.
+// Declaring the table before deleting it makes the delete succeed even if the table doesn't exist yet.
+func (rs NFTablesRuleset) script() string {
+	rules := rs.rules()
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "table %s %s {}\n", nftFamily, nftTable)
+	fmt.Fprintf(&b, "delete table %s %s\n", nftFamily, nftTable)
+	fmt.Fprintf(&b, "table %s %s {\n", nftFamily, nftTable)
+	if r, ok := rules["postrouting"]; ok {
+		writeNFTChain(&b, "postrouting", "type nat hook postrouting priority 100; policy accept;", r)
+	}
+	if r, ok := rules["forward"]; ok {
+		writeNFTChain(&b, "forward", "type filter hook forward priority 0; policy accept;", r)
+	}
+	fmt.Fprintf(&b, "}\n")
+	return b.String()
+}
+
+func writeNFTChain(b *bytes.Buffer, name, hook string, rules []string) {
+	fmt.Fprintf(b, "\tchain %s {\n", name)
+	fmt.Fprintf(b, "\t\t%s\n", hook)
+	for _, r := range rules {
+		fmt.Fprintf(b, "\t\t%s\n", r)
+	}
+	fmt.Fprintf(b, "\t}\n")
+}
+
+// parseNFTRules returns the rules per chain in the output of "nft list table".
+func parseNFTRules(listing string) map[string][]string {
+	rules := map[string][]string{}
+	chain := ""
+	for _, line := range strings.Split(listing, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "chain "):
+			chain = strings.Fields(line)[1]
+			rules[chain] = nil
+		case line == "}":
+			chain = ""
+		case chain == "" || line == "" || strings.HasPrefix(line, "type "):
+		default:
+			rules[chain] = append(rules[chain], line)
+		}
+	}
+	return rules
+}
+
+// nftSupportsFullyRandom tells whether the kernel and nft can fully randomize the source
+// ports of masqueraded traffic, by having the kernel check the ruleset using it.
+func nftSupportsFullyRandom(nft NFTables, rs NFTablesRuleset) bool {
+	rs.fullyRandom = true
+	if err := nft.Check(rs.script()); err != nil {
+		log.Infof("nftables doesn't support fully random masquerading, masquerading without it: %v", err)
+		return false
+	}
+	return true
+}
+
+func nftRulesExist(nft NFTables, rs NFTablesRuleset) (bool, error) {
+	listing, err := nft.ListTable(nftFamily, nftTable)
+	if err != nil {
+		// Most likely the table doesn't exist, e.g. because the whole ruleset was flushed.
+		log.V(1).Infof("Failed to list nftables table %s %s: %v", nftFamily, nftTable, err)
+		return false, nil
+	}
+
+	// nft prints the rules the way they are rendered, so any difference means they were modified
+	existing := parseNFTRules(listing)
+	rules := rs.rules()
+	if len(existing) != len(rules) {
+		return false, nil
+	}
+	for chain, r := range rules {
+		got, ok := existing[chain]
+		if !ok || len(got) != len(r) {
+			return false, nil
+		}
+		for i := range r {
+			if got[i] != r[i] {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+func ensureNFTables(nft NFTables, rs NFTablesRuleset) error {
+	exists, err := nftRulesExist(nft, rs)
+	if err != nil {
+		return fmt.Errorf("Error checking rule existence: %v", err)
+	}
+	if exists {
+		return nil
+	}
+
+	log.Infof("Some nftables rules are missing or modified; replacing table %s %s", nftFamily, nftTable)
+	before := ""
+	if audit.Enabled() {
+		before, _ = nft.ListTable(nftFamily, nftTable)
+	}
+	err = nft.Apply(rs.script())
+	audit.Log(audit.KindNFTables, audit.ActionReplace, before, rs.script(), err)
+	if err != nil {
+		return fmt.Errorf("Error setting up rules: %v", err)
+	}
+	return nil
+}
+
+// SetupAndEnsureNFTables installs the ruleset in flannel's nftables table and keeps
+// re-installing it every resyncPeriod seconds if it was modified or flushed.
+func SetupAndEnsureNFTables(rs NFTablesRuleset, resyncPeriod int) {
+	nft, err := newNFTCmd()
+	if err != nil {
+		log.Errorf("Failed to setup nftables. nft binary was not found: %v", err)
+		return
+	}
+	if rs.Masquerade {
+		rs.fullyRandom = nftSupportsFullyRandom(nft, rs)
+	}
+
+	for {
+		if err := ensureNFTables(nft, rs); err != nil {
+			log.Errorf("Failed to ensure nftables rules: %v", err)
+		}
+
+		time.Sleep(time.Duration(resyncPeriod) * time.Second)
+	}
+}
+
+// DeleteNFTables removes flannel's nftables table.
+func DeleteNFTables() error {
+	nft, err := newNFTCmd()
+	if err != nil {
+		return err
+	}
+	err = nft.Apply(fmt.Sprintf("table %s %s {}\ndelete table %s %s\n", nftFamily, nftTable, nftFamily, nftTable))
+	audit.Log(audit.KindNFTables, audit.ActionDelete, fmt.Sprintf("table %s %s", nftFamily, nftTable), "", err)
+	return err
+}
+
+type nftCmd struct {
+	path string
+}
+
+func newNFTCmd() (*nftCmd, error) {
+	path, err := exec.LookPath("nft")
+	if err != nil {
+		return nil, err
+	}
+	return &nftCmd{path: path}, nil
+}
+
+func (c *nftCmd) run(stdin string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(c.path, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("nft %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+func (c *nftCmd) Apply(script string) error {
+	_, err := c.run(script, "-f", "-")
+	return err
+}
+
+func (c *nftCmd) Check(script string) error {
+	_, err := c.run(script, "--check", "-f", "-")
+	return err
+}
+
+func (c *nftCmd) ListTable(family, table string) (string, error) {
+	return c.run("", "list", "table", family, table)
+}
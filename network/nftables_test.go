@@ -0,0 +1,144 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package network
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+type MockNFTables struct {
+	applied  []string
+	listing  string
+	checkErr error
+}
+
+func (mock *MockNFTables) Apply(script string) error {
+	mock.applied = append(mock.applied, script)
+	return nil
+}
+
+func (mock *MockNFTables) Check(script string) error {
+	return mock.checkErr
+}
+
+func (mock *MockNFTables) ListTable(family, table string) (string, error) {
+	if mock.listing == "" {
+		return "", errors.New("No such file or directory")
+	}
+	return mock.listing, nil
+}
+
+func ruleset() NFTablesRuleset {
+	return NFTablesRuleset{
+		Network:     ip.IP4Net{IP: ip.MustParseIP4("10.0.0.0"), PrefixLen: 8},
+		Subnet:      ip.IP4Net{IP: ip.MustParseIP4("10.0.1.0"), PrefixLen: 24},
+		Masquerade:  true,
+		Forward:     true,
+		fullyRandom: true,
+	}
+}
+
+// listing is what "nft list table ip flannel" prints for ruleset()
+const listing = `table ip flannel {
+	chain postrouting {
+		type nat hook postrouting priority srcnat; policy accept;
+		ip saddr 10.0.0.0/8 ip daddr 10.0.0.0/8 return
+		ip saddr 10.0.0.0/8 ip daddr != 224.0.0.0/4 masquerade fully-random
+		ip saddr != 10.0.0.0/8 ip daddr 10.0.1.0/24 return
+		ip saddr != 10.0.0.0/8 ip daddr 10.0.0.0/8 masquerade fully-random
+	}
+
+	chain forward {
+		type filter hook forward priority filter; policy accept;
+		ip saddr 10.0.0.0/8 accept
+		ip daddr 10.0.0.0/8 accept
+	}
+}
+`
+
+func TestNFTablesScript(t *testing.T) {
+	script := ruleset().script()
+	if !strings.HasPrefix(script, "table ip flannel {}\ndelete table ip flannel\n") {
+		t.Errorf("script should atomically replace the flannel table:\n%s", script)
+	}
+	for _, r := range []string{
+		"ip saddr 10.0.0.0/8 ip daddr != 224.0.0.0/4 masquerade fully-random\n",
+		"ip saddr != 10.0.0.0/8 ip daddr 10.0.1.0/24 return\n",
+		"ip daddr 10.0.0.0/8 accept\n",
+	} {
+		if !strings.Contains(script, r) {
+			t.Errorf("script is missing rule %q:\n%s", r, script)
+		}
+	}
+
+	rs := ruleset()
+	rs.Forward = false
+	script = rs.script()
+	if strings.Contains(script, "chain forward") {
+		t.Errorf("forward chain should only be rendered when enabled:\n%s", script)
+	}
+
+	// Without support for fully random masquerading, plain masquerading is used
+	nft := &MockNFTables{checkErr: errors.New("syntax error")}
+	rs = ruleset()
+	rs.fullyRandom = nftSupportsFullyRandom(nft, rs)
+	if script = rs.script(); strings.Contains(script, "fully-random") || !strings.Contains(script, "224.0.0.0/4 masquerade\n") {
+		t.Errorf("script should masquerade without fully-random:\n%s", script)
+	}
+	if !nftSupportsFullyRandom(&MockNFTables{}, rs) {
+		t.Error("fully random masquerading should be used when the kernel accepts it")
+	}
+}
+
+func TestEnsureNFTables(t *testing.T) {
+	nft := &MockNFTables{}
+	if err := ensureNFTables(nft, ruleset()); err != nil {
+		t.Fatal(err)
+	}
+	if len(nft.applied) != 1 {
+		t.Fatalf("missing table should be installed, applied %d scripts", len(nft.applied))
+	}
+
+	nft = &MockNFTables{listing: listing}
+	if err := ensureNFTables(nft, ruleset()); err != nil {
+		t.Fatal(err)
+	}
+	if len(nft.applied) != 0 {
+		t.Errorf("complete table should be left alone, applied %d scripts", len(nft.applied))
+	}
+
+	for _, tc := range []struct {
+		name    string
+		listing string
+	}{
+		{"one of the forward rules was deleted", strings.Replace(listing, "\t\tip daddr 10.0.0.0/8 accept\n", "", 1)},
+		{"one of the forward rules was modified", strings.Replace(listing, "ip daddr 10.0.0.0/8 accept", "ip daddr 10.0.0.0/8 drop", 1)},
+		{"masquerading isn't fully random", strings.Replace(listing, " fully-random", "", -1)},
+		{"a chain was added", strings.Replace(listing, "\tchain forward {", "\tchain input {\n\t}\n\n\tchain forward {", 1)},
+	} {
+		nft = &MockNFTables{listing: tc.listing}
+		if err := ensureNFTables(nft, ruleset()); err != nil {
+			t.Fatal(err)
+		}
+		if len(nft.applied) != 1 {
+			t.Errorf("table should be replaced when %s, applied %d scripts", tc.name, len(nft.applied))
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package audit keeps a trail of every change flannel makes to the host's
+// dataplane (routes, neighbor and FDB entries, firewall rules), so that it is
+// possible to reconstruct after the fact what was changed and when.
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+const (
+	KindRoute    = "route"
+	KindARP      = "arp"
+	KindFDB      = "fdb"
+	KindIPTables = "iptables"
+	KindNFTables = "nftables"
+	KindLink     = "link"
+
+	ActionAdd     = "add"
+	ActionReplace = "replace"
+	ActionDelete  = "delete"
+)
+
+// Record is a single dataplane mutation. It is written as one line of JSON.
+type Record struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Action string    `json:"action"`
+	Before string    `json:"before,omitempty"`
+	After  string    `json:"after,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+var (
+	mux  sync.Mutex
+	sink io.WriteCloser
+)
+
+// Open starts writing audit records to dest, which is either the path of a
+// file to append to or "syslog". An empty dest disables auditing.
+func Open(dest string) error {
+	var w io.WriteCloser
+	var err error
+
+	switch dest {
+	case "":
+	case "syslog":
+		w, err = openSyslog()
+	default:
+		w, err = os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	}
+	if err != nil {
+		return err
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	if sink != nil {
+		sink.Close()
+	}
+	sink = w
+	return nil
+}
+
+// Enabled reports whether records are being written. Callers can use it to
+// skip collecting the "before" state when nobody is going to look at it.
+func Enabled() bool {
+	mux.Lock()
+	defer mux.Unlock()
+	return sink != nil
+}
+
+// Log records a mutation of kind (e.g. KindRoute). Either before or after
+// may be empty, for additions and deletions respectively. err is the outcome
+// of the mutation, if it failed.
+func Log(kind, action, before, after string, err error) {
+	mux.Lock()
+	defer mux.Unlock()
+
+	if sink == nil {
+		return
+	}
+
+	r := Record{
+		Time:   time.Now(),
+		Kind:   kind,
+		Action: action,
+		Before: before,
+		After:  after,
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	b, jerr := json.Marshal(r)
+	if jerr != nil {
+		log.Errorf("Failed to encode audit record: %v", jerr)
+		return
+	}
+	if _, werr := sink.Write(append(b, '\n')); werr != nil {
+		log.Errorf("Failed to write audit record: %v", werr)
+	}
+}
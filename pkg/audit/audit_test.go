@@ -0,0 +1,80 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Nothing is recorded while auditing is disabled
+	Log(KindRoute, ActionAdd, "", "10.1.0.0/24 via 192.168.0.2", nil)
+
+	path := filepath.Join(dir, "audit.log")
+	if err := Open(path); err != nil {
+		t.Fatal(err)
+	}
+	if !Enabled() {
+		t.Fatal("auditing should be enabled")
+	}
+
+	Log(KindRoute, ActionReplace, "10.1.0.0/24 via 192.168.0.2", "10.1.0.0/24 via 192.168.0.3", nil)
+	Log(KindFDB, ActionDelete, "192.168.0.3 de:ad:be:ef:00:01", "", errors.New("no such entry"))
+
+	if err := Open(""); err != nil {
+		t.Fatal(err)
+	}
+	if Enabled() {
+		t.Fatal("auditing should be disabled")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("bad audit record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("expected 2 audit records, got %d: %v", len(records), records)
+	}
+	if records[0].Kind != KindRoute || records[0].Action != ActionReplace || records[0].Before != "10.1.0.0/24 via 192.168.0.2" || records[0].After != "10.1.0.0/24 via 192.168.0.3" {
+		t.Errorf("unexpected route record: %+v", records[0])
+	}
+	if records[1].Kind != KindFDB || records[1].Error != "no such entry" || records[1].After != "" {
+		t.Errorf("unexpected fdb record: %+v", records[1])
+	}
+}
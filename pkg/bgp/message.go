@@ -0,0 +1,230 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bgp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// Message types and codes of RFC 4271, and the capabilities of RFC 4760 and RFC 6793.
+const (
+	headerLen  = 19
+	maxMsgSize = 4096
+
+	msgOpen         = 1
+	msgUpdate       = 2
+	msgNotification = 3
+	msgKeepalive    = 4
+
+	paramCapabilities = 2
+	capMultiprotocol  = 1
+	capFourOctetAS    = 65
+
+	attrFlagTransitive = 0x40
+	attrOrigin         = 1
+	attrASPath         = 2
+	attrNextHop        = 3
+	attrLocalPref      = 5
+
+	originIGP     = 0
+	asSequence    = 2
+	asTrans       = 23456
+	defaultPref   = 100
+	afiIPv4       = 1
+	safiUnicast   = 1
+	bgpVersion    = 4
+	errOpen       = 2
+	errBadPeerAS  = 2
+	errHoldTimer  = 4
+	errCease      = 6
+	ceaseShutdown = 2
+)
+
+var errMalformed = errors.New("malformed BGP message")
+
+type message struct {
+	typ  byte
+	body []byte
+}
+
+func encodeMessage(typ byte, body []byte) []byte {
+	b := make([]byte, headerLen, headerLen+len(body))
+	for i := 0; i < 16; i++ {
+		b[i] = 0xff
+	}
+	binary.BigEndian.PutUint16(b[16:18], uint16(headerLen+len(body)))
+	b[18] = typ
+	return append(b, body...)
+}
+
+func readMessage(r io.Reader) (message, error) {
+	hdr := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return message{}, err
+	}
+	for i := 0; i < 16; i++ {
+		if hdr[i] != 0xff {
+			return message{}, errMalformed
+		}
+	}
+	l := int(binary.BigEndian.Uint16(hdr[16:18]))
+	if l < headerLen || l > maxMsgSize {
+		return message{}, errMalformed
+	}
+	body := make([]byte, l-headerLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return message{}, err
+	}
+	return message{typ: hdr[18], body: body}, nil
+}
+
+type open struct {
+	as       uint32
+	holdTime uint16
+	routerID net.IP
+	// fourOctetAS is set if the speaker supports 4-octet AS numbers.
+	fourOctetAS bool
+}
+
+func encodeOpen(o open) []byte {
+	myAS := uint16(o.as)
+	if o.as > 0xffff {
+		myAS = asTrans
+	}
+
+	caps := []byte{
+		capMultiprotocol, 4, 0, afiIPv4, 0, safiUnicast,
+		capFourOctetAS, 4, 0, 0, 0, 0,
+	}
+	binary.BigEndian.PutUint32(caps[8:], o.as)
+
+	b := make([]byte, 10, 10+2+len(caps))
+	b[0] = bgpVersion
+	binary.BigEndian.PutUint16(b[1:3], myAS)
+	binary.BigEndian.PutUint16(b[3:5], o.holdTime)
+	copy(b[5:9], o.routerID.To4())
+	b[9] = byte(2 + len(caps))
+	b = append(b, paramCapabilities, byte(len(caps)))
+	return encodeMessage(msgOpen, append(b, caps...))
+}
+
+func parseOpen(body []byte) (open, error) {
+	if len(body) < 10 || len(body) < 10+int(body[9]) {
+		return open{}, errMalformed
+	}
+	if body[0] != bgpVersion {
+		return open{}, fmt.Errorf("unsupported BGP version %d", body[0])
+	}
+	o := open{
+		as:       uint32(binary.BigEndian.Uint16(body[1:3])),
+		holdTime: binary.BigEndian.Uint16(body[3:5]),
+		routerID: net.IP(append([]byte(nil), body[5:9]...)),
+	}
+
+	params := body[10 : 10+int(body[9])]
+	for len(params) >= 2 {
+		typ, l := params[0], int(params[1])
+		if len(params) < 2+l {
+			return open{}, errMalformed
+		}
+		if typ == paramCapabilities {
+			caps := params[2 : 2+l]
+			for len(caps) >= 2 {
+				code, cl := caps[0], int(caps[1])
+				if len(caps) < 2+cl {
+					return open{}, errMalformed
+				}
+				if code == capFourOctetAS && cl == 4 {
+					o.fourOctetAS = true
+					o.as = binary.BigEndian.Uint32(caps[2:6])
+				}
+				caps = caps[2+cl:]
+			}
+		}
+		params = params[2+l:]
+	}
+	return o, nil
+}
+
+func encodeKeepalive() []byte {
+	return encodeMessage(msgKeepalive, nil)
+}
+
+func encodeNotification(code, subcode byte) []byte {
+	return encodeMessage(msgNotification, []byte{code, subcode})
+}
+
+func encodePrefix(b []byte, sn ip.IP4Net) []byte {
+	addr := sn.IP.ToIP().To4()
+	return append(append(b, byte(sn.PrefixLen)), addr[:(sn.PrefixLen+7)/8]...)
+}
+
+// update describes an UPDATE message announcing and withdrawing IPv4 unicast prefixes.
+type update struct {
+	withdrawn []ip.IP4Net
+	announced []ip.IP4Net
+	// The attributes of the announced prefixes
+	localAS     uint32
+	fourOctetAS bool
+	ibgp        bool
+	nextHop     net.IP
+}
+
+func encodeUpdate(u update) []byte {
+	var withdrawn []byte
+	for _, sn := range u.withdrawn {
+		withdrawn = encodePrefix(withdrawn, sn)
+	}
+
+	var attrs, nlri []byte
+	if len(u.announced) > 0 {
+		attrs = append(attrs, attrFlagTransitive, attrOrigin, 1, originIGP)
+
+		// The AS path is empty towards iBGP peers, and holds the local AS towards eBGP peers
+		if u.ibgp {
+			attrs = append(attrs, attrFlagTransitive, attrASPath, 0)
+		} else if u.fourOctetAS {
+			attrs = append(attrs, attrFlagTransitive, attrASPath, 6, asSequence, 1, 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(attrs[len(attrs)-4:], u.localAS)
+		} else {
+			attrs = append(attrs, attrFlagTransitive, attrASPath, 4, asSequence, 1, 0, 0)
+			binary.BigEndian.PutUint16(attrs[len(attrs)-2:], uint16(u.localAS))
+		}
+
+		attrs = append(attrs, attrFlagTransitive, attrNextHop, 4)
+		attrs = append(attrs, u.nextHop.To4()...)
+
+		if u.ibgp {
+			attrs = append(attrs, attrFlagTransitive, attrLocalPref, 4, 0, 0, 0, defaultPref)
+		}
+
+		for _, sn := range u.announced {
+			nlri = encodePrefix(nlri, sn)
+		}
+	}
+
+	b := make([]byte, 2, 4+len(withdrawn)+len(attrs)+len(nlri))
+	binary.BigEndian.PutUint16(b, uint16(len(withdrawn)))
+	b = append(b, withdrawn...)
+	b = append(b, byte(len(attrs)>>8), byte(len(attrs)))
+	b = append(b, attrs...)
+	return encodeMessage(msgUpdate, append(b, nlri...))
+}
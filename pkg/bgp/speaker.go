@@ -0,0 +1,481 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bgp announces the subnets of a node to BGP peers, e.g. top-of-rack
+// switches, so that they route the subnets natively to the node.
+//
+// It implements an announce-only BGP-4 speaker: it connects to the configured
+// peers, advertises IPv4 unicast prefixes with the node as next hop, and
+// ignores the routes the peers advertise. That's all flannel needs, so it's
+// implemented here instead of vendoring gobgp, whose gRPC and protobuf
+// dependencies conflict with the versions the etcd and Kubernetes clients pin.
+package bgp
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+const (
+	DefaultHoldTime = 90 * time.Second
+
+	bgpPort           = "179"
+	dialTimeout       = 10 * time.Second
+	writeTimeout      = 10 * time.Second
+	maxRedialInterval = time.Minute
+	// maxPrefixesPerUpdate keeps UPDATE messages well below the 4096 bytes limit.
+	maxPrefixesPerUpdate = 500
+)
+
+type Peer struct {
+	// Address is the IP of the peer, with an optional port.
+	Address string
+	AS      uint32
+}
+
+// ParsePeers parses a comma separated list of peers like "10.0.0.1=64512,10.0.0.2:1179=64512".
+func ParsePeers(s string) ([]Peer, error) {
+	var peers []Peer
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		parts := strings.SplitN(p, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("peer %q isn't of the form address=AS", p)
+		}
+		as, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil || as == 0 {
+			return nil, fmt.Errorf("invalid AS of peer %q", p)
+		}
+		if _, _, err := net.SplitHostPort(parts[0]); err != nil && net.ParseIP(parts[0]) == nil {
+			return nil, fmt.Errorf("invalid address of peer %q", p)
+		}
+		peers = append(peers, Peer{Address: parts[0], AS: uint32(as)})
+	}
+	return peers, nil
+}
+
+type Config struct {
+	LocalAS  uint32
+	RouterID net.IP
+	// NextHop is the address the peers route the announced prefixes to.
+	NextHop  net.IP
+	HoldTime time.Duration
+	Peers    []Peer
+}
+
+// Speaker keeps a session to each peer and announces the prefixes added with Announce
+// on all of them.
+type Speaker struct {
+	cfg Config
+
+	mux      sync.Mutex
+	prefixes map[ip.IP4Net]bool
+	// gen counts the changes of prefixes.
+	gen     uint64
+	changed []chan struct{}
+	// synced holds the generation of the prefixes last sent to each peer with an
+	// established session, syncedCh is closed and replaced when it changes.
+	synced   map[int]uint64
+	syncedCh chan struct{}
+}
+
+func NewSpeaker(cfg Config) (*Speaker, error) {
+	if cfg.LocalAS == 0 {
+		return nil, fmt.Errorf("the local AS is required")
+	}
+	if cfg.RouterID.To4() == nil {
+		return nil, fmt.Errorf("the router ID must be an IPv4 address")
+	}
+	if cfg.NextHop.To4() == nil {
+		return nil, fmt.Errorf("the next hop must be an IPv4 address")
+	}
+	if len(cfg.Peers) == 0 {
+		return nil, fmt.Errorf("no peers")
+	}
+	if cfg.HoldTime == 0 {
+		cfg.HoldTime = DefaultHoldTime
+	}
+	if cfg.HoldTime < 3*time.Second || cfg.HoldTime > 0xffff*time.Second {
+		return nil, fmt.Errorf("hold time %v is out of range", cfg.HoldTime)
+	}
+
+	s := &Speaker{
+		cfg:      cfg,
+		prefixes: make(map[ip.IP4Net]bool),
+		synced:   make(map[int]uint64),
+		syncedCh: make(chan struct{}),
+	}
+	for range cfg.Peers {
+		s.changed = append(s.changed, make(chan struct{}, 1))
+	}
+	return s, nil
+}
+
+// Announce advertises sn to the peers.
+func (s *Speaker) Announce(sn ip.IP4Net) {
+	s.update(sn, true)
+}
+
+// Withdraw stops advertising sn and waits until the established sessions have sent the
+// withdrawal, or ctx is done.
+func (s *Speaker) Withdraw(ctx context.Context, sn ip.IP4Net) error {
+	gen := s.update(sn, false)
+	for {
+		s.mux.Lock()
+		done := true
+		for _, g := range s.synced {
+			if g < gen {
+				done = false
+			}
+		}
+		ch := s.syncedCh
+		s.mux.Unlock()
+
+		if done {
+			return nil
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *Speaker) update(sn ip.IP4Net, announce bool) uint64 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if announce {
+		s.prefixes[sn] = true
+	} else {
+		delete(s.prefixes, sn)
+	}
+	s.gen++
+	for _, c := range s.changed {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+	return s.gen
+}
+
+// announced returns the prefixes to advertise and their generation.
+func (s *Speaker) announced() (map[ip.IP4Net]bool, uint64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	prefixes := make(map[ip.IP4Net]bool, len(s.prefixes))
+	for sn := range s.prefixes {
+		prefixes[sn] = true
+	}
+	return prefixes, s.gen
+}
+
+// setSynced records that the prefixes of generation gen were sent to peer i, or that
+// its session is down if up is false.
+func (s *Speaker) setSynced(i int, gen uint64, up bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if up {
+		s.synced[i] = gen
+	} else {
+		delete(s.synced, i)
+	}
+	close(s.syncedCh)
+	s.syncedCh = make(chan struct{})
+}
+
+// Run keeps the sessions to the peers up until ctx is done, when the prefixes are
+// withdrawn and the sessions closed.
+func (s *Speaker) Run(ctx context.Context) {
+	wg := sync.WaitGroup{}
+	for i, p := range s.cfg.Peers {
+		ss := &session{speaker: s, index: i, peer: p, changed: s.changed[i]}
+		wg.Add(1)
+		go func() {
+			ss.run(ctx)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+}
+
+type session struct {
+	speaker *Speaker
+	index   int
+	peer    Peer
+	changed chan struct{}
+
+	conn        net.Conn
+	hold        time.Duration
+	fourOctetAS bool
+	advertised  map[ip.IP4Net]bool
+}
+
+func (ss *session) addr() string {
+	if _, _, err := net.SplitHostPort(ss.peer.Address); err == nil {
+		return ss.peer.Address
+	}
+	return net.JoinHostPort(ss.peer.Address, bgpPort)
+}
+
+func (ss *session) run(ctx context.Context) {
+	interval := time.Second
+	for {
+		err := ss.connect(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			interval = time.Second
+			err = ss.established(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+		}
+		log.Warningf("BGP session to %s failed: %v", ss.addr(), err)
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+		if interval *= 2; interval > maxRedialInterval {
+			interval = maxRedialInterval
+		}
+	}
+}
+
+func (ss *session) send(b []byte) error {
+	ss.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := ss.conn.Write(b)
+	return err
+}
+
+// connect opens the session up to the established state.
+func (ss *session) connect(ctx context.Context) error {
+	cfg := ss.speaker.cfg
+	d := net.Dialer{Timeout: dialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", ss.addr())
+	if err != nil {
+		return err
+	}
+	ss.conn = conn
+
+	err = ss.send(encodeOpen(open{as: cfg.LocalAS, holdTime: uint16(cfg.HoldTime / time.Second), routerID: cfg.RouterID}))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(cfg.HoldTime))
+	msg, err := readMessage(conn)
+	if err == nil && msg.typ != msgOpen {
+		err = fmt.Errorf("expected OPEN, got message type %d", msg.typ)
+	}
+	var o open
+	if err == nil {
+		o, err = parseOpen(msg.body)
+	}
+	if err == nil && o.as != ss.peer.AS {
+		ss.send(encodeNotification(errOpen, errBadPeerAS))
+		err = fmt.Errorf("peer has AS %d, expected %d", o.as, ss.peer.AS)
+	}
+	if err == nil && !o.fourOctetAS && cfg.LocalAS > 0xffff {
+		err = fmt.Errorf("peer doesn't support the 4-octet local AS %d", cfg.LocalAS)
+	}
+	if err == nil {
+		err = ss.send(encodeKeepalive())
+	}
+	// The session is established once the peer confirms the OPEN with a KEEPALIVE
+	if err == nil {
+		msg, err = readMessage(conn)
+	}
+	if err == nil && msg.typ != msgKeepalive {
+		err = fmt.Errorf("expected KEEPALIVE, got message type %d", msg.typ)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	ss.hold = ss.holdTime(o.holdTime)
+	ss.fourOctetAS = o.fourOctetAS
+	ss.advertised = make(map[ip.IP4Net]bool)
+	log.Infof("BGP session to %s (AS %d) established", ss.addr(), o.as)
+	return nil
+}
+
+// holdTime negotiates the smaller of the configured hold time and the one of the peer.
+func (ss *session) holdTime(peerHoldTime uint16) time.Duration {
+	hold := ss.speaker.cfg.HoldTime
+	if peer := time.Duration(peerHoldTime) * time.Second; peer < hold {
+		hold = peer
+	}
+	return hold
+}
+
+// established keeps the session alive and the advertised prefixes in sync until the
+// session fails or ctx is done.
+func (ss *session) established(ctx context.Context) error {
+	defer ss.conn.Close()
+	defer ss.speaker.setSynced(ss.index, 0, false)
+
+	// A hold time of zero turns keepalives and the hold timer off
+	var keepalive <-chan time.Time
+	if ss.hold > 0 {
+		t := time.NewTicker(ss.hold / 3)
+		defer t.Stop()
+		keepalive = t.C
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			if ss.hold > 0 {
+				ss.conn.SetReadDeadline(time.Now().Add(ss.hold))
+			} else {
+				ss.conn.SetReadDeadline(time.Time{})
+			}
+			msg, err := readMessage(ss.conn)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					ss.send(encodeNotification(errHoldTimer, 0))
+					err = fmt.Errorf("hold timer expired")
+				}
+				readErr <- err
+				return
+			}
+			if msg.typ == msgNotification {
+				if len(msg.body) >= 2 {
+					err = fmt.Errorf("peer sent NOTIFICATION %d/%d", msg.body[0], msg.body[1])
+				} else {
+					err = fmt.Errorf("peer sent NOTIFICATION")
+				}
+				readErr <- err
+				return
+			}
+			// KEEPALIVEs and UPDATEs of the peer only reset the hold timer
+		}
+	}()
+
+	if err := ss.syncAnnounced(); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ss.changed:
+			if err := ss.syncAnnounced(); err != nil {
+				return err
+			}
+
+		case <-keepalive:
+			if err := ss.send(encodeKeepalive()); err != nil {
+				return err
+			}
+
+		case err := <-readErr:
+			return err
+
+		case <-ctx.Done():
+			if err := ss.sync(nil); err != nil {
+				return err
+			}
+			log.Infof("Closing BGP session to %s", ss.addr())
+			return ss.send(encodeNotification(errCease, ceaseShutdown))
+		}
+	}
+}
+
+// syncAnnounced advertises the prefixes of the speaker to the peer.
+func (ss *session) syncAnnounced() error {
+	prefixes, gen := ss.speaker.announced()
+	if err := ss.sync(prefixes); err != nil {
+		return err
+	}
+	ss.speaker.setSynced(ss.index, gen, true)
+	return nil
+}
+
+// sync sends the UPDATEs that change the advertised prefixes into prefixes.
+func (ss *session) sync(prefixes map[ip.IP4Net]bool) error {
+	var announce, withdraw []ip.IP4Net
+	for sn := range prefixes {
+		if !ss.advertised[sn] {
+			announce = append(announce, sn)
+		}
+	}
+	for sn := range ss.advertised {
+		if !prefixes[sn] {
+			withdraw = append(withdraw, sn)
+		}
+	}
+	sortPrefixes(announce)
+	sortPrefixes(withdraw)
+
+	cfg := ss.speaker.cfg
+	for len(announce) > 0 || len(withdraw) > 0 {
+		u := update{
+			localAS:     cfg.LocalAS,
+			fourOctetAS: ss.fourOctetAS,
+			ibgp:        ss.peer.AS == cfg.LocalAS,
+			nextHop:     cfg.NextHop,
+		}
+		u.withdrawn, withdraw = split(withdraw, maxPrefixesPerUpdate)
+		u.announced, announce = split(announce, maxPrefixesPerUpdate-len(u.withdrawn))
+		if err := ss.send(encodeUpdate(u)); err != nil {
+			return err
+		}
+
+		for _, sn := range u.withdrawn {
+			log.Infof("Withdrew %v from BGP peer %s", sn, ss.addr())
+			delete(ss.advertised, sn)
+		}
+		for _, sn := range u.announced {
+			log.Infof("Announced %v to BGP peer %s", sn, ss.addr())
+			ss.advertised[sn] = true
+		}
+	}
+	return nil
+}
+
+func split(prefixes []ip.IP4Net, n int) ([]ip.IP4Net, []ip.IP4Net) {
+	if len(prefixes) <= n {
+		return prefixes, nil
+	}
+	return prefixes[:n], prefixes[n:]
+}
+
+func sortPrefixes(prefixes []ip.IP4Net) {
+	sort.Slice(prefixes, func(i, j int) bool {
+		return prefixes[i].IP < prefixes[j].IP
+	})
+}
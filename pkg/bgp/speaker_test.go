@@ -0,0 +1,186 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+func mustParsePrefix(s string) ip.IP4Net {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return ip.FromIPNet(n)
+}
+
+// parsePrefixes decodes NLRI encoded prefixes.
+func parsePrefixes(t *testing.T, b []byte) []ip.IP4Net {
+	var prefixes []ip.IP4Net
+	for len(b) > 0 {
+		l := int(b[0])
+		n := (l + 7) / 8
+		addr := make(net.IP, 4)
+		copy(addr, b[1:1+n])
+		prefixes = append(prefixes, ip.IP4Net{IP: ip.FromIP(addr), PrefixLen: uint(l)})
+		b = b[1+n:]
+	}
+	return prefixes
+}
+
+func parseUpdate(t *testing.T, body []byte) (withdrawn, attrs, announced []byte) {
+	wl := int(binary.BigEndian.Uint16(body))
+	withdrawn = body[2 : 2+wl]
+	al := int(binary.BigEndian.Uint16(body[2+wl:]))
+	attrs = body[4+wl : 4+wl+al]
+	return withdrawn, attrs, body[4+wl+al:]
+}
+
+func TestEncodeUpdate(t *testing.T) {
+	msg := encodeUpdate(update{
+		announced: []ip.IP4Net{mustParsePrefix("10.244.7.0/24")},
+		withdrawn: []ip.IP4Net{mustParsePrefix("10.244.0.0/17")},
+		localAS:   64512,
+		nextHop:   net.ParseIP("192.168.1.7"),
+	})
+	m, err := readMessage(bytes.NewReader(msg))
+	if err != nil || m.typ != msgUpdate {
+		t.Fatalf("unexpected message %v: %v", m, err)
+	}
+
+	withdrawn, attrs, announced := parseUpdate(t, m.body)
+	if !bytes.Equal(withdrawn, []byte{17, 10, 244, 0}) {
+		t.Errorf("unexpected withdrawn routes %v", withdrawn)
+	}
+	if !bytes.Equal(announced, []byte{24, 10, 244, 7}) {
+		t.Errorf("unexpected NLRI %v", announced)
+	}
+	want := []byte{
+		0x40, attrOrigin, 1, originIGP,
+		0x40, attrASPath, 4, asSequence, 1, 0xfc, 0x00,
+		0x40, attrNextHop, 4, 192, 168, 1, 7,
+	}
+	if !bytes.Equal(attrs, want) {
+		t.Errorf("expected attributes %v, got %v", want, attrs)
+	}
+}
+
+func TestParsePeers(t *testing.T) {
+	peers, err := ParsePeers("10.0.0.1=64512, 10.0.0.2:1179=4200000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 || peers[0] != (Peer{"10.0.0.1", 64512}) || peers[1] != (Peer{"10.0.0.2:1179", 4200000000}) {
+		t.Errorf("unexpected peers %v", peers)
+	}
+	for _, s := range []string{"10.0.0.1", "10.0.0.1=0", "switch=64512", "10.0.0.1=as1"} {
+		if _, err := ParsePeers(s); err == nil {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+}
+
+func expectMessage(t *testing.T, conn net.Conn, typ byte) message {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	m, err := readMessage(conn)
+	if err != nil {
+		t.Fatalf("expected message type %d: %v", typ, err)
+	}
+	if m.typ != typ {
+		t.Fatalf("expected message type %d, got %d", typ, m.typ)
+	}
+	return m
+}
+
+func TestSpeaker(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	s, err := NewSpeaker(Config{
+		LocalAS:  4200000000,
+		RouterID: net.ParseIP("10.0.0.1"),
+		NextHop:  net.ParseIP("192.168.1.7"),
+		Peers:    []Peer{{Address: l.Addr().String(), AS: 64513}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn := mustParsePrefix("10.244.7.0/24")
+	s.Announce(sn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	o, err := parseOpen(expectMessage(t, conn, msgOpen).body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.as != 4200000000 || !o.fourOctetAS || o.holdTime != 90 || !o.routerID.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("unexpected OPEN %+v", o)
+	}
+
+	conn.Write(encodeOpen(open{as: 64513, holdTime: 30, routerID: net.ParseIP("10.0.0.254")}))
+	conn.Write(encodeKeepalive())
+	expectMessage(t, conn, msgKeepalive)
+
+	_, _, announced := parseUpdate(t, expectMessage(t, conn, msgUpdate).body)
+	if p := parsePrefixes(t, announced); len(p) != 1 || p[0] != sn {
+		t.Errorf("expected %v to be announced, got %v", sn, p)
+	}
+
+	withdrawErr := make(chan error, 1)
+	go func() {
+		withdrawErr <- s.Withdraw(context.Background(), sn)
+	}()
+	withdrawn, _, _ := parseUpdate(t, expectMessage(t, conn, msgUpdate).body)
+	if p := parsePrefixes(t, withdrawn); len(p) != 1 || p[0] != sn {
+		t.Errorf("expected %v to be withdrawn, got %v", sn, p)
+	}
+	select {
+	case err := <-withdrawErr:
+		if err != nil {
+			t.Errorf("expected the withdrawal to be sent, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected Withdraw to return once the withdrawal was sent")
+	}
+
+	cancel()
+	if m := expectMessage(t, conn, msgNotification); m.body[0] != errCease {
+		t.Errorf("expected a Cease NOTIFICATION, got %v", m.body)
+	}
+	<-done
+}
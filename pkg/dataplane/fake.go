@@ -0,0 +1,413 @@
+// +build !windows
+
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dataplane
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+// calls records the operations made on a fake and the errors to fail them with.
+type calls struct {
+	mux   sync.Mutex
+	calls []string
+	// Errors makes the operations named by the keys, e.g. "RouteAdd", fail with the
+	// error instead of changing the state of the fake. Failed operations are recorded too.
+	Errors map[string]error
+}
+
+func (c *calls) record(op, format string, args ...interface{}) error {
+	c.calls = append(c.calls, op+" "+fmt.Sprintf(format, args...))
+	return c.Errors[op]
+}
+
+// Calls returns the operations made since the last call of Calls or Expect.
+func (c *calls) Calls() []string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	calls := c.calls
+	c.calls = nil
+	return calls
+}
+
+// Expect fails t unless the operations made since the last call of Calls or Expect
+// are exactly want, in this order.
+func (c *calls) Expect(t testing.TB, want ...string) {
+	t.Helper()
+
+	got := c.Calls()
+	if len(got) == 0 && len(want) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected operations:\ngot:\n\t%s\nwant:\n\t%s", strings.Join(got, "\n\t"), strings.Join(want, "\n\t"))
+	}
+}
+
+// FakeNetlink is a Netlink that keeps links, routes and neighbors in memory and records
+// the operations that change them, e.g. "RouteAdd 10.1.1.0/24 via 192.168.0.2 dev 2".
+type FakeNetlink struct {
+	calls
+	links  []netlink.Link
+	routes []netlink.Route
+	neighs []netlink.Neigh
+	subs   []routeSub
+}
+
+type routeSub struct {
+	ch   chan<- netlink.RouteUpdate
+	done <-chan struct{}
+}
+
+var _ Netlink = &FakeNetlink{}
+
+func NewFakeNetlink() *FakeNetlink {
+	return &FakeNetlink{}
+}
+
+// AddLinks sets up links for LinkByName.
+func (f *FakeNetlink) AddLinks(links ...netlink.Link) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.links = append(f.links, links...)
+}
+
+// AddRoutes sets up routes without recording them as operations.
+func (f *FakeNetlink) AddRoutes(routes ...netlink.Route) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.routes = append(f.routes, routes...)
+}
+
+// DeleteRoutes deletes routes behind the back of the user of the fake, without recording
+// them as operations, and notifies the subscribers of RouteSubscribe.
+func (f *FakeNetlink) DeleteRoutes(routes ...netlink.Route) {
+	f.mux.Lock()
+	for _, route := range routes {
+		if i := f.routeIndex(route.Dst); i >= 0 {
+			f.routes = append(f.routes[:i], f.routes[i+1:]...)
+		}
+	}
+	subs := append([]routeSub(nil), f.subs...)
+	f.mux.Unlock()
+
+	// The subscribers may use the fake when handling the updates
+	for _, route := range routes {
+		for _, sub := range subs {
+			select {
+			case sub.ch <- netlink.RouteUpdate{Type: syscall.RTM_DELROUTE, Route: route}:
+			case <-sub.done:
+			}
+		}
+	}
+}
+
+// Routes returns the routes in the fake routing table.
+func (f *FakeNetlink) Routes() []netlink.Route {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	return append([]netlink.Route(nil), f.routes...)
+}
+
+// Neighs returns the neighbors in the fake neighbor tables.
+func (f *FakeNetlink) Neighs() []netlink.Neigh {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	return append([]netlink.Neigh(nil), f.neighs...)
+}
+
+func (f *FakeNetlink) LinkByName(name string) (netlink.Link, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if err := f.Errors["LinkByName"]; err != nil {
+		return nil, err
+	}
+	for _, l := range f.links {
+		if l.Attrs().Name == name {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("link %s not found", name)
+}
+
+func (f *FakeNetlink) RouteAdd(route *netlink.Route) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if err := f.record("RouteAdd", "%s", routeString(route)); err != nil {
+		return err
+	}
+	if f.routeIndex(route.Dst) >= 0 {
+		return syscall.EEXIST
+	}
+	f.routes = append(f.routes, *route)
+	return nil
+}
+
+func (f *FakeNetlink) RouteReplace(route *netlink.Route) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if err := f.record("RouteReplace", "%s", routeString(route)); err != nil {
+		return err
+	}
+	if i := f.routeIndex(route.Dst); i >= 0 {
+		f.routes[i] = *route
+	} else {
+		f.routes = append(f.routes, *route)
+	}
+	return nil
+}
+
+func (f *FakeNetlink) RouteDel(route *netlink.Route) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if err := f.record("RouteDel", "%s", routeString(route)); err != nil {
+		return err
+	}
+	i := f.routeIndex(route.Dst)
+	if i < 0 {
+		return syscall.ESRCH
+	}
+	f.routes = append(f.routes[:i], f.routes[i+1:]...)
+	return nil
+}
+
+func (f *FakeNetlink) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	filter := &netlink.Route{}
+	var mask uint64
+	if link != nil {
+		filter.LinkIndex = link.Attrs().Index
+		mask = netlink.RT_FILTER_OIF
+	}
+	return f.RouteListFiltered(family, filter, mask)
+}
+
+// RouteListFiltered supports filtering by destination, gateway and link.
+func (f *FakeNetlink) RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if err := f.Errors["RouteList"]; err != nil {
+		return nil, err
+	}
+
+	var routes []netlink.Route
+	for _, r := range f.routes {
+		switch {
+		case filterMask&netlink.RT_FILTER_DST != 0 && !ipNetEqual(r.Dst, filter.Dst):
+		case filterMask&netlink.RT_FILTER_GW != 0 && !r.Gw.Equal(filter.Gw):
+		case filterMask&netlink.RT_FILTER_OIF != 0 && r.LinkIndex != filter.LinkIndex:
+		default:
+			routes = append(routes, r)
+		}
+	}
+	return routes, nil
+}
+
+func (f *FakeNetlink) RouteSubscribe(ch chan<- netlink.RouteUpdate, done <-chan struct{}) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if err := f.Errors["RouteSubscribe"]; err != nil {
+		return err
+	}
+	f.subs = append(f.subs, routeSub{ch: ch, done: done})
+	return nil
+}
+
+func (f *FakeNetlink) NeighSet(neigh *netlink.Neigh) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if err := f.record("NeighSet", "%s", neighString(neigh)); err != nil {
+		return err
+	}
+	if i := f.neighIndex(neigh); i >= 0 {
+		f.neighs[i] = *neigh
+	} else {
+		f.neighs = append(f.neighs, *neigh)
+	}
+	return nil
+}
+
+func (f *FakeNetlink) NeighDel(neigh *netlink.Neigh) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if err := f.record("NeighDel", "%s", neighString(neigh)); err != nil {
+		return err
+	}
+	i := f.neighIndex(neigh)
+	if i < 0 {
+		return syscall.ENOENT
+	}
+	f.neighs = append(f.neighs[:i], f.neighs[i+1:]...)
+	return nil
+}
+
+func (f *FakeNetlink) NeighList(linkIndex, family int) ([]netlink.Neigh, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if err := f.Errors["NeighList"]; err != nil {
+		return nil, err
+	}
+
+	var neighs []netlink.Neigh
+	for _, n := range f.neighs {
+		if (linkIndex == 0 || n.LinkIndex == linkIndex) && (family == 0 || n.Family == family) {
+			neighs = append(neighs, n)
+		}
+	}
+	return neighs, nil
+}
+
+func (f *FakeNetlink) routeIndex(dst *net.IPNet) int {
+	for i, r := range f.routes {
+		if ipNetEqual(r.Dst, dst) {
+			return i
+		}
+	}
+	return -1
+}
+
+// neighIndex finds the entry neigh replaces: FDB entries are keyed by MAC and other
+// entries by IP, like the kernel does for a vxlan device.
+func (f *FakeNetlink) neighIndex(neigh *netlink.Neigh) int {
+	for i, n := range f.neighs {
+		if n.LinkIndex != neigh.LinkIndex || n.Family != neigh.Family {
+			continue
+		}
+		if neigh.Family == syscall.AF_BRIDGE && bytes.Equal(n.HardwareAddr, neigh.HardwareAddr) ||
+			neigh.Family != syscall.AF_BRIDGE && n.IP.Equal(neigh.IP) {
+			return i
+		}
+	}
+	return -1
+}
+
+func ipNetEqual(x, y *net.IPNet) bool {
+	if x == nil || y == nil {
+		return x == y
+	}
+	return x.String() == y.String()
+}
+
+func routeString(r *netlink.Route) string {
+	s := fmt.Sprint(r.Dst)
+	if r.Gw != nil {
+		s += " via " + r.Gw.String()
+	}
+	if r.LinkIndex != 0 {
+		s += fmt.Sprintf(" dev %d", r.LinkIndex)
+	}
+	return s
+}
+
+func neighString(n *netlink.Neigh) string {
+	kind := "arp"
+	if n.Family == syscall.AF_BRIDGE {
+		kind = "fdb"
+	}
+	return fmt.Sprintf("%s %v lladdr %v dev %d", kind, n.IP, n.HardwareAddr, n.LinkIndex)
+}
+
+// FakeIPTables keeps iptables rules in memory and records the operations that change
+// them, e.g. "AppendUnique nat POSTROUTING -s 10.1.0.0/16 -j RETURN". It implements
+// network.IPTables.
+type FakeIPTables struct {
+	calls
+	rules map[string][]string
+}
+
+func NewFakeIPTables() *FakeIPTables {
+	return &FakeIPTables{rules: make(map[string][]string)}
+}
+
+// Rules returns the rules of a chain in the form of their rulespecs.
+func (f *FakeIPTables) Rules(table, chain string) []string {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	return append([]string(nil), f.rules[table+" "+chain]...)
+}
+
+func (f *FakeIPTables) AppendUnique(table string, chain string, rulespec ...string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	rule := strings.Join(rulespec, " ")
+	if err := f.record("AppendUnique", "%s %s %s", table, chain, rule); err != nil {
+		return err
+	}
+	if f.ruleIndex(table, chain, rule) < 0 {
+		f.rules[table+" "+chain] = append(f.rules[table+" "+chain], rule)
+	}
+	return nil
+}
+
+func (f *FakeIPTables) Delete(table string, chain string, rulespec ...string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	rule := strings.Join(rulespec, " ")
+	if err := f.record("Delete", "%s %s %s", table, chain, rule); err != nil {
+		return err
+	}
+	i := f.ruleIndex(table, chain, rule)
+	if i < 0 {
+		return fmt.Errorf("no rule %q in %s %s", rule, table, chain)
+	}
+	rules := f.rules[table+" "+chain]
+	f.rules[table+" "+chain] = append(rules[:i], rules[i+1:]...)
+	return nil
+}
+
+func (f *FakeIPTables) Exists(table string, chain string, rulespec ...string) (bool, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if err := f.Errors["Exists"]; err != nil {
+		return false, err
+	}
+	return f.ruleIndex(table, chain, strings.Join(rulespec, " ")) >= 0, nil
+}
+
+func (f *FakeIPTables) ruleIndex(table, chain, rule string) int {
+	for i, r := range f.rules[table+" "+chain] {
+		if r == rule {
+			return i
+		}
+	}
+	return -1
+}
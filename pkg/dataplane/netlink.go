@@ -0,0 +1,54 @@
+// +build !windows
+
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dataplane holds the interfaces through which backends program the kernel,
+// so that tests can swap in the fakes of this package and check the exact operations.
+package dataplane
+
+import (
+	"github.com/vishvananda/netlink"
+)
+
+// Netlink is the part of the netlink API used to program routes and neighbors.
+type Netlink interface {
+	LinkByName(name string) (netlink.Link, error)
+
+	RouteAdd(route *netlink.Route) error
+	RouteReplace(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+	RouteList(link netlink.Link, family int) ([]netlink.Route, error)
+	RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error)
+	// RouteSubscribe sends the changes of the routing table to ch until done is closed.
+	RouteSubscribe(ch chan<- netlink.RouteUpdate, done <-chan struct{}) error
+
+	NeighSet(neigh *netlink.Neigh) error
+	NeighDel(neigh *netlink.Neigh) error
+	NeighList(linkIndex, family int) ([]netlink.Neigh, error)
+}
+
+// handle adds the subscriptions, which netlink only has as functions, to *netlink.Handle.
+type handle struct {
+	*netlink.Handle
+}
+
+func (h handle) RouteSubscribe(ch chan<- netlink.RouteUpdate, done <-chan struct{}) error {
+	return netlink.RouteSubscribe(ch, done)
+}
+
+// NewNetlink returns a Netlink that operates in the current network namespace.
+func NewNetlink() Netlink {
+	return handle{&netlink.Handle{}}
+}
@@ -0,0 +1,162 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/fileutil"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+const (
+	// FormatHosts writes lines like /etc/hosts: "192.168.1.7 10-244-7-0--24.nodes.flannel.local node-a".
+	FormatHosts = "hosts"
+	// FormatDnsmasq writes host-record lines dnsmasq reads with conf-file or conf-dir.
+	FormatDnsmasq = "dnsmasq"
+
+	// HostnameLabel is the lease label whose value is added as a name of the node,
+	// as set by the kube subnet manager from the node labels.
+	HostnameLabel = "kubernetes.io/hostname"
+)
+
+// HostsExporter renders the leases into a file mapping the names of the subnets, and
+// the host names of the nodes when known, to the public IPs of the nodes owning them.
+// The file is rewritten whenever the leases change.
+type HostsExporter struct {
+	path   string
+	format string
+	domain string
+
+	mux     sync.Mutex
+	leases  map[ip.IP4Net]subnet.Lease
+	written []byte
+	// changed is signaled when the leases change, for Run to rewrite the file
+	changed chan struct{}
+}
+
+func NewHostsExporter(path, format, domain string) (*HostsExporter, error) {
+	if format != FormatHosts && format != FormatDnsmasq {
+		return nil, fmt.Errorf("unknown format %q, must be %q or %q", format, FormatHosts, FormatDnsmasq)
+	}
+	return &HostsExporter{
+		path:    path,
+		format:  format,
+		domain:  normalizeDomain(domain),
+		leases:  make(map[ip.IP4Net]subnet.Lease),
+		changed: make(chan struct{}, 1),
+	}, nil
+}
+
+// HandleEvents updates the leases from a batch of lease events and rewrites the file.
+func (e *HostsExporter) HandleEvents(batch []subnet.Event) error {
+	e.update(batch)
+	return e.write()
+}
+
+func (e *HostsExporter) update(batch []subnet.Event) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	for _, evt := range batch {
+		switch evt.Type {
+		case subnet.EventAdded:
+			e.leases[evt.Lease.Subnet] = evt.Lease
+		case subnet.EventRemoved:
+			delete(e.leases, evt.Lease.Subnet)
+		}
+	}
+}
+
+// write rewrites the file if the leases changed since it was last written.
+func (e *HostsExporter) write() error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	content := e.render()
+	if e.written != nil && bytes.Equal(content, e.written) {
+		return nil
+	}
+	if err := fileutil.WriteFileAtomic(e.path, content, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", e.path, err)
+	}
+	e.written = content
+	return nil
+}
+
+// Run keeps the file in sync with the leases of cache until ctx is done. The file is
+// written by Run rather than by the handler of the cache, so that a slow disk doesn't
+// hold up the other consumers of the leases, and bursts of changes are written once.
+func (e *HostsExporter) Run(ctx context.Context, cache *subnet.LeaseCache, ownLease *subnet.Lease) {
+	log.Infof("Exporting the leases to %s", e.path)
+
+	// The peer selector may leave out the lease of this node
+	e.update([]subnet.Event{{Type: subnet.EventAdded, Lease: *ownLease}})
+	cache.OnEvents(func(batch []subnet.Event) {
+		e.update(batch)
+		select {
+		case e.changed <- struct{}{}:
+		default:
+		}
+	})
+
+	for {
+		if err := e.write(); err != nil {
+			log.Error(err)
+		}
+		select {
+		case <-e.changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (e *HostsExporter) render() []byte {
+	leases := make([]subnet.Lease, 0, len(e.leases))
+	for _, l := range e.leases {
+		leases = append(leases, l)
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].Subnet.IP < leases[j].Subnet.IP
+	})
+
+	var b bytes.Buffer
+	b.WriteString("# Generated by flanneld from the subnet leases, do not edit.\n")
+	for _, l := range leases {
+		names := subnetName(l.Subnet, e.domain)
+		sep := " "
+		if e.format == FormatDnsmasq {
+			sep = ","
+		}
+		if hostname := l.Attrs.Labels[HostnameLabel]; hostname != "" {
+			names += sep + hostname
+		}
+
+		if e.format == FormatDnsmasq {
+			fmt.Fprintf(&b, "host-record=%s,%s\n", names, l.Attrs.PublicIP)
+		} else {
+			fmt.Fprintf(&b, "%s\t%s\n", l.Attrs.PublicIP, names)
+		}
+	}
+	return b.Bytes()
+}
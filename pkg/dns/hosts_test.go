@@ -0,0 +1,82 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+func TestHostsExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sn1 := ip.IP4Net{IP: ip.FromIP(net.ParseIP("10.244.8.0")), PrefixLen: 24}
+	sn2 := ip.IP4Net{IP: ip.FromIP(net.ParseIP("10.244.7.0")), PrefixLen: 24}
+	batch := []subnet.Event{
+		{Type: subnet.EventAdded, Lease: subnet.Lease{Subnet: sn1, Attrs: subnet.LeaseAttrs{PublicIP: ip.FromIP(net.ParseIP("192.168.1.8"))}}},
+		{Type: subnet.EventAdded, Lease: subnet.Lease{Subnet: sn2, Attrs: subnet.LeaseAttrs{
+			PublicIP: ip.FromIP(net.ParseIP("192.168.1.7")),
+			Labels:   map[string]string{HostnameLabel: "node-a"},
+		}}},
+	}
+
+	for _, tc := range []struct {
+		format string
+		want   string
+	}{
+		{FormatHosts, "# Generated by flanneld from the subnet leases, do not edit.\n" +
+			"192.168.1.7\t10-244-7-0--24.nodes.flannel.local node-a\n" +
+			"192.168.1.8\t10-244-8-0--24.nodes.flannel.local\n"},
+		{FormatDnsmasq, "# Generated by flanneld from the subnet leases, do not edit.\n" +
+			"host-record=10-244-7-0--24.nodes.flannel.local,node-a,192.168.1.7\n" +
+			"host-record=10-244-8-0--24.nodes.flannel.local,192.168.1.8\n"},
+	} {
+		path := filepath.Join(dir, tc.format)
+		e, err := NewHostsExporter(path, tc.format, DefaultDomain+".")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := e.HandleEvents(batch); err != nil {
+			t.Fatal(err)
+		}
+		if content, _ := ioutil.ReadFile(path); string(content) != tc.want {
+			t.Errorf("%s: expected\n%s\ngot\n%s", tc.format, tc.want, content)
+		}
+	}
+
+	path := filepath.Join(dir, FormatHosts)
+	e, _ := NewHostsExporter(path, FormatHosts, DefaultDomain)
+	e.HandleEvents(batch)
+	e.HandleEvents([]subnet.Event{{Type: subnet.EventRemoved, Lease: subnet.Lease{Subnet: sn2}}})
+	want := "# Generated by flanneld from the subnet leases, do not edit.\n" +
+		"192.168.1.8\t10-244-8-0--24.nodes.flannel.local\n"
+	if content, _ := ioutil.ReadFile(path); string(content) != want {
+		t.Errorf("expected the removed lease to be dropped, got\n%s", content)
+	}
+
+	if _, err := NewHostsExporter(path, "bind", DefaultDomain); err == nil {
+		t.Error("expected an unknown format to be rejected")
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dns implements a small DNS responder that maps the subnets of the
+// flannel network to the public IPs of the nodes owning them, e.g.
+// 10-244-7-0--24.nodes.flannel.local resolves to the node that leased
+// 10.244.7.0/24, and the reverse (PTR) record of that node's public IP
+// points back at the name of its subnet.
+//
+// It only answers A and PTR queries over UDP and is meant for debugging and
+// external tooling, not as a general purpose name server. For resolvers that
+// can't forward to it, HostsExporter writes the same records to a hosts or
+// dnsmasq file.
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+const (
+	DefaultDomain = "nodes.flannel.local"
+
+	ttl = 30
+
+	typeA   = 1
+	typePTR = 12
+	classIN = 1
+
+	rcodeSuccess        = 0
+	rcodeFormatError    = 1
+	rcodeNameError      = 3
+	rcodeNotImplemented = 4
+
+	headerLen  = 12
+	maxMsgSize = 512
+)
+
+var errMalformed = errors.New("malformed DNS message")
+
+type Server struct {
+	domain string
+
+	mux    sync.RWMutex
+	names  map[string]ip.IP4Net
+	leases map[ip.IP4Net]ip.IP4
+}
+
+func NewServer(domain string) *Server {
+	return &Server{
+		domain: normalizeDomain(domain),
+		names:  make(map[string]ip.IP4Net),
+		leases: make(map[ip.IP4Net]ip.IP4),
+	}
+}
+
+// Name returns the fully qualified name of sn, e.g. 10-244-7-0--24.nodes.flannel.local.
+func (s *Server) Name(sn ip.IP4Net) string {
+	return subnetName(sn, s.domain)
+}
+
+func subnetName(sn ip.IP4Net, domain string) string {
+	return fmt.Sprintf("%s.%s", sn.StringSep("-", "--"), domain)
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.Trim(domain, "."))
+}
+
+// HandleEvents updates the records from a batch of lease events.
+func (s *Server) HandleEvents(batch []subnet.Event) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for _, evt := range batch {
+		sn := evt.Lease.Subnet
+		switch evt.Type {
+		case subnet.EventAdded:
+			s.names[s.Name(sn)] = sn
+			s.leases[sn] = evt.Lease.Attrs.PublicIP
+		case subnet.EventRemoved:
+			delete(s.names, s.Name(sn))
+			delete(s.leases, sn)
+		}
+	}
+}
+
+// Run serves DNS queries on the UDP address addr and keeps the records in sync with
+// the leases of cache until ctx is done.
+func (s *Server) Run(ctx context.Context, cache *subnet.LeaseCache, ownLease *subnet.Lease, addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	defer conn.Close()
+	log.Infof("Serving DNS for %s on %s", s.domain, addr)
+
+	// The peer selector may leave out the lease of this node
+	s.HandleEvents([]subnet.Event{{Type: subnet.EventAdded, Lease: *ownLease}})
+	cache.OnEvents(s.HandleEvents)
+
+	// Unblock ReadFrom when ctx is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	buf := make([]byte, maxMsgSize)
+	for {
+		n, raddr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to read DNS query: %v", err)
+		}
+
+		resp := s.handle(buf[:n])
+		if resp == nil {
+			continue
+		}
+		if _, err := conn.WriteTo(resp, raddr); err != nil {
+			log.Warningf("Failed to send DNS response to %v: %v", raddr, err)
+		}
+	}
+}
+
+type question struct {
+	name  string
+	qtype uint16
+	// raw is the question section as sent by the client
+	raw []byte
+}
+
+// handle builds the response to the query req, or returns nil if req should be ignored.
+func (s *Server) handle(req []byte) []byte {
+	if len(req) < headerLen {
+		return nil
+	}
+	id := binary.BigEndian.Uint16(req[0:2])
+	flags := binary.BigEndian.Uint16(req[2:4])
+	if flags&0x8000 != 0 {
+		// Not a query
+		return nil
+	}
+	rd := flags & 0x0100
+
+	if opcode := (flags >> 11) & 0xf; opcode != 0 {
+		return response(id, rd, rcodeNotImplemented, nil, nil)
+	}
+	if qdcount := binary.BigEndian.Uint16(req[4:6]); qdcount != 1 {
+		return response(id, rd, rcodeFormatError, nil, nil)
+	}
+
+	q, err := parseQuestion(req[headerLen:])
+	if err != nil {
+		return response(id, rd, rcodeFormatError, nil, nil)
+	}
+
+	rcode, answers := s.answer(q)
+	return response(id, rd, rcode, &q, answers)
+}
+
+func (s *Server) answer(q question) (int, [][]byte) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	if strings.HasSuffix(q.name, ".in-addr.arpa") {
+		pip, ok := parseReverseName(q.name)
+		if !ok {
+			return rcodeNameError, nil
+		}
+		var answers [][]byte
+		for sn, publicIP := range s.leases {
+			if publicIP != pip {
+				continue
+			}
+			if q.qtype == typePTR {
+				answers = append(answers, record(typePTR, encodeName(s.Name(sn))))
+			}
+		}
+		if len(answers) == 0 && q.qtype == typePTR {
+			return rcodeNameError, nil
+		}
+		return rcodeSuccess, answers
+	}
+
+	sn, ok := s.names[q.name]
+	if !ok {
+		return rcodeNameError, nil
+	}
+	if q.qtype != typeA {
+		// The name exists, but there is no record of the requested type
+		return rcodeSuccess, nil
+	}
+	publicIP := s.leases[sn]
+	return rcodeSuccess, [][]byte{record(typeA, publicIP.ToIP().To4())}
+}
+
+func parseQuestion(msg []byte) (question, error) {
+	var labels []string
+	off := 0
+	for {
+		if off >= len(msg) {
+			return question{}, errMalformed
+		}
+		l := int(msg[off])
+		off++
+		if l == 0 {
+			break
+		}
+		if l&0xc0 != 0 || off+l > len(msg) {
+			// Compression pointers make no sense in the first name of a message
+			return question{}, errMalformed
+		}
+		labels = append(labels, string(msg[off:off+l]))
+		off += l
+	}
+	if off+4 > len(msg) {
+		return question{}, errMalformed
+	}
+
+	return question{
+		name:  strings.ToLower(strings.Join(labels, ".")),
+		qtype: binary.BigEndian.Uint16(msg[off : off+2]),
+		raw:   msg[:off+4],
+	}, nil
+}
+
+// parseReverseName parses a name like 4.3.2.1.in-addr.arpa.
+func parseReverseName(name string) (ip.IP4, bool) {
+	octets := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+	if len(octets) != 4 {
+		return 0, false
+	}
+	addr := net.ParseIP(fmt.Sprintf("%s.%s.%s.%s", octets[3], octets[2], octets[1], octets[0]))
+	if addr == nil || addr.To4() == nil {
+		return 0, false
+	}
+	return ip.FromIP(addr), true
+}
+
+func encodeName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.Trim(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// record encodes a resource record for the name of the question, which is
+// referenced through a compression pointer to offset 12 of the message.
+func record(rtype uint16, rdata []byte) []byte {
+	b := make([]byte, 12, 12+len(rdata))
+	binary.BigEndian.PutUint16(b[0:2], 0xc000|headerLen)
+	binary.BigEndian.PutUint16(b[2:4], rtype)
+	binary.BigEndian.PutUint16(b[4:6], classIN)
+	binary.BigEndian.PutUint32(b[6:10], ttl)
+	binary.BigEndian.PutUint16(b[10:12], uint16(len(rdata)))
+	return append(b, rdata...)
+}
+
+func response(id, rd uint16, rcode int, q *question, answers [][]byte) []byte {
+	b := make([]byte, headerLen, maxMsgSize)
+	binary.BigEndian.PutUint16(b[0:2], id)
+	// QR and AA set, RD copied from the query
+	binary.BigEndian.PutUint16(b[2:4], 0x8400|rd|uint16(rcode))
+	if q == nil {
+		return b
+	}
+
+	binary.BigEndian.PutUint16(b[4:6], 1)
+	b = append(b, q.raw...)
+
+	var ancount uint16
+	for _, a := range answers {
+		if len(b)+len(a) > maxMsgSize {
+			// Not all answers fit, mark the response as truncated
+			b[2] |= 0x02
+			break
+		}
+		b = append(b, a...)
+		ancount++
+	}
+	binary.BigEndian.PutUint16(b[6:8], ancount)
+	return b
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+func query(name string, qtype uint16) []byte {
+	b := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	b = append(b, encodeName(name)...)
+	return append(b, byte(qtype>>8), byte(qtype), 0, classIN)
+}
+
+func parseResponse(t *testing.T, q, resp []byte) (rcode int, ancount int, rdata []byte) {
+	if len(resp) < headerLen {
+		t.Fatalf("short response: %v", resp)
+	}
+	if id := binary.BigEndian.Uint16(resp[0:2]); id != 0x1234 {
+		t.Fatalf("expected ID 0x1234, got %#x", id)
+	}
+	rcode = int(resp[3] & 0xf)
+	ancount = int(binary.BigEndian.Uint16(resp[6:8]))
+	if ancount > 0 {
+		// Skip the header and question, then the fixed part of the first answer
+		off := len(q) + 10
+		rdlen := int(binary.BigEndian.Uint16(resp[off : off+2]))
+		rdata = resp[off+2 : off+2+rdlen]
+	}
+	return
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer(DefaultDomain)
+	sn := ip.IP4Net{IP: ip.FromIP(net.ParseIP("10.244.7.0")), PrefixLen: 24}
+	removed := ip.IP4Net{IP: ip.FromIP(net.ParseIP("10.244.8.0")), PrefixLen: 24}
+	s.HandleEvents([]subnet.Event{
+		{Type: subnet.EventAdded, Lease: subnet.Lease{Subnet: sn, Attrs: subnet.LeaseAttrs{PublicIP: ip.FromIP(net.ParseIP("192.168.1.7"))}}},
+		{Type: subnet.EventAdded, Lease: subnet.Lease{Subnet: removed, Attrs: subnet.LeaseAttrs{PublicIP: ip.FromIP(net.ParseIP("192.168.1.8"))}}},
+		{Type: subnet.EventRemoved, Lease: subnet.Lease{Subnet: removed}},
+	})
+
+	if name := s.Name(sn); name != "10-244-7-0--24.nodes.flannel.local" {
+		t.Errorf("unexpected name %q", name)
+	}
+
+	q := query("10-244-7-0--24.Nodes.Flannel.Local", typeA)
+	rcode, ancount, rdata := parseResponse(t, q, s.handle(q))
+	if rcode != rcodeSuccess || ancount != 1 || !net.IP(rdata).Equal(net.ParseIP("192.168.1.7")) {
+		t.Errorf("A: unexpected response rcode=%d ancount=%d rdata=%v", rcode, ancount, rdata)
+	}
+
+	q = query("10-244-7-0--24.nodes.flannel.local", 28)
+	rcode, ancount, _ = parseResponse(t, q, s.handle(q))
+	if rcode != rcodeSuccess || ancount != 0 {
+		t.Errorf("AAAA: unexpected response rcode=%d ancount=%d", rcode, ancount)
+	}
+
+	q = query("7.1.168.192.in-addr.arpa", typePTR)
+	rcode, ancount, rdata = parseResponse(t, q, s.handle(q))
+	if rcode != rcodeSuccess || ancount != 1 || string(rdata) != string(encodeName("10-244-7-0--24.nodes.flannel.local")) {
+		t.Errorf("PTR: unexpected response rcode=%d ancount=%d rdata=%q", rcode, ancount, rdata)
+	}
+
+	for _, q := range [][]byte{query("10-244-8-0--24.nodes.flannel.local", typeA), query("8.1.168.192.in-addr.arpa", typePTR)} {
+		if rcode, _, _ := parseResponse(t, q, s.handle(q)); rcode != rcodeNameError {
+			t.Errorf("expected NXDOMAIN for a removed lease, got rcode %d", rcode)
+		}
+	}
+
+	q = query("10-244-7-0--24.nodes.flannel.local", typeA)
+	if resp := s.handle(q[:len(q)-3]); resp == nil || int(resp[3]&0xf) != rcodeFormatError {
+		t.Errorf("expected FORMERR for a truncated query, got %v", resp)
+	}
+}
@@ -0,0 +1,398 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hooks runs external programs on lease events, so that operators can
+// integrate e.g. firewalling or route announcements with flannel without
+// modifying it.
+package hooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/fileutil"
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/pkg/negcache"
+	"github.com/coreos/flannel/subnet"
+)
+
+const (
+	// DefaultTimeout is how long a hook may run before it's killed.
+	DefaultTimeout = 30 * time.Second
+
+	// workers is how many hooks Run runs at the same time, for different subnets.
+	workers = 4
+
+	// Failed hooks are retried with the backoff of the peers in the backend quarantine.
+	retryBase = 5 * time.Second
+	retryMax  = 5 * time.Minute
+)
+
+// Runner executes the hooks of lease events. The hooks of a subnet run one at a time in
+// the order of its events, the ones of different subnets in parallel.
+// The lease is passed in environment variables:
+//
+//   LEASE_EVENT   "added" or "removed"
+//   SUBNET        the subnet of the lease, e.g. 10.244.7.0/24
+//   PUBLIC_IP     the public IP of the node
+//   PUBLIC_IPV6   the public IPv6 address of the node, if any
+//   BACKEND_TYPE  the backend type of the node
+//   BACKEND_DATA  the backend data of the node, as JSON
+//   LEASE_LABELS  the labels of the lease, as comma separated key=value pairs
+type Runner struct {
+	// Added and Removed are the programs run on added and removed leases. Either may be empty.
+	Added   string
+	Removed string
+	Timeout time.Duration
+	// StatePath is the file the leases the hooks ran for are saved to, so that a restarted
+	// flanneld only runs the hooks of the leases that changed meanwhile. Disabled if empty.
+	StatePath string
+
+	mux   sync.Mutex
+	state map[ip.IP4Net]subnet.Lease
+	dirty bool
+
+	// retryDelay returns the delay before the retry of a hook that failed failures times
+	retryDelay func(failures int) time.Duration
+}
+
+// failedEvent is an event whose hook failed. It's retried until the hook succeeds or a
+// newer event of its subnet replaces it.
+type failedEvent struct {
+	evt      subnet.Event
+	failures int
+	next     time.Time
+}
+
+// handle runs the hook of evt, and tells whether it succeeded or there is none.
+func (r *Runner) handle(ctx context.Context, evt subnet.Event) bool {
+	var path, event string
+	switch evt.Type {
+	case subnet.EventAdded:
+		path, event = r.Added, "added"
+	case subnet.EventRemoved:
+		path, event = r.Removed, "removed"
+	}
+	if path == "" {
+		return true
+	}
+
+	output, err := r.run(ctx, path, env(event, &evt.Lease))
+	if err != nil {
+		log.Errorf("Hook %s for %s subnet %v failed: %v Output: %s", path, event, evt.Lease.Subnet, err, output)
+		return false
+	}
+	log.V(1).Infof("Ran hook %s for %s subnet %v Output: %s", path, event, evt.Lease.Subnet, output)
+	return true
+}
+
+// Run runs the hooks on the lease events of cache until ctx is done. The leases present
+// at startup are reported as added, unless the hooks ran for them before the restart
+// according to the saved state, so hooks have to be idempotent.
+//
+// The events are queued by subnet and the hooks run by workers, so that slow hooks hold
+// up neither the cache nor the hooks of the other subnets. Failed hooks are retried with
+// exponential backoff.
+func (r *Runner) Run(ctx context.Context, cache *subnet.LeaseCache, ownLease *subnet.Lease) {
+	r.loadState()
+	if r.retryDelay == nil {
+		r.retryDelay = func(failures int) time.Duration {
+			return negcache.Backoff(retryBase, retryMax, failures)
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	queues := make([]*queue, workers)
+	for i := range queues {
+		q := newQueue()
+		queues[i] = q
+		wg.Add(1)
+		go func() {
+			r.work(ctx, q)
+			wg.Done()
+		}()
+	}
+
+	// The handlers of the cache are called one at a time, starting with all leases
+	snapshot := true
+	cache.OnEvents(func(batch []subnet.Event) {
+		for _, evt := range r.pending(batch, ownLease, snapshot) {
+			queues[worker(evt.Lease.Subnet)].push(evt)
+		}
+		snapshot = false
+	})
+
+	wg.Wait()
+}
+
+// worker returns the index of the worker running the hooks of sn.
+func worker(sn ip.IP4Net) int {
+	return int(uint32(sn.IP>>(32-sn.PrefixLen)) % workers)
+}
+
+func (r *Runner) work(ctx context.Context, q *queue) {
+	failed := make(map[ip.IP4Net]failedEvent)
+	for {
+		var timer *time.Timer
+		var retry <-chan time.Time
+		if next, ok := nextRetry(failed); ok {
+			timer = time.NewTimer(time.Until(next))
+			retry = timer.C
+		}
+
+		select {
+		case <-q.ready:
+		case <-retry:
+		case <-ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		// The failed events that are due run first; newer events of their subnets replace them
+		evts := q.pop()
+		for _, evt := range evts {
+			delete(failed, evt.Lease.Subnet)
+		}
+		var run []failedEvent
+		now := time.Now()
+		for _, f := range failed {
+			if !now.Before(f.next) {
+				run = append(run, f)
+			}
+		}
+		for _, evt := range evts {
+			run = append(run, failedEvent{evt: evt})
+		}
+
+		for _, f := range run {
+			if ctx.Err() != nil {
+				return
+			}
+			sn := f.evt.Lease.Subnet
+			if r.handle(ctx, f.evt) {
+				r.record(f.evt)
+				delete(failed, sn)
+				continue
+			}
+
+			f.failures++
+			delay := r.retryDelay(f.failures)
+			f.next = time.Now().Add(delay)
+			failed[sn] = f
+			log.Infof("Retrying the hook for subnet %v in %v", sn, delay)
+		}
+		r.saveState()
+	}
+}
+
+// nextRetry returns the time the first of the failed events is due.
+func nextRetry(failed map[ip.IP4Net]failedEvent) (time.Time, bool) {
+	var next time.Time
+	for _, f := range failed {
+		if next.IsZero() || f.next.Before(next) {
+			next = f.next
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// pending leaves out of batch the events of ownLease and those of leases the hooks already
+// ran for. If batch holds all leases, the leases the hooks ran for that are missing from
+// it are reported as removed.
+func (r *Runner) pending(batch []subnet.Event, ownLease *subnet.Lease, snapshot bool) []subnet.Event {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	var evts []subnet.Event
+	seen := make(map[ip.IP4Net]bool)
+	for _, evt := range batch {
+		sn := evt.Lease.Subnet
+		if sn.Equal(ownLease.Subnet) {
+			continue
+		}
+		seen[sn] = true
+		if l, ok := r.state[sn]; ok && evt.Type == subnet.EventAdded && sameAttrs(&l.Attrs, &evt.Lease.Attrs) {
+			// Renewed, or already handled before the restart
+			continue
+		}
+		evts = append(evts, evt)
+	}
+	if snapshot {
+		for sn, l := range r.state {
+			if !seen[sn] {
+				evts = append(evts, subnet.Event{Type: subnet.EventRemoved, Lease: l})
+			}
+		}
+	}
+	return evts
+}
+
+// record remembers the lease of evt as handled.
+func (r *Runner) record(evt subnet.Event) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.state == nil {
+		r.state = make(map[ip.IP4Net]subnet.Lease)
+	}
+	switch evt.Type {
+	case subnet.EventAdded:
+		r.state[evt.Lease.Subnet] = evt.Lease
+	case subnet.EventRemoved:
+		delete(r.state, evt.Lease.Subnet)
+	}
+	r.dirty = true
+}
+
+func (r *Runner) loadState() {
+	if r.StatePath == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(r.StatePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warningf("Failed to read the lease hook state: %v", err)
+		}
+		return
+	}
+	var leases []subnet.Lease
+	if err := json.Unmarshal(data, &leases); err != nil {
+		log.Warningf("Ignoring the lease hook state %s: %v", r.StatePath, err)
+		return
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.state = make(map[ip.IP4Net]subnet.Lease)
+	for _, l := range leases {
+		r.state[l.Subnet] = l
+	}
+	log.Infof("Loaded the lease hook state with %d leases", len(leases))
+}
+
+func (r *Runner) saveState() {
+	if r.StatePath == "" {
+		return
+	}
+	r.mux.Lock()
+	if !r.dirty {
+		r.mux.Unlock()
+		return
+	}
+	leases := make([]subnet.Lease, 0, len(r.state))
+	for _, l := range r.state {
+		leases = append(leases, l)
+	}
+	r.dirty = false
+	r.mux.Unlock()
+
+	data, err := json.Marshal(leases)
+	if err == nil {
+		err = fileutil.WriteFileAtomic(r.StatePath, data, 0644)
+	}
+	if err != nil {
+		log.Warningf("Failed to save the lease hook state: %v", err)
+	}
+}
+
+func sameAttrs(a, b *subnet.LeaseAttrs) bool {
+	ja, erra := json.Marshal(a)
+	jb, errb := json.Marshal(b)
+	return erra == nil && errb == nil && bytes.Equal(ja, jb)
+}
+
+// queue holds the events of a worker.
+type queue struct {
+	mux    sync.Mutex
+	events []subnet.Event
+	// ready is signaled when events are pushed
+	ready chan struct{}
+}
+
+func newQueue() *queue {
+	return &queue{ready: make(chan struct{}, 1)}
+}
+
+func (q *queue) push(evt subnet.Event) {
+	q.mux.Lock()
+	q.events = append(q.events, evt)
+	q.mux.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *queue) pop() []subnet.Event {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	evts := q.events
+	q.events = nil
+	return evts
+}
+
+func (r *Runner) run(ctx context.Context, path string, env []string) (string, error) {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Env = append(os.Environ(), env...)
+
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("killed after %v", timeout)
+	}
+	return strings.TrimSpace(string(output)), err
+}
+
+func env(event string, l *subnet.Lease) []string {
+	var labels []string
+	for k, v := range l.Attrs.Labels {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+
+	e := []string{
+		"LEASE_EVENT=" + event,
+		"SUBNET=" + l.Subnet.String(),
+		"PUBLIC_IP=" + l.Attrs.PublicIP.String(),
+		"BACKEND_TYPE=" + l.Attrs.BackendType,
+		"BACKEND_DATA=" + string(l.Attrs.BackendData),
+		"LEASE_LABELS=" + strings.Join(labels, ","),
+	}
+	if l.Attrs.PublicIPv6 != nil {
+		e = append(e, "PUBLIC_IPV6="+l.Attrs.PublicIPv6.String())
+	}
+	return e
+}
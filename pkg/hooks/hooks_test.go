@@ -0,0 +1,206 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hooks
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+	"github.com/coreos/flannel/subnet"
+)
+
+func writeScript(t *testing.T, dir, name, body string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// chanManager serves WatchLeases from a channel.
+type chanManager struct {
+	subnet.Manager
+	results chan subnet.LeaseWatchResult
+}
+
+func (m *chanManager) WatchLeases(ctx context.Context, cursor interface{}) (subnet.LeaseWatchResult, error) {
+	select {
+	case res := <-m.results:
+		return res, nil
+	case <-ctx.Done():
+		return subnet.LeaseWatchResult{}, ctx.Err()
+	}
+}
+
+// startRunner runs r on a lease cache fed by the returned channel until the returned
+// function is called.
+func startRunner(r *Runner, own *subnet.Lease) (chan<- subnet.LeaseWatchResult, func()) {
+	m := &chanManager{results: make(chan subnet.LeaseWatchResult)}
+	cache := subnet.NewLeaseCache(m)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{}, 2)
+	go func() {
+		cache.Run(ctx)
+		done <- struct{}{}
+	}()
+	go func() {
+		r.Run(ctx, cache, own)
+		done <- struct{}{}
+	}()
+	return m.results, func() {
+		cancel()
+		<-done
+		<-done
+	}
+}
+
+// waitForFile waits for the content of path to become want.
+func waitForFile(t *testing.T, path, want string) {
+	var content []byte
+	for i := 0; i < 500; i++ {
+		content, _ = ioutil.ReadFile(path)
+		if string(content) == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %s to hold\n%s\ngot\n%s", path, want, content)
+}
+
+func TestRunner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	r := &Runner{
+		Added:   writeScript(t, dir, "added", `echo "$LEASE_EVENT $SUBNET $PUBLIC_IP $BACKEND_TYPE $LEASE_LABELS" >> `+out),
+		Removed: writeScript(t, dir, "removed", `echo "$LEASE_EVENT $SUBNET" >> `+out),
+	}
+
+	own := subnet.Lease{Subnet: ip.IP4Net{IP: ip.FromIP(net.ParseIP("10.244.1.0")), PrefixLen: 24}}
+	lease := subnet.Lease{
+		Subnet: ip.IP4Net{IP: ip.FromIP(net.ParseIP("10.244.7.0")), PrefixLen: 24},
+		Attrs: subnet.LeaseAttrs{
+			PublicIP:    ip.FromIP(net.ParseIP("192.168.1.7")),
+			BackendType: "vxlan",
+			Labels:      map[string]string{"zone": "a", "tier": "web"},
+		},
+	}
+	results, stop := startRunner(r, &own)
+	defer stop()
+
+	// The leases of the snapshot are reported as added, except the own lease
+	results <- subnet.LeaseWatchResult{Snapshot: []subnet.Lease{own, lease}}
+	waitForFile(t, out, "added 10.244.7.0/24 192.168.1.7 vxlan tier=web,zone=a\n")
+	results <- subnet.LeaseWatchResult{Events: []subnet.Event{{Type: subnet.EventRemoved, Lease: lease}}}
+	waitForFile(t, out, "added 10.244.7.0/24 192.168.1.7 vxlan tier=web,zone=a\nremoved 10.244.7.0/24\n")
+}
+
+func TestRunnerRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The hook fails the first two times it runs
+	out, tries := filepath.Join(dir, "out"), filepath.Join(dir, "tries")
+	r := &Runner{
+		Added:      writeScript(t, dir, "added", `echo >> `+tries+`; [ $(wc -l < `+tries+`) -gt 2 ] && echo "$SUBNET" >> `+out),
+		retryDelay: func(failures int) time.Duration { return time.Duration(failures) * 10 * time.Millisecond },
+	}
+
+	own := subnet.Lease{Subnet: ip.IP4Net{IP: ip.FromIP(net.ParseIP("10.244.1.0")), PrefixLen: 24}}
+	lease := subnet.Lease{Subnet: ip.IP4Net{IP: ip.FromIP(net.ParseIP("10.244.7.0")), PrefixLen: 24}}
+	results, stop := startRunner(r, &own)
+	defer stop()
+
+	results <- subnet.LeaseWatchResult{Snapshot: []subnet.Lease{lease}}
+	waitForFile(t, out, "10.244.7.0/24\n")
+	waitForFile(t, tries, "\n\n\n")
+}
+
+func TestRunnerTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &Runner{Timeout: 100 * time.Millisecond}
+	start := time.Now()
+	if _, err := r.run(context.Background(), writeScript(t, dir, "slow", "exec sleep 10"), nil); err == nil {
+		t.Error("expected a hook running past the timeout to fail")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("expected the hook to be killed at the timeout")
+	}
+}
+
+func TestRunnerState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lease := func(sn, pip string) subnet.Lease {
+		_, n, _ := net.ParseCIDR(sn)
+		return subnet.Lease{Subnet: ip.FromIPNet(n), Attrs: subnet.LeaseAttrs{PublicIP: ip.FromIP(net.ParseIP(pip))}}
+	}
+	own := lease("10.244.1.0/24", "192.168.1.1")
+	l2, l3, l4 := lease("10.244.2.0/24", "192.168.1.2"), lease("10.244.3.0/24", "192.168.1.3"), lease("10.244.4.0/24", "192.168.1.4")
+
+	state := filepath.Join(dir, "state", "hooks.json")
+	r := &Runner{StatePath: state}
+	r.record(subnet.Event{Type: subnet.EventAdded, Lease: l2})
+	r.record(subnet.Event{Type: subnet.EventAdded, Lease: l3})
+	r.saveState()
+
+	// After a restart, only the changes since are reported
+	r = &Runner{StatePath: state}
+	r.loadState()
+	l3.Attrs.PublicIP = ip.FromIP(net.ParseIP("192.168.1.33"))
+	evts := r.pending([]subnet.Event{
+		{Type: subnet.EventAdded, Lease: own},
+		{Type: subnet.EventAdded, Lease: l3},
+		{Type: subnet.EventAdded, Lease: l4},
+	}, &own, true)
+	if len(evts) != 3 {
+		t.Fatalf("expected 3 events, got %+v", evts)
+	}
+	if evts[0].Lease.Subnet != l3.Subnet || evts[1].Lease.Subnet != l4.Subnet {
+		t.Errorf("expected the changed and the new lease to be added, got %+v", evts)
+	}
+	if evts[2].Type != subnet.EventRemoved || evts[2].Lease.Subnet != l2.Subnet {
+		t.Errorf("expected the missing lease to be removed, got %+v", evts[2])
+	}
+
+	// Renewals don't run the hooks again
+	r.record(subnet.Event{Type: subnet.EventAdded, Lease: l4})
+	if evts := r.pending([]subnet.Event{{Type: subnet.EventAdded, Lease: l4}}, &own, false); len(evts) != 0 {
+		t.Errorf("expected the renewal to be left out, got %+v", evts)
+	}
+}
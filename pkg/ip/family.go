@@ -0,0 +1,109 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Family is an IP address family. It holds what differs between IPv4 and IPv6, so that
+// code handling both families is written once.
+type Family int
+
+const (
+	IPv4 Family = iota
+	IPv6
+)
+
+// FamilyOf returns the family of ip. IPv4-mapped IPv6 addresses are IPv4.
+func FamilyOf(ip net.IP) Family {
+	if ip.To4() != nil {
+		return IPv4
+	}
+	return IPv6
+}
+
+func (f Family) String() string {
+	if f == IPv6 {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+// Bits returns the length of the addresses of f.
+func (f Family) Bits() int {
+	if f == IPv6 {
+		return 128
+	}
+	return 32
+}
+
+// Zero returns the unspecified address of f.
+func (f Family) Zero() net.IP {
+	if f == IPv6 {
+		return net.IPv6zero
+	}
+	return net.IPv4zero
+}
+
+// RouteFamily returns the address family of f in the routing and address APIs of the
+// kernel, e.g. AF_INET.
+func (f Family) RouteFamily() int {
+	if f == IPv6 {
+		return syscall.AF_INET6
+	}
+	return syscall.AF_INET
+}
+
+// Contains tells whether ip is an address of f.
+func (f Family) Contains(ip net.IP) bool {
+	return ip != nil && ip.To16() != nil && FamilyOf(ip) == f
+}
+
+// ParseIP parses s as an address of f.
+func (f Family) ParseIP(s string) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if !f.Contains(ip) {
+		return nil, fmt.Errorf("%q is not an %v address", s, f)
+	}
+	return ip, nil
+}
+
+// ParseCIDR parses s as a prefix of f, and returns it with the host bits cleared.
+func (f Family) ParseCIDR(s string) (*net.IPNet, error) {
+	ip, ipn, err := net.ParseCIDR(s)
+	if err != nil || !f.Contains(ip) {
+		return nil, fmt.Errorf("%q is not an %v prefix", s, f)
+	}
+	return ipn, nil
+}
+
+// Mask returns the mask of a prefix of f of length prefixLen.
+func (f Family) Mask(prefixLen int) net.IPMask {
+	return net.CIDRMask(prefixLen, f.Bits())
+}
+
+// OnBoundary tells whether ip is the first address of a prefix of length prefixLen.
+func (f Family) OnBoundary(ip net.IP, prefixLen int) bool {
+	return ip.Mask(f.Mask(prefixLen)).Equal(ip)
+}
+
+// isDefault tells whether ipn is the default route of f.
+func isDefault(ipn *net.IPNet, f Family) bool {
+	ones, _ := ipn.Mask.Size()
+	return ones == 0 && ipn.IP.Equal(f.Zero())
+}
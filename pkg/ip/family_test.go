@@ -0,0 +1,75 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ip
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFamily(t *testing.T) {
+	for _, tc := range []struct {
+		addr   string
+		family Family
+	}{
+		{"10.0.0.1", IPv4},
+		{"::ffff:10.0.0.1", IPv4},
+		{"2001:db8::1", IPv6},
+		{"::", IPv6},
+	} {
+		if f := FamilyOf(net.ParseIP(tc.addr)); f != tc.family {
+			t.Errorf("expected %s to be %v, got %v", tc.addr, tc.family, f)
+		}
+		if _, err := tc.family.ParseIP(tc.addr); err != nil {
+			t.Errorf("expected %s to parse as %v: %v", tc.addr, tc.family, err)
+		}
+	}
+
+	if _, err := IPv4.ParseIP("2001:db8::1"); err == nil {
+		t.Error("expected an IPv6 address to be rejected as IPv4")
+	}
+	if _, err := IPv6.ParseCIDR("10.0.0.0/8"); err == nil {
+		t.Error("expected an IPv4 prefix to be rejected as IPv6")
+	}
+	if ipn, err := IPv6.ParseCIDR("2001:db8::1/64"); err != nil || ipn.String() != "2001:db8::/64" {
+		t.Errorf("expected 2001:db8::/64, got %v, %v", ipn, err)
+	}
+
+	if IPv4.Bits() != 32 || IPv6.Bits() != 128 {
+		t.Error("unexpected address lengths")
+	}
+	if !IPv4.OnBoundary(net.ParseIP("10.1.4.0"), 22) || IPv4.OnBoundary(net.ParseIP("10.1.5.0"), 22) {
+		t.Error("unexpected IPv4 boundaries")
+	}
+	if !IPv6.OnBoundary(net.ParseIP("2001:db8:0:100::"), 56) || IPv6.OnBoundary(net.ParseIP("2001:db8:0:180::"), 56) {
+		t.Error("unexpected IPv6 boundaries")
+	}
+
+	for _, tc := range []struct {
+		cidr   string
+		family Family
+		dflt   bool
+	}{
+		{"0.0.0.0/0", IPv4, true},
+		{"0.0.0.0/1", IPv4, false},
+		{"::/0", IPv6, true},
+		{"::/0", IPv4, false},
+	} {
+		_, ipn, _ := net.ParseCIDR(tc.cidr)
+		if isDefault(ipn, tc.family) != tc.dflt {
+			t.Errorf("expected %s to be the %v default route: %v", tc.cidr, tc.family, tc.dflt)
+		}
+	}
+}
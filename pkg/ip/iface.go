@@ -20,23 +20,22 @@ import (
 	"errors"
 	"fmt"
 	"net"
-	"syscall"
 
 	"github.com/vishvananda/netlink"
 )
 
-func getIfaceAddrs(iface *net.Interface) ([]netlink.Addr, error) {
+func getIfaceAddrs(iface *net.Interface, f Family) ([]netlink.Addr, error) {
 	link := &netlink.Device{
-		netlink.LinkAttrs{
+		LinkAttrs: netlink.LinkAttrs{
 			Index: iface.Index,
 		},
 	}
 
-	return netlink.AddrList(link, syscall.AF_INET)
+	return netlink.AddrList(link, f.RouteFamily())
 }
 
 func GetInterfaceIP4Addr(iface *net.Interface) (net.IP, error) {
-	addrs, err := getIfaceAddrs(iface)
+	addrs, err := getIfaceAddrs(iface, IPv4)
 	if err != nil {
 		return nil, err
 	}
@@ -45,7 +44,7 @@ func GetInterfaceIP4Addr(iface *net.Interface) (net.IP, error) {
 	var ll net.IP
 
 	for _, addr := range addrs {
-		if addr.IP.To4() == nil {
+		if !IPv4.Contains(addr.IP) {
 			continue
 		}
 
@@ -66,8 +65,24 @@ func GetInterfaceIP4Addr(iface *net.Interface) (net.IP, error) {
 	return nil, errors.New("No IPv4 address found for given interface")
 }
 
+// GetInterfaceIP6Addr returns the global unicast IPv6 address of the given interface.
+func GetInterfaceIP6Addr(iface *net.Interface) (net.IP, error) {
+	addrs, err := getIfaceAddrs(iface, IPv6)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		if IPv6.Contains(addr.IP) && addr.IP.IsGlobalUnicast() {
+			return addr.IP, nil
+		}
+	}
+
+	return nil, errors.New("No IPv6 address found for given interface")
+}
+
 func GetInterfaceIP4AddrMatch(iface *net.Interface, matchAddr net.IP) error {
-	addrs, err := getIfaceAddrs(iface)
+	addrs, err := getIfaceAddrs(iface, IPv4)
 	if err != nil {
 		return err
 	}
@@ -86,13 +101,13 @@ func GetInterfaceIP4AddrMatch(iface *net.Interface, matchAddr net.IP) error {
 }
 
 func GetDefaultGatewayInterface() (*net.Interface, error) {
-	routes, err := netlink.RouteList(nil, syscall.AF_INET)
+	routes, err := netlink.RouteList(nil, IPv4.RouteFamily())
 	if err != nil {
 		return nil, err
 	}
 
 	for _, route := range routes {
-		if route.Dst == nil || route.Dst.String() == "0.0.0.0/0" {
+		if route.Dst == nil || isDefault(route.Dst, IPv4) {
 			if route.LinkIndex <= 0 {
 				return nil, errors.New("Found default route but could not determine interface")
 			}
@@ -119,6 +134,28 @@ func GetInterfaceByIP(ip net.IP) (*net.Interface, error) {
 	return nil, errors.New("No interface with given IP found")
 }
 
+// GetInterfaceBySpecificIPRouting returns the interface and source address the kernel
+// would use to reach ip.
+func GetInterfaceBySpecificIPRouting(ip net.IP) (*net.Interface, net.IP, error) {
+	routes, err := netlink.RouteGet(ip)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't lookup route to %v: %v", ip, err)
+	}
+
+	for _, route := range routes {
+		if route.LinkIndex <= 0 || route.Src == nil {
+			continue
+		}
+		iface, err := net.InterfaceByIndex(route.LinkIndex)
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't lookup interface with index %d: %v", route.LinkIndex, err)
+		}
+		return iface, route.Src, nil
+	}
+
+	return nil, nil, fmt.Errorf("no route to %v found", ip)
+}
+
 func DirectRouting(ip net.IP) (bool, error) {
 	routes, err := netlink.RouteGet(ip)
 	if err != nil {
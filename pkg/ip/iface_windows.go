@@ -25,6 +25,17 @@ import (
 
 // GetInterfaceIP4Addr returns the IPv4 address for the given network interface
 func GetInterfaceIP4Addr(iface *net.Interface) (net.IP, error) {
+	return getInterfaceAddr(iface, IPv4)
+}
+
+// GetInterfaceIP6Addr returns the global unicast IPv6 address for the given network interface
+func GetInterfaceIP6Addr(iface *net.Interface) (net.IP, error) {
+	return getInterfaceAddr(iface, IPv6)
+}
+
+// getInterfaceAddr returns the first address of family f of iface. IPv6 addresses
+// need to be global unicast ones.
+func getInterfaceAddr(iface *net.Interface, f Family) (net.IP, error) {
 	addrs, err := iface.Addrs()
 	if err != nil {
 		return nil, err
@@ -39,12 +50,17 @@ func GetInterfaceIP4Addr(iface *net.Interface) (net.IP, error) {
 			ip = v.IP
 		}
 
-		if ip != nil && ip.To4() != nil {
+		if f.Contains(ip) && (f == IPv4 || ip.IsGlobalUnicast()) {
 			return ip, nil
 		}
 	}
 
-	return nil, errors.New("no IPv4 address found for given interface")
+	return nil, fmt.Errorf("no %v address found for given interface", f)
+}
+
+// GetInterfaceBySpecificIPRouting is not supported on Windows
+func GetInterfaceBySpecificIPRouting(ip net.IP) (*net.Interface, net.IP, error) {
+	return nil, nil, errors.New("looking up the interface by route is not supported on Windows")
 }
 
 // GetDefaultGatewayInterface returns the first network interface found with a default gateway set
@@ -0,0 +1,216 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ipam hands out the individual addresses of the subnet leased to a node,
+// e.g. to its containers, so that consumers of the lease don't have to track them.
+//
+// The first address of the subnet is reserved for the gateway, i.e. the bridge or
+// the flannel device of the node, like the FLANNEL_SUBNET of the subnet file. The
+// network and broadcast addresses are never handed out either.
+package ipam
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	log "github.com/golang/glog"
+
+	"github.com/coreos/flannel/pkg/fileutil"
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// ErrExhausted is returned when all addresses of the subnet are in use.
+var ErrExhausted = errors.New("no free addresses left in the subnet")
+
+type state struct {
+	Subnet ip.IP4Net `json:"subnet"`
+	Last   ip.IP4    `json:"last"`
+	// Owners maps the allocated addresses to their owners
+	Owners map[string]string `json:"owners"`
+}
+
+// Allocator assigns the addresses of a subnet to owners, e.g. container IDs, and saves
+// the assignments to a file so that they survive restarts.
+type Allocator struct {
+	subnet ip.IP4Net
+	path   string
+
+	mux    sync.Mutex
+	owners map[ip.IP4]string
+	// last is the address allocated last; allocations go round robin so that
+	// released addresses aren't reused right away
+	last ip.IP4
+}
+
+// New returns an Allocator for subnet that saves its state to path, or keeps it in
+// memory only if path is empty. Saved allocations of another subnet, i.e. from before
+// the node got a new lease, are dropped.
+func New(subnet ip.IP4Net, path string) (*Allocator, error) {
+	subnet = subnet.Network()
+	if subnet.PrefixLen > 30 {
+		return nil, fmt.Errorf("subnet %v is too small to allocate addresses from", subnet)
+	}
+
+	a := &Allocator{
+		subnet: subnet,
+		path:   path,
+		owners: make(map[ip.IP4]string),
+		last:   subnet.IP + 1,
+	}
+	if path == "" {
+		return a, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return a, nil
+	case err != nil:
+		return nil, err
+	}
+
+	var st state
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	if !st.Subnet.Equal(subnet) {
+		log.Warningf("Dropping %d address allocations of the previous subnet %v", len(st.Owners), st.Subnet)
+		return a, nil
+	}
+	for s, owner := range st.Owners {
+		addr, err := ip.ParseIP4(s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: invalid address %q", path, s)
+		}
+		a.owners[addr] = owner
+	}
+	if subnet.Contains(st.Last) {
+		a.last = st.Last
+	}
+	return a, nil
+}
+
+// Subnet returns the subnet the addresses are allocated from.
+func (a *Allocator) Subnet() ip.IP4Net {
+	return a.subnet
+}
+
+// Gateway returns the reserved first address of the subnet.
+func (a *Allocator) Gateway() ip.IP4 {
+	return a.subnet.IP + 1
+}
+
+// Allocate assigns a free address to owner. An owner that already has an address gets
+// the same one again.
+func (a *Allocator) Allocate(owner string) (ip.IP4, error) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if addr, ok := a.lookup(owner); ok {
+		return addr, nil
+	}
+
+	first, last := a.subnet.IP+2, a.subnet.Next().IP-2
+	addr := a.last
+	for i := first; i <= last; i++ {
+		addr++
+		if addr < first || addr > last {
+			addr = first
+		}
+		if _, ok := a.owners[addr]; ok {
+			continue
+		}
+
+		a.owners[addr] = owner
+		prevLast := a.last
+		a.last = addr
+		if err := a.save(); err != nil {
+			delete(a.owners, addr)
+			a.last = prevLast
+			return 0, err
+		}
+		return addr, nil
+	}
+	return 0, ErrExhausted
+}
+
+// Release frees the address of owner. Releasing an owner without address is not an error.
+func (a *Allocator) Release(owner string) error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	addr, ok := a.lookup(owner)
+	if !ok {
+		return nil
+	}
+	delete(a.owners, addr)
+	if err := a.save(); err != nil {
+		a.owners[addr] = owner
+		return err
+	}
+	return nil
+}
+
+// Lookup returns the address of owner, if it has one.
+func (a *Allocator) Lookup(owner string) (ip.IP4, bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.lookup(owner)
+}
+
+func (a *Allocator) lookup(owner string) (ip.IP4, bool) {
+	for addr, o := range a.owners {
+		if o == owner {
+			return addr, true
+		}
+	}
+	return 0, false
+}
+
+// Allocations returns the owners by allocated address.
+func (a *Allocator) Allocations() map[ip.IP4]string {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	owners := make(map[ip.IP4]string, len(a.owners))
+	for addr, owner := range a.owners {
+		owners[addr] = owner
+	}
+	return owners
+}
+
+func (a *Allocator) save() error {
+	if a.path == "" {
+		return nil
+	}
+
+	st := state{
+		Subnet: a.subnet,
+		Last:   a.last,
+		Owners: make(map[string]string, len(a.owners)),
+	}
+	for addr, owner := range a.owners {
+		st.Owners[addr.String()] = owner
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	return fileutil.WriteFileAtomic(a.path, data, 0600)
+}
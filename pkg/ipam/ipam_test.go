@@ -0,0 +1,113 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipam
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+func mustParseIP4Net(t *testing.T, s string) ip.IP4Net {
+	var n ip.IP4Net
+	if err := n.UnmarshalJSON([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestAllocate(t *testing.T) {
+	a, err := New(mustParseIP4Net(t, "10.1.15.0/29"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Gateway().String() != "10.1.15.1" {
+		t.Fatalf("unexpected gateway %v", a.Gateway())
+	}
+
+	// .0, .1 and .7 are reserved
+	for i, want := range []string{"10.1.15.2", "10.1.15.3", "10.1.15.4", "10.1.15.5", "10.1.15.6"} {
+		addr, err := a.Allocate(string(rune('a' + i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.String() != want {
+			t.Fatalf("expected %s, got %v", want, addr)
+		}
+	}
+	if _, err := a.Allocate("f"); err != ErrExhausted {
+		t.Fatalf("expected ErrExhausted, got %v", err)
+	}
+
+	// Owners keep their address
+	if addr, _ := a.Allocate("b"); addr.String() != "10.1.15.3" {
+		t.Fatalf("expected b to keep 10.1.15.3, got %v", addr)
+	}
+
+	if err := a.Release("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Release("b"); err != nil {
+		t.Fatal(err)
+	}
+	if addr, err := a.Allocate("f"); err != nil || addr.String() != "10.1.15.3" {
+		t.Fatalf("expected the released address, got %v, %v", addr, err)
+	}
+}
+
+func TestAllocatePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ipam.json")
+
+	sn := mustParseIP4Net(t, "10.1.15.0/24")
+	a, err := New(sn, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Allocate("a")
+	a.Allocate("b")
+	a.Release("a")
+
+	a, err = New(sn, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr, ok := a.Lookup("b"); !ok || addr.String() != "10.1.15.3" {
+		t.Fatalf("expected b to keep 10.1.15.3, got %v", addr)
+	}
+	if _, ok := a.Lookup("a"); ok {
+		t.Fatal("expected a to be released")
+	}
+	// The round robin continues after the last allocation
+	if addr, _ := a.Allocate("c"); addr.String() != "10.1.15.4" {
+		t.Fatalf("expected 10.1.15.4, got %v", addr)
+	}
+
+	// Allocations of another lease are dropped
+	a, err = New(mustParseIP4Net(t, "10.1.16.0/24"), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Allocations()) != 0 {
+		t.Fatalf("expected no allocations, got %v", a.Allocations())
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package negcache implements a cache of negative lookup results, so that lookups
+// that keep missing don't have to be repeated every time. The vxlan backend uses it
+// for the L3 misses of destinations that don't belong to any subnet lease, which
+// would otherwise search the leases for each packet sent to them. It's scoped to
+// flanneld: the flannel-ipam plugin runs once per container and never looks up
+// other subnets or peers, so it has nothing to cache.
+//
+// A key that misses is remembered for a TTL that doubles with every
+// consecutive miss, up to a maximum. Once a key has not missed for a while
+// its miss count ages out again, so a key that is only looked up once in a
+// long while starts over with the base TTL.
+package negcache
+
+import (
+	"sync"
+	"time"
+)
+
+type entry struct {
+	misses int
+	until  time.Time
+}
+
+type Cache struct {
+	base time.Duration
+	max  time.Duration
+	now  func() time.Time
+
+	mux     sync.Mutex
+	entries map[string]*entry
+}
+
+// New returns a cache whose entries are negative for base after the first miss,
+// twice as long after the second one and so on, but never longer than max.
+func New(base, max time.Duration) *Cache {
+	return &Cache{
+		base:    base,
+		max:     max,
+		now:     time.Now,
+		entries: make(map[string]*entry),
+	}
+}
+
+// Missing tells whether key missed recently and should not be looked up again yet.
+func (c *Cache) Missing(key string) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	e, ok := c.entries[key]
+	return ok && c.now().Before(e.until)
+}
+
+// Miss records a failed lookup of key and returns how long it is considered missing.
+func (c *Cache) Miss(key string) time.Duration {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	now := c.now()
+	e, ok := c.entries[key]
+	if !ok || c.aged(e, now) {
+		e = &entry{}
+		c.entries[key] = e
+	}
+	e.misses++
+
+	ttl := Backoff(c.base, c.max, e.misses)
+	e.until = now.Add(ttl)
+	return ttl
+}
+
+// Found forgets key, e.g. because a lease for it showed up.
+func (c *Cache) Found(key string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	delete(c.entries, key)
+}
+
+// Purge drops all entries, e.g. after the leases were reloaded.
+func (c *Cache) Purge() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.entries = make(map[string]*entry)
+}
+
+// Prune drops the entries whose miss count aged out and returns how many are left.
+func (c *Cache) Prune() int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	now := c.now()
+	for key, e := range c.entries {
+		if c.aged(e, now) {
+			delete(c.entries, key)
+		}
+	}
+	return len(c.entries)
+}
+
+// aged tells whether e expired more than max ago, after which its misses no longer count.
+// Backoff returns base doubled for every one of n consecutive failures after the first,
+// capped at max.
+func Backoff(base, max time.Duration, n int) time.Duration {
+	d := base
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+func (c *Cache) aged(e *entry, now time.Time) bool {
+	return now.Sub(e.until) > c.max
+}
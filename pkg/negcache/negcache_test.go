@@ -0,0 +1,62 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package negcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	now := time.Now()
+	c := New(time.Second, 8*time.Second)
+	c.now = func() time.Time { return now }
+
+	if c.Missing("10.1.1.0/24") {
+		t.Fatal("unknown key reported as missing")
+	}
+
+	for _, exp := range []time.Duration{1, 2, 4, 8, 8} {
+		if ttl := c.Miss("10.1.1.0/24"); ttl != exp*time.Second {
+			t.Fatalf("expected a TTL of %v, got %v", exp*time.Second, ttl)
+		}
+	}
+	if !c.Missing("10.1.1.0/24") {
+		t.Fatal("expected key to be missing")
+	}
+
+	now = now.Add(8 * time.Second)
+	if c.Missing("10.1.1.0/24") {
+		t.Fatal("expected entry to expire")
+	}
+	// The miss count is kept for a while after the entry expired
+	if ttl := c.Miss("10.1.1.0/24"); ttl != 8*time.Second {
+		t.Fatalf("expected the TTL to stay at the maximum, got %v", ttl)
+	}
+
+	// and ages out after that
+	now = now.Add(17 * time.Second)
+	if n := c.Prune(); n != 0 {
+		t.Fatalf("expected aged entry to be pruned, %d left", n)
+	}
+	if ttl := c.Miss("10.1.1.0/24"); ttl != time.Second {
+		t.Fatalf("expected the TTL to start over, got %v", ttl)
+	}
+
+	c.Found("10.1.1.0/24")
+	if c.Missing("10.1.1.0/24") {
+		t.Fatal("found key still reported as missing")
+	}
+}
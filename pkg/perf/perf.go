@@ -0,0 +1,238 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package perf measures the latency and throughput between two nodes, over the overlay
+// and directly between their public IPs, so that the cost of the encapsulation shows.
+//
+// The node under test runs a Server, started through the debug endpoint of flanneld.
+// Clients open one connection per measurement; its first byte selects the mode:
+// 'p' echoes every byte back, 'b' discards everything until the client closes its
+// side and then replies with the number of bytes received.
+package perf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+const (
+	modePing = 'p'
+	modeBulk = 'b'
+
+	// ServeTimeout is how long a Server accepts connections.
+	ServeTimeout = time.Minute
+
+	pings     = 10
+	chunkSize = 128 * 1024
+)
+
+// Target tells the client where to find a Server.
+type Target struct {
+	Port int
+	// OverlayIP is an address of the node inside its subnet, to test the overlay with.
+	OverlayIP net.IP `json:",omitempty"`
+}
+
+// Server serves the test connections of a single client for ServeTimeout.
+type Server struct {
+	ln *net.TCPListener
+}
+
+// Listen starts a Server on a random port of all addresses.
+func Listen() (*Server, error) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	return &Server{ln: ln}, nil
+}
+
+func (s *Server) Port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+// Serve handles connections until ServeTimeout elapsed.
+func (s *Server) Serve() {
+	deadline := time.Now().Add(ServeTimeout)
+	s.ln.SetDeadline(deadline)
+	defer s.ln.Close()
+
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+				log.Warningf("Performance test server failed: %v", err)
+			}
+			return
+		}
+		conn.SetDeadline(deadline)
+		go handle(conn)
+	}
+}
+
+func handle(conn net.Conn) {
+	defer conn.Close()
+
+	mode := make([]byte, 1)
+	if _, err := io.ReadFull(conn, mode); err != nil {
+		return
+	}
+
+	switch mode[0] {
+	case modePing:
+		io.Copy(conn, conn)
+
+	case modeBulk:
+		n, err := io.Copy(ioutil.Discard, conn)
+		if err != nil {
+			log.Warningf("Performance test from %v failed: %v", conn.RemoteAddr(), err)
+			return
+		}
+		fmt.Fprintf(conn, "%d\n", n)
+		log.Infof("Received %d bytes of performance test data from %v", n, conn.RemoteAddr())
+	}
+}
+
+// Result is the outcome of a test.
+type Result struct {
+	// RTT is the shortest round trip time of a few pings.
+	RTT time.Duration
+	// Bytes were sent in Duration, until the server confirmed them.
+	Bytes    int64
+	Duration time.Duration
+}
+
+// Throughput returns the throughput in bits per second.
+func (r Result) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Bytes*8) / r.Duration.Seconds()
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("rtt %v, throughput %.1f Mbit/s", r.RTT, r.Throughput()/1e6)
+}
+
+// Run measures the round trip time and the throughput to the server at addr, sending data for duration.
+func Run(addr string, duration time.Duration) (Result, error) {
+	var res Result
+	var err error
+	if res.RTT, err = ping(addr); err != nil {
+		return res, fmt.Errorf("ping to %s failed: %v", addr, err)
+	}
+	if res.Bytes, res.Duration, err = bulk(addr, duration); err != nil {
+		return res, fmt.Errorf("throughput test to %s failed: %v", addr, err)
+	}
+	return res, nil
+}
+
+func ping(addr string) (time.Duration, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if _, err := conn.Write([]byte{modePing}); err != nil {
+		return 0, err
+	}
+
+	var min time.Duration
+	b := []byte{0}
+	for i := 0; i < pings; i++ {
+		start := time.Now()
+		if _, err := conn.Write(b); err != nil {
+			return 0, err
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return 0, err
+		}
+		if rtt := time.Since(start); min == 0 || rtt < min {
+			min = rtt
+		}
+	}
+	return min, nil
+}
+
+func bulk(addr string, duration time.Duration) (int64, time.Duration, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(duration + 30*time.Second))
+
+	start := time.Now()
+	if _, err := conn.Write([]byte{modeBulk}); err != nil {
+		return 0, 0, err
+	}
+	chunk := make([]byte, chunkSize)
+	var sent int64
+	for time.Since(start) < duration {
+		n, err := conn.Write(chunk)
+		sent += int64(n)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		return 0, 0, err
+	}
+
+	// The data only counts once the server got it
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return 0, 0, err
+	}
+	elapsed := time.Since(start)
+	received, err := strconv.ParseInt(strings.TrimSpace(line), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid reply %q", line)
+	}
+	if received != sent {
+		return 0, 0, fmt.Errorf("sent %d bytes but the server received %d", sent, received)
+	}
+	return received, elapsed, nil
+}
+
+// LocalAddrIn returns an address of a local interface inside sn, like the address of
+// the vxlan device or of the bridge of the containers, or nil if there is none.
+func LocalAddrIn(sn ip.IP4Net) net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok || ipn.IP.To4() == nil {
+			continue
+		}
+		if sn.Contains(ip.FromIP(ipn.IP)) {
+			return ipn.IP
+		}
+	}
+	return nil
+}
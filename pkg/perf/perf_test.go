@@ -0,0 +1,41 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perf
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	s, err := Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.ln.Close()
+
+	res, err := Run(fmt.Sprintf("127.0.0.1:%d", s.Port()), 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RTT <= 0 || res.Bytes < chunkSize || res.Duration < 100*time.Millisecond {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if res.Throughput() <= 0 {
+		t.Fatalf("unexpected throughput %v", res.Throughput())
+	}
+}
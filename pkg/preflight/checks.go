@@ -0,0 +1,192 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package preflight
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Run checks the kernel for the network described by opts.
+func Run(opts Options) []Result {
+	return run("/", opts)
+}
+
+// run checks the kernel whose /proc, /sys, /dev and /lib/modules are under root.
+func run(root string, opts Options) []Result {
+	c := &checker{root: root}
+	var results []Result
+
+	modules := backendModules[opts.BackendType]
+	if opts.OuterIPv6 {
+		if m, ok := outerIPv6Modules[opts.BackendType]; ok {
+			modules = m
+		}
+		results = append(results, c.ipv6())
+	}
+	for _, m := range modules {
+		results = append(results, c.module(m))
+	}
+	if tunBackends[opts.BackendType] {
+		results = append(results, c.tunDevice())
+	}
+
+	// The alloc backend only hands out subnets, the others forward the traffic of the pods
+	if opts.BackendType != "alloc" {
+		results = append(results, c.sysctl("net.ipv4.ip_forward", "1",
+			"pods can't reach other nodes without IPv4 forwarding"))
+		if opts.IPv6 {
+			results = append(results, c.sysctl("net.ipv6.conf.all.forwarding", "1",
+				"pods can't reach other nodes over IPv6 without IPv6 forwarding"))
+		}
+	}
+
+	if opts.ExtIface != "" && opts.DefaultIface != "" && opts.ExtIface != opts.DefaultIface {
+		results = append(results, c.rpFilter(opts.ExtIface))
+	}
+	return results
+}
+
+type checker struct {
+	root string
+}
+
+func (c *checker) path(elem ...string) string {
+	return filepath.Join(append([]string{c.root}, elem...)...)
+}
+
+func (c *checker) read(elem ...string) (string, error) {
+	b, err := ioutil.ReadFile(c.path(elem...))
+	return strings.TrimSpace(string(b)), err
+}
+
+// module checks that m is loaded, built in, or can be loaded on demand.
+func (c *checker) module(m module) Result {
+	r := Result{Check: "module " + m.name, Status: StatusOK}
+	if _, err := os.Stat(c.path("sys/module", m.name)); err == nil {
+		return r
+	}
+
+	release, err := c.read("proc/sys/kernel/osrelease")
+	if err != nil {
+		r.Status = StatusWarning
+		r.Message = fmt.Sprintf("not loaded, and the kernel release is unknown: %v", err)
+		return r
+	}
+	dir := c.path("lib/modules", release)
+	if _, err := os.Stat(dir); err != nil {
+		r.Status = StatusWarning
+		r.Message = fmt.Sprintf("not loaded, and the modules of kernel %s aren't available to tell whether it can be (mount /lib/modules into the container, or run \"modprobe %s\" on the host)", release, m.name)
+		return r
+	}
+
+	for _, list := range []string{"modules.builtin", "modules.dep"} {
+		if listsModule(filepath.Join(dir, list), m.name) {
+			r.Message = "not loaded yet, the kernel loads it on demand"
+			return r
+		}
+	}
+	r.Status = StatusFailed
+	r.Message = fmt.Sprintf("kernel %s has no %s module, use a kernel built with %s", release, m.name, m.config)
+	return r
+}
+
+// listsModule tells whether the modules.dep or modules.builtin file at path lists name.
+func listsModule(path, name string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	name = strings.Replace(name, "-", "_", -1)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// e.g. "kernel/drivers/net/vxlan.ko.xz: kernel/net/ipv4/udp_tunnel.ko.xz"
+		mod := filepath.Base(strings.SplitN(s.Text(), ":", 2)[0])
+		if i := strings.Index(mod, ".ko"); i >= 0 {
+			mod = mod[:i]
+		}
+		if strings.Replace(mod, "-", "_", -1) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ipv6 checks that the kernel has IPv6, for the backends tunneling over it.
+func (c *checker) ipv6() Result {
+	r := Result{Check: "ipv6", Status: StatusOK}
+	if _, err := os.Stat(c.path("proc/sys/net/ipv6")); err != nil {
+		r.Status = StatusFailed
+		r.Message = "the kernel has no IPv6 to tunnel over, use a kernel built with CONFIG_IPV6 and booted without ipv6.disable=1"
+	}
+	return r
+}
+
+// tunDevice checks that the userspace backends can open TUN devices.
+func (c *checker) tunDevice() Result {
+	r := Result{Check: "device /dev/net/tun", Status: StatusOK}
+	if _, err := os.Stat(c.path("dev/net/tun")); err != nil {
+		r.Status = StatusFailed
+		r.Message = "missing, run \"modprobe tun\" on the host, and give the container access to /dev/net/tun"
+	}
+	return r
+}
+
+// sysctl checks that name is set to want, and warns with why otherwise.
+func (c *checker) sysctl(name, want, why string) Result {
+	r := Result{Check: "sysctl " + name, Status: StatusOK}
+	got, err := c.read("proc/sys", strings.Replace(name, ".", "/", -1))
+	if err != nil {
+		r.Status = StatusWarning
+		r.Message = fmt.Sprintf("can't be read: %v", err)
+	} else if got != want {
+		r.Status = StatusWarning
+		r.Message = fmt.Sprintf("is %s, %s; set it with \"sysctl -w %s=%s\"", got, why, name, want)
+	}
+	return r
+}
+
+// rpFilter warns about strict reverse path filtering on iface, which drops the packets of
+// peers that the default route doesn't reach over iface.
+func (c *checker) rpFilter(iface string) Result {
+	r := Result{Check: "sysctl net.ipv4.conf." + iface + ".rp_filter", Status: StatusOK}
+
+	// The kernel uses the higher of the values of all and the interface
+	mode := ""
+	for _, conf := range []string{"all", iface} {
+		v, err := c.read("proc/sys/net/ipv4/conf", conf, "rp_filter")
+		if err != nil {
+			r.Status = StatusWarning
+			r.Message = fmt.Sprintf("can't be read: %v", err)
+			return r
+		}
+		if v > mode {
+			mode = v
+		}
+	}
+	if mode == "1" {
+		r.Status = StatusWarning
+		r.Message = fmt.Sprintf("strict reverse path filtering drops the packets of peers whose replies leave by the default route instead of %s; "+
+			"set \"sysctl -w net.ipv4.conf.all.rp_filter=2 net.ipv4.conf.%s.rp_filter=2\" if peers are unreachable", iface, iface)
+	}
+	return r
+}
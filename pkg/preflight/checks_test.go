@@ -0,0 +1,123 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// +build !windows
+
+package preflight
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeRoot creates the files of a kernel with the given contents under a temporary directory.
+func fakeRoot(t *testing.T, files map[string]string) string {
+	root, err := ioutil.TempDir("", "preflight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func statuses(results []Result) map[string]Status {
+	s := make(map[string]Status)
+	for _, r := range results {
+		s[r.Check] = r.Status
+	}
+	return s
+}
+
+func TestRun(t *testing.T) {
+	root := fakeRoot(t, map[string]string{
+		"proc/sys/kernel/osrelease":              "5.4.0-test\n",
+		"proc/sys/net/ipv4/ip_forward":           "1\n",
+		"proc/sys/net/ipv6/conf/all/forwarding":  "0\n",
+		"proc/sys/net/ipv4/conf/all/rp_filter":   "0\n",
+		"proc/sys/net/ipv4/conf/eth1/rp_filter":  "1\n",
+		"lib/modules/5.4.0-test/modules.dep":     "kernel/net/ipv4/ipip.ko.xz: kernel/net/ipv4/ip_tunnel.ko.xz\n",
+		"lib/modules/5.4.0-test/modules.builtin": "kernel/net/ipv4/udp_tunnel.ko\n",
+		"sys/module/vxlan/parameters/udp_port":   "8472\n",
+	})
+	defer os.RemoveAll(root)
+
+	// The vxlan module is loaded
+	results := run(root, Options{BackendType: "vxlan", ExtIface: "eth0", DefaultIface: "eth0"})
+	if s := statuses(results); s["module vxlan"] != StatusOK || s["sysctl net.ipv4.ip_forward"] != StatusOK || len(s) != 2 {
+		t.Errorf("unexpected vxlan results %+v", results)
+	}
+	if err := Err(results); err != nil {
+		t.Error(err)
+	}
+
+	// The ipip module can be loaded, the gre one can't
+	if s := statuses(run(root, Options{BackendType: "ipip"})); s["module ipip"] != StatusOK {
+		t.Errorf("unexpected ipip results %+v", s)
+	}
+	results = run(root, Options{BackendType: "gre"})
+	if s := statuses(results); s["module ip_gre"] != StatusFailed {
+		t.Errorf("unexpected gre results %+v", s)
+	}
+	if err := Err(results); err == nil {
+		t.Error("no error for the missing ip_gre module")
+	}
+
+	// Tunneling over IPv6 needs the ip6_gre module instead
+	results = run(root, Options{BackendType: "gre", OuterIPv6: true})
+	if s := statuses(results); s["module ip6_gre"] != StatusFailed || s["ipv6"] != StatusOK || s["module ip_gre"] != "" {
+		t.Errorf("unexpected gre results with OuterIPv6 %+v", s)
+	}
+
+	// IPv6 forwarding is off, and strict reverse path filtering is on for the non-default interface
+	s := statuses(run(root, Options{BackendType: "host-gw", IPv6: true, ExtIface: "eth1", DefaultIface: "eth0"}))
+	if s["sysctl net.ipv6.conf.all.forwarding"] != StatusWarning || s["sysctl net.ipv4.conf.eth1.rp_filter"] != StatusWarning {
+		t.Errorf("unexpected host-gw results %+v", s)
+	}
+
+	// The udp backend needs a TUN device
+	if s := statuses(run(root, Options{BackendType: "udp"})); s["device /dev/net/tun"] != StatusFailed {
+		t.Errorf("unexpected udp results %+v", s)
+	}
+}
+
+func TestRunWithoutModules(t *testing.T) {
+	root := fakeRoot(t, map[string]string{
+		"proc/sys/kernel/osrelease":    "5.4.0-test\n",
+		"proc/sys/net/ipv4/ip_forward": "1\n",
+	})
+	defer os.RemoveAll(root)
+
+	// Without /lib/modules, a module that isn't loaded may still be loadable
+	results := run(root, Options{BackendType: "vxlan"})
+	if s := statuses(results); s["module vxlan"] != StatusWarning {
+		t.Errorf("unexpected results %+v", results)
+	}
+	if err := Err(results); err != nil {
+		t.Error(err)
+	}
+
+	// A kernel without IPv6 can't tunnel over it
+	if s := statuses(run(root, Options{BackendType: "vxlan", OuterIPv6: true})); s["ipv6"] != StatusFailed {
+		t.Errorf("unexpected results with OuterIPv6 %+v", s)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package preflight checks that the kernel has the modules, devices and sysctls the
+// selected backend needs, before flannel acquires a lease, so that what's missing is
+// reported plainly instead of as a netlink error halfway through setting up the network.
+package preflight
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Status string
+
+const (
+	StatusOK Status = "ok"
+	// StatusWarning is reported for what may break the network, but doesn't keep flannel from starting.
+	StatusWarning Status = "warning"
+	// StatusFailed is reported for what the backend can't work without.
+	StatusFailed Status = "failed"
+)
+
+// Result is the outcome of a single check.
+type Result struct {
+	Check   string `json:"check"`
+	Status  Status `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// Options describe the network to check the kernel for.
+type Options struct {
+	BackendType string
+	// IPv6 is set if the network routes IPv6 pod traffic.
+	IPv6 bool
+	// OuterIPv6 is set if the backend tunnels between the public IPv6 addresses of the nodes.
+	OuterIPv6 bool
+	// ExtIface is the interface flannel talks to its peers over, and DefaultIface the one
+	// of the default route.
+	ExtIface     string
+	DefaultIface string
+}
+
+// module is a kernel module a backend needs, with the kernel option that builds it.
+type module struct {
+	name   string
+	config string
+}
+
+// backendModules are the kernel modules of the backends. Kernels load most of them on
+// demand, when the backend creates its first device.
+var backendModules = map[string][]module{
+	"vxlan":     {{"vxlan", "CONFIG_VXLAN"}},
+	"ipip":      {{"ipip", "CONFIG_NET_IPIP"}},
+	"gre":       {{"ip_gre", "CONFIG_NET_IPGRE"}},
+	"wireguard": {{"wireguard", "CONFIG_WIREGUARD"}},
+}
+
+// outerIPv6Modules are the kernel modules the backends need to tunnel over IPv6 instead.
+var outerIPv6Modules = map[string][]module{
+	"gre": {{"ip6_gre", "CONFIG_IPV6_GRE"}},
+}
+
+// tunBackends are the backends forwarding packets through a TUN device in userspace.
+var tunBackends = map[string]bool{
+	"udp":     true,
+	"tcp-tls": true,
+}
+
+// Err returns an error listing the failed checks, or nil if none failed.
+func Err(results []Result) error {
+	var failed []string
+	for _, r := range results {
+		if r.Status == StatusFailed {
+			failed = append(failed, fmt.Sprintf("%s: %s", r.Check, r.Message))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("kernel preflight checks failed: %s", strings.Join(failed, "; "))
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"fmt"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// ForeignRoute is a kernel route into the flannel network, e.g. one left by the
+// networking solution flannel replaces. Gw is zero for routes without gateway.
+type ForeignRoute struct {
+	Dst ip.IP4Net
+	Gw  ip.IP4
+}
+
+// AdoptionPlan is the outcome of PlanAdoption.
+type AdoptionPlan struct {
+	// Reservations are the leases proposed to keep the existing routes working, one per
+	// route to a subnet of the node with the gateway as public IP.
+	Reservations []Lease
+	// Conflicts describe the routes that can't be turned into reservations.
+	Conflicts []string
+}
+
+// PlanAdoption proposes reservations for the routes into the network of config, so that
+// the nodes they point to keep their subnets when they move onto flannel. Routes to
+// subnets that are already leased, like the routes flannel set up itself, are skipped
+// unless they point somewhere else than the lease.
+func PlanAdoption(config *Config, routes []ForeignRoute, leases []Lease) AdoptionPlan {
+	var plan AdoptionPlan
+	conflict := func(format string, args ...interface{}) {
+		plan.Conflicts = append(plan.Conflicts, fmt.Sprintf(format, args...))
+	}
+
+	proposed := make(map[ip.IP4Net]ip.IP4)
+OuterLoop:
+	for _, r := range routes {
+		// Routes covering the whole network, like the one to a vxlan device, aren't per node
+		if !config.Network.Contains(r.Dst.IP) || r.Dst.PrefixLen <= config.Network.PrefixLen {
+			continue
+		}
+
+		for _, l := range leases {
+			switch {
+			case l.Subnet.Equal(r.Dst):
+				// host-gw routes point at the public IP, vxlan routes into the subnet itself
+				if r.Gw != 0 && r.Gw != l.Attrs.PublicIP && !r.Dst.Contains(r.Gw) {
+					conflict("route to %v via %v, but %v is leased to %v", r.Dst, r.Gw, l.Subnet, l.Attrs.PublicIP)
+				}
+				continue OuterLoop
+
+			case l.Subnet.Overlaps(r.Dst):
+				conflict("route to %v via %v overlaps the lease of %v to %v", r.Dst, r.Gw, l.Subnet, l.Attrs.PublicIP)
+				continue OuterLoop
+			}
+		}
+
+		switch {
+		case r.Dst.PrefixLen != config.SubnetLen:
+			conflict("route to %v via %v doesn't match the subnet length /%d", r.Dst, r.Gw, config.SubnetLen)
+
+		case r.Gw == 0:
+			conflict("route to %v has no gateway, so the node owning it is unknown", r.Dst)
+
+		case r.Dst.IP < config.SubnetMin || r.Dst.IP > config.SubnetMax:
+			conflict("route to %v via %v is outside of the subnet range %v-%v", r.Dst, r.Gw, config.SubnetMin, config.SubnetMax)
+
+		default:
+			if gw, ok := proposed[r.Dst]; ok {
+				if gw != r.Gw {
+					conflict("routes to %v via both %v and %v", r.Dst, gw, r.Gw)
+				}
+				continue
+			}
+			proposed[r.Dst] = r.Gw
+			plan.Reservations = append(plan.Reservations, Lease{
+				Subnet: r.Dst,
+				Attrs:  LeaseAttrs{PublicIP: r.Gw},
+			})
+		}
+	}
+	return plan
+}
@@ -0,0 +1,61 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+func foreignRoute(dst, gw string) ForeignRoute {
+	_, n, _ := net.ParseCIDR(dst)
+	r := ForeignRoute{Dst: ip.FromIPNet(n)}
+	if gw != "" {
+		r.Gw = ip.FromIP(net.ParseIP(gw))
+	}
+	return r
+}
+
+func TestPlanAdoption(t *testing.T) {
+	config, err := ParseConfig(`{"Network":"10.3.0.0/16"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leased := testLease("10.3.1.0/24")
+	leased.Attrs.PublicIP = ip.FromIP(net.ParseIP("192.168.0.1"))
+
+	routes := []ForeignRoute{
+		foreignRoute("10.3.0.0/16", ""),              // vxlan device route
+		foreignRoute("10.3.1.0/24", "192.168.0.1"),   // host-gw route to a lease
+		foreignRoute("10.3.1.0/24", "10.3.1.0"),      // vxlan route to a lease
+		foreignRoute("10.3.1.0/24", "192.168.0.9"),   // conflicts with the lease
+		foreignRoute("10.3.1.128/25", "192.168.0.9"), // overlaps the lease
+		foreignRoute("10.3.2.0/24", "192.168.0.2"),   // adopted
+		foreignRoute("10.3.2.0/24", "192.168.0.3"),   // conflicts with the adopted route
+		foreignRoute("10.3.3.0/26", "192.168.0.3"),   // wrong length
+		foreignRoute("10.3.4.0/24", ""),              // no gateway
+		foreignRoute("10.4.0.0/24", "192.168.0.4"),   // outside of the network
+	}
+	plan := PlanAdoption(config, routes, []Lease{leased})
+
+	if len(plan.Reservations) != 1 || plan.Reservations[0].Subnet.String() != "10.3.2.0/24" || plan.Reservations[0].Attrs.PublicIP.String() != "192.168.0.2" {
+		t.Errorf("unexpected reservations: %v", plan.Reservations)
+	}
+	if len(plan.Conflicts) != 5 {
+		t.Errorf("expected 5 conflicts, got %q", plan.Conflicts)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"time"
+
+	log "github.com/golang/glog"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+const (
+	// AllocationRandom picks a random subnet among the first free ones. It's the default.
+	AllocationRandom = "random"
+	// AllocationHash derives the subnet from the node ID.
+	AllocationHash = "hash"
+)
+
+// Allocator is a strategy picking the subnet of a node without lease among the subnets
+// of the network that don't overlap the leases.
+type Allocator interface {
+	Allocate(config *Config, leases []Lease, nodeID string) (ip.IP4Net, error)
+}
+
+// NewAllocator returns the Allocator of the SubnetAllocation of config.
+func NewAllocator(config *Config) Allocator {
+	if config.SubnetAllocation == AllocationHash {
+		return hashAllocator{}
+	}
+	return randomAllocator{}
+}
+
+func leased(sn ip.IP4Net, leases []Lease) bool {
+	for _, l := range leases {
+		if sn.Overlaps(l.Subnet) {
+			return true
+		}
+	}
+	return false
+}
+
+var rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// randomAllocator picks a random subnet among the first 100 free ones, so that nodes
+// starting at the same time rarely race for the same subnet.
+type randomAllocator struct{}
+
+func (randomAllocator) Allocate(config *Config, leases []Lease, nodeID string) (ip.IP4Net, error) {
+	log.Infof("Picking subnet in range %s ... %s", config.SubnetMin, config.SubnetMax)
+
+	var bag []ip.IP4
+	for sn := (ip.IP4Net{IP: config.SubnetMin, PrefixLen: config.SubnetLen}); sn.IP <= config.SubnetMax && len(bag) < 100; sn = sn.Next() {
+		if !leased(sn, leases) {
+			bag = append(bag, sn.IP)
+		}
+	}
+
+	if len(bag) == 0 {
+		return ip.IP4Net{}, ErrNoMoreSubnets
+	}
+	return ip.IP4Net{IP: bag[rnd.Intn(len(bag))], PrefixLen: config.SubnetLen}, nil
+}
+
+// hashAllocator picks the subnet at the position of the hash of the node ID in the range,
+// or the next free one after it. A node thus gets the same subnet whenever it's free,
+// e.g. after being reinstalled, which keeps firewall rules and DNS records referring to
+// it stable.
+type hashAllocator struct{}
+
+func (hashAllocator) Allocate(config *Config, leases []Lease, nodeID string) (ip.IP4Net, error) {
+	size := uint64(1) << (32 - config.SubnetLen)
+	if config.SubnetMax < config.SubnetMin {
+		return ip.IP4Net{}, ErrNoMoreSubnets
+	}
+	count := (uint64(config.SubnetMax)-uint64(config.SubnetMin))/size + 1
+
+	h := fnv.New64a()
+	h.Write([]byte(nodeID))
+	first := h.Sum64() % count
+
+	for i := uint64(0); i < count; i++ {
+		n := (first + i) % count
+		sn := ip.IP4Net{IP: config.SubnetMin + ip.IP4(n*size), PrefixLen: config.SubnetLen}
+		if !leased(sn, leases) {
+			if i > 0 {
+				log.Infof("Subnet %v of node %q is taken, using %v", ip.IP4Net{IP: config.SubnetMin + ip.IP4(first*size), PrefixLen: config.SubnetLen}, nodeID, sn)
+			}
+			return sn, nil
+		}
+	}
+	return ip.IP4Net{}, ErrNoMoreSubnets
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"testing"
+)
+
+func TestHashAllocator(t *testing.T) {
+	cfg, err := ParseConfig(`{ "Network": "10.3.0.0/24", "SubnetLen": 28, "SubnetAllocation": "hash" }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAllocator(cfg)
+
+	sn, err := a.Allocate(cfg, nil, "node-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Network.Contains(sn.IP) || sn.IP < cfg.SubnetMin || sn.PrefixLen != 28 {
+		t.Fatalf("allocated %v outside of the subnet range", sn)
+	}
+
+	// The same node gets the same subnet
+	if again, _ := a.Allocate(cfg, nil, "node-1"); again != sn {
+		t.Errorf("expected %v again, got %v", sn, again)
+	}
+
+	// Taken subnets are skipped
+	taken := []Lease{{Subnet: sn}}
+	next, err := a.Allocate(cfg, taken, "node-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == sn {
+		t.Errorf("expected another subnet than the taken %v", sn)
+	}
+
+	// Until there are none left
+	var leases []Lease
+	for i := 0; i < 15; i++ {
+		sn, err := a.Allocate(cfg, leases, "node-1")
+		if err != nil {
+			t.Fatalf("allocation %d failed: %v", i, err)
+		}
+		leases = append(leases, Lease{Subnet: sn})
+	}
+	if _, err := a.Allocate(cfg, leases, "node-1"); err != ErrNoMoreSubnets {
+		t.Errorf("expected ErrNoMoreSubnets, got %v", err)
+	}
+}
+
+func TestRandomAllocator(t *testing.T) {
+	cfg, err := ParseConfig(`{ "Network": "10.3.0.0/24", "SubnetLen": 26 }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAllocator(cfg)
+
+	var leases []Lease
+	for i := 0; i < 3; i++ {
+		sn, err := a.Allocate(cfg, leases, "")
+		if err != nil {
+			t.Fatalf("allocation %d failed: %v", i, err)
+		}
+		if sn.IP < cfg.SubnetMin || sn.IP > cfg.SubnetMax {
+			t.Fatalf("allocated %v outside of the subnet range", sn)
+		}
+		leases = append(leases, Lease{Subnet: sn})
+	}
+	if _, err := a.Allocate(cfg, leases, ""); err != ErrNoMoreSubnets {
+		t.Errorf("expected ErrNoMoreSubnets, got %v", err)
+	}
+
+	if _, err := ParseConfig(`{ "Network": "10.3.0.0/24", "SubnetAllocation": "linear" }`); err == nil {
+		t.Error("expected an unknown SubnetAllocation to be rejected")
+	}
+}
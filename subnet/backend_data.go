@@ -0,0 +1,67 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// BackendDataManager wraps a Manager and publishes the data of additional backends in the
+// BackendDataByType of the lease of the node, e.g. of a second dataplane run next to the
+// one of flanneld while migrating between backends.
+type BackendDataManager struct {
+	Manager
+	data map[string]json.RawMessage
+}
+
+// NewBackendDataManager wraps sm, publishing data keyed by backend type.
+func NewBackendDataManager(sm Manager, data map[string]json.RawMessage) *BackendDataManager {
+	return &BackendDataManager{
+		Manager: sm,
+		data:    data,
+	}
+}
+
+// ParseBackendDataByType parses a JSON object of backend data keyed by backend type, e.g.
+// {"ipsec":{},"wireguard":{"PublicKey":"..."}}.
+func ParseBackendDataByType(s string) (map[string]json.RawMessage, error) {
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(s), &data); err != nil {
+		return nil, err
+	}
+	for bt, d := range data {
+		if bt == "" {
+			return nil, fmt.Errorf("backend data without backend type")
+		}
+		if string(d) == "null" {
+			data[bt] = json.RawMessage("{}")
+		}
+	}
+	return data, nil
+}
+
+func (m *BackendDataManager) AcquireLease(ctx context.Context, attrs *LeaseAttrs) (*Lease, error) {
+	a := *attrs
+	a.BackendDataByType = m.data
+	return m.Manager.AcquireLease(ctx, &a)
+}
+
+func (m *BackendDataManager) RenewLease(ctx context.Context, lease *Lease) error {
+	lease.Attrs.BackendDataByType = m.data
+	return m.Manager.RenewLease(ctx, lease)
+}
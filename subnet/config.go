@@ -18,17 +18,41 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/coreos/flannel/pkg/ip"
 )
 
+// DefaultLeaseDuration is how long leases last without being renewed by default.
+const DefaultLeaseDuration = 24 * time.Hour
+
 type Config struct {
-	Network     ip.IP4Net
-	SubnetMin   ip.IP4
-	SubnetMax   ip.IP4
-	SubnetLen   uint
+	Network   ip.IP4Net
+	SubnetMin ip.IP4
+	SubnetMax ip.IP4
+	SubnetLen uint
+	// ReclaimFirstSubnet makes the first subnet of Network available for leases,
+	// which is skipped by default.
+	ReclaimFirstSubnet bool `json:",omitempty"`
+	// AlignSubnets rounds SubnetMin up and SubnetMax down to a SubnetLen boundary,
+	// instead of rejecting them when they aren't on one.
+	AlignSubnets bool `json:",omitempty"`
+	// LeaseDuration is how long leases last without being renewed, e.g. "72h" for edge
+	// nodes with flaky WAN links. Defaults to DefaultLeaseDuration.
+	LeaseDuration string `json:",omitempty"`
+	// SubnetAllocation is the strategy picking the subnets of new nodes, AllocationRandom
+	// or AllocationHash.
+	SubnetAllocation string `json:",omitempty"`
+	// IPv6Network is the IPv6 prefix of the pods, e.g. routed natively in a dual-stack
+	// cluster. flannel doesn't lease subnets of it, it's only used for ip6tables rules.
+	IPv6Network string          `json:",omitempty"`
 	BackendType string          `json:"-"`
 	Backend     json.RawMessage `json:",omitempty"`
+
+	leaseDuration time.Duration
+	unknown       map[string]json.RawMessage
 }
 
 func parseBackendType(be json.RawMessage) (string, error) {
@@ -45,13 +69,39 @@ func parseBackendType(be json.RawMessage) (string, error) {
 	return bt.Type, nil
 }
 
+// ParseConfig parses the network config and fills in the defaults. Fields it doesn't
+// know are kept, as they may belong to a newer version of flannel.
 func ParseConfig(s string) (*Config, error) {
+	return parseConfig(s, false)
+}
+
+// ParseConfigStrict parses the network config like ParseConfig, but also rejects unknown
+// fields, e.g. misspelled ones, and a missing backend type.
+func ParseConfigStrict(s string) (*Config, error) {
+	return parseConfig(s, true)
+}
+
+func parseConfig(s string, strict bool) (*Config, error) {
 	cfg := new(Config)
 	err := json.Unmarshal([]byte(s), cfg)
 	if err != nil {
 		return nil, err
 	}
 
+	if strict {
+		if len(cfg.unknown) > 0 {
+			var names []string
+			for name := range cfg.unknown {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown fields in config: %s", strings.Join(names, ", "))
+		}
+		if cfg.Network.Empty() {
+			return nil, errors.New("Network is missing")
+		}
+	}
+
 	if cfg.SubnetLen > 0 {
 		// SubnetLen needs to allow for a tunnel and bridge device on each host.
 		if cfg.SubnetLen > 30 {
@@ -81,13 +131,56 @@ func ParseConfig(s string) (*Config, error) {
 		}
 	}
 
+	cfg.leaseDuration = DefaultLeaseDuration
+	if cfg.LeaseDuration != "" {
+		d, err := time.ParseDuration(cfg.LeaseDuration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LeaseDuration: %v", err)
+		}
+		if d < 5*time.Minute {
+			return nil, fmt.Errorf("LeaseDuration %v is shorter than 5m", d)
+		}
+		cfg.leaseDuration = d
+	}
+
+	switch cfg.SubnetAllocation {
+	case "", AllocationRandom, AllocationHash:
+	default:
+		return nil, fmt.Errorf("unknown SubnetAllocation %q, expected %q or %q", cfg.SubnetAllocation, AllocationRandom, AllocationHash)
+	}
+
+	if cfg.IPv6Network != "" {
+		ipn, err := ip.IPv6.ParseCIDR(cfg.IPv6Network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IPv6Network: %v", err)
+		}
+		cfg.IPv6Network = ipn.String()
+	}
+
+	bt, err := parseBackendType(cfg.Backend)
+	if err != nil {
+		return nil, err
+	}
+	if strict && bt == "" {
+		return nil, errors.New("Backend has no Type")
+	}
+	cfg.BackendType = bt
+
 	subnetSize := ip.IP4(1 << (32 - cfg.SubnetLen))
 
+	if cfg.ReclaimFirstSubnet && cfg.SubnetMin != ip.IP4(0) {
+		return nil, errors.New("SubnetMin and ReclaimFirstSubnet can't be used together")
+	}
+
 	if cfg.SubnetMin == ip.IP4(0) {
-		// skip over the first subnet otherwise it causes problems. e.g.
-		// if Network is 10.100.0.0/16, having an interface with 10.0.0.0
-		// conflicts with the broadcast address.
-		cfg.SubnetMin = cfg.Network.IP + subnetSize
+		if cfg.ReclaimFirstSubnet {
+			cfg.SubnetMin = cfg.Network.IP
+		} else {
+			// skip over the first subnet otherwise it causes problems. e.g.
+			// if Network is 10.100.0.0/16, having an interface with 10.0.0.0
+			// conflicts with the broadcast address.
+			cfg.SubnetMin = cfg.Network.IP + subnetSize
+		}
 	} else if !cfg.Network.Contains(cfg.SubnetMin) {
 		return nil, errors.New("SubnetMin is not in the range of the Network")
 	}
@@ -100,19 +193,43 @@ func ParseConfig(s string) (*Config, error) {
 
 	// The SubnetMin and SubnetMax need to be aligned to a SubnetLen boundary
 	mask := ip.IP4(0xFFFFFFFF << (32 - cfg.SubnetLen))
-	if cfg.SubnetMin != cfg.SubnetMin&mask {
-		return nil, fmt.Errorf("SubnetMin is not on a SubnetLen boundary: %v", cfg.SubnetMin)
+	if cfg.AlignSubnets {
+		if min := (cfg.SubnetMin + subnetSize - 1) & mask; min != cfg.SubnetMin {
+			if !cfg.Network.Contains(min) {
+				return nil, fmt.Errorf("SubnetMin %v rounded up to a SubnetLen boundary is not in the range of the Network", cfg.SubnetMin)
+			}
+			cfg.SubnetMin = min
+		}
+		cfg.SubnetMax &= mask
+		if cfg.SubnetMin > cfg.SubnetMax {
+			return nil, fmt.Errorf("no subnet boundary between SubnetMin and SubnetMax, which were aligned to %v and %v", cfg.SubnetMin, cfg.SubnetMax)
+		}
+	}
+	if !ip.IPv4.OnBoundary(cfg.SubnetMin.ToIP(), int(cfg.SubnetLen)) {
+		return nil, fmt.Errorf("SubnetMin is not on a SubnetLen boundary: %v (set AlignSubnets to round it up)", cfg.SubnetMin)
 	}
 
-	if cfg.SubnetMax != cfg.SubnetMax&mask {
-		return nil, fmt.Errorf("SubnetMax is not on a SubnetLen boundary: %v", cfg.SubnetMax)
+	if !ip.IPv4.OnBoundary(cfg.SubnetMax.ToIP(), int(cfg.SubnetLen)) {
+		return nil, fmt.Errorf("SubnetMax is not on a SubnetLen boundary: %v (set AlignSubnets to round it down)", cfg.SubnetMax)
 	}
 
-	bt, err := parseBackendType(cfg.Backend)
-	if err != nil {
-		return nil, err
+	if cfg.SubnetMin > cfg.SubnetMax {
+		return nil, fmt.Errorf("SubnetMin %v is above SubnetMax %v", cfg.SubnetMin, cfg.SubnetMax)
+	}
+
+	// The udp backend routes the whole Network to its TUN device, whose address would
+	// be the network address of Network for the node leasing the first subnet.
+	if cfg.SubnetMin == cfg.Network.IP && cfg.BackendType == "udp" {
+		return nil, fmt.Errorf("the first subnet of the Network (%v) can't be leased with the udp backend", cfg.Network)
 	}
-	cfg.BackendType = bt
 
 	return cfg, nil
 }
+
+// LeaseTTL returns the LeaseDuration of a parsed config.
+func (c *Config) LeaseTTL() time.Duration {
+	if c.leaseDuration == 0 {
+		return DefaultLeaseDuration
+	}
+	return c.leaseDuration
+}
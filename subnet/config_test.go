@@ -16,6 +16,7 @@ package subnet
 
 import (
 	"testing"
+	"time"
 )
 
 func TestConfigDefaults(t *testing.T) {
@@ -69,3 +70,129 @@ func TestConfigOverrides(t *testing.T) {
 		t.Errorf("SubnetLen mismatch: expected 28, got %d", cfg.SubnetLen)
 	}
 }
+
+func TestConfigReclaimFirstSubnet(t *testing.T) {
+	s := `{ "Network": "10.3.0.0/16", "ReclaimFirstSubnet": true, "Backend": { "Type": "vxlan" } }`
+
+	cfg, err := ParseConfig(s)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+
+	if cfg.SubnetMin.String() != "10.3.0.0" {
+		t.Errorf("SubnetMin mismatch: expected 10.3.0.0, got %s", cfg.SubnetMin)
+	}
+
+	for _, s := range []string{
+		// SubnetMin already says where to start
+		`{ "Network": "10.3.0.0/16", "ReclaimFirstSubnet": true, "SubnetMin": "10.3.5.0", "Backend": { "Type": "vxlan" } }`,
+		// udp is the default backend
+		`{ "Network": "10.3.0.0/16", "ReclaimFirstSubnet": true }`,
+		`{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.0.0", "Backend": { "Type": "udp" } }`,
+	} {
+		if _, err := ParseConfig(s); err == nil {
+			t.Errorf("ParseConfig of %s succeeded, expected an error", s)
+		}
+	}
+}
+
+func TestConfigStrict(t *testing.T) {
+	s := `{ "Network": "10.3.0.0/16", "Backend": { "Type": "vxlan" } }`
+	cfg, err := ParseConfigStrict(s)
+	if err != nil {
+		t.Fatalf("ParseConfigStrict failed: %s", err)
+	}
+	if cfg.SubnetLen != 24 || cfg.SubnetMin.String() != "10.3.1.0" || cfg.BackendType != "vxlan" {
+		t.Errorf("unexpected effective config %+v", cfg)
+	}
+
+	for _, s := range []string{
+		`{ "Network": "10.3.0.0/16", "SubnetLenght": 26 }`,
+		`{ "SubnetLen": 26 }`,
+		`{ "Network": "10.3.0.0/16", "Backend": { "VNI": 2 } }`,
+		`{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.8.0", "SubnetMax": "10.3.5.0" }`,
+	} {
+		if _, err := ParseConfigStrict(s); err == nil {
+			t.Errorf("expected %s to be rejected", s)
+		}
+	}
+
+	// The lenient parsing lets unknown fields through, but not an empty subnet range
+	if _, err := ParseConfig(`{ "Network": "10.3.0.0/16", "SubnetLenght": 26 }`); err != nil {
+		t.Errorf("ParseConfig failed: %s", err)
+	}
+	if _, err := ParseConfig(`{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.8.0", "SubnetMax": "10.3.5.0" }`); err == nil {
+		t.Error("expected a SubnetMin above the SubnetMax to be rejected")
+	}
+}
+
+func TestConfigAlignSubnets(t *testing.T) {
+	s := `{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.5.10", "SubnetMax": "10.3.8.200" }`
+	if _, err := ParseConfig(s); err == nil {
+		t.Fatal("ParseConfig of misaligned subnets succeeded, expected an error")
+	}
+
+	s = `{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.5.10", "SubnetMax": "10.3.8.200", "AlignSubnets": true }`
+	cfg, err := ParseConfig(s)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	if cfg.SubnetMin.String() != "10.3.6.0" {
+		t.Errorf("SubnetMin mismatch: expected 10.3.6.0, got %s", cfg.SubnetMin)
+	}
+	if cfg.SubnetMax.String() != "10.3.8.0" {
+		t.Errorf("SubnetMax mismatch: expected 10.3.8.0, got %s", cfg.SubnetMax)
+	}
+
+	// Rounding SubnetMin up mustn't leave the Network
+	s = `{ "Network": "10.3.0.0/16", "SubnetMin": "10.3.255.10", "AlignSubnets": true }`
+	if _, err := ParseConfig(s); err == nil {
+		t.Error("ParseConfig of a SubnetMin rounded out of the Network succeeded, expected an error")
+	}
+}
+
+func TestConfigIPv6Network(t *testing.T) {
+	cfg, err := ParseConfigStrict(`{ "Network": "10.3.0.0/16", "IPv6Network": "fd00:10:3::1/48", "Backend": { "Type": "vxlan" } }`)
+	if err != nil {
+		t.Fatalf("ParseConfigStrict failed: %s", err)
+	}
+	if cfg.IPv6Network != "fd00:10:3::/48" {
+		t.Errorf("IPv6Network mismatch: expected fd00:10:3::/48, got %s", cfg.IPv6Network)
+	}
+
+	for _, s := range []string{
+		`{ "Network": "10.3.0.0/16", "IPv6Network": "10.4.0.0/16" }`,
+		`{ "Network": "10.3.0.0/16", "IPv6Network": "fd00:10:3::" }`,
+	} {
+		if _, err := ParseConfig(s); err == nil {
+			t.Errorf("expected %s to be rejected", s)
+		}
+	}
+}
+
+func TestConfigLeaseDuration(t *testing.T) {
+	cfg, err := ParseConfig(`{ "Network": "10.3.0.0/16" }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	if cfg.LeaseTTL() != DefaultLeaseDuration {
+		t.Errorf("LeaseTTL mismatch: expected %v, got %v", DefaultLeaseDuration, cfg.LeaseTTL())
+	}
+
+	cfg, err = ParseConfig(`{ "Network": "10.3.0.0/16", "LeaseDuration": "72h" }`)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %s", err)
+	}
+	if cfg.LeaseTTL() != 72*time.Hour {
+		t.Errorf("LeaseTTL mismatch: expected 72h, got %v", cfg.LeaseTTL())
+	}
+
+	for _, s := range []string{
+		`{ "Network": "10.3.0.0/16", "LeaseDuration": "3 days" }`,
+		`{ "Network": "10.3.0.0/16", "LeaseDuration": "1m" }`,
+	} {
+		if _, err := ParseConfig(s); err == nil {
+			t.Errorf("expected %s to be rejected", s)
+		}
+	}
+}
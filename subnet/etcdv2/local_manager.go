@@ -29,12 +29,12 @@ import (
 
 const (
 	raceRetries = 10
-	subnetTTL   = 24 * time.Hour
 )
 
 type LocalManager struct {
 	registry       Registry
 	previousSubnet ip.IP4Net
+	nodeID         string
 }
 
 type watchCursor struct {
@@ -65,6 +65,18 @@ func isErrEtcdKeyNotFound(e error) bool {
 	return ok || etcdErr.Code == etcd.ErrorCodeKeyNotFound
 }
 
+// IsRetriable tells whether err may go away when the operation is retried: etcd is
+// unreachable, has no leader or dropped a watcher, or the network failed.
+func IsRetriable(err error) bool {
+	switch e := err.(type) {
+	case *etcd.ClusterError:
+		return true
+	case etcd.Error:
+		return e.Code == etcd.ErrorCodeRaftInternal || e.Code == etcd.ErrorCodeLeaderElect || e.Code == etcd.ErrorCodeWatcherCleared
+	}
+	return IsTransient(err)
+}
+
 func (c watchCursor) String() string {
 	return strconv.FormatUint(c.index, 10)
 }
@@ -74,10 +86,12 @@ func NewLocalManager(config *EtcdConfig, prevSubnet ip.IP4Net) (Manager, error)
 	if err != nil {
 		return nil, err
 	}
-	return newLocalManager(r, prevSubnet), nil
+	m := newLocalManager(r, prevSubnet)
+	m.nodeID = config.NodeID
+	return m, nil
 }
 
-func newLocalManager(r Registry, prevSubnet ip.IP4Net) Manager {
+func newLocalManager(r Registry, prevSubnet ip.IP4Net) *LocalManager {
 	return &LocalManager{
 		registry:       r,
 		previousSubnet: prevSubnet,
@@ -149,14 +163,17 @@ func (m *LocalManager) tryAcquireLease(ctx context.Context, config *Config, extI
 			ttl := time.Duration(0)
 			if !l.Expiration.IsZero() {
 				// Not a reservation
-				ttl = subnetTTL
+				ttl = config.LeaseTTL()
 			}
-			exp, err := m.registry.updateSubnet(ctx, l.Subnet, attrs, ttl, 0)
+			// Keep the fields a newer version of flannel stored in the lease
+			a := *attrs
+			a.PreserveUnknownFields(&l.Attrs)
+			exp, err := m.registry.updateSubnet(ctx, l.Subnet, &a, ttl, 0)
 			if err != nil {
 				return nil, err
 			}
 
-			l.Attrs = *attrs
+			l.Attrs = a
 			l.Expiration = exp
 			return l, nil
 		} else {
@@ -179,14 +196,17 @@ func (m *LocalManager) tryAcquireLease(ctx context.Context, config *Config, extI
 				ttl := time.Duration(0)
 				if !l.Expiration.IsZero() {
 					// Not a reservation
-					ttl = subnetTTL
+					ttl = config.LeaseTTL()
 				}
-				exp, err := m.registry.updateSubnet(ctx, l.Subnet, attrs, ttl, 0)
+				// Keep the fields a newer version of flannel stored in the lease
+				a := *attrs
+				a.PreserveUnknownFields(&l.Attrs)
+				exp, err := m.registry.updateSubnet(ctx, l.Subnet, &a, ttl, 0)
 				if err != nil {
 					return nil, err
 				}
 
-				l.Attrs = *attrs
+				l.Attrs = a
 				l.Expiration = exp
 				return l, nil
 			} else {
@@ -208,13 +228,17 @@ func (m *LocalManager) tryAcquireLease(ctx context.Context, config *Config, extI
 
 	if sn.Empty() {
 		// no existing match, grab a new one
-		sn, err = m.allocateSubnet(config, leases)
+		nodeID := m.nodeID
+		if nodeID == "" {
+			nodeID = extIaddr.String()
+		}
+		sn, err = NewAllocator(config).Allocate(config, leases, nodeID)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	exp, err := m.registry.createSubnet(ctx, sn, attrs, subnetTTL)
+	exp, err := m.registry.createSubnet(ctx, sn, attrs, config.LeaseTTL())
 	switch {
 	case err == nil:
 		log.Infof("Allocated lease (%v) to current node (%v) ", sn, extIaddr)
@@ -230,32 +254,14 @@ func (m *LocalManager) tryAcquireLease(ctx context.Context, config *Config, extI
 	}
 }
 
-func (m *LocalManager) allocateSubnet(config *Config, leases []Lease) (ip.IP4Net, error) {
-	log.Infof("Picking subnet in range %s ... %s", config.SubnetMin, config.SubnetMax)
-
-	var bag []ip.IP4
-	sn := ip.IP4Net{IP: config.SubnetMin, PrefixLen: config.SubnetLen}
-
-OuterLoop:
-	for ; sn.IP <= config.SubnetMax && len(bag) < 100; sn = sn.Next() {
-		for _, l := range leases {
-			if sn.Overlaps(l.Subnet) {
-				continue OuterLoop
-			}
-		}
-		bag = append(bag, sn.IP)
-	}
-
-	if len(bag) == 0 {
-		return ip.IP4Net{}, errors.New("out of subnets")
-	} else {
-		i := randInt(0, len(bag))
-		return ip.IP4Net{IP: bag[i], PrefixLen: config.SubnetLen}, nil
+// RenewLease extends the lease by the LeaseDuration of the current network config.
+func (m *LocalManager) RenewLease(ctx context.Context, lease *Lease) error {
+	config, err := m.GetNetworkConfig(ctx)
+	if err != nil {
+		return err
 	}
-}
 
-func (m *LocalManager) RenewLease(ctx context.Context, lease *Lease) error {
-	exp, err := m.registry.updateSubnet(ctx, lease.Subnet, &lease.Attrs, subnetTTL, 0)
+	exp, err := m.registry.updateSubnet(ctx, lease.Subnet, &lease.Attrs, config.LeaseTTL(), 0)
 	if err != nil {
 		return err
 	}
@@ -282,6 +288,50 @@ func getNextIndex(cursor interface{}) (uint64, error) {
 	return nextIndex, nil
 }
 
+// ReleaseLease deletes the lease of sn.
+func (m *LocalManager) ReleaseLease(ctx context.Context, sn ip.IP4Net) error {
+	return m.registry.deleteSubnet(ctx, sn)
+}
+
+// NetworkConfig returns the config key of the network, or "" if there is none.
+func (m *LocalManager) NetworkConfig(ctx context.Context) (string, error) {
+	cfg, err := m.registry.getNetworkConfig(ctx)
+	if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeKeyNotFound {
+		return "", nil
+	}
+	return cfg, err
+}
+
+// SetNetworkConfig creates the config key of the network. It fails if the key exists.
+func (m *LocalManager) SetNetworkConfig(ctx context.Context, config string) error {
+	return m.registry.setNetworkConfig(ctx, config)
+}
+
+// Leases returns the leases and the reservations of the network.
+func (m *LocalManager) Leases(ctx context.Context) ([]Lease, error) {
+	leases, _, err := m.registry.getSubnets(ctx)
+	return leases, err
+}
+
+// ImportLease creates the lease with its remaining time to live, or as a reservation if
+// it doesn't expire.
+func (m *LocalManager) ImportLease(ctx context.Context, lease *Lease) error {
+	ttl := time.Duration(0)
+	if !lease.Expiration.IsZero() {
+		// etcd counts TTLs in seconds, round up so that the lease doesn't become a reservation
+		ttl = time.Until(lease.Expiration).Truncate(time.Second) + time.Second
+	}
+	_, err := m.registry.createSubnet(ctx, lease.Subnet, &lease.Attrs, ttl)
+	if etcdErr, ok := err.(etcd.Error); ok && etcdErr.Code == etcd.ErrorCodeNodeExist {
+		return ErrLeaseTaken
+	}
+	return err
+}
+
+func (m *LocalManager) TryLead(ctx context.Context, name, id string, ttl time.Duration) (bool, error) {
+	return m.registry.lead(ctx, name, id, ttl)
+}
+
 func (m *LocalManager) leaseWatchReset(ctx context.Context, sn ip.IP4Net) (LeaseWatchResult, error) {
 	l, index, err := m.registry.getSubnet(ctx, sn)
 	if err != nil {
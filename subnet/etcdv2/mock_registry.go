@@ -67,10 +67,16 @@ type event struct {
 	index uint64
 }
 
+type mockLeader struct {
+	id      string
+	expires time.Time
+}
+
 type MockSubnetRegistry struct {
 	mux     sync.Mutex
 	network *netwk
 	index   uint64
+	leaders map[string]mockLeader
 }
 
 func NewMockRegistry(config string, initialSubnets []Lease) *MockSubnetRegistry {
@@ -90,6 +96,16 @@ func (msr *MockSubnetRegistry) getNetworkConfig(ctx context.Context) (string, er
 	return msr.network.config, nil
 }
 
+func (msr *MockSubnetRegistry) setNetworkConfig(ctx context.Context, config string) error {
+	if msr.network.config != "" {
+		return etcd.Error{
+			Code:  etcd.ErrorCodeNodeExist,
+			Index: msr.index,
+		}
+	}
+	return msr.setConfig(config)
+}
+
 func (msr *MockSubnetRegistry) setConfig(config string) error {
 	msr.network.config = config
 	return nil
@@ -261,6 +277,20 @@ func (msr *MockSubnetRegistry) watchSubnet(ctx context.Context, since uint64, sn
 	}
 }
 
+func (msr *MockSubnetRegistry) lead(ctx context.Context, name, id string, ttl time.Duration) (bool, error) {
+	msr.mux.Lock()
+	defer msr.mux.Unlock()
+
+	if l, ok := msr.leaders[name]; ok && l.id != id && clock.Now().Before(l.expires) {
+		return false, nil
+	}
+	if msr.leaders == nil {
+		msr.leaders = make(map[string]mockLeader)
+	}
+	msr.leaders[name] = mockLeader{id: id, expires: clock.Now().Add(ttl)}
+	return true, nil
+}
+
 func (msr *MockSubnetRegistry) expireSubnet(network string, sn ip.IP4Net) {
 	if sub, i, err := msr.network.findSubnet(sn); err == nil {
 		msr.index += 1
@@ -38,6 +38,7 @@ var (
 
 type Registry interface {
 	getNetworkConfig(ctx context.Context) (string, error)
+	setNetworkConfig(ctx context.Context, config string) error
 	getSubnets(ctx context.Context) ([]Lease, uint64, error)
 	getSubnet(ctx context.Context, sn ip.IP4Net) (*Lease, uint64, error)
 	createSubnet(ctx context.Context, sn ip.IP4Net, attrs *LeaseAttrs, ttl time.Duration) (time.Time, error)
@@ -45,16 +46,37 @@ type Registry interface {
 	deleteSubnet(ctx context.Context, sn ip.IP4Net) error
 	watchSubnets(ctx context.Context, since uint64) (Event, uint64, error)
 	watchSubnet(ctx context.Context, since uint64, sn ip.IP4Net) (Event, uint64, error)
+	lead(ctx context.Context, name, id string, ttl time.Duration) (bool, error)
 }
 
 type EtcdConfig struct {
 	Endpoints []string
-	Keyfile   string
-	Certfile  string
-	CAFile    string
-	Prefix    string
-	Username  string
-	Password  string
+	// DiscoverySRV is a domain whose etcd-client(-ssl) SRV records list the endpoints.
+	// It takes precedence over Endpoints.
+	DiscoverySRV string
+	Keyfile      string
+	Certfile     string
+	CAFile       string
+	Prefix       string
+	Username     string
+	Password     string
+	// NodeID identifies the node to the hash SubnetAllocation, which derives the subnet
+	// from it. The public IP is used if it's empty.
+	NodeID string
+}
+
+// endpoints returns the etcd endpoints, looking them up through SRV records if DiscoverySRV is set.
+func (c *EtcdConfig) endpoints() ([]string, error) {
+	if c.DiscoverySRV == "" {
+		return c.Endpoints, nil
+	}
+
+	eps, err := etcd.NewSRVDiscover().Discover(c.DiscoverySRV)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover etcd endpoints of %s: %v", c.DiscoverySRV, err)
+	}
+	log.Infof("Discovered etcd endpoints %v through SRV records of %s", eps, c.DiscoverySRV)
+	return eps, nil
 }
 
 type etcdNewFunc func(c *EtcdConfig) (etcd.KeysAPI, error)
@@ -79,8 +101,14 @@ func newEtcdClient(c *EtcdConfig) (etcd.KeysAPI, error) {
 		return nil, err
 	}
 
+	endpoints, err := c.endpoints()
+	if err != nil {
+		return nil, err
+	}
+
+	// The client sticks to one of the endpoints and moves on to the next one when it fails.
 	cli, err := etcd.New(etcd.Config{
-		Endpoints: c.Endpoints,
+		Endpoints: endpoints,
 		Transport: t,
 		Username:  c.Username,
 		Password:  c.Password,
@@ -116,11 +144,18 @@ func (esr *etcdSubnetRegistry) getNetworkConfig(ctx context.Context) (string, er
 	key := path.Join(esr.etcdCfg.Prefix, "config")
 	resp, err := esr.client().Get(ctx, key, &etcd.GetOptions{Quorum: true})
 	if err != nil {
-		return "", err
+		return "", esr.checkError(err)
 	}
 	return resp.Node.Value, nil
 }
 
+// setNetworkConfig creates the config key, unless it exists.
+func (esr *etcdSubnetRegistry) setNetworkConfig(ctx context.Context, config string) error {
+	key := path.Join(esr.etcdCfg.Prefix, "config")
+	_, err := esr.client().Set(ctx, key, config, &etcd.SetOptions{PrevExist: etcd.PrevNoExist})
+	return esr.checkError(err)
+}
+
 // getSubnets queries etcd to get a list of currently allocated leases for a given network.
 // It returns the leases along with the "as-of" etcd-index that can be used as the starting
 // point for etcd watch.
@@ -132,7 +167,7 @@ func (esr *etcdSubnetRegistry) getSubnets(ctx context.Context) ([]Lease, uint64,
 			// key not found: treat it as empty set
 			return []Lease{}, etcdErr.Index, nil
 		}
-		return nil, 0, err
+		return nil, 0, esr.checkError(err)
 	}
 
 	leases := []Lease{}
@@ -153,7 +188,7 @@ func (esr *etcdSubnetRegistry) getSubnet(ctx context.Context, sn ip.IP4Net) (*Le
 	key := path.Join(esr.etcdCfg.Prefix, "subnets", MakeSubnetKey(sn))
 	resp, err := esr.client().Get(ctx, key, &etcd.GetOptions{Quorum: true})
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, esr.checkError(err)
 	}
 
 	l, err := nodeToLease(resp.Node)
@@ -174,7 +209,7 @@ func (esr *etcdSubnetRegistry) createSubnet(ctx context.Context, sn ip.IP4Net, a
 
 	resp, err := esr.client().Set(ctx, key, string(value), opts)
 	if err != nil {
-		return time.Time{}, err
+		return time.Time{}, esr.checkError(err)
 	}
 
 	exp := time.Time{}
@@ -197,7 +232,7 @@ func (esr *etcdSubnetRegistry) updateSubnet(ctx context.Context, sn ip.IP4Net, a
 		TTL:       ttl,
 	})
 	if err != nil {
-		return time.Time{}, err
+		return time.Time{}, esr.checkError(err)
 	}
 
 	exp := time.Time{}
@@ -211,7 +246,29 @@ func (esr *etcdSubnetRegistry) updateSubnet(ctx context.Context, sn ip.IP4Net, a
 func (esr *etcdSubnetRegistry) deleteSubnet(ctx context.Context, sn ip.IP4Net) error {
 	key := path.Join(esr.etcdCfg.Prefix, "subnets", MakeSubnetKey(sn))
 	_, err := esr.client().Delete(ctx, key, nil)
-	return err
+	return esr.checkError(err)
+}
+
+// lead creates the leader key of name with id, or refreshes it if id already leads.
+func (esr *etcdSubnetRegistry) lead(ctx context.Context, name, id string, ttl time.Duration) (bool, error) {
+	key := path.Join(esr.etcdCfg.Prefix, "leaders", name)
+	_, err := esr.client().Set(ctx, key, id, &etcd.SetOptions{PrevExist: etcd.PrevNoExist, TTL: ttl})
+	if err == nil {
+		return true, nil
+	}
+	if etcdErr, ok := err.(etcd.Error); !ok || etcdErr.Code != etcd.ErrorCodeNodeExist {
+		return false, esr.checkError(err)
+	}
+
+	_, err = esr.client().Set(ctx, key, id, &etcd.SetOptions{PrevValue: id, TTL: ttl})
+	if err == nil {
+		return true, nil
+	}
+	if etcdErr, ok := err.(etcd.Error); ok && (etcdErr.Code == etcd.ErrorCodeTestFailed || etcdErr.Code == etcd.ErrorCodeKeyNotFound) {
+		// Led by another node, or the key just expired
+		return false, nil
+	}
+	return false, esr.checkError(err)
 }
 
 func (esr *etcdSubnetRegistry) watchSubnets(ctx context.Context, since uint64) (Event, uint64, error) {
@@ -222,7 +279,7 @@ func (esr *etcdSubnetRegistry) watchSubnets(ctx context.Context, since uint64) (
 	}
 	e, err := esr.client().Watcher(key, opts).Next(ctx)
 	if err != nil {
-		return Event{}, 0, err
+		return Event{}, 0, esr.checkError(err)
 	}
 
 	evt, err := parseSubnetWatchResponse(e)
@@ -237,7 +294,7 @@ func (esr *etcdSubnetRegistry) watchSubnet(ctx context.Context, since uint64, sn
 
 	e, err := esr.client().Watcher(key, opts).Next(ctx)
 	if err != nil {
-		return Event{}, 0, err
+		return Event{}, 0, esr.checkError(err)
 	}
 
 	evt, err := parseSubnetWatchResponse(e)
@@ -250,15 +307,28 @@ func (esr *etcdSubnetRegistry) client() etcd.KeysAPI {
 	return esr.cli
 }
 
+// resetClient recreates the etcd client, which resolves the endpoints and loads the TLS files again.
+// The current client is kept if that fails.
 func (esr *etcdSubnetRegistry) resetClient() {
 	esr.mux.Lock()
 	defer esr.mux.Unlock()
 
-	var err error
-	esr.cli, err = newEtcdClient(esr.etcdCfg)
+	cli, err := esr.cliNewFunc(esr.etcdCfg)
 	if err != nil {
-		panic(fmt.Errorf("resetClient: error recreating etcd client: %v", err))
+		log.Errorf("Error recreating etcd client: %v", err)
+		return
 	}
+	esr.cli = cli
+}
+
+// checkError reconnects when none of the etcd endpoints could be reached, e.g. because
+// the members of the cluster were replaced, and passes err on.
+func (esr *etcdSubnetRegistry) checkError(err error) error {
+	if _, ok := err.(*etcd.ClusterError); ok {
+		log.Warningf("No etcd endpoint is reachable, reconnecting: %v", err)
+		esr.resetClient()
+	}
+	return err
 }
 
 func parseSubnetWatchResponse(resp *etcd.Response) (Event, error) {
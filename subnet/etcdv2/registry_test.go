@@ -188,3 +188,43 @@ func TestEtcdRegistry(t *testing.T) {
 
 	// TODO: watchSubnet and watchNetworks
 }
+
+type unreachableEtcd struct {
+	etcd.KeysAPI
+}
+
+func (unreachableEtcd) Get(ctx context.Context, key string, opts *etcd.GetOptions) (*etcd.Response, error) {
+	return nil, &etcd.ClusterError{Errors: []error{fmt.Errorf("connection refused")}}
+}
+
+func TestEtcdRegistryReconnect(t *testing.T) {
+	cfg := &EtcdConfig{
+		Endpoints: []string{"http://127.0.0.1:2379"},
+		Prefix:    "/coreos.com/network",
+	}
+
+	clients := 0
+	r, err := newEtcdSubnetRegistry(cfg, func(c *EtcdConfig) (etcd.KeysAPI, error) {
+		clients++
+		if clients == 1 {
+			return unreachableEtcd{}, nil
+		}
+		return newMockEtcd(), nil
+	})
+	if err != nil {
+		t.Fatal("Failed to create etcd subnet registry")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, _, err := r.getSubnets(ctx); err == nil {
+		t.Fatal("Expected getSubnets to fail while etcd is unreachable")
+	}
+	if clients != 2 {
+		t.Fatalf("Expected the etcd client to be recreated, got %d clients", clients)
+	}
+	if _, ok := r.(*etcdSubnetRegistry).client().(*mockEtcd); !ok {
+		t.Fatal("Registry didn't switch to the new etcd client")
+	}
+}
@@ -292,7 +292,7 @@ func TestRenewLease(t *testing.T) {
 		t.Fatal("AcquireLease failed: ", err)
 	}
 
-	now = now.Add(subnetTTL)
+	now = now.Add(DefaultLeaseDuration)
 
 	fakeClock.Advance(24 * time.Hour)
 
@@ -308,7 +308,7 @@ func TestRenewLease(t *testing.T) {
 
 	for _, sn := range n.subnets {
 		if sn.Subnet.Equal(l.Subnet) {
-			expected := now.Add(subnetTTL)
+			expected := now.Add(DefaultLeaseDuration)
 			if !sn.Expiration.Equal(expected) {
 				t.Errorf("Failed to renew lease: bad expiration; expected %v, got %v", expected, sn.Expiration)
 			}
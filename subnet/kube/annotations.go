@@ -23,8 +23,10 @@ import (
 type annotations struct {
 	SubnetKubeManaged        string
 	BackendData              string
+	BackendDataByType        string
 	BackendType              string
 	BackendPublicIP          string
+	BackendPublicIPv6        string
 	BackendPublicIPOverwrite string
 }
 
@@ -57,8 +59,10 @@ func newAnnotations(prefix string) (annotations, error) {
 	a := annotations{
 		SubnetKubeManaged:        prefix + "kube-subnet-manager",
 		BackendData:              prefix + "backend-data",
+		BackendDataByType:        prefix + "backend-data-by-type",
 		BackendType:              prefix + "backend-type",
 		BackendPublicIP:          prefix + "public-ip",
+		BackendPublicIPv6:        prefix + "public-ipv6",
 		BackendPublicIPOverwrite: prefix + "public-ip-overwrite",
 	}
 
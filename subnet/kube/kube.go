@@ -20,7 +20,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
+	"reflect"
 	"time"
 
 	"github.com/coreos/flannel/pkg/ip"
@@ -28,6 +30,7 @@ import (
 
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
@@ -187,7 +190,7 @@ func (ksm *kubeSubnetManager) handleAddLeaseEvent(et subnet.EventType, obj inter
 		return
 	}
 
-	l, err := ksm.nodeToLease(*n)
+	l, err := nodeToLease(ksm.annotations, *n)
 	if err != nil {
 		glog.Infof("Error turning node %q to lease: %v", n.ObjectMeta.Name, err)
 		return
@@ -202,12 +205,15 @@ func (ksm *kubeSubnetManager) handleUpdateLeaseEvent(oldObj, newObj interface{})
 		return
 	}
 	if o.Annotations[ksm.annotations.BackendData] == n.Annotations[ksm.annotations.BackendData] &&
+		o.Annotations[ksm.annotations.BackendDataByType] == n.Annotations[ksm.annotations.BackendDataByType] &&
 		o.Annotations[ksm.annotations.BackendType] == n.Annotations[ksm.annotations.BackendType] &&
-		o.Annotations[ksm.annotations.BackendPublicIP] == n.Annotations[ksm.annotations.BackendPublicIP] {
+		o.Annotations[ksm.annotations.BackendPublicIP] == n.Annotations[ksm.annotations.BackendPublicIP] &&
+		o.Annotations[ksm.annotations.BackendPublicIPv6] == n.Annotations[ksm.annotations.BackendPublicIPv6] &&
+		reflect.DeepEqual(o.Labels, n.Labels) {
 		return // No change to lease
 	}
 
-	l, err := ksm.nodeToLease(*n)
+	l, err := nodeToLease(ksm.annotations, *n)
 	if err != nil {
 		glog.Infof("Error turning node %q to lease: %v", n.ObjectMeta.Name, err)
 		return
@@ -237,17 +243,28 @@ func (ksm *kubeSubnetManager) AcquireLease(ctx context.Context, attrs *subnet.Le
 	if err != nil {
 		return nil, err
 	}
+	bdByType, err := backendDataByTypeString(attrs)
+	if err != nil {
+		return nil, err
+	}
 	_, cidr, err := net.ParseCIDR(n.Spec.PodCIDR)
 	if err != nil {
 		return nil, err
 	}
 	if n.Annotations[ksm.annotations.BackendData] != string(bd) ||
+		n.Annotations[ksm.annotations.BackendDataByType] != bdByType ||
 		n.Annotations[ksm.annotations.BackendType] != attrs.BackendType ||
 		n.Annotations[ksm.annotations.BackendPublicIP] != attrs.PublicIP.String() ||
+		n.Annotations[ksm.annotations.BackendPublicIPv6] != publicIPv6String(attrs) ||
 		n.Annotations[ksm.annotations.SubnetKubeManaged] != "true" ||
 		(n.Annotations[ksm.annotations.BackendPublicIPOverwrite] != "" && n.Annotations[ksm.annotations.BackendPublicIPOverwrite] != attrs.PublicIP.String()) {
 		n.Annotations[ksm.annotations.BackendType] = attrs.BackendType
 		n.Annotations[ksm.annotations.BackendData] = string(bd)
+		if bdByType != "" {
+			n.Annotations[ksm.annotations.BackendDataByType] = bdByType
+		} else {
+			delete(n.Annotations, ksm.annotations.BackendDataByType)
+		}
 		if n.Annotations[ksm.annotations.BackendPublicIPOverwrite] != "" {
 			if n.Annotations[ksm.annotations.BackendPublicIP] != n.Annotations[ksm.annotations.BackendPublicIPOverwrite] {
 				glog.Infof("Overriding public ip with '%s' from node annotation '%s'",
@@ -258,6 +275,11 @@ func (ksm *kubeSubnetManager) AcquireLease(ctx context.Context, attrs *subnet.Le
 		} else {
 			n.Annotations[ksm.annotations.BackendPublicIP] = attrs.PublicIP.String()
 		}
+		if attrs.PublicIPv6 != nil {
+			n.Annotations[ksm.annotations.BackendPublicIPv6] = attrs.PublicIPv6.String()
+		} else {
+			delete(n.Annotations, ksm.annotations.BackendPublicIPv6)
+		}
 		n.Annotations[ksm.annotations.SubnetKubeManaged] = "true"
 
 		oldData, err := json.Marshal(cachedNode)
@@ -307,14 +329,29 @@ func (ksm *kubeSubnetManager) Run(ctx context.Context) {
 	ksm.nodeController.Run(ctx.Done())
 }
 
-func (ksm *kubeSubnetManager) nodeToLease(n v1.Node) (l subnet.Lease, err error) {
-	l.Attrs.PublicIP, err = ip.ParseIP4(n.Annotations[ksm.annotations.BackendPublicIP])
+func nodeToLease(sa annotations, n v1.Node) (l subnet.Lease, err error) {
+	l.Attrs.PublicIP, err = ip.ParseIP4(n.Annotations[sa.BackendPublicIP])
 	if err != nil {
 		return l, err
 	}
 
-	l.Attrs.BackendType = n.Annotations[ksm.annotations.BackendType]
-	l.Attrs.BackendData = json.RawMessage(n.Annotations[ksm.annotations.BackendData])
+	if s := n.Annotations[sa.BackendPublicIPv6]; s != "" {
+		l.Attrs.PublicIPv6 = net.ParseIP(s)
+		if l.Attrs.PublicIPv6 == nil || l.Attrs.PublicIPv6.To4() != nil {
+			return l, fmt.Errorf("invalid public IPv6 address %q", s)
+		}
+	}
+
+	l.Attrs.BackendType = n.Annotations[sa.BackendType]
+	l.Attrs.BackendData = json.RawMessage(n.Annotations[sa.BackendData])
+	if s := n.Annotations[sa.BackendDataByType]; s != "" {
+		if err := json.Unmarshal([]byte(s), &l.Attrs.BackendDataByType); err != nil {
+			return l, fmt.Errorf("invalid backend data by type %q: %v", s, err)
+		}
+	}
+
+	// The labels of a node are managed by Kubernetes, so the lease carries the node labels
+	l.Attrs.Labels = n.Labels
 
 	_, cidr, err := net.ParseCIDR(n.Spec.PodCIDR)
 	if err != nil {
@@ -325,15 +362,51 @@ func (ksm *kubeSubnetManager) nodeToLease(n v1.Node) (l subnet.Lease, err error)
 	return l, nil
 }
 
-// RenewLease: unimplemented
+func backendDataByTypeString(attrs *subnet.LeaseAttrs) (string, error) {
+	if len(attrs.BackendDataByType) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(attrs.BackendDataByType)
+	return string(data), err
+}
+
+func publicIPv6String(attrs *subnet.LeaseAttrs) string {
+	if attrs.PublicIPv6 == nil {
+		return ""
+	}
+	return attrs.PublicIPv6.String()
+}
+
+// RenewLease updates the backend annotations of the node with the attributes of lease.
+// The subnet of a node is its pod CIDR, which doesn't expire, so this only matters when the
+// attributes changed, e.g. because the public IP of the node did.
 func (ksm *kubeSubnetManager) RenewLease(ctx context.Context, lease *subnet.Lease) error {
-	return ErrUnimplemented
+	l, err := ksm.AcquireLease(ctx, &lease.Attrs)
+	if err != nil {
+		return err
+	}
+	if !l.Subnet.Equal(lease.Subnet) {
+		return fmt.Errorf("pod cidr of node %q changed from %v to %v", ksm.nodeName, lease.Subnet, l.Subnet)
+	}
+
+	lease.Expiration = l.Expiration
+	return nil
 }
 
 func (ksm *kubeSubnetManager) WatchLease(ctx context.Context, sn ip.IP4Net, cursor interface{}) (subnet.LeaseWatchResult, error) {
 	return subnet.LeaseWatchResult{}, ErrUnimplemented
 }
 
+// IsRetriable tells whether err may go away when the operation is retried: the API server
+// is overloaded, timed out or failed internally, or the network failed.
+func IsRetriable(err error) bool {
+	if s, ok := err.(apierrors.APIStatus); ok {
+		code := s.Status().Code
+		return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+	}
+	return subnet.IsTransient(err)
+}
+
 func (ksm *kubeSubnetManager) Name() string {
 	return fmt.Sprintf("Kubernetes Subnet Manager - %s", ksm.nodeName)
 }
@@ -0,0 +1,77 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// NewNodeLister returns a function listing the public IPs of the Kubernetes nodes, for
+// subnet.Reaper to remove the leases of deleted nodes. The IPs of a node are its
+// internal and external addresses and its flannel public IP annotations.
+func NewNodeLister(apiUrl, kubeconfig, prefix string) (func(ctx context.Context) (map[ip.IP4]bool, error), error) {
+	cfg, err := clientcmd.BuildConfigFromFlags(apiUrl, kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("fail to create kubernetes config: %v", err)
+	}
+	c, err := clientset.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize client: %v", err)
+	}
+	sa, err := newAnnotations(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx context.Context) (map[ip.IP4]bool, error) {
+		nodes, err := c.CoreV1().Nodes().List(metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		ips := make(map[ip.IP4]bool)
+		for _, n := range nodes.Items {
+			for _, addr := range nodeAddresses(&n, sa) {
+				if pip := net.ParseIP(addr); pip != nil && pip.To4() != nil {
+					ips[ip.FromIP(pip)] = true
+				}
+			}
+		}
+		return ips, nil
+	}, nil
+}
+
+func nodeAddresses(n *v1.Node, sa annotations) []string {
+	var addrs []string
+	for _, addr := range n.Status.Addresses {
+		if addr.Type == v1.NodeInternalIP || addr.Type == v1.NodeExternalIP {
+			addrs = append(addrs, addr.Address)
+		}
+	}
+	for _, key := range []string{sa.BackendPublicIP, sa.BackendPublicIPOverwrite} {
+		if addr, ok := n.Annotations[key]; ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,148 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/coreos/flannel/subnet"
+)
+
+// leaseStore reads and writes the leases of all nodes, for subnet.Migrate. The subnet of
+// a node is its pod CIDR, so leases can only be imported to nodes having that pod CIDR.
+type leaseStore struct {
+	client      clientset.Interface
+	annotations annotations
+	netConfPath string
+}
+
+// NewLeaseStore returns the leases of the Kubernetes nodes as a subnet.LeaseStore. The
+// network config is the one of netConfPath, as with kube-subnet-mgr.
+func NewLeaseStore(apiUrl, kubeconfig, prefix, netConfPath string) (subnet.LeaseStore, error) {
+	cfg, err := clientcmd.BuildConfigFromFlags(apiUrl, kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("fail to create kubernetes config: %v", err)
+	}
+	c, err := clientset.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize client: %v", err)
+	}
+	sa, err := newAnnotations(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return &leaseStore{client: c, annotations: sa, netConfPath: netConfPath}, nil
+}
+
+func (s *leaseStore) NetworkConfig(ctx context.Context) (string, error) {
+	netConf, err := ioutil.ReadFile(s.netConfPath)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(netConf), err
+}
+
+func (s *leaseStore) SetNetworkConfig(ctx context.Context, config string) error {
+	return fmt.Errorf("kube-subnet-mgr reads the network config from %s, which has to be written first, e.g. from the kube-flannel ConfigMap", s.netConfPath)
+}
+
+// Leases returns the leases of the nodes managed by kube-subnet-mgr. They expire a day
+// from now, like the ones of kubeSubnetManager.
+func (s *leaseStore) Leases(ctx context.Context) ([]subnet.Lease, error) {
+	nodes, err := s.client.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var leases []subnet.Lease
+	for _, n := range nodes.Items {
+		if n.Annotations[s.annotations.SubnetKubeManaged] != "true" {
+			continue
+		}
+		l, err := nodeToLease(s.annotations, n)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lease of node %q: %v", n.Name, err)
+		}
+		l.Expiration = time.Now().Add(24 * time.Hour)
+		leases = append(leases, l)
+	}
+	return leases, nil
+}
+
+// ImportLease annotates the node whose pod CIDR is the subnet of lease with its attributes.
+func (s *leaseStore) ImportLease(ctx context.Context, lease *subnet.Lease) error {
+	nodes, err := s.client.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	var node *v1.Node
+	for i, n := range nodes.Items {
+		if _, cidr, err := net.ParseCIDR(n.Spec.PodCIDR); err == nil && cidr.String() == lease.Subnet.String() {
+			node = &nodes.Items[i]
+			break
+		}
+	}
+	if node == nil {
+		return fmt.Errorf("no node has the pod CIDR %v", lease.Subnet)
+	}
+	if node.Annotations[s.annotations.SubnetKubeManaged] == "true" {
+		return subnet.ErrLeaseTaken
+	}
+
+	bdByType, err := backendDataByTypeString(&lease.Attrs)
+	if err != nil {
+		return err
+	}
+	// A null value removes an annotation
+	annotations := map[string]*string{
+		s.annotations.BackendType:       &lease.Attrs.BackendType,
+		s.annotations.BackendPublicIP:   stringPtr(lease.Attrs.PublicIP.String()),
+		s.annotations.SubnetKubeManaged: stringPtr("true"),
+		s.annotations.BackendData:       stringPtr(string(lease.Attrs.BackendData)),
+		s.annotations.BackendDataByType: nil,
+		s.annotations.BackendPublicIPv6: nil,
+	}
+	if bdByType != "" {
+		annotations[s.annotations.BackendDataByType] = &bdByType
+	}
+	if lease.Attrs.PublicIPv6 != nil {
+		annotations[s.annotations.BackendPublicIPv6] = stringPtr(lease.Attrs.PublicIPv6.String())
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := s.client.CoreV1().Nodes().Patch(node.Name, types.MergePatchType, patch); err != nil {
+		return fmt.Errorf("failed to annotate node %q: %v", node.Name, err)
+	}
+	return nil
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
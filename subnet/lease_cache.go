@@ -0,0 +1,239 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// leaseCacheHistory is the number of event batches a LeaseCache keeps, so that lease
+// watchers that fell behind by up to that many get events instead of a snapshot.
+const leaseCacheHistory = 100
+
+// leaseCacheCursor is the revision of the leases of a LeaseCache.
+type leaseCacheCursor uint64
+
+type leaseCacheBatch struct {
+	rev    leaseCacheCursor
+	events []Event
+}
+
+// LeaseCache wraps a Manager and keeps the leases of all nodes in memory, from a single
+// watch of the wrapped manager. Lease watches are served from memory, so that the
+// backend and the other consumers of the leases don't each watch the datastore, and
+// leases can be looked up without asking it.
+//
+// Run has to be running for the watches to return.
+type LeaseCache struct {
+	Manager
+
+	// notifyMux orders the calls of the handlers, so that a handler registered while
+	// the leases change gets the leases before the change first
+	notifyMux sync.Mutex
+
+	mux      sync.Mutex
+	synced   bool
+	leases   map[ip.IP4Net]Lease
+	rev      leaseCacheCursor
+	history  []leaseCacheBatch
+	changed  chan struct{}
+	handlers []func([]Event)
+}
+
+func NewLeaseCache(sm Manager) *LeaseCache {
+	return &LeaseCache{
+		Manager: sm,
+		leases:  make(map[ip.IP4Net]Lease),
+		changed: make(chan struct{}),
+	}
+}
+
+// Run keeps the cache in sync with the wrapped manager until ctx is done.
+func (c *LeaseCache) Run(ctx context.Context) {
+	lw := &leaseWatcher{}
+	var cursor interface{}
+
+	for {
+		res, err := c.Manager.WatchLeases(ctx, cursor)
+		if err != nil {
+			if err == context.Canceled || err == context.DeadlineExceeded {
+				return
+			}
+
+			log.Errorf("Watch subnets: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		cursor = res.Cursor
+
+		var batch []Event
+		if len(res.Events) > 0 {
+			batch = lw.update(res.Events)
+		} else {
+			batch = lw.reset(res.Snapshot)
+		}
+		c.apply(batch)
+	}
+}
+
+func (c *LeaseCache) apply(batch []Event) {
+	c.notifyMux.Lock()
+	defer c.notifyMux.Unlock()
+
+	c.mux.Lock()
+	if len(batch) == 0 && c.synced {
+		c.mux.Unlock()
+		return
+	}
+
+	for _, evt := range batch {
+		switch evt.Type {
+		case EventAdded:
+			c.leases[evt.Lease.Subnet] = evt.Lease
+		case EventRemoved:
+			delete(c.leases, evt.Lease.Subnet)
+		}
+	}
+	if len(batch) > 0 {
+		c.rev++
+		c.history = append(c.history, leaseCacheBatch{rev: c.rev, events: batch})
+		if len(c.history) > leaseCacheHistory {
+			c.history = c.history[len(c.history)-leaseCacheHistory:]
+		}
+	}
+	c.synced = true
+
+	// Wake up the watches
+	close(c.changed)
+	c.changed = make(chan struct{})
+	handlers := c.handlers
+	c.mux.Unlock()
+
+	if len(batch) > 0 {
+		for _, h := range handlers {
+			h(batch)
+		}
+	}
+}
+
+// OnEvents registers h to be called with every batch of lease changes. h is first called
+// with the cached leases as added, or with the leases of the first snapshot if the cache
+// isn't synced yet. Handlers are called from Run, one at a time, so they must not block.
+func (c *LeaseCache) OnEvents(h func([]Event)) {
+	c.notifyMux.Lock()
+	defer c.notifyMux.Unlock()
+
+	c.mux.Lock()
+	c.handlers = append(c.handlers, h)
+	var batch []Event
+	if c.synced {
+		for _, l := range c.list() {
+			batch = append(batch, Event{Type: EventAdded, Lease: l})
+		}
+	}
+	c.mux.Unlock()
+
+	if len(batch) > 0 {
+		h(batch)
+	}
+}
+
+// WatchLeases returns the cached leases if cursor is nil or too old, and otherwise waits
+// for the leases to change after cursor.
+func (c *LeaseCache) WatchLeases(ctx context.Context, cursor interface{}) (LeaseWatchResult, error) {
+	rev, hasRev := cursor.(leaseCacheCursor)
+
+	for {
+		c.mux.Lock()
+		if c.synced {
+			first := c.rev - leaseCacheCursor(len(c.history))
+			switch {
+			case !hasRev || rev < first || rev > c.rev:
+				res := LeaseWatchResult{Snapshot: c.list(), Cursor: c.rev}
+				c.mux.Unlock()
+				return res, nil
+
+			case rev < c.rev:
+				res := LeaseWatchResult{Cursor: c.rev}
+				for _, b := range c.history[rev-first:] {
+					res.Events = append(res.Events, b.events...)
+				}
+				c.mux.Unlock()
+				return res, nil
+			}
+		}
+		changed := c.changed
+		c.mux.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return LeaseWatchResult{}, ctx.Err()
+		}
+	}
+}
+
+// Lookup returns the lease of sn.
+func (c *LeaseCache) Lookup(sn ip.IP4Net) (Lease, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	l, ok := c.leases[sn]
+	return l, ok
+}
+
+// LookupPublicIP returns the leases of the node with the public IP pip.
+func (c *LeaseCache) LookupPublicIP(pip ip.IP4) []Lease {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	var leases []Lease
+	for _, l := range c.leases {
+		if l.Attrs.PublicIP == pip {
+			leases = append(leases, l)
+		}
+	}
+	sortLeases(leases)
+	return leases
+}
+
+// Leases returns all cached leases, ordered by subnet.
+func (c *LeaseCache) Leases() []Lease {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.list()
+}
+
+func (c *LeaseCache) list() []Lease {
+	leases := make([]Lease, 0, len(c.leases))
+	for _, l := range c.leases {
+		leases = append(leases, l)
+	}
+	sortLeases(leases)
+	return leases
+}
+
+func sortLeases(leases []Lease) {
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].Subnet.IP < leases[j].Subnet.IP
+	})
+}
@@ -0,0 +1,122 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// chanManager serves WatchLeases from a channel.
+type chanManager struct {
+	Manager
+	results chan LeaseWatchResult
+	calls   int
+}
+
+func (m *chanManager) WatchLeases(ctx context.Context, cursor interface{}) (LeaseWatchResult, error) {
+	m.calls++
+	select {
+	case res := <-m.results:
+		return res, nil
+	case <-ctx.Done():
+		return LeaseWatchResult{}, ctx.Err()
+	}
+}
+
+func TestLeaseCache(t *testing.T) {
+	l1, l2, l3 := testLease("10.1.1.0/24"), testLease("10.1.2.0/24"), testLease("10.1.3.0/24")
+	l1.Attrs.PublicIP = ip.MustParseIP4("192.168.0.1")
+
+	inner := &chanManager{results: make(chan LeaseWatchResult)}
+	c := NewLeaseCache(inner)
+	handled := make(chan []Event, 10)
+	c.OnEvents(func(batch []Event) { handled <- batch })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+
+	inner.results <- LeaseWatchResult{Snapshot: []Lease{l1, l2}, Cursor: testCursor(10)}
+	if batch := <-handled; len(batch) != 2 {
+		t.Fatalf("expected the snapshot to be handled, got %v", batch)
+	}
+
+	// Watches start from the cached snapshot
+	res, err := c.WatchLeases(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Snapshot) != 2 || res.Snapshot[0].Subnet != l1.Subnet {
+		t.Fatalf("expected the cached leases, got %v", res.Snapshot)
+	}
+	first := res.Cursor
+
+	inner.results <- LeaseWatchResult{Events: []Event{{EventAdded, l3}}, Cursor: testCursor(11)}
+	<-handled
+	inner.results <- LeaseWatchResult{Events: []Event{{EventRemoved, l2}}, Cursor: testCursor(12)}
+	<-handled
+
+	// A watch behind by two batches gets both
+	res, err = c.WatchLeases(ctx, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Events) != 2 || res.Events[0].Lease.Subnet != l3.Subnet || res.Events[1].Type != EventRemoved {
+		t.Fatalf("expected the events since the snapshot, got %+v", res)
+	}
+
+	// An up to date watch waits for the next change
+	results := make(chan LeaseWatchResult)
+	go func() {
+		res, _ := c.WatchLeases(ctx, res.Cursor)
+		results <- res
+	}()
+	inner.results <- LeaseWatchResult{Events: []Event{{EventAdded, l2}}, Cursor: testCursor(13)}
+	if res := <-results; len(res.Events) != 1 || res.Events[0].Lease.Subnet != l2.Subnet {
+		t.Fatalf("expected the new lease, got %+v", res)
+	}
+
+	if l, ok := c.Lookup(l3.Subnet); !ok || l.Subnet != l3.Subnet {
+		t.Fatalf("expected to find %v, got %v", l3.Subnet, l)
+	}
+	if leases := c.LookupPublicIP(l1.Attrs.PublicIP); len(leases) != 1 || leases[0].Subnet != l1.Subnet {
+		t.Fatalf("expected to find the lease of %v, got %v", l1.Attrs.PublicIP, leases)
+	}
+	if len(c.Leases()) != 3 {
+		t.Fatalf("expected 3 leases, got %v", c.Leases())
+	}
+
+	// A handler registered late starts from the cached leases
+	var late []Event
+	c.OnEvents(func(batch []Event) { late = append(late, batch...) })
+	if len(late) != 3 || late[0].Type != EventAdded || late[0].Lease.Subnet != l1.Subnet {
+		t.Fatalf("expected the cached leases to be added, got %+v", late)
+	}
+
+	// Only the cache watches the wrapped manager
+	cancel()
+	<-done
+	if inner.calls != 5 {
+		t.Fatalf("expected 5 watches of the wrapped manager, got %d", inner.calls)
+	}
+}
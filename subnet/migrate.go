@@ -0,0 +1,201 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// LeaseStore is implemented by datastores whose network config and leases can be read
+// and written as a whole, so that a network can be moved from one datastore to another.
+type LeaseStore interface {
+	// NetworkConfig returns the network config as JSON, or "" if there is none.
+	NetworkConfig(ctx context.Context) (string, error)
+	SetNetworkConfig(ctx context.Context, config string) error
+	// Leases returns the leases and the reservations.
+	Leases(ctx context.Context) ([]Lease, error)
+	// ImportLease stores lease with its subnet and attributes, and its expiration if the
+	// datastore has one. It fails with ErrLeaseTaken if the subnet is leased already.
+	ImportLease(ctx context.Context, lease *Lease) error
+}
+
+// MigrationReport describes what Migrate did, or would do in a dry run.
+type MigrationReport struct {
+	// ConfigCopied is set if the destination had no network config and got the one of the source.
+	ConfigCopied bool
+	// Imported are the subnets copied to the destination, Unchanged the ones it already had.
+	Imported  []ip.IP4Net
+	Unchanged []ip.IP4Net
+	// Skipped are the subnets of expired leases, which aren't copied.
+	Skipped []ip.IP4Net
+	// Failed are the subnets that couldn't be copied, or didn't read back the same.
+	Failed map[ip.IP4Net]error
+}
+
+// Migrate copies the network config and the leases of from to to, keeping the subnet of
+// every node, and reads them back from to to verify them. The networks of both have to be
+// the same, since the nodes would have to be renumbered otherwise. Leases to already leased
+// subnets are left alone unless their attributes differ, which fails them.
+//
+// The labels of the leases aren't verified, since the Kubernetes datastore takes them
+// from the nodes.
+func Migrate(ctx context.Context, from, to LeaseStore, dryRun bool) (*MigrationReport, error) {
+	r := &MigrationReport{Failed: make(map[ip.IP4Net]error)}
+
+	srcConfig, err := from.NetworkConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the network config of the source: %v", err)
+	}
+	if srcConfig == "" {
+		return nil, fmt.Errorf("the source has no network config")
+	}
+	src, err := ParseConfig(srcConfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network config in the source: %v", err)
+	}
+
+	dstConfig, err := to.NetworkConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the network config of the destination: %v", err)
+	}
+	if dstConfig == "" {
+		if !dryRun {
+			if err := to.SetNetworkConfig(ctx, srcConfig); err != nil {
+				return nil, fmt.Errorf("failed to write the network config to the destination: %v", err)
+			}
+		}
+		r.ConfigCopied = true
+	} else {
+		dst, err := ParseConfig(dstConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network config in the destination: %v", err)
+		}
+		if !dst.Network.Equal(src.Network) || dst.SubnetLen != src.SubnetLen {
+			return nil, fmt.Errorf("the destination network %v with /%d subnets differs from the source network %v with /%d subnets",
+				dst.Network, dst.SubnetLen, src.Network, src.SubnetLen)
+		}
+	}
+
+	leases, err := from.Leases(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the leases of the source: %v", err)
+	}
+	existing, err := leasesBySubnet(ctx, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the leases of the destination: %v", err)
+	}
+
+	now := time.Now()
+	var copied []Lease
+	for i := range leases {
+		l := &leases[i]
+		switch {
+		case !l.Expiration.IsZero() && l.Expiration.Before(now):
+			r.Skipped = append(r.Skipped, l.Subnet)
+		case !src.Network.Contains(l.Subnet.IP):
+			r.Failed[l.Subnet] = fmt.Errorf("outside of the network %v", src.Network)
+		default:
+			if e, ok := existing[l.Subnet]; ok {
+				if !sameAttrs(&e.Attrs, &l.Attrs) {
+					r.Failed[l.Subnet] = fmt.Errorf("leased to %v in the destination: %v", e.Attrs.PublicIP, ErrLeaseTaken)
+					continue
+				}
+				r.Unchanged = append(r.Unchanged, l.Subnet)
+				copied = append(copied, *l)
+				continue
+			}
+			if !dryRun {
+				if err := to.ImportLease(ctx, l); err != nil {
+					r.Failed[l.Subnet] = err
+					continue
+				}
+			}
+			r.Imported = append(r.Imported, l.Subnet)
+			copied = append(copied, *l)
+		}
+	}
+
+	if !dryRun {
+		// Read everything back, to catch what the destination couldn't represent
+		if existing, err = leasesBySubnet(ctx, to); err != nil {
+			return r, fmt.Errorf("failed to read back the leases of the destination: %v", err)
+		}
+		for i := range copied {
+			l := &copied[i]
+			if e, ok := existing[l.Subnet]; !ok {
+				r.Failed[l.Subnet] = fmt.Errorf("missing from the destination after the migration")
+			} else if !sameAttrs(&e.Attrs, &l.Attrs) {
+				r.Failed[l.Subnet] = fmt.Errorf("differs in the destination after the migration")
+			}
+		}
+	}
+
+	sortSubnets(r.Imported)
+	sortSubnets(r.Unchanged)
+	sortSubnets(r.Skipped)
+	if len(r.Failed) > 0 {
+		return r, fmt.Errorf("%d of %d leases failed to migrate", len(r.Failed), len(leases))
+	}
+	return r, nil
+}
+
+func leasesBySubnet(ctx context.Context, s LeaseStore) (map[ip.IP4Net]Lease, error) {
+	leases, err := s.Leases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[ip.IP4Net]Lease, len(leases))
+	for _, l := range leases {
+		m[l.Subnet] = l
+	}
+	return m, nil
+}
+
+// sameAttrs tells whether two leases have the same public IPs and backend data.
+func sameAttrs(a, b *LeaseAttrs) bool {
+	if a.PublicIP != b.PublicIP || !a.PublicIPv6.Equal(b.PublicIPv6) || a.BackendType != b.BackendType ||
+		!sameJSON(a.BackendData, b.BackendData) || len(a.BackendDataByType) != len(b.BackendDataByType) {
+		return false
+	}
+	for bt, data := range a.BackendDataByType {
+		if other, ok := b.BackendDataByType[bt]; !ok || !sameJSON(data, other) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameJSON compares two JSON documents, ignoring the whitespace datastores may add or remove.
+func sameJSON(a, b json.RawMessage) bool {
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+func sortSubnets(sns []ip.IP4Net) {
+	sort.Slice(sns, func(i, j int) bool {
+		return sns[i].IP < sns[j].IP
+	})
+}
@@ -0,0 +1,153 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// memStore is a LeaseStore in memory. If dropData is set, it loses the backend data of
+// imported leases, like a datastore that can't represent them.
+type memStore struct {
+	config   string
+	leases   map[ip.IP4Net]Lease
+	dropData bool
+}
+
+func newMemStore(config string, leases ...Lease) *memStore {
+	s := &memStore{config: config, leases: make(map[ip.IP4Net]Lease)}
+	for _, l := range leases {
+		s.leases[l.Subnet] = l
+	}
+	return s
+}
+
+func (s *memStore) NetworkConfig(ctx context.Context) (string, error) {
+	return s.config, nil
+}
+
+func (s *memStore) SetNetworkConfig(ctx context.Context, config string) error {
+	s.config = config
+	return nil
+}
+
+func (s *memStore) Leases(ctx context.Context) ([]Lease, error) {
+	var leases []Lease
+	for _, l := range s.leases {
+		leases = append(leases, l)
+	}
+	return leases, nil
+}
+
+func (s *memStore) ImportLease(ctx context.Context, lease *Lease) error {
+	if _, ok := s.leases[lease.Subnet]; ok {
+		return ErrLeaseTaken
+	}
+	l := *lease
+	if s.dropData {
+		l.Attrs.BackendData = nil
+	}
+	s.leases[l.Subnet] = l
+	return nil
+}
+
+const migrateConfig = `{"Network": "10.1.0.0/16", "Backend": {"Type": "vxlan"}}`
+
+func migrateLease(sn, publicIP string) Lease {
+	l := testLease(sn)
+	l.Attrs.PublicIP = ip.MustParseIP4(publicIP)
+	l.Attrs.BackendData = json.RawMessage(`{"VNI": 1}`)
+	l.Expiration = time.Now().Add(time.Hour)
+	return l
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	a, b, c := migrateLease("10.1.1.0/24", "192.168.0.1"), migrateLease("10.1.2.0/24", "192.168.0.2"), migrateLease("10.1.3.0/24", "192.168.0.3")
+	expired := migrateLease("10.1.4.0/24", "192.168.0.4")
+	expired.Expiration = time.Now().Add(-time.Minute)
+	// Reservations don't expire
+	c.Expiration = time.Time{}
+
+	// The destination already has b, with the backend data formatted differently
+	bb := b
+	bb.Attrs.BackendData = json.RawMessage(`{"VNI":1}`)
+	from, to := newMemStore(migrateConfig, a, b, c, expired), newMemStore("", bb)
+
+	// A dry run doesn't write anything
+	r, err := Migrate(ctx, from, to, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.ConfigCopied || len(r.Imported) != 2 || to.config != "" || len(to.leases) != 1 {
+		t.Fatalf("unexpected dry run %+v, destination %+v", r, to)
+	}
+
+	r, err = Migrate(ctx, from, to, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.ConfigCopied || to.config != migrateConfig {
+		t.Errorf("the config wasn't copied: %+v", r)
+	}
+	if len(r.Imported) != 2 || !r.Imported[0].Equal(a.Subnet) || !r.Imported[1].Equal(c.Subnet) {
+		t.Errorf("imported %v, want %v and %v", r.Imported, a.Subnet, c.Subnet)
+	}
+	if len(r.Unchanged) != 1 || len(r.Skipped) != 1 || !r.Skipped[0].Equal(expired.Subnet) {
+		t.Errorf("unexpected report %+v", r)
+	}
+	if !to.leases[c.Subnet].Expiration.IsZero() {
+		t.Error("the reservation got an expiration")
+	}
+
+	// Migrating again changes nothing
+	if r, err = Migrate(ctx, from, to, false); err != nil || r.ConfigCopied || len(r.Imported) != 0 || len(r.Unchanged) != 3 {
+		t.Errorf("unexpected second migration %+v: %v", r, err)
+	}
+}
+
+func TestMigrateFailures(t *testing.T) {
+	ctx := context.Background()
+	a, b := migrateLease("10.1.1.0/24", "192.168.0.1"), migrateLease("10.1.2.0/24", "192.168.0.2")
+
+	// The nodes would have to be renumbered
+	from := newMemStore(migrateConfig, a)
+	if _, err := Migrate(ctx, from, newMemStore(`{"Network": "10.2.0.0/16"}`), false); err == nil {
+		t.Error("migrated to another network")
+	}
+
+	// The destination leases b to another node
+	taken := b
+	taken.Attrs.PublicIP = ip.MustParseIP4("192.168.0.9")
+	from = newMemStore(migrateConfig, a, b)
+	r, err := Migrate(ctx, from, newMemStore(migrateConfig, taken), false)
+	if err == nil || len(r.Failed) != 1 || r.Failed[b.Subnet] == nil || len(r.Imported) != 1 {
+		t.Errorf("unexpected report %+v: %v", r, err)
+	}
+
+	// The leases don't read back the same
+	to := newMemStore("")
+	to.dropData = true
+	r, err = Migrate(ctx, from, to, false)
+	if err == nil || len(r.Failed) != 2 {
+		t.Errorf("unexpected report %+v: %v", r, err)
+	}
+}
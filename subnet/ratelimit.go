@@ -0,0 +1,251 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/juju/ratelimit"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// RetryPolicy is how failed operations on the datastore are retried.
+type RetryPolicy struct {
+	// Retries is how many times an operation is retried after it failed. 0 disables retries.
+	Retries int
+	// The backoff before the first retry, doubled after each retry up to MaxBackoff.
+	// A random jitter of up to half the backoff is added, so that nodes failing at the
+	// same time don't retry at the same time.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Transient tells whether an error may go away when the operation is retried, e.g.
+	// because the datastore is unreachable. Only transient errors are retried.
+	// IsTransient is used if it's nil.
+	Transient func(error) bool
+}
+
+// DefaultRetryPolicy is the retry policy of NewRateLimitedManager if none is given.
+var DefaultRetryPolicy = RetryPolicy{
+	Retries:        5,
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+}
+
+// RateLimitStats counts the throttled and retried operations of a RateLimitedManager.
+type RateLimitStats struct {
+	Throttled       int64 `json:"throttled"`
+	ThrottleSeconds int64 `json:"throttle_seconds"`
+	Retries         int64 `json:"retries"`
+	Failures        int64 `json:"failures"`
+}
+
+// RateLimitedManager wraps a Manager and limits the rate of its operations with a
+// token bucket shared by all of them, and retries the failed ones with an exponential
+// backoff. This keeps a fleet of nodes restarting at the same time from overwhelming
+// the datastore.
+//
+// Watches that continue from a cursor are long polls returning one event at a time, so
+// they are only limited when they start from a snapshot or are retried after a failure.
+type RateLimitedManager struct {
+	Manager
+	// UnlimitedWatches exempts all watches from the rate limit, for managers whose watches
+	// read a local cache, like the Kubernetes one.
+	UnlimitedWatches bool
+
+	bucket *ratelimit.Bucket
+	policy RetryPolicy
+
+	throttled    int64
+	throttleWait int64
+	retries      int64
+	failures     int64
+}
+
+// NewRateLimitedManager wraps sm, allowing qps operations per second on average and
+// bursts of up to burst operations. qps <= 0 disables the rate limit.
+func NewRateLimitedManager(sm Manager, qps float64, burst int, policy RetryPolicy) *RateLimitedManager {
+	m := &RateLimitedManager{
+		Manager: sm,
+		policy:  policy,
+	}
+	if qps > 0 {
+		if burst < 1 {
+			burst = 1
+		}
+		m.bucket = ratelimit.NewBucketWithRate(qps, int64(burst))
+	}
+	return m
+}
+
+// Stats returns the counters of the throttled and retried operations.
+func (m *RateLimitedManager) Stats() RateLimitStats {
+	return RateLimitStats{
+		Throttled:       atomic.LoadInt64(&m.throttled),
+		ThrottleSeconds: int64(time.Duration(atomic.LoadInt64(&m.throttleWait)).Seconds()),
+		Retries:         atomic.LoadInt64(&m.retries),
+		Failures:        atomic.LoadInt64(&m.failures),
+	}
+}
+
+func (m *RateLimitedManager) GetNetworkConfig(ctx context.Context) (*Config, error) {
+	var cfg *Config
+	err := m.do(ctx, "get network config", true, func() (err error) {
+		cfg, err = m.Manager.GetNetworkConfig(ctx)
+		return err
+	})
+	return cfg, err
+}
+
+func (m *RateLimitedManager) AcquireLease(ctx context.Context, attrs *LeaseAttrs) (*Lease, error) {
+	var l *Lease
+	err := m.do(ctx, "acquire lease", true, func() (err error) {
+		l, err = m.Manager.AcquireLease(ctx, attrs)
+		return err
+	})
+	return l, err
+}
+
+func (m *RateLimitedManager) RenewLease(ctx context.Context, lease *Lease) error {
+	return m.do(ctx, "renew lease", true, func() error {
+		return m.Manager.RenewLease(ctx, lease)
+	})
+}
+
+func (m *RateLimitedManager) WatchLease(ctx context.Context, sn ip.IP4Net, cursor interface{}) (LeaseWatchResult, error) {
+	var res LeaseWatchResult
+	err := m.do(ctx, "watch lease", cursor == nil && !m.UnlimitedWatches, func() (err error) {
+		res, err = m.Manager.WatchLease(ctx, sn, cursor)
+		return err
+	})
+	return res, err
+}
+
+func (m *RateLimitedManager) WatchLeases(ctx context.Context, cursor interface{}) (LeaseWatchResult, error) {
+	var res LeaseWatchResult
+	err := m.do(ctx, "watch leases", cursor == nil && !m.UnlimitedWatches, func() (err error) {
+		res, err = m.Manager.WatchLeases(ctx, cursor)
+		return err
+	})
+	return res, err
+}
+
+// ReleaseLease releases the lease of sn through the wrapped manager.
+func (m *RateLimitedManager) ReleaseLease(ctx context.Context, sn ip.IP4Net) error {
+	r, ok := m.Manager.(LeaseReleaser)
+	if !ok {
+		return fmt.Errorf("%s can't release leases", m.Manager.Name())
+	}
+	return m.do(ctx, "release lease", true, func() error {
+		return r.ReleaseLease(ctx, sn)
+	})
+}
+
+// TryLead tries to lead the task name through the wrapped manager.
+func (m *RateLimitedManager) TryLead(ctx context.Context, name, id string, ttl time.Duration) (bool, error) {
+	e, ok := m.Manager.(LeaderElector)
+	if !ok {
+		return false, fmt.Errorf("%s can't elect a leader", m.Manager.Name())
+	}
+	var lead bool
+	err := m.do(ctx, "try lead", true, func() (err error) {
+		lead, err = e.TryLead(ctx, name, id, ttl)
+		return err
+	})
+	return lead, err
+}
+
+// do runs op, and retries it according to the retry policy. Each retry waits for a token,
+// and so does the first attempt if limited is set. A transient error left after the last
+// retry is returned wrapped in ErrUnreachable.
+func (m *RateLimitedManager) do(ctx context.Context, name string, limited bool, op func() error) error {
+	transient := m.policy.Transient
+	if transient == nil {
+		transient = IsTransient
+	}
+
+	backoff := m.policy.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		if limited || attempt > 0 {
+			if err := m.wait(ctx); err != nil {
+				return err
+			}
+		}
+
+		err := op()
+		if err == nil || ctx.Err() != nil || !transient(err) {
+			return err
+		}
+		if attempt >= m.policy.Retries {
+			atomic.AddInt64(&m.failures, 1)
+			return fmt.Errorf("%w: %v", ErrUnreachable, err)
+		}
+
+		delay := backoff
+		if delay > 0 {
+			delay += time.Duration(rand.Int63n(int64(delay)/2 + 1))
+		}
+		log.Warningf("Failed to %s, retrying in %v: %v", name, delay.Round(time.Millisecond), err)
+		atomic.AddInt64(&m.retries, 1)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if backoff *= 2; backoff > m.policy.MaxBackoff {
+			backoff = m.policy.MaxBackoff
+		}
+	}
+}
+
+// wait blocks until the rate limit allows another operation, or ctx is done.
+func (m *RateLimitedManager) wait(ctx context.Context) error {
+	if m.bucket == nil {
+		return ctx.Err()
+	}
+	d := m.bucket.Take(1)
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	atomic.AddInt64(&m.throttled, 1)
+	atomic.AddInt64(&m.throttleWait, int64(d))
+	log.V(1).Infof("Throttling datastore operation for %v", d)
+
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// IsTransient tells whether err is a network error, which may go away when retried.
+// Datastores wrap it to add their own transient errors.
+func IsTransient(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	// A request timeout of the client, as the context of the operation isn't done
+	return err == context.DeadlineExceeded
+}
@@ -0,0 +1,167 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// flakyManager fails the first failures renewals with err.
+type flakyManager struct {
+	Manager
+	failures int
+	err      error
+	calls    int
+}
+
+func (m *flakyManager) RenewLease(ctx context.Context, lease *Lease) error {
+	m.calls++
+	if m.calls <= m.failures {
+		return m.err
+	}
+	return nil
+}
+
+func (m *flakyManager) WatchLeases(ctx context.Context, cursor interface{}) (LeaseWatchResult, error) {
+	m.calls++
+	return LeaseWatchResult{Cursor: m.calls}, nil
+}
+
+func (m *flakyManager) Name() string {
+	return "flaky"
+}
+
+// errUnavailable is a transient error.
+var errUnavailable = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+var testRetryPolicy = RetryPolicy{
+	Retries:        2,
+	InitialBackoff: time.Millisecond,
+	MaxBackoff:     2 * time.Millisecond,
+}
+
+func TestRateLimitedManagerRetries(t *testing.T) {
+	ctx := context.Background()
+	lease := testLease("10.1.1.0/24")
+
+	fm := &flakyManager{failures: 2, err: errUnavailable}
+	m := NewRateLimitedManager(fm, 0, 0, testRetryPolicy)
+	if err := m.RenewLease(ctx, &lease); err != nil {
+		t.Fatalf("RenewLease failed after retries: %v", err)
+	}
+	if fm.calls != 3 {
+		t.Errorf("RenewLease was called %d times, want 3", fm.calls)
+	}
+	if s := m.Stats(); s.Retries != 2 || s.Failures != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	// Give up after the last retry
+	fm = &flakyManager{failures: 3, err: errUnavailable}
+	m = NewRateLimitedManager(fm, 0, 0, testRetryPolicy)
+	if err := m.RenewLease(ctx, &lease); !errors.Is(err, ErrUnreachable) {
+		t.Errorf("RenewLease returned %v, want the error of the last retry", err)
+	}
+	if s := m.Stats(); s.Retries != 2 || s.Failures != 1 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	// Errors that won't go away aren't retried
+	for _, perm := range []error{ErrLeaseTaken, errors.New("invalid network config")} {
+		fm = &flakyManager{failures: 1, err: perm}
+		m = NewRateLimitedManager(fm, 0, 0, testRetryPolicy)
+		if err := m.RenewLease(ctx, &lease); err != perm {
+			t.Errorf("RenewLease returned %v, want %v", err, perm)
+		}
+		if fm.calls != 1 {
+			t.Errorf("RenewLease was called %d times, want 1", fm.calls)
+		}
+	}
+
+	// The datastore tells which of its errors are transient
+	policy := testRetryPolicy
+	policy.Transient = func(err error) bool { return err == ErrLeaseTaken }
+	fm = &flakyManager{failures: 1, err: ErrLeaseTaken}
+	m = NewRateLimitedManager(fm, 0, 0, policy)
+	if err := m.RenewLease(ctx, &lease); err != nil || fm.calls != 2 {
+		t.Errorf("RenewLease returned %v after %d calls, want a retry", err, fm.calls)
+	}
+}
+
+func TestRateLimitedManagerThrottles(t *testing.T) {
+	ctx := context.Background()
+	lease := testLease("10.1.1.0/24")
+
+	fm := &flakyManager{}
+	m := NewRateLimitedManager(fm, 100, 2, testRetryPolicy)
+	for i := 0; i < 4; i++ {
+		if err := m.RenewLease(ctx, &lease); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The burst goes through, the rest waits for the bucket to refill
+	if s := m.Stats(); s.Throttled != 2 {
+		t.Errorf("%d operations were throttled, want 2", s.Throttled)
+	}
+
+	// Watches continuing from a cursor aren't throttled, only the ones starting from a snapshot
+	m = NewRateLimitedManager(fm, 100, 1, testRetryPolicy)
+	if _, err := m.WatchLeases(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := m.WatchLeases(ctx, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := m.Stats(); s.Throttled != 0 {
+		t.Errorf("%d watches were throttled, want 0", s.Throttled)
+	}
+	if _, err := m.WatchLeases(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s := m.Stats(); s.Throttled != 1 {
+		t.Errorf("%d snapshots were throttled, want 1", s.Throttled)
+	}
+
+	// A throttled operation gives up when its context is done
+	m = NewRateLimitedManager(fm, 0.001, 1, testRetryPolicy)
+	if err := m.RenewLease(ctx, &lease); err != nil {
+		t.Fatal(err)
+	}
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := m.RenewLease(cctx, &lease); err != context.DeadlineExceeded {
+		t.Errorf("RenewLease returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestRateLimitedManagerForwards(t *testing.T) {
+	m := NewRateLimitedManager(&flakyManager{}, 0, 0, testRetryPolicy)
+	if _, err := m.TryLead(context.Background(), "reaper", "a", time.Minute); err == nil {
+		t.Error("TryLead succeeded on a manager that can't elect a leader")
+	}
+
+	rm := &reapManager{leader: true}
+	m = NewRateLimitedManager(rm, 0, 0, testRetryPolicy)
+	if lead, err := m.TryLead(context.Background(), "reaper", "a", time.Minute); err != nil || !lead {
+		t.Errorf("TryLead returned %v, %v, want true", lead, err)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+const (
+	// DefaultReapInterval is how often a Reaper looks for leases to remove by default.
+	DefaultReapInterval = 5 * time.Minute
+	// DefaultMaxReaps is how many leases a Reaper removes at most per pass by default.
+	DefaultMaxReaps  = 10
+	reaperLeaderName = "reaper"
+)
+
+// Reaper removes the leases of nodes that are gone, so that churned nodes don't slowly
+// exhaust the subnets of the network. Leases are removed when they are past their
+// expiration, e.g. when the datastore failed to expire them, and, if the nodes are
+// listed by LiveNodes, the leases whose public IP isn't among them. Reservations, the
+// leases without expiration, are never reaped: they were made by hand and stay until
+// they are removed by hand.
+// Watchers of the leases see the removed ones as EventRemoved.
+//
+// All nodes can run a Reaper; the one elected through the manager does the work.
+//
+// As a node list that is wrong would reap the leases of live nodes, the leases aren't
+// reaped for missing nodes if the list is empty or lacks the node of the Reaper, and no
+// more than MaxReaps leases are removed per pass.
+type Reaper struct {
+	sm       Manager
+	releaser LeaseReleaser
+	elector  LeaderElector
+	publicIP ip.IP4
+
+	// LiveNodes returns the public IPs of the existing nodes; leases are only reaped
+	// for being expired if it's nil.
+	LiveNodes func(ctx context.Context) (map[ip.IP4]bool, error)
+	Interval  time.Duration
+	// MaxReaps is how many leases are removed at most per pass, 0 for no limit.
+	MaxReaps int
+	now      func() time.Time
+}
+
+// NewReaper returns a Reaper removing the leases of sm, run by the node with the public IP
+// publicIP, which it's elected as. sm has to be able to release leases and elect a leader,
+// and needs to return the current leases when watched without cursor, like the etcd manager.
+func NewReaper(sm Manager, publicIP ip.IP4) (*Reaper, error) {
+	releaser, ok := sm.(LeaseReleaser)
+	if !ok {
+		return nil, fmt.Errorf("the subnet manager can't release leases")
+	}
+	elector, ok := sm.(LeaderElector)
+	if !ok {
+		return nil, fmt.Errorf("the subnet manager can't elect a leader")
+	}
+	return &Reaper{
+		sm:       sm,
+		releaser: releaser,
+		elector:  elector,
+		publicIP: publicIP,
+		Interval: DefaultReapInterval,
+		MaxReaps: DefaultMaxReaps,
+		now:      time.Now,
+	}, nil
+}
+
+// Run looks for leases to remove every Interval while leading, until ctx is done.
+func (r *Reaper) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.reap(ctx); err != nil && ctx.Err() == nil {
+			log.Errorf("Failed to reap leases: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *Reaper) reap(ctx context.Context) error {
+	// Lead for two intervals, so that the lead doesn't lapse between two runs
+	lead, err := r.elector.TryLead(ctx, reaperLeaderName, r.publicIP.String(), 2*r.Interval)
+	if err != nil {
+		return fmt.Errorf("failed to elect the leader: %v", err)
+	}
+	if !lead {
+		log.V(1).Info("Not reaping leases, another node leads")
+		return nil
+	}
+
+	res, err := r.sm.WatchLeases(ctx, nil)
+	if err != nil {
+		return err
+	}
+	var live map[ip.IP4]bool
+	if r.LiveNodes != nil {
+		if live, err = r.LiveNodes(ctx); err != nil {
+			return fmt.Errorf("failed to list the nodes: %v", err)
+		}
+		// The list of a cache that isn't synced, or of the wrong cluster
+		switch {
+		case len(live) == 0:
+			return fmt.Errorf("the node list is empty")
+		case !live[r.publicIP]:
+			return fmt.Errorf("the node list lacks the public IP %v of this node", r.publicIP)
+		}
+	}
+
+	now := r.now()
+	reaped := 0
+	for _, l := range res.Snapshot {
+		var reason string
+		switch {
+		case !l.Expiration.IsZero() && l.Expiration.Before(now):
+			reason = fmt.Sprintf("it expired at %v", l.Expiration)
+		case live != nil && !l.Expiration.IsZero() && !live[l.Attrs.PublicIP]:
+			reason = fmt.Sprintf("there is no node with the public IP %v", l.Attrs.PublicIP)
+		default:
+			continue
+		}
+
+		if r.MaxReaps > 0 && reaped >= r.MaxReaps {
+			log.Warningf("Reaped %d leases, leaving the others to the next pass", reaped)
+			break
+		}
+		if err := r.releaser.ReleaseLease(ctx, l.Subnet); err != nil {
+			log.Errorf("Failed to reap the lease of %v: %v", l.Subnet, err)
+			continue
+		}
+		log.Infof("Reaped the lease of %v, %s", l.Subnet, reason)
+		reaped++
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// reapManager serves a snapshot of leases, releases them and leads if leader is set.
+type reapManager struct {
+	Manager
+	leases   []Lease
+	leader   bool
+	released []ip.IP4Net
+}
+
+func (m *reapManager) WatchLeases(ctx context.Context, cursor interface{}) (LeaseWatchResult, error) {
+	return LeaseWatchResult{Snapshot: m.leases}, nil
+}
+
+func (m *reapManager) ReleaseLease(ctx context.Context, sn ip.IP4Net) error {
+	m.released = append(m.released, sn)
+	return nil
+}
+
+func (m *reapManager) TryLead(ctx context.Context, name, id string, ttl time.Duration) (bool, error) {
+	return m.leader, nil
+}
+
+func TestReaper(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	live, expired, gone, reserved := testLease("10.1.1.0/24"), testLease("10.1.2.0/24"), testLease("10.1.3.0/24"), testLease("10.1.4.0/24")
+	live.Attrs.PublicIP = ip.MustParseIP4("192.168.0.1")
+	live.Expiration = now.Add(time.Hour)
+	expired.Attrs.PublicIP = ip.MustParseIP4("192.168.0.2")
+	expired.Expiration = now.Add(-time.Minute)
+	gone.Attrs.PublicIP = ip.MustParseIP4("192.168.0.3")
+	gone.Expiration = now.Add(time.Hour)
+	// Reservations don't expire
+	reserved.Attrs.PublicIP = ip.MustParseIP4("192.168.0.4")
+
+	sm := &reapManager{leases: []Lease{live, expired, gone, reserved}}
+	r, err := NewReaper(sm, live.Attrs.PublicIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	// Only the leader reaps
+	if err := r.reap(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(sm.released) != 0 {
+		t.Fatalf("expected no leases to be reaped without lead, got %v", sm.released)
+	}
+
+	sm.leader = true
+	if err := r.reap(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(sm.released) != 1 || sm.released[0] != expired.Subnet {
+		t.Fatalf("expected the expired lease to be reaped, got %v", sm.released)
+	}
+
+	// With the nodes known, the leases of the missing ones are reaped too, but not their reservations
+	sm.released = nil
+	r.LiveNodes = func(ctx context.Context) (map[ip.IP4]bool, error) {
+		return map[ip.IP4]bool{live.Attrs.PublicIP: true}, nil
+	}
+	if err := r.reap(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(sm.released) != 2 || sm.released[1] != gone.Subnet {
+		t.Fatalf("expected the leases of missing nodes to be reaped, got %v", sm.released)
+	}
+
+	// A node list that is empty or lacks this node is wrong, nothing is reaped
+	for _, nodes := range []map[ip.IP4]bool{{}, {gone.Attrs.PublicIP: true}} {
+		sm.released = nil
+		r.LiveNodes = func(ctx context.Context) (map[ip.IP4]bool, error) {
+			return nodes, nil
+		}
+		if err := r.reap(ctx); err == nil {
+			t.Errorf("expected the node list %v to be refused", nodes)
+		}
+		if len(sm.released) != 0 {
+			t.Errorf("expected no leases to be reaped with the node list %v, got %v", nodes, sm.released)
+		}
+	}
+
+	// The leases past the limit are left to the next pass
+	sm.released = nil
+	r.MaxReaps = 1
+	r.LiveNodes = func(ctx context.Context) (map[ip.IP4]bool, error) {
+		return map[ip.IP4]bool{live.Attrs.PublicIP: true}, nil
+	}
+	if err := r.reap(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(sm.released) != 1 {
+		t.Fatalf("expected 1 lease to be reaped, got %v", sm.released)
+	}
+
+	if _, err := NewReaper(&watchManager{}, live.Attrs.PublicIP); err == nil {
+		t.Fatal("expected a manager that can't release leases to be rejected")
+	}
+}
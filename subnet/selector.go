@@ -0,0 +1,162 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+// SelectorManager wraps a Manager to build a partial mesh: it publishes labels on the
+// lease of the node, and its lease watch only reports the peers whose labels match a
+// selector. Backends therefore only program routes and tunnels to the selected peers.
+//
+// A peer whose labels stop matching is reported as removed. The peers a watch selected
+// are kept in its cursor, so that each lease watch has its own.
+type SelectorManager struct {
+	Manager
+	labels   map[string]string
+	selector labels.Selector
+}
+
+// selectorCursor is the cursor of a lease watch of a SelectorManager.
+type selectorCursor struct {
+	cursor interface{}
+	// selected are the peers reported to the watch, never modified once returned
+	selected map[ip.IP4Net]bool
+}
+
+// NewSelectorManager wraps sm, publishing leaseLabels and selecting the peers that
+// match selector, e.g. "tier=web" or "zone in (a,b)". An empty selector selects all peers.
+func NewSelectorManager(sm Manager, leaseLabels map[string]string, selector string) (*SelectorManager, error) {
+	sel, err := labels.Parse(selector)
+	if err != nil {
+		return nil, err
+	}
+	return &SelectorManager{
+		Manager:  sm,
+		labels:   leaseLabels,
+		selector: sel,
+	}, nil
+}
+
+// ParseLabels parses labels of the form "key1=value1,key2=value2".
+func ParseLabels(s string) (map[string]string, error) {
+	set, err := labels.ConvertSelectorToLabelsMap(s)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string(set), nil
+}
+
+func (m *SelectorManager) AcquireLease(ctx context.Context, attrs *LeaseAttrs) (*Lease, error) {
+	a := *attrs
+	a.Labels = m.labels
+	return m.Manager.AcquireLease(ctx, &a)
+}
+
+func (m *SelectorManager) RenewLease(ctx context.Context, lease *Lease) error {
+	lease.Attrs.Labels = m.labels
+	return m.Manager.RenewLease(ctx, lease)
+}
+
+func (m *SelectorManager) WatchLeases(ctx context.Context, cursor interface{}) (LeaseWatchResult, error) {
+	var selected map[ip.IP4Net]bool
+	if c, ok := cursor.(selectorCursor); ok {
+		cursor, selected = c.cursor, c.selected
+	}
+
+	for {
+		res, err := m.Manager.WatchLeases(ctx, cursor)
+		if err != nil {
+			return res, err
+		}
+
+		if len(res.Events) == 0 {
+			res.Snapshot, selected = m.filterSnapshot(res.Snapshot)
+			res.Cursor = selectorCursor{cursor: res.Cursor, selected: selected}
+			return res, nil
+		}
+
+		// An empty list of events would be taken for an empty snapshot, so keep
+		// watching until there is an event about a selected peer.
+		if res.Events, selected = m.filterEvents(res.Events, selected); len(res.Events) > 0 {
+			res.Cursor = selectorCursor{cursor: res.Cursor, selected: selected}
+			return res, nil
+		}
+		cursor = res.Cursor
+	}
+}
+
+func (m *SelectorManager) filterSnapshot(leases []Lease) ([]Lease, map[ip.IP4Net]bool) {
+	selected := make(map[ip.IP4Net]bool)
+	snapshot := make([]Lease, 0, len(leases))
+	for _, l := range leases {
+		if m.matches(&l) {
+			selected[l.Subnet] = true
+			snapshot = append(snapshot, l)
+		}
+	}
+	return snapshot, selected
+}
+
+// filterEvents returns the events about the peers that are or were selected, and the
+// peers selected after them. selected is copied before it's changed, as the cursors
+// returned before hold it.
+func (m *SelectorManager) filterEvents(events []Event, selected map[ip.IP4Net]bool) ([]Event, map[ip.IP4Net]bool) {
+	copied := false
+	update := func(sn ip.IP4Net, sel bool) {
+		if selected[sn] == sel {
+			return
+		}
+		if !copied {
+			s := make(map[ip.IP4Net]bool, len(selected)+1)
+			for k := range selected {
+				s[k] = true
+			}
+			selected, copied = s, true
+		}
+		if sel {
+			selected[sn] = true
+		} else {
+			delete(selected, sn)
+		}
+	}
+
+	var filtered []Event
+	for _, e := range events {
+		switch {
+		case e.Type == EventAdded && m.matches(&e.Lease):
+			update(e.Lease.Subnet, true)
+			filtered = append(filtered, e)
+
+		case selected[e.Lease.Subnet]:
+			// Removed, or its labels don't match anymore
+			if e.Type == EventAdded {
+				log.Infof("Peer %v doesn't match the peer selector anymore", e.Lease.Subnet)
+			}
+			update(e.Lease.Subnet, false)
+			filtered = append(filtered, Event{EventRemoved, e.Lease})
+		}
+	}
+	return filtered, selected
+}
+
+func (m *SelectorManager) matches(l *Lease) bool {
+	return m.selector.Matches(labels.Set(l.Attrs.Labels))
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func labeledLease(s, tier string) Lease {
+	l := testLease(s)
+	l.Attrs.Labels = map[string]string{"tier": tier}
+	return l
+}
+
+func TestSelectorManagerWatch(t *testing.T) {
+	web1, db := labeledLease("10.1.1.0/24", "web"), labeledLease("10.1.2.0/24", "db")
+	web2, web3 := labeledLease("10.1.3.0/24", "web"), labeledLease("10.1.4.0/24", "web")
+	moved := labeledLease("10.1.1.0/24", "db")
+
+	inner := &watchManager{results: []LeaseWatchResult{
+		{Snapshot: []Lease{web1, db}, Cursor: testCursor(10)},
+		{Events: []Event{{EventRemoved, db}}, Cursor: testCursor(11)},
+		{Events: []Event{{EventAdded, web2}, {EventAdded, moved}}, Cursor: testCursor(12)},
+		{Events: []Event{{EventAdded, db}}, Cursor: testCursor(13)},
+		{Events: []Event{{EventAdded, web3}}, Cursor: testCursor(14)},
+	}}
+	m, err := NewSelectorManager(inner, nil, "tier=web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	res, err := m.WatchLeases(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Snapshot) != 1 || res.Snapshot[0].Subnet != web1.Subnet {
+		t.Fatalf("expected a snapshot of the web peer, got %v", res.Snapshot)
+	}
+
+	// The removal of an unselected peer is skipped
+	res, err = m.WatchLeases(ctx, res.Cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Events) != 2 || res.Cursor.(selectorCursor).cursor != testCursor(12) {
+		t.Fatalf("expected the events at cursor 12, got %+v", res)
+	}
+	if res.Events[0].Type != EventAdded || res.Events[0].Lease.Subnet != web2.Subnet {
+		t.Fatalf("expected the web peer to be added, got %v", res.Events[0])
+	}
+	// A peer whose labels don't match anymore is removed
+	if res.Events[1].Type != EventRemoved || res.Events[1].Lease.Subnet != web1.Subnet {
+		t.Fatalf("expected the relabeled peer to be removed, got %v", res.Events[1])
+	}
+
+	// Results without selected peers aren't returned, as they would look like an empty snapshot
+	res, err = m.WatchLeases(ctx, res.Cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Events) != 1 || res.Events[0].Lease.Subnet != web3.Subnet || res.Cursor.(selectorCursor).cursor != testCursor(14) {
+		t.Fatalf("expected the web peer at cursor 14, got %+v", res)
+	}
+	if inner.cursors[4] != testCursor(13) {
+		t.Fatalf("expected the watch to continue at cursor 13, got %v", inner.cursors[4])
+	}
+}
+
+func TestSelectorManagerWatches(t *testing.T) {
+	web1, db := labeledLease("10.1.1.0/24", "web"), labeledLease("10.1.2.0/24", "db")
+	moved := labeledLease("10.1.1.0/24", "db")
+
+	inner := &watchManager{results: []LeaseWatchResult{
+		{Snapshot: []Lease{web1, db}, Cursor: testCursor(10)},
+		{Snapshot: []Lease{db}, Cursor: testCursor(11)},
+		{Events: []Event{{EventAdded, moved}}, Cursor: testCursor(12)},
+	}}
+	m, err := NewSelectorManager(inner, nil, "tier=web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second watch starting from another snapshot doesn't change what the first selected
+	ctx := context.Background()
+	first, err := m.WatchLeases(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.WatchLeases(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	res, err := m.WatchLeases(ctx, first.Cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Events) != 1 || res.Events[0].Type != EventRemoved || res.Events[0].Lease.Subnet != web1.Subnet {
+		t.Fatalf("expected the relabeled peer to be removed, got %+v", res)
+	}
+
+	// Relabeled leases are changed leases
+	if sameLeaseAttrs(&web1.Attrs, &moved.Attrs) {
+		t.Fatal("expected leases with different labels to differ")
+	}
+}
+
+func TestSelectorManagerLabels(t *testing.T) {
+	leaseLabels, err := ParseLabels("tier=web, zone=a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaseLabels) != 2 || leaseLabels["zone"] != "a" {
+		t.Fatalf("unexpected labels %v", leaseLabels)
+	}
+	if _, err := ParseLabels("tier"); err == nil {
+		t.Fatal("expected labels without value to be rejected")
+	}
+	if _, err := NewSelectorManager(&watchManager{}, nil, "tier in (web"); err == nil {
+		t.Fatal("expected an invalid selector to be rejected")
+	}
+}
@@ -30,13 +30,37 @@ import (
 var (
 	ErrLeaseTaken  = errors.New("subnet: lease already taken")
 	ErrNoMoreTries = errors.New("subnet: no more tries")
+	// ErrNoMoreSubnets is returned when all subnets of the network are leased.
+	ErrNoMoreSubnets = errors.New("subnet: out of subnets")
+	// ErrUnreachable wraps the errors of datastore operations that still failed with a
+	// transient error after the last retry.
+	ErrUnreachable = errors.New("subnet: datastore unreachable")
 	subnetRegex    = regexp.MustCompile(`(\d+\.\d+.\d+.\d+)-(\d+)`)
 )
 
 type LeaseAttrs struct {
-	PublicIP    ip.IP4
+	PublicIP ip.IP4
+	// PublicIPv6 is advertised next to PublicIP if the node has a global IPv6 address,
+	// so that backends can tunnel over IPv6 when both ends support it.
+	PublicIPv6  net.IP          `json:",omitempty"`
 	BackendType string          `json:",omitempty"`
 	BackendData json.RawMessage `json:",omitempty"`
+	// BackendDataByType carries the data of additional backends keyed by backend type,
+	// for nodes running more than one dataplane, e.g. while migrating between backends.
+	BackendDataByType map[string]json.RawMessage `json:",omitempty"`
+	// Labels describe the node, so that peers can select whom to connect to.
+	Labels map[string]string `json:",omitempty"`
+
+	unknown map[string]json.RawMessage
+}
+
+// BackendDataFor returns the data published for backend type bt, and whether the node runs that backend at all.
+func (a *LeaseAttrs) BackendDataFor(bt string) (json.RawMessage, bool) {
+	if a.BackendType == bt {
+		return a.BackendData, true
+	}
+	data, ok := a.BackendDataByType[bt]
+	return data, ok
 }
 
 type Lease struct {
@@ -127,3 +151,17 @@ type Manager interface {
 
 	Name() string
 }
+
+// LeaseReleaser is implemented by managers that can give up a lease before it expires,
+// so that its subnet is free for other nodes right away.
+type LeaseReleaser interface {
+	ReleaseLease(ctx context.Context, sn ip.IP4Net) error
+}
+
+// LeaderElector is implemented by managers that can elect a single node to run a
+// cluster-wide task.
+type LeaderElector interface {
+	// TryLead makes id the leader of the task name for ttl, unless another node leads it,
+	// and returns whether id leads.
+	TryLead(ctx context.Context, name, id string, ttl time.Duration) (bool, error)
+}
@@ -0,0 +1,141 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"encoding/json"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestBackendDataFor(t *testing.T) {
+	var attrs LeaseAttrs
+	s := `{"PublicIP":"10.0.0.1","BackendType":"vxlan","BackendData":{"VtepMAC":"aa:bb:cc:dd:ee:ff"},"BackendDataByType":{"ipsec":{"Key":1}}}`
+	if err := json.Unmarshal([]byte(s), &attrs); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, ok := attrs.BackendDataFor("vxlan"); !ok || string(data) != `{"VtepMAC":"aa:bb:cc:dd:ee:ff"}` {
+		t.Errorf("unexpected vxlan data %s (%v)", data, ok)
+	}
+	if data, ok := attrs.BackendDataFor("ipsec"); !ok || string(data) != `{"Key":1}` {
+		t.Errorf("unexpected ipsec data %s (%v)", data, ok)
+	}
+	if _, ok := attrs.BackendDataFor("host-gw"); ok {
+		t.Error("expected no host-gw data")
+	}
+}
+
+// attrsManager records the attributes of the acquired and renewed leases.
+type attrsManager struct {
+	Manager
+	attrs []LeaseAttrs
+}
+
+func (m *attrsManager) AcquireLease(ctx context.Context, attrs *LeaseAttrs) (*Lease, error) {
+	m.attrs = append(m.attrs, *attrs)
+	return &Lease{Attrs: *attrs}, nil
+}
+
+func (m *attrsManager) RenewLease(ctx context.Context, lease *Lease) error {
+	m.attrs = append(m.attrs, lease.Attrs)
+	return nil
+}
+
+func TestBackendDataManager(t *testing.T) {
+	data, err := ParseBackendDataByType(`{"ipsec":null,"wireguard":{"PublicKey":"k"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseBackendDataByType(`["ipsec"]`); err == nil {
+		t.Error("expected backend data that isn't keyed by type to be rejected")
+	}
+
+	inner := &attrsManager{}
+	m := NewBackendDataManager(inner, data)
+	ctx := context.Background()
+	l, err := m.AcquireLease(ctx, &LeaseAttrs{BackendType: "vxlan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Attrs.BackendDataByType = nil
+	if err := m.RenewLease(ctx, l); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, attrs := range inner.attrs {
+		if d, ok := attrs.BackendDataFor("ipsec"); !ok || string(d) != "{}" {
+			t.Errorf("unexpected ipsec data %s (%v)", d, ok)
+		}
+		if d, ok := attrs.BackendDataFor("wireguard"); !ok || string(d) != `{"PublicKey":"k"}` {
+			t.Errorf("unexpected wireguard data %s (%v)", d, ok)
+		}
+	}
+	if len(inner.attrs) != 2 {
+		t.Fatalf("expected the lease to be acquired and renewed, got %d calls", len(inner.attrs))
+	}
+}
+
+func TestLeaseAttrsUnknownFields(t *testing.T) {
+	var stored LeaseAttrs
+	s := `{"PublicIP":"10.0.0.1","backendtype":"vxlan","Zone":"a","Tunnels":{"wireguard":{"Port":51820}}}`
+	if err := json.Unmarshal([]byte(s), &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.BackendType != "vxlan" {
+		t.Fatalf("expected fields to be matched case-insensitively, got %+v", stored)
+	}
+
+	// A renewal with new attributes keeps the fields of the newer version
+	attrs := LeaseAttrs{PublicIP: stored.PublicIP, BackendType: "host-gw"}
+	attrs.PreserveUnknownFields(&stored)
+	data, err := json.Marshal(attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"BackendType":"host-gw","PublicIP":"10.0.0.1","Tunnels":{"wireguard":{"Port":51820}},"Zone":"a"}`
+	if string(data) != expected {
+		t.Fatalf("expected %s, got %s", expected, data)
+	}
+
+	// Without unknown fields the encoding is unchanged
+	data, err = json.Marshal(LeaseAttrs{PublicIP: stored.PublicIP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"PublicIP":"10.0.0.1"}` {
+		t.Fatalf("unexpected encoding %s", data)
+	}
+}
+
+func TestConfigUnknownFields(t *testing.T) {
+	cfg, err := ParseConfig(`{"Network":"10.3.0.0/16","IPv6Network":"fd00::/48","Backend":{"Type":"vxlan"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if string(fields["IPv6Network"]) != `"fd00::/48"` || string(fields["Network"]) != `"10.3.0.0/16"` {
+		t.Fatalf("unexpected encoding %s", data)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// Newer versions of flannel may store fields in the config and the leases that this
+// version doesn't know about. They are kept aside when decoding and written back when
+// encoding, so that an older daemon in a mixed-version cluster doesn't drop them.
+
+// leaseAttrs and config have the fields of LeaseAttrs and Config without their JSON methods.
+type leaseAttrs LeaseAttrs
+type config Config
+
+func (a *LeaseAttrs) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*leaseAttrs)(a)); err != nil {
+		return err
+	}
+	var err error
+	a.unknown, err = unknownFields(data, a)
+	return err
+}
+
+func (a LeaseAttrs) MarshalJSON() ([]byte, error) {
+	return marshalWithUnknown(leaseAttrs(a), a.unknown)
+}
+
+// PreserveUnknownFields copies the fields of stored this version doesn't know about to a,
+// so that they survive when a replaces stored in the datastore.
+func (a *LeaseAttrs) PreserveUnknownFields(stored *LeaseAttrs) {
+	a.unknown = stored.unknown
+}
+
+func (c *Config) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*config)(c)); err != nil {
+		return err
+	}
+	var err error
+	c.unknown, err = unknownFields(data, c)
+	return err
+}
+
+func (c Config) MarshalJSON() ([]byte, error) {
+	return marshalWithUnknown(config(c), c.unknown)
+}
+
+// unknownFields returns the fields of the JSON object data that don't match a field of
+// the struct v points to, using the case-insensitive matching of encoding/json.
+func unknownFields(data []byte, v interface{}) (map[string]json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	t := reflect.TypeOf(v).Elem()
+	for name := range fields {
+		for i := 0; i < t.NumField(); i++ {
+			if strings.EqualFold(name, jsonName(t.Field(i))) {
+				delete(fields, name)
+				break
+			}
+		}
+	}
+
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return fields, nil
+}
+
+func jsonName(f reflect.StructField) string {
+	if f.PkgPath != "" {
+		// unexported
+		return ""
+	}
+	tag := strings.Split(f.Tag.Get("json"), ",")[0]
+	switch tag {
+	case "-":
+		return ""
+	case "":
+		return f.Name
+	default:
+		return tag
+	}
+}
+
+func marshalWithUnknown(v interface{}, unknown map[string]json.RawMessage) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(unknown) == 0 {
+		return data, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for name, value := range unknown {
+		if _, ok := fields[name]; !ok {
+			fields[name] = value
+		}
+	}
+	return json.Marshal(fields)
+}
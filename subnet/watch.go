@@ -15,6 +15,8 @@
 package subnet
 
 import (
+	"bytes"
+	"reflect"
 	"time"
 
 	log "github.com/golang/glog"
@@ -28,8 +30,16 @@ import (
 // of handling "fall-behind" logic where the history window has advanced too far
 // and it needs to diff the latest snapshot with its saved state and generate events
 func WatchLeases(ctx context.Context, sm Manager, ownLease *Lease, receiver chan []Event) {
+	WatchLeasesFrom(ctx, sm, ownLease, nil, receiver)
+}
+
+// WatchLeasesFrom is like WatchLeases, but starts out with the known leases, e.g. the ones
+// a backend programmed before flanneld restarted. Snapshots then only report the changes
+// to them: the leases that are gone or changed and the new ones.
+func WatchLeasesFrom(ctx context.Context, sm Manager, ownLease *Lease, known []Lease, receiver chan []Event) {
 	lw := &leaseWatcher{
 		ownLease: ownLease,
+		leases:   append([]Lease(nil), known...),
 	}
 	var cursor interface{}
 
@@ -79,6 +89,10 @@ func (lw *leaseWatcher) reset(leases []Lease) []Event {
 			if ol.Subnet.Equal(nl.Subnet) {
 				lw.leases = deleteLease(lw.leases, i)
 				found = true
+				if !sameLeaseAttrs(&ol.Attrs, &nl.Attrs) {
+					// changed lease
+					batch = append(batch, Event{EventAdded, nl})
+				}
 				break
 			}
 		}
@@ -185,3 +199,23 @@ func WatchLease(ctx context.Context, sm Manager, sn ip.IP4Net, receiver chan Eve
 		cursor = wr.Cursor
 	}
 }
+
+// sameLeaseAttrs tells whether a and b describe the same dataplane of a node, and have
+// the same labels, which select the peers of a SelectorManager.
+func sameLeaseAttrs(a, b *LeaseAttrs) bool {
+	return a.PublicIP == b.PublicIP && a.PublicIPv6.Equal(b.PublicIPv6) && a.BackendType == b.BackendType &&
+		bytes.Equal(a.BackendData, b.BackendData) && reflect.DeepEqual(a.BackendDataByType, b.BackendDataByType) &&
+		sameLabels(a.Labels, b.Labels)
+}
+
+func sameLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,246 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/fileutil"
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+const (
+	watchStateSaveInterval = 5 * time.Second
+	// WatchStateMaxAge is how old a saved watch state may be to be resumed.
+	WatchStateMaxAge = time.Hour
+)
+
+type watchState struct {
+	Kind   string    `json:"kind"`
+	Cursor string    `json:"cursor"`
+	Saved  time.Time `json:"saved"`
+	Leases []Lease   `json:"leases"`
+}
+
+// WatchStateManager wraps a Manager and saves the leases and the cursor of its lease
+// watch to a file. After a restart, watches start from the saved leases and resume
+// at the saved cursor, instead of fetching a full snapshot of all leases.
+//
+// This only works for managers whose cursors can be passed back as strings, i.e.
+// the etcd manager. If the manager rejects a saved cursor, e.g. because it fell
+// out of the etcd history window, the watch falls back to a snapshot.
+type WatchStateManager struct {
+	Manager
+	path string
+	kind string
+	now  func() time.Time
+
+	mux      sync.Mutex
+	cursor   string
+	leases   map[ip.IP4Net]Lease
+	dirty    bool
+	lastSave time.Time
+}
+
+// NewWatchStateManager wraps sm, saving its watch state to path. kind identifies the
+// datastore, e.g. the etcd prefix, so that a state saved for another one isn't resumed.
+func NewWatchStateManager(sm Manager, path, kind string) *WatchStateManager {
+	m := &WatchStateManager{
+		Manager: sm,
+		path:    path,
+		kind:    kind,
+		now:     time.Now,
+		leases:  make(map[ip.IP4Net]Lease),
+	}
+	m.load()
+	return m
+}
+
+func (m *WatchStateManager) load() {
+	data, err := ioutil.ReadFile(m.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warningf("Failed to read watch state: %v", err)
+		}
+		return
+	}
+
+	var st watchState
+	if err := json.Unmarshal(data, &st); err != nil {
+		log.Warningf("Ignoring watch state %s: %v", m.path, err)
+		return
+	}
+	switch {
+	case st.Kind != m.kind:
+		log.Infof("Ignoring watch state %s saved for %q", m.path, st.Kind)
+		return
+	case st.Cursor == "":
+		log.Infof("Ignoring watch state %s without cursor", m.path)
+		return
+	case m.now().Sub(st.Saved) > WatchStateMaxAge:
+		log.Infof("Ignoring watch state %s saved at %v", m.path, st.Saved)
+		return
+	}
+
+	for _, l := range st.Leases {
+		m.leases[l.Subnet] = l
+	}
+	m.cursor = st.Cursor
+	log.Infof("Loaded watch state with %d leases at cursor %s", len(st.Leases), st.Cursor)
+}
+
+func (m *WatchStateManager) WatchLeases(ctx context.Context, cursor interface{}) (LeaseWatchResult, error) {
+	if cursor == nil {
+		if res, ok := m.snapshot(); ok {
+			return res, nil
+		}
+	}
+
+	res, err := m.Manager.WatchLeases(ctx, cursor)
+	if err != nil {
+		if _, ok := cursor.(string); !ok || ctx.Err() != nil {
+			return res, err
+		}
+		// The cursor was handed out from the saved state
+		log.Warningf("Failed to resume lease watch at %v, falling back to a snapshot: %v", cursor, err)
+		cursor = nil
+		if res, err = m.Manager.WatchLeases(ctx, nil); err != nil {
+			return res, err
+		}
+	}
+
+	m.record(cursor, res)
+	return res, nil
+}
+
+// snapshot returns the tracked leases and cursor to start a new watch with.
+func (m *WatchStateManager) snapshot() (LeaseWatchResult, bool) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if m.cursor == "" {
+		return LeaseWatchResult{}, false
+	}
+
+	leases := make([]Lease, 0, len(m.leases))
+	for _, l := range m.leases {
+		leases = append(leases, l)
+	}
+	log.Infof("Resuming lease watch at cursor %s with %d known leases", m.cursor, len(leases))
+	return LeaseWatchResult{Snapshot: leases, Cursor: m.cursor}, true
+}
+
+func (m *WatchStateManager) record(cursor interface{}, res LeaseWatchResult) {
+	next, ok := cursorString(res.Cursor)
+	if !ok {
+		return
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if len(res.Events) == 0 {
+		m.leases = make(map[ip.IP4Net]Lease, len(res.Snapshot))
+		for _, l := range res.Snapshot {
+			m.leases[l.Subnet] = l
+		}
+	} else {
+		// Several watches may run on the same manager; only follow the one that
+		// continues from the tracked cursor.
+		if prev, ok := cursorString(cursor); !ok || prev != m.cursor {
+			return
+		}
+		for _, e := range res.Events {
+			switch e.Type {
+			case EventAdded:
+				m.leases[e.Lease.Subnet] = e.Lease
+			case EventRemoved:
+				delete(m.leases, e.Lease.Subnet)
+			}
+		}
+	}
+	m.cursor = next
+	m.dirty = true
+
+	if m.now().Sub(m.lastSave) >= watchStateSaveInterval {
+		if err := m.save(); err != nil {
+			log.Warningf("Failed to save watch state: %v", err)
+		}
+	}
+}
+
+// Save writes the current watch state to the file.
+func (m *WatchStateManager) Save() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.save()
+}
+
+func (m *WatchStateManager) save() error {
+	if !m.dirty {
+		return nil
+	}
+
+	st := watchState{
+		Kind:   m.kind,
+		Cursor: m.cursor,
+		Saved:  m.now(),
+		Leases: make([]Lease, 0, len(m.leases)),
+	}
+	for _, l := range m.leases {
+		st.Leases = append(st.Leases, l)
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	if err := fileutil.WriteFileAtomic(m.path, data, 0600); err != nil {
+		return err
+	}
+
+	m.dirty = false
+	m.lastSave = st.Saved
+	return nil
+}
+
+// ReleaseLease releases the lease of sn through the wrapped manager.
+func (m *WatchStateManager) ReleaseLease(ctx context.Context, sn ip.IP4Net) error {
+	r, ok := m.Manager.(LeaseReleaser)
+	if !ok {
+		return fmt.Errorf("%s can't release leases", m.Manager.Name())
+	}
+	return r.ReleaseLease(ctx, sn)
+}
+
+// cursorString returns the string form of a watch cursor, if it has one.
+func cursorString(cursor interface{}) (string, bool) {
+	switch c := cursor.(type) {
+	case string:
+		return c, true
+	case fmt.Stringer:
+		return c.String(), true
+	default:
+		return "", false
+	}
+}
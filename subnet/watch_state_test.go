@@ -0,0 +1,164 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+type testCursor uint64
+
+func (c testCursor) String() string {
+	return strconv.FormatUint(uint64(c), 10)
+}
+
+// watchManager serves WatchLeases from a list of results and records the cursors it was called with.
+type watchManager struct {
+	Manager
+	results []LeaseWatchResult
+	cursors []interface{}
+	fail    string
+}
+
+func (m *watchManager) WatchLeases(ctx context.Context, cursor interface{}) (LeaseWatchResult, error) {
+	m.cursors = append(m.cursors, cursor)
+	if s, ok := cursor.(string); ok && s == m.fail {
+		return LeaseWatchResult{}, errors.New("index cleared")
+	}
+	res := m.results[0]
+	m.results = m.results[1:]
+	return res, nil
+}
+
+func testLease(s string) Lease {
+	_, n, _ := net.ParseCIDR(s)
+	return Lease{Subnet: ip.FromIPNet(n), Attrs: LeaseAttrs{BackendType: "vxlan"}}
+}
+
+func TestWatchStateResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watchstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	l1, l2 := testLease("10.1.1.0/24"), testLease("10.1.2.0/24")
+	inner := &watchManager{results: []LeaseWatchResult{
+		{Snapshot: []Lease{l1}, Cursor: testCursor(10)},
+		{Events: []Event{{EventAdded, l2}}, Cursor: testCursor(11)},
+	}}
+	m := NewWatchStateManager(inner, path, "etcd /coreos.com/network")
+
+	ctx := context.Background()
+	res, err := m.WatchLeases(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.WatchLeases(ctx, res.Cursor); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restarted daemon gets the saved leases and continues at the saved cursor
+	inner = &watchManager{results: []LeaseWatchResult{
+		{Events: []Event{{EventRemoved, l1}}, Cursor: testCursor(12)},
+	}}
+	m = NewWatchStateManager(inner, path, "etcd /coreos.com/network")
+	res, err = m.WatchLeases(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inner.cursors) != 0 {
+		t.Fatalf("expected the watch to start from the saved state, manager was called with %v", inner.cursors)
+	}
+	if len(res.Snapshot) != 2 || res.Cursor != "11" {
+		t.Fatalf("unexpected resumed watch: %+v", res)
+	}
+
+	if _, err := m.WatchLeases(ctx, res.Cursor); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.leases) != 1 || m.cursor != "12" {
+		t.Fatalf("unexpected tracked state: cursor %q leases %v", m.cursor, m.leases)
+	}
+
+	// A state saved for another datastore is ignored
+	m = NewWatchStateManager(inner, path, "etcd /other/network")
+	if m.cursor != "" {
+		t.Fatalf("expected state of another datastore to be ignored, got cursor %q", m.cursor)
+	}
+}
+
+func TestWatchStateStaleCursor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watchstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	l1 := testLease("10.1.1.0/24")
+	m := NewWatchStateManager(&watchManager{results: []LeaseWatchResult{
+		{Snapshot: []Lease{l1}, Cursor: testCursor(10)},
+	}}, path, "etcd")
+	if _, err := m.WatchLeases(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The saved cursor is rejected, so the watch falls back to a snapshot
+	inner := &watchManager{fail: "10", results: []LeaseWatchResult{
+		{Snapshot: []Lease{}, Cursor: testCursor(50)},
+	}}
+	m = NewWatchStateManager(inner, path, "etcd")
+	res, err := m.WatchLeases(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = m.WatchLeases(context.Background(), res.Cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inner.cursors) != 2 || inner.cursors[1] != nil {
+		t.Fatalf("expected a snapshot after the saved cursor failed, got cursors %v", inner.cursors)
+	}
+	if len(res.Snapshot) != 0 || len(m.leases) != 0 || m.cursor != "50" {
+		t.Fatalf("unexpected state after snapshot: %+v, tracked %v at %q", res, m.leases, m.cursor)
+	}
+
+	// Old states are not resumed
+	m.now = func() time.Time { return time.Now().Add(WatchStateMaxAge + time.Minute) }
+	m.cursor = ""
+	m.load()
+	if m.cursor != "" {
+		t.Fatal("expected an expired state to be ignored")
+	}
+}
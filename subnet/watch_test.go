@@ -0,0 +1,44 @@
+// Copyright 2020 flannel authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subnet
+
+import (
+	"testing"
+
+	"github.com/coreos/flannel/pkg/ip"
+)
+
+func TestLeaseWatcherResetFromKnown(t *testing.T) {
+	l1, l2, l3, l4 := testLease("10.1.1.0/24"), testLease("10.1.2.0/24"), testLease("10.1.3.0/24"), testLease("10.1.4.0/24")
+	moved := l2
+	moved.Attrs.PublicIP = ip.MustParseIP4("192.168.0.2")
+
+	lw := &leaseWatcher{leases: []Lease{l1, l2, l3}}
+	batch := lw.reset([]Lease{l1, moved, l4})
+
+	// l1 is unchanged, l2 moved, l3 is gone and l4 is new
+	if len(batch) != 3 {
+		t.Fatalf("expected 3 events, got %v", batch)
+	}
+	if batch[0].Type != EventAdded || batch[0].Lease.Attrs.PublicIP != moved.Attrs.PublicIP {
+		t.Errorf("expected the moved lease to be added, got %v", batch[0])
+	}
+	if batch[1].Type != EventAdded || batch[1].Lease.Subnet != l4.Subnet {
+		t.Errorf("expected the new lease to be added, got %v", batch[1])
+	}
+	if batch[2].Type != EventRemoved || batch[2].Lease.Subnet != l3.Subnet {
+		t.Errorf("expected the gone lease to be removed, got %v", batch[2])
+	}
+}